@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/url"
 
+	"github.com/projecteru2/vmihub/client/base"
 	svctypes "github.com/projecteru2/vmihub/pkg/types"
 )
 
@@ -31,6 +32,7 @@ func Register(ctx context.Context, serverURL string, body *svctypes.RegisterRequ
 		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
+	base.InjectTrace(req)
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -69,6 +71,7 @@ func GetToken(ctx context.Context, serverURL, username, password string) (string
 		return "", "", err
 	}
 	req.Header.Set("Content-Type", "application/json")
+	base.InjectTrace(req)
 
 	resp, err := http.DefaultClient.Do(req) //nolint:bodyclose
 	if err != nil {
@@ -113,6 +116,7 @@ func RefreshToken(ctx context.Context, serverURL, accessToken, refreshToken stri
 		return "", "", err
 	}
 	req.Header.Set("Content-Type", "application/json")
+	base.InjectTrace(req)
 
 	resp, err := http.DefaultClient.Do(req) //nolint:bodyclose
 	if err != nil {
@@ -13,6 +13,8 @@ import (
 
 	"github.com/projecteru2/vmihub/client/terrors"
 	"github.com/projecteru2/vmihub/client/types"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
 )
 
 type APIImpl struct {
@@ -28,6 +30,8 @@ func NewAPI(addr string, cred *types.Credential) *APIImpl {
 	return impl
 }
 
+// AddAuth sets the credential of request, the trace context of request is injected too,
+// because it is called by all requests of SDK.
 func (i *APIImpl) AddAuth(req *http.Request) error {
 	var val string
 	if i.Cred.Username != "" && i.Cred.Password != "" {
@@ -36,9 +40,16 @@ func (i *APIImpl) AddAuth(req *http.Request) error {
 		val = fmt.Sprintf("Bearer %s", i.Cred.Token)
 	}
 	req.Header.Set("Authorization", val)
+	InjectTrace(req)
 	return nil
 }
 
+// InjectTrace adds the headers of the trace context in the context of req,
+// it uses the global propagator which is set by otel.SetTextMapPropagator.
+func InjectTrace(req *http.Request) {
+	otel.GetTextMapPropagator().Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+}
+
 func (i *APIImpl) AddAuthToHeader(req *http.Header) error {
 	var val string
 	if i.Cred.Username != "" && i.Cred.Password != "" {
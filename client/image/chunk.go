@@ -80,7 +80,41 @@ func (i *APIImpl) StartUploadImageChunk(ctx context.Context, chunk *types.ChunkS
 	return err
 }
 
-// MergeChunk after uploaded big size file slice, need merge slice
+// GetChunkUploadStatus returns the chunks received by server,
+// ErrUploadNotFound is returned if the upload is finished or expired.
+func (i *APIImpl) GetChunkUploadStatus(ctx context.Context, uploadID string) (*svctypes.UploadStatusResp, error) {
+	reqURL := fmt.Sprintf("%s/api/v1/image/chunk/%s/status", i.ServerURL, url.PathEscape(uploadID))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = i.AddAuth(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, terrors.ErrUploadNotFound
+	}
+	data, err := util.GetRespData(resp)
+	if err != nil {
+		return nil, err
+	}
+	status := &svctypes.UploadStatusResp{}
+	if err = json.Unmarshal(data, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// MergeChunk after uploaded big size file slice, need merge slice,
+// it returns after the merged file is verified and the image is saved by server.
 func (i *APIImpl) MergeChunk(ctx context.Context, uploadID string) error {
 	reqURL := fmt.Sprintf("%s/api/v1/image/chunk/merge", i.ServerURL)
 
@@ -107,7 +141,17 @@ func (i *APIImpl) MergeChunk(ctx context.Context, uploadID string) error {
 		return err
 	}
 	defer resp.Body.Close()
-	_, err = util.GetRespData(resp)
+	data, err := util.GetRespData(resp)
+	if err != nil {
+		return err
+	}
+	obj := struct {
+		TaskID int64 `json:"taskID"`
+	}{}
+	if err = json.Unmarshal(data, &obj); err != nil {
+		return err
+	}
+	_, err = i.WaitTask(ctx, obj.TaskID)
 	return err
 }
 
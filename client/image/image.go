@@ -3,6 +3,7 @@ package image
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -36,8 +37,12 @@ type API interface {
 	Push(ctx context.Context, img *types.Image, force bool) error
 	Pull(ctx context.Context, imgName string, policy PullPolicy) (img *types.Image, err error)
 	GetInfo(ctx context.Context, imgFullname string) (info *types.Image, err error)
+	GetTask(ctx context.Context, id int64) (*svctypes.Task, error)
+	WaitTask(ctx context.Context, id int64) (*svctypes.Task, error)
 	RemoveLocalImage(ctx context.Context, img *types.Image) (err error)
 	RemoveImage(ctx context.Context, img *types.Image) (err error)
+	Tag(ctx context.Context, srcFullname string, tag string, force bool) (*types.Image, error)
+	SetLatest(ctx context.Context, imgFullname string) (*types.Image, error)
 }
 
 type APIImpl struct {
@@ -165,11 +170,101 @@ func (i *APIImpl) uploadWithChunk(ctx context.Context, img *types.Image, force b
 		Image:     *img,
 		ChunkSize: i.chunkSize,
 	}
-	if err := i.StartUploadImageChunk(ctx, ck, force); err != nil {
+	metadata, err := ck.LoadLocalMetadata()
+	if err != nil {
+		return err
+	}
+	pending, err := i.startOrResumeChunkUpload(ctx, ck, metadata.Digest, force)
+	if err != nil {
+		return err
+	}
+	if err := i.uploadChunks(ctx, ck, pending); err != nil {
+		return err
+	}
+	if err := i.MergeChunk(ctx, ck.UploadID); err != nil {
 		return err
 	}
+	return i.mdb.RemoveUpload(img)
+}
 
+// startOrResumeChunkUpload resumes the unfinished upload of the same file saved in metadata db,
+// a new upload is started if there isn't one or it can't be resumed.
+// It returns the indexes of the chunks which need to be uploaded.
+func (i *APIImpl) startOrResumeChunkUpload(ctx context.Context, ck *types.ChunkSlice, digest string, force bool) ([]int64, error) {
 	nChunks := int64(math.Ceil(float64(ck.Size) / float64(ck.ChunkSize)))
+	upload, err := i.mdb.LoadUpload(&ck.Image)
+	if err != nil {
+		return nil, err
+	}
+	if upload != nil && upload.Digest == digest && upload.Size == ck.Size && upload.ChunkSize == ck.ChunkSize {
+		status, err := i.GetChunkUploadStatus(ctx, upload.UploadID)
+		switch {
+		case errors.Is(err, terrors.ErrUploadNotFound):
+			// the upload is expired, start over
+		case err != nil:
+			return nil, err
+		case !status.Merged && int64(status.NChunks) == nChunks:
+			ck.UploadID = upload.UploadID
+			return missingChunks(ck, nChunks, status.Chunks)
+		}
+	}
+
+	if err := i.StartUploadImageChunk(ctx, ck, force); err != nil {
+		return nil, err
+	}
+	err = i.mdb.SaveUpload(&ck.Image, &types.Upload{
+		UploadID:  ck.UploadID,
+		Digest:    digest,
+		Size:      ck.Size,
+		ChunkSize: ck.ChunkSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+	pending := make([]int64, 0, nChunks)
+	for idx := int64(0); idx < nChunks; idx++ {
+		pending = append(pending, idx)
+	}
+	return pending, nil
+}
+
+// missingChunks returns the indexes of the chunks which aren't received by server,
+// the received chunks whose digest doesn't match the local file are uploaded again.
+func missingChunks(ck *types.ChunkSlice, nChunks int64, received []*svctypes.UploadChunkResp) ([]int64, error) {
+	digests := map[int64]string{}
+	for _, chunk := range received {
+		digests[int64(chunk.Idx)] = chunk.Digest
+	}
+	fp, err := os.Open(ck.Filepath())
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	var ans []int64
+	for idx := int64(0); idx < nChunks; idx++ {
+		digest, ok := digests[idx]
+		if ok {
+			h := sha256.New()
+			if _, err := io.Copy(h, io.NewSectionReader(fp, idx*ck.ChunkSize, ck.ChunkSize)); err != nil {
+				return nil, err
+			}
+			if digest == fmt.Sprintf("%x", h.Sum(nil)) {
+				continue
+			}
+		}
+		ans = append(ans, idx)
+	}
+	return ans, nil
+}
+
+// uploadChunks uploads the chunks of pending concurrently, the failed chunks are retried
+// until the number of retries reaches the number of chunks.
+func (i *APIImpl) uploadChunks(ctx context.Context, ck *types.ChunkSlice, pending []int64) error {
+	nChunks := int64(len(pending))
+	if nChunks == 0 {
+		return nil
+	}
 	retries := nChunks
 	success := 0
 	resCh := make(chan *execResult, nChunks)
@@ -184,7 +279,7 @@ func (i *APIImpl) uploadWithChunk(ctx context.Context, img *types.Image, force b
 	defer p.Release()
 
 	// Submit tasks one by one.
-	for idx := int64(0); idx < nChunks; idx++ {
+	for _, idx := range pending {
 		_ = p.Invoke(idx)
 	}
 	for res := range resCh {
@@ -202,15 +297,16 @@ func (i *APIImpl) uploadWithChunk(ctx context.Context, img *types.Image, force b
 			return res.err
 		}
 	}
-	return i.MergeChunk(ctx, ck.UploadID)
+	return nil
 }
 
-func (i *APIImpl) startUpload(ctx context.Context, img *types.Image, force bool) (uploadID string, err error) {
+// startUpload returns the upload id of the file, or the id of import task when the image is imported from url
+func (i *APIImpl) startUpload(ctx context.Context, img *types.Image, force bool) (uploadID string, taskID int64, err error) {
 	reqURL := fmt.Sprintf("%s/api/v1/image/%s/%s/startUpload", i.ServerURL, img.Username, img.Name)
 
 	metadata, err := img.LoadLocalMetadata()
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
 	var digest string
 	if metadata != nil {
@@ -236,32 +332,35 @@ func (i *APIImpl) startUpload(ctx context.Context, img *types.Image, force bool)
 
 	bodyBytes, err := json.Marshal(body)
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(bodyBytes))
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
 	req.Header.Set("Content-Type", "application/json")
 	_ = i.AddAuth(req)
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("failed to execute http request: %w", err)
+		return "", 0, fmt.Errorf("failed to execute http request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	data, err := util.GetRespData(resp)
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
-	obj := map[string]string{}
+	obj := struct {
+		UploadID string `json:"uploadID"`
+		TaskID   int64  `json:"taskID"`
+	}{}
 	err = json.Unmarshal(data, &obj)
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
-	return obj["uploadID"], nil
+	return obj.UploadID, obj.TaskID, nil
 }
 
 func (i *APIImpl) upload(ctx context.Context, img *types.Image, uploadID string) (err error) {
@@ -328,11 +427,14 @@ func (i *APIImpl) upload(ctx context.Context, img *types.Image, uploadID string)
 
 func (i *APIImpl) uploadSingle(ctx context.Context, img *types.Image, force bool) (err error) {
 	remoteUpload := img.URL != ""
-	uploadID, err := i.startUpload(ctx, img, force)
+	uploadID, taskID, err := i.startUpload(ctx, img, force)
 	if err != nil {
 		return err
 	}
-	if !remoteUpload {
+	if remoteUpload {
+		// the remote file is imported by server in background
+		_, err = i.WaitTask(ctx, taskID)
+	} else {
 		err = i.upload(ctx, img, uploadID)
 	}
 	return
@@ -510,6 +612,60 @@ func (i *APIImpl) RemoveImage(ctx context.Context, img *types.Image) (err error)
 	return err
 }
 
+// Tag creates tag in the repository of source image, the new tag shares the file of source image.
+// The existing tag is overwritten only if force is true.
+func (i *APIImpl) Tag(ctx context.Context, srcFullname string, tag string, force bool) (*types.Image, error) {
+	username, name, srcTag, err := svcutils.ParseImageName(srcFullname)
+	if err != nil {
+		return nil, err
+	}
+	reqURL := fmt.Sprintf("%s/api/v1/image/%s/%s/tags/%s", i.ServerURL, username, name, url.PathEscape(tag))
+	u, err := url.Parse(reqURL)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	query.Add("force", strconv.FormatBool(force))
+	u.RawQuery = query.Encode()
+
+	bs, err := json.Marshal(svctypes.TagImageRequest{Source: srcTag})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), bytes.NewReader(bs))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	_ = i.AddAuth(req)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, terrors.ErrImageNotFound
+	}
+	data, err := util.GetRespData(resp)
+	if err != nil {
+		return nil, err
+	}
+	img := &types.Image{
+		BaseDir: i.baseDir,
+		MDB:     i.mdb,
+	}
+	if err = json.Unmarshal(data, &img.ImageInfoResp); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// SetLatest makes the latest tag of repository refer to the image instead of the newest one
+func (i *APIImpl) SetLatest(ctx context.Context, imgFullname string) (*types.Image, error) {
+	return i.Tag(ctx, imgFullname, "latest", false)
+}
+
 type execResult struct {
 	chunkIdx int64
 	err      error
@@ -568,23 +724,72 @@ func (i *APIImpl) downloadWithChunk(ctx context.Context, img *types.Image) (err
 	return nil
 }
 
+// download writes the image file into a partial file first, an interrupted download
+// is resumed from the partial file by the next retry or the next pull.
 func (i *APIImpl) download(ctx context.Context, img *types.Image) (err error) {
-	reqURL := fmt.Sprintf("%s/api/v1/image/%s/%s/download", i.ServerURL, img.Username, img.Name)
+	partFile := img.PartFilePath()
+	if err := util.EnsureDir(filepath.Dir(partFile)); err != nil {
+		return err
+	}
+	// remove the partial files of other versions
+	if stales, err := filepath.Glob(img.Filepath() + ".*.part"); err == nil {
+		for _, fname := range stales {
+			if fname != partFile {
+				_ = os.Remove(fname)
+			}
+		}
+	}
 
+	backoffStrategy := backoff.NewExponentialBackOff()
+	err = backoff.Retry(func() error {
+		return i.downloadPart(ctx, img, partFile)
+	}, backoff.WithContext(backoffStrategy, ctx))
+	if err != nil {
+		return err
+	}
+	return img.MoveFrom(partFile)
+}
+
+// downloadPart downloads the rest of the image file and appends it to partFile
+func (i *APIImpl) downloadPart(ctx context.Context, img *types.Image, partFile string) error {
+	fp, err := os.OpenFile(partFile, os.O_WRONLY|os.O_CREATE, 0766)
+	if err != nil {
+		return backoff.Permanent(err)
+	}
+	defer fp.Close()
+	offset, err := fp.Seek(0, io.SeekEnd)
+	if err != nil {
+		return backoff.Permanent(err)
+	}
+	if offset > img.Size {
+		if err := fp.Truncate(0); err != nil {
+			return backoff.Permanent(err)
+		}
+		offset = 0
+	}
+	if offset > 0 && offset == img.Size {
+		return verifyPart(fp, img, true)
+	}
+
+	reqURL := fmt.Sprintf("%s/api/v1/image/%s/%s/download", i.ServerURL, img.Username, img.Name)
 	u, err := url.Parse(reqURL)
 	if err != nil {
-		return
+		return backoff.Permanent(err)
 	}
 	query := u.Query()
 	query.Add("tag", img.Tag)
-
 	u.RawQuery = query.Encode()
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
 	if err != nil {
-		return err
+		return backoff.Permanent(err)
 	}
 	_ = i.AddAuth(req)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		// the server sends the whole file if the image is changed
+		req.Header.Set("If-Range", strconv.Quote(img.Digest))
+	}
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -592,9 +797,72 @@ func (i *APIImpl) download(ctx context.Context, img *types.Image) (err error) {
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
+	resumed := resp.StatusCode == http.StatusPartialContent
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		// the content must start at the end of partial file
+		if start, ok := contentRangeStart(resp.Header.Get("Content-Range")); !ok || start != offset {
+			_ = fp.Truncate(0)
+			return fmt.Errorf("failed to resume image, unexpected content range %q at offset %d", resp.Header.Get("Content-Range"), offset)
+		}
+	case http.StatusOK:
+		if err := fp.Truncate(0); err != nil {
+			return backoff.Permanent(err)
+		}
+		if _, err := fp.Seek(0, io.SeekStart); err != nil {
+			return backoff.Permanent(err)
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// start over in next retry
+		_ = fp.Truncate(0)
+		return fmt.Errorf("failed to resume image, status code: %d", resp.StatusCode)
+	default:
 		bs, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("failed to pull image, status code: %d, body: %s", resp.StatusCode, string(bs))
+		err := fmt.Errorf("failed to pull image, status code: %d, body: %s", resp.StatusCode, string(bs))
+		if resp.StatusCode < http.StatusInternalServerError {
+			return backoff.Permanent(err)
+		}
+		return err
+	}
+	if _, err = io.Copy(fp, resp.Body); err != nil {
+		return err
+	}
+	return verifyPart(fp, img, resumed)
+}
+
+// verifyPart checks the digest of the downloaded file, the partial file is truncated if it doesn't match,
+// so the download is started over by next retry. It makes no sense to retry if a whole download doesn't match.
+func verifyPart(fp *os.File, img *types.Image, resumed bool) error {
+	if img.Digest == "" {
+		return nil
+	}
+	digest, err := svcutils.CalcDigestOfFile(fp.Name())
+	if err != nil {
+		return backoff.Permanent(err)
+	}
+	if digest == img.Digest {
+		return nil
+	}
+	if err := fp.Truncate(0); err != nil {
+		return backoff.Permanent(err)
+	}
+	err = fmt.Errorf("%w: got %s, want %s", terrors.ErrInvalidDigest, digest, img.Digest)
+	if !resumed {
+		return backoff.Permanent(err)
+	}
+	return err
+}
+
+// contentRangeStart returns the first byte position of a Content-Range header, eg: bytes 5-11/12
+func contentRangeStart(cr string) (int64, bool) {
+	unit, rng, found := strings.Cut(cr, " ")
+	if !found || unit != "bytes" {
+		return 0, false
+	}
+	start, _, found := strings.Cut(rng, "-")
+	if !found {
+		return 0, false
 	}
-	return i.mdb.CopyFile(img, resp.Body)
+	n, err := strconv.ParseInt(start, 10, 64)
+	return n, err == nil
 }
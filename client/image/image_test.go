@@ -1,8 +1,28 @@
 package image
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/projecteru2/vmihub/client/terrors"
 	"github.com/projecteru2/vmihub/client/types"
 	svctypes "github.com/projecteru2/vmihub/pkg/types"
+	svcutils "github.com/projecteru2/vmihub/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const (
@@ -20,6 +40,200 @@ var testImg = &types.Image{
 	BaseDir: baseDir,
 }
 
+func TestDownloadPart(t *testing.T) {
+	digest, err := svcutils.CalcDigestOfStr(testContent)
+	require.NoError(t, err)
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("ETag", strconv.Quote(digest))
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(testContent))
+	}))
+	defer server.Close()
+
+	api, err := NewAPI(server.URL, t.TempDir(), &types.Credential{Token: "testtoken"})
+	require.NoError(t, err)
+	img, err := api.NewImage("test-user/test-image:test-tag")
+	require.NoError(t, err)
+	img.Digest = digest
+	img.Size = int64(len(testContent))
+
+	// resume from the partial file
+	partFile := img.PartFilePath()
+	err = os.MkdirAll(filepath.Dir(partFile), 0755)
+	require.NoError(t, err)
+	err = os.WriteFile(partFile, []byte(testContent[:5]), 0644)
+	require.NoError(t, err)
+	err = api.downloadPart(context.Background(), img, partFile)
+	assert.Nil(t, err)
+	bs, err := os.ReadFile(partFile)
+	assert.Nil(t, err)
+	assert.Equal(t, testContent, string(bs))
+	assert.Equal(t, []string{"bytes=5-"}, ranges)
+
+	// the partial file is corrupted, so the download starts over
+	err = os.WriteFile(partFile, []byte("xxxxx"), 0644)
+	require.NoError(t, err)
+	err = api.downloadPart(context.Background(), img, partFile)
+	assert.ErrorIs(t, err, terrors.ErrInvalidDigest)
+	var permanent *backoff.PermanentError
+	assert.False(t, errors.As(err, &permanent))
+	err = api.downloadPart(context.Background(), img, partFile)
+	assert.Nil(t, err)
+	bs, err = os.ReadFile(partFile)
+	assert.Nil(t, err)
+	assert.Equal(t, testContent, string(bs))
+
+	// the image is changed, so the server sends the whole file which doesn't match the stale digest
+	img.Digest = "stale"
+	err = os.WriteFile(partFile, []byte("xxxxx"), 0644)
+	require.NoError(t, err)
+	err = api.downloadPart(context.Background(), img, partFile)
+	assert.ErrorIs(t, err, terrors.ErrInvalidDigest)
+	assert.True(t, errors.As(err, &permanent))
+	bs, err = os.ReadFile(partFile)
+	assert.Nil(t, err)
+	assert.Empty(t, bs)
+}
+
+func TestDownloadPartWrongRange(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		// the content doesn't start at the requested offset
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(testContent)-1, len(testContent)))
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = w.Write([]byte(testContent))
+	}))
+	defer server.Close()
+
+	api, err := NewAPI(server.URL, t.TempDir(), &types.Credential{Token: "testtoken"})
+	require.NoError(t, err)
+	img, err := api.NewImage("test-user/test-image:test-tag")
+	require.NoError(t, err)
+	img.Digest, err = svcutils.CalcDigestOfStr(testContent)
+	require.NoError(t, err)
+	img.Size = int64(len(testContent))
+
+	partFile := img.PartFilePath()
+	err = os.MkdirAll(filepath.Dir(partFile), 0755)
+	require.NoError(t, err)
+	err = os.WriteFile(partFile, []byte(testContent[:5]), 0644)
+	require.NoError(t, err)
+	err = api.downloadPart(context.Background(), img, partFile)
+	assert.ErrorContains(t, err, "unexpected content range")
+	bs, err := os.ReadFile(partFile)
+	assert.Nil(t, err)
+	assert.Empty(t, bs)
+}
+
+func TestTag(t *testing.T) {
+	var (
+		paths  []string
+		bodies []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPut, r.Method)
+		bs, _ := io.ReadAll(r.Body)
+		paths = append(paths, r.URL.Path+"?"+r.URL.RawQuery)
+		bodies = append(bodies, string(bs))
+		tag := filepath.Base(r.URL.Path)
+		if tag == "latest" {
+			tag = "test-tag"
+		}
+		_, _ = w.Write([]byte(`{"data":{"username":"test-user","name":"test-image","tag":"` + tag + `"}}`))
+	}))
+	defer server.Close()
+
+	api, err := NewAPI(server.URL, t.TempDir(), &types.Credential{Token: "testtoken"})
+	require.NoError(t, err)
+	img, err := api.Tag(context.Background(), "test-user/test-image:test-tag", "v1", true)
+	require.NoError(t, err)
+	assert.Equal(t, "test-user/test-image:v1", img.Fullname())
+	img, err = api.SetLatest(context.Background(), "test-user/test-image:test-tag")
+	require.NoError(t, err)
+	assert.Equal(t, "test-user/test-image:test-tag", img.Fullname())
+	assert.Equal(t, []string{
+		"/api/v1/image/test-user/test-image/tags/v1?force=true",
+		"/api/v1/image/test-user/test-image/tags/latest?force=false",
+	}, paths)
+	assert.Equal(t, []string{`{"source":"test-tag"}`, `{"source":"test-tag"}`}, bodies)
+}
+
+func TestResumeChunkUpload(t *testing.T) {
+	chunkDigest := func(s string) string {
+		digest, err := svcutils.CalcDigestOfStr(s)
+		require.NoError(t, err)
+		return digest
+	}
+	// chunk 1 is corrupted, chunks 2 and 4 are missing
+	status := &svctypes.UploadStatusResp{
+		UploadSessionResp: svctypes.UploadSessionResp{UploadID: "upload1", NChunks: 5},
+		Chunks: []*svctypes.UploadChunkResp{
+			{Idx: 0, Digest: chunkDigest(testContent[0:4])},
+			{Idx: 1, Digest: chunkDigest("xxxx")},
+			{Idx: 3, Digest: chunkDigest(testContent[12:16])},
+		},
+	}
+	uploaded := map[string]string{}
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v1/image/chunk/upload1/status":
+			bs, _ := json.Marshal(map[string]any{"data": status})
+			_, _ = w.Write(bs)
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/upload"):
+			assert.Equal(t, "upload1", r.URL.Query().Get("uploadID"))
+			file, _, err := r.FormFile("file")
+			require.NoError(t, err)
+			bs, _ := io.ReadAll(file)
+			mu.Lock()
+			uploaded[r.URL.Path] = string(bs)
+			mu.Unlock()
+			_, _ = w.Write([]byte(`{"msg":"upload chunk successfully"}`))
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	api, err := NewAPI(server.URL, t.TempDir(), &types.Credential{Token: "testtoken"}, WithChunSize("4"))
+	require.NoError(t, err)
+	img, err := api.NewImage("test-user/test-image:test-tag")
+	require.NoError(t, err)
+	err = os.MkdirAll(filepath.Dir(img.Filepath()), 0755)
+	require.NoError(t, err)
+	err = os.WriteFile(img.Filepath(), []byte(testContent), 0644)
+	require.NoError(t, err)
+	img.Size = int64(len(testContent))
+	digest := chunkDigest(testContent)
+	err = api.mdb.SaveUpload(img, &types.Upload{UploadID: "upload1", Digest: digest, Size: img.Size, ChunkSize: 4})
+	require.NoError(t, err)
+
+	ck := &types.ChunkSlice{Image: *img, ChunkSize: api.chunkSize}
+	pending, err := api.startOrResumeChunkUpload(context.Background(), ck, digest, false)
+	require.NoError(t, err)
+	assert.Equal(t, "upload1", ck.UploadID)
+	assert.Equal(t, []int64{1, 2, 4}, pending)
+
+	err = api.uploadChunks(context.Background(), ck, pending)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"/api/v1/image/chunk/1/upload": testContent[4:8],
+		"/api/v1/image/chunk/2/upload": testContent[8:12],
+		"/api/v1/image/chunk/4/upload": testContent[16:],
+	}, uploaded)
+
+	// the saved upload is kept until the image is merged
+	upload, err := api.mdb.LoadUpload(img)
+	require.NoError(t, err)
+	assert.Equal(t, "upload1", upload.UploadID)
+	err = api.mdb.RemoveUpload(img)
+	require.NoError(t, err)
+	upload, err = api.mdb.LoadUpload(img)
+	require.NoError(t, err)
+	assert.Nil(t, upload)
+}
+
 // func TestPullImage(t *testing.T) {
 // 	defer os.RemoveAll(baseDir)
 
@@ -8,6 +8,8 @@ import (
 	image "github.com/projecteru2/vmihub/client/image"
 	mock "github.com/stretchr/testify/mock"
 
+	pkgtypes "github.com/projecteru2/vmihub/pkg/types"
+
 	types "github.com/projecteru2/vmihub/client/types"
 )
 
@@ -46,6 +48,36 @@ func (_m *API) GetInfo(ctx context.Context, imgFullname string) (*types.Image, e
 	return r0, r1
 }
 
+// GetTask provides a mock function with given fields: ctx, id
+func (_m *API) GetTask(ctx context.Context, id int64) (*pkgtypes.Task, error) {
+	ret := _m.Called(ctx, id)
+
+	if len(ret) == 0 {
+		panic("no return value specified for GetTask")
+	}
+
+	var r0 *pkgtypes.Task
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, int64) (*pkgtypes.Task, error)); ok {
+		return rf(ctx, id)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, int64) *pkgtypes.Task); ok {
+		r0 = rf(ctx, id)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*pkgtypes.Task)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, int64) error); ok {
+		r1 = rf(ctx, id)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // ListImages provides a mock function with given fields: ctx, user, pageN, pageSize
 func (_m *API) ListImages(ctx context.Context, user string, pageN int, pageSize int) ([]*types.Image, int, error) {
 	ret := _m.Called(ctx, user, pageN, pageSize)
@@ -83,7 +115,7 @@ func (_m *API) ListImages(ctx context.Context, user string, pageN int, pageSize
 	return r0, r1, r2
 }
 
-// ListLocalImages provides a mock function with given fields:
+// ListLocalImages provides a mock function with no fields
 func (_m *API) ListLocalImages() ([]*types.Image, error) {
 	ret := _m.Called()
 
@@ -227,6 +259,96 @@ func (_m *API) RemoveLocalImage(ctx context.Context, img *types.Image) error {
 	return r0
 }
 
+// SetLatest provides a mock function with given fields: ctx, imgFullname
+func (_m *API) SetLatest(ctx context.Context, imgFullname string) (*types.Image, error) {
+	ret := _m.Called(ctx, imgFullname)
+
+	if len(ret) == 0 {
+		panic("no return value specified for SetLatest")
+	}
+
+	var r0 *types.Image
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, string) (*types.Image, error)); ok {
+		return rf(ctx, imgFullname)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, string) *types.Image); ok {
+		r0 = rf(ctx, imgFullname)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*types.Image)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, imgFullname)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// Tag provides a mock function with given fields: ctx, srcFullname, tag, force
+func (_m *API) Tag(ctx context.Context, srcFullname string, tag string, force bool) (*types.Image, error) {
+	ret := _m.Called(ctx, srcFullname, tag, force)
+
+	if len(ret) == 0 {
+		panic("no return value specified for Tag")
+	}
+
+	var r0 *types.Image
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, bool) (*types.Image, error)); ok {
+		return rf(ctx, srcFullname, tag, force)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, bool) *types.Image); ok {
+		r0 = rf(ctx, srcFullname, tag, force)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*types.Image)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, bool) error); ok {
+		r1 = rf(ctx, srcFullname, tag, force)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// WaitTask provides a mock function with given fields: ctx, id
+func (_m *API) WaitTask(ctx context.Context, id int64) (*pkgtypes.Task, error) {
+	ret := _m.Called(ctx, id)
+
+	if len(ret) == 0 {
+		panic("no return value specified for WaitTask")
+	}
+
+	var r0 *pkgtypes.Task
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, int64) (*pkgtypes.Task, error)); ok {
+		return rf(ctx, id)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, int64) *pkgtypes.Task); ok {
+		r0 = rf(ctx, id)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*pkgtypes.Task)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, int64) error); ok {
+		r1 = rf(ctx, id)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // NewAPI creates a new instance of API. It also registers a testing interface on the mock and a cleanup function to assert the mocks expectations.
 // The first argument is typically a *testing.T value.
 func NewAPI(t interface {
@@ -0,0 +1,65 @@
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/projecteru2/vmihub/client/terrors"
+	"github.com/projecteru2/vmihub/client/util"
+	svctypes "github.com/projecteru2/vmihub/pkg/types"
+)
+
+// interval of polling the status of task
+var taskPollInterval = 2 * time.Second
+
+// GetTask get the status of a background task
+func (i *APIImpl) GetTask(ctx context.Context, id int64) (*svctypes.Task, error) {
+	reqURL := fmt.Sprintf("%s/api/v1/tasks/%d", i.ServerURL, id)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	_ = i.AddAuth(req)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := util.GetRespData(resp)
+	if err != nil {
+		return nil, err
+	}
+	t := &svctypes.Task{}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// WaitTask waits until the task is finished, an error is returned if the task is failed
+func (i *APIImpl) WaitTask(ctx context.Context, id int64) (*svctypes.Task, error) {
+	ticker := time.NewTicker(taskPollInterval)
+	defer ticker.Stop()
+	for {
+		t, err := i.GetTask(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		switch t.Status {
+		case svctypes.TaskStatusSuccess:
+			return t, nil
+		case svctypes.TaskStatusFailed:
+			return t, fmt.Errorf("%w: task %d(%s): %s", terrors.ErrTaskFailed, t.ID, t.Type, t.Error)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -10,6 +10,8 @@ var (
 	ErrInvalidHash      = errors.New("invalid hash type")
 	ErrInvalidDigest    = errors.New("invalid digest")
 	ErrImageNotFound    = errors.New("image not found")
+	ErrUploadNotFound   = errors.New("upload not found")
+	ErrTaskFailed       = errors.New("task failed")
 
 	ErrPlaceholder = errors.New("placeholder error")
 )
@@ -21,6 +21,18 @@ type Metadata struct {
 	VirtualSize int64  `mapstructure:"virtual_size" json:"virtualSize"`
 }
 
+// Upload is an unfinished chunk upload of image, it is kept in MetadataDB,
+// so the upload can be resumed after the client is restarted.
+type Upload struct {
+	UploadID  string `json:"uploadID"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+	ChunkSize int64  `json:"chunkSize"`
+}
+
+// the bucket of unfinished uploads, the key is the fullname of image
+const uploadBucket = "uploads"
+
 type MetadataDB struct {
 	baseDir string
 	bucket  string
@@ -33,8 +45,12 @@ func NewMetadataDB(baseDir, bucket string) (*MetadataDB, error) {
 		return nil, fmt.Errorf("failed to open db: %w", err)
 	}
 	if err := db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(bucket))
-		return err
+		for _, name := range []string{bucket, uploadBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
 	}); err != nil {
 		return nil, fmt.Errorf("failed to create bucket: %w", err)
 	}
@@ -112,6 +128,23 @@ func (mdb *MetadataDB) CopyFile(img *Image, src io.Reader) (err error) {
 	return err
 }
 
+// MoveFile moves fname to the image file and updates the metadata of image
+func (mdb *MetadataDB) MoveFile(img *Image, fname string) (err error) {
+	if err := util.EnsureDir(filepath.Dir(img.Filepath())); err != nil {
+		return err
+	}
+	if err := os.Rename(fname, img.Filepath()); err != nil {
+		return err
+	}
+	md, err := mdb.update(img, false)
+	if err != nil {
+		return err
+	}
+	img.ActualSize, img.VirtualSize = md.ActualSize, md.VirtualSize
+	img.Digest = md.Digest
+	return nil
+}
+
 // before calling this method,you should ensure the local image file exists.
 func (mdb *MetadataDB) Load(img *Image) (meta *Metadata, err error) {
 	fullname := img.Fullname()
@@ -139,6 +172,40 @@ func (mdb *MetadataDB) Load(img *Image) (meta *Metadata, err error) {
 	return mdb.update(img, true)
 }
 
+// SaveUpload saves the unfinished upload of img, it replaces the previous one
+func (mdb *MetadataDB) SaveUpload(img *Image, upload *Upload) error {
+	bs, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	return mdb.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(uploadBucket))
+		return b.Put([]byte(img.Fullname()), bs)
+	})
+}
+
+// LoadUpload returns the unfinished upload of img, nil is returned if there isn't one
+func (mdb *MetadataDB) LoadUpload(img *Image) (upload *Upload, err error) {
+	err = mdb.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(uploadBucket))
+		v := b.Get([]byte(img.Fullname()))
+		if v == nil {
+			return nil
+		}
+		upload = &Upload{}
+		return json.Unmarshal(v, upload)
+	})
+	return
+}
+
+// RemoveUpload removes the upload of img after it is finished
+func (mdb *MetadataDB) RemoveUpload(img *Image) error {
+	return mdb.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(uploadBucket))
+		return b.Delete([]byte(img.Fullname()))
+	})
+}
+
 func (mdb *MetadataDB) update(img *Image, oldEmpty bool) (meta *Metadata, err error) {
 	fullname := img.Fullname()
 	localfile := img.Filepath()
@@ -195,6 +262,12 @@ func (img *Image) CopyFrom(fname string) error {
 	return img.MDB.CopyFile(img, srcF)
 }
 
+// MoveFrom moves fname to the image file, it is cheaper than CopyFrom
+// when fname is in the same file system.
+func (img *Image) MoveFrom(fname string) error {
+	return img.MDB.MoveFile(img, fname)
+}
+
 // before calling this method,you should ensure the local image file exists.
 func (img *Image) LoadLocalMetadata() (meta *Metadata, err error) {
 	return img.MDB.Load(img)
@@ -208,6 +281,12 @@ func (img *Image) Filepath() string {
 	return filepath.Join(img.BaseDir, "image", fmt.Sprintf("%s/%s:%s.img", user, img.Name, img.Tag))
 }
 
+// PartFilePath returns the file which keeps the partial content of an unfinished download,
+// the digest is part of the name, so the partial content of an old version is never resumed.
+func (img *Image) PartFilePath() string {
+	return fmt.Sprintf("%s.%s.part", img.Filepath(), img.Digest)
+}
+
 func (img *Image) Cached() (ans bool, err error) {
 	meta, err := img.MDB.Load(img)
 	if err != nil || meta == nil {
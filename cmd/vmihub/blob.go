@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/projecteru2/core/log"
+	"github.com/projecteru2/vmihub/config"
+	"github.com/projecteru2/vmihub/internal/blob"
+	storFact "github.com/projecteru2/vmihub/internal/storage/factory"
+	cli "github.com/urfave/cli/v2"
+)
+
+func runMigrateBlobs(c *cli.Context) error {
+	cfg, err := config.Init(configPath)
+	if err != nil {
+		return err
+	}
+	ctx := context.TODO()
+	if err := setupLog(ctx, cfg); err != nil {
+		return err
+	}
+	if err := prepare(ctx, cfg); err != nil {
+		log.WithFunc("runMigrateBlobs").Error(ctx, err, "Can't init")
+		return err
+	}
+	stats, err := blob.Migrate(ctx, storFact.Instance(), c.Bool("dry-run"))
+	fmt.Println(stats.String())
+	return err
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/projecteru2/core/log"
+	"github.com/projecteru2/vmihub/config"
+	"github.com/projecteru2/vmihub/internal/gc"
+	storFact "github.com/projecteru2/vmihub/internal/storage/factory"
+	cli "github.com/urfave/cli/v2"
+)
+
+func runGC(c *cli.Context) error {
+	cfg, err := config.Init(configPath)
+	if err != nil {
+		return err
+	}
+	ctx := context.TODO()
+	if err := setupLog(ctx, cfg); err != nil {
+		return err
+	}
+	if err := prepare(ctx, cfg); err != nil {
+		log.WithFunc("runGC").Error(ctx, err, "Can't init")
+		return err
+	}
+	opts := &gc.Options{
+		DryRun: c.Bool("dry-run"),
+		MinAge: c.Duration("min-age"),
+	}
+	report, err := gc.Run(ctx, storFact.Instance(), opts)
+	if report != nil {
+		for _, it := range report.Reclaimed {
+			fmt.Println(it.String())
+		}
+		for _, name := range report.Abandoned {
+			fmt.Printf("abandoned image: %s\n", name)
+		}
+		for _, name := range report.Unknown {
+			fmt.Printf("skipped unknown object: %s\n", name)
+		}
+		for _, it := range report.Failed {
+			fmt.Printf("failed: %s\n", it.String())
+		}
+		action := "reclaimed"
+		if opts.DryRun {
+			action = "would reclaim"
+		}
+		fmt.Printf("%s %d items(%d bytes), failed %d items\n", action, len(report.Reclaimed), report.Bytes(), len(report.Failed))
+	}
+	return err
+}
@@ -17,10 +17,16 @@ import (
 	"github.com/projecteru2/core/types"
 	"github.com/projecteru2/vmihub/config"
 	"github.com/projecteru2/vmihub/internal/api"
+	"github.com/projecteru2/vmihub/internal/auth"
+	"github.com/projecteru2/vmihub/internal/gc"
 	"github.com/projecteru2/vmihub/internal/models"
+	"github.com/projecteru2/vmihub/internal/oidc"
 	storFact "github.com/projecteru2/vmihub/internal/storage/factory"
+	"github.com/projecteru2/vmihub/internal/task"
+	"github.com/projecteru2/vmihub/internal/tracing"
 	"github.com/projecteru2/vmihub/internal/utils"
 	myvalidator "github.com/projecteru2/vmihub/internal/validator"
+	"github.com/projecteru2/vmihub/internal/verification"
 	"github.com/projecteru2/vmihub/internal/version"
 	zerolog "github.com/rs/zerolog/log"
 	cli "github.com/urfave/cli/v2"
@@ -54,6 +60,33 @@ func main() {
 			Usage:  "run vmihub server",
 			Action: runServer,
 		},
+		{
+			Name:  "migrate-blobs",
+			Usage: "move images stored by tag name to the content-addressed blob store",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "only print what would be done",
+				},
+			},
+			Action: runMigrateBlobs,
+		},
+		{
+			Name:  "gc",
+			Usage: "remove orphaned blobs and abandoned uploads from storage",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "only print what would be reclaimed",
+				},
+				&cli.DurationFlag{
+					Name:  "min-age",
+					Usage: "objects and uploads younger than this are kept",
+					Value: 24 * time.Hour,
+				},
+			},
+			Action: runGC,
+		},
 	}
 	app.Action = runServer
 	_ = app.Run(os.Args)
@@ -67,10 +100,28 @@ func prepare(_ context.Context, cfg *config.Config) error {
 		return err
 	}
 	utils.SetupRedis(&cfg.Redis, nil)
+	if err := verification.Init(&cfg.Register); err != nil {
+		return err
+	}
+	if err := auth.Init(&cfg.Auth); err != nil {
+		return err
+	}
 
 	return nil
 }
 
+func setupLog(ctx context.Context, cfg *config.Config) error {
+	logCfg := &types.ServerLogConfig{
+		Level:      cfg.Log.Level,
+		UseJSON:    cfg.Log.UseJSON,
+		Filename:   cfg.Log.Filename,
+		MaxSize:    cfg.Log.MaxSize,
+		MaxAge:     cfg.Log.MaxAge,
+		MaxBackups: cfg.Log.MaxBackups,
+	}
+	return log.SetupLog(ctx, logCfg, cfg.Log.SentryDSN)
+}
+
 // @title vmihub project
 // @version 1.0
 // @description this is vmihub server.
@@ -84,15 +135,7 @@ func runServer(_ *cli.Context) error {
 	ctx, cancel := signal.NotifyContext(context.TODO(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
-	logCfg := &types.ServerLogConfig{
-		Level:      cfg.Log.Level,
-		UseJSON:    cfg.Log.UseJSON,
-		Filename:   cfg.Log.Filename,
-		MaxSize:    cfg.Log.MaxSize,
-		MaxAge:     cfg.Log.MaxAge,
-		MaxBackups: cfg.Log.MaxBackups,
-	}
-	if err := log.SetupLog(ctx, logCfg, cfg.Log.SentryDSN); err != nil {
+	if err := setupLog(ctx, cfg); err != nil {
 		zerolog.Fatal().Err(err).Send()
 	}
 	defer log.SentryDefer()
@@ -101,6 +144,33 @@ func runServer(_ *cli.Context) error {
 		log.WithFunc("main").Error(ctx, err, "Can't init server")
 		return err
 	}
+	if err := oidc.Init(ctx, &cfg.OIDC); err != nil {
+		log.WithFunc("main").Error(ctx, err, "Can't init OIDC login")
+		return err
+	}
+	shutdownTracing, err := tracing.Init(ctx, &cfg.Tracing)
+	if err != nil {
+		log.WithFunc("main").Error(ctx, err, "Can't init tracing")
+		return err
+	}
+	defer func() {
+		// the ctx is canceled by signals, so flush the spans with a new one
+		sctx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
+		defer cancel()
+		if err := shutdownTracing(sctx); err != nil {
+			log.WithFunc("main").Error(sctx, err, "failed to flush spans")
+		}
+	}()
+
+	if cfg.GC.Enabled {
+		go gc.RunPeriodically(ctx, storFact.Instance(), cfg.GC.Interval, &gc.Options{MinAge: cfg.GC.MinAge})
+	}
+
+	go task.Start(ctx, &task.Options{
+		Workers:     cfg.Task.Workers,
+		MaxAttempts: cfg.Task.MaxAttempts,
+		Timeout:     cfg.Task.Timeout,
+	})
 
 	gin.SetMode(cfg.Server.RunMode)
 	routersInit, err := api.SetupRouter()
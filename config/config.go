@@ -18,15 +18,21 @@ var (
 )
 
 type Config struct {
-	GlobalTimeout  time.Duration `toml:"global_timeout" default:"5m"`
-	MaxConcurrency int           `toml:"max_concurrency" default:"10000"`
-	Server         ServerConfig  `toml:"server"`
-	RBD            RBDConfig     `toml:"rbd"`
-	Log            LogConfig     `toml:"log"`
-	Redis          RedisConfig   `toml:"redis"`
-	Mysql          MysqlConfig   `toml:"mysql"`
-	Storage        StorageConfig `toml:"storage"`
-	JWT            JWTConfig     `toml:"jwt"`
+	GlobalTimeout  time.Duration  `toml:"global_timeout" default:"5m"`
+	MaxConcurrency int            `toml:"max_concurrency" default:"10000"`
+	Server         ServerConfig   `toml:"server"`
+	RBD            RBDConfig      `toml:"rbd"`
+	Log            LogConfig      `toml:"log"`
+	Redis          RedisConfig    `toml:"redis"`
+	Mysql          MysqlConfig    `toml:"mysql"`
+	Storage        StorageConfig  `toml:"storage"`
+	JWT            JWTConfig      `toml:"jwt"`
+	GC             GCConfig       `toml:"gc"`
+	Task           TaskConfig     `toml:"task"`
+	Register       RegisterConfig `toml:"register"`
+	OIDC           OIDCConfig     `toml:"oidc"`
+	Auth           AuthConfig     `toml:"auth"`
+	Tracing        TracingConfig  `toml:"tracing"`
 }
 
 type ServerConfig struct {
@@ -85,6 +91,10 @@ type StorageConfig struct {
 	Type  string              `toml:"type"`
 	Local *LocalStorageConfig `toml:"local"`
 	S3    *S3Config           `toml:"s3"`
+	Azure *AzureConfig        `toml:"azure"`
+	GCS   *GCSConfig          `toml:"gcs"`
+	// a chunk upload session expires if there is no activity in upload_ttl
+	UploadTTL time.Duration `toml:"upload_ttl" default:"1h"`
 }
 
 type RBDConfig struct {
@@ -109,6 +119,27 @@ type S3Config struct {
 	BaseDir   string `toml:"base_dir"`
 }
 
+// AzureConfig Azure Blob storage, the images are stored as block blobs
+type AzureConfig struct {
+	// eg: https://<account_name>.blob.core.windows.net/, or http://127.0.0.1:10000/<account_name> for Azurite
+	Endpoint    string `toml:"endpoint"`
+	AccountName string `toml:"account_name"`
+	AccountKey  string `toml:"account_key"`
+	Container   string `toml:"container"`
+	BaseDir     string `toml:"base_dir"`
+}
+
+// GCSConfig Google Cloud Storage
+type GCSConfig struct {
+	// empty for Google Cloud Storage, or the JSON API of a compatible server, eg: http://127.0.0.1:4443/storage/v1/
+	Endpoint string `toml:"endpoint"`
+	// the service account key file, the application default credentials are used if it is empty,
+	// and no credentials are sent if endpoint is set too.
+	CredentialsFile string `toml:"credentials_file"`
+	Bucket          string `toml:"bucket"`
+	BaseDir         string `toml:"base_dir"`
+}
+
 type LogConfig struct {
 	Level     string `toml:"level" default:"info"`
 	UseJSON   bool   `toml:"use_json"`
@@ -120,6 +151,104 @@ type LogConfig struct {
 	MaxBackups int    `toml:"max_backups" default:"3"`
 }
 
+// GCConfig periodic garbage collection of storage
+type GCConfig struct {
+	Enabled  bool          `toml:"enabled"`
+	Interval time.Duration `toml:"interval" default:"24h"`
+	// objects younger than min_age are never collected
+	MinAge time.Duration `toml:"min_age" default:"24h"`
+}
+
+// TaskConfig workers of background tasks
+type TaskConfig struct {
+	Workers     int `toml:"workers" default:"4"`
+	MaxAttempts int `toml:"max_attempts" default:"3"`
+	// timeout of each attempt
+	Timeout time.Duration `toml:"timeout" default:"6h"`
+}
+
+// RegisterConfig self registration of users
+type RegisterConfig struct {
+	Enabled bool `toml:"enabled"`
+	// log or file, the verification codes are only written to log or file,
+	// other senders such as email and SMS can be set by verification.SetSender
+	Sender string `toml:"sender" default:"log"`
+	// the file which verification codes are appended to
+	File    string        `toml:"file"`
+	CodeTTL time.Duration `toml:"code_ttl" default:"5m"`
+}
+
+// OIDCConfig single sign-on with an OpenID Connect identity provider
+type OIDCConfig struct {
+	Enabled      bool   `toml:"enabled"`
+	Issuer       string `toml:"issuer"`
+	ClientID     string `toml:"client_id"`
+	ClientSecret string `toml:"client_secret"`
+	// the url of /api/v1/user/oidc/callback which is registered in the identity provider
+	RedirectURL string   `toml:"redirect_url"`
+	Scopes      []string `toml:"scopes"`
+	// the claims of ID token which are used as username and groups
+	UsernameClaim string `toml:"username_claim" default:"preferred_username"`
+	GroupsClaim   string `toml:"groups_claim" default:"groups"`
+	// members of these groups are administrators, the admin flag isn't managed if it is empty
+	AdminGroups []string `toml:"admin_groups"`
+	// the memberships of the organizations listed here are managed by the identity provider
+	GroupRoles []OIDCGroupRole `toml:"group_roles"`
+}
+
+// OIDCGroupRole grants role of organization to the members of group
+type OIDCGroupRole struct {
+	Group string `toml:"group"`
+	Org   string `toml:"org"`
+	Role  string `toml:"role"`
+}
+
+// AuthConfig the backend which checks the passwords of users
+type AuthConfig struct {
+	// local or ldap, local checks the password hashes in user table
+	Type string     `toml:"type" default:"local"`
+	LDAP LDAPConfig `toml:"ldap"`
+}
+
+// LDAPConfig users login by binding to LDAP server, they are created on first login
+type LDAPConfig struct {
+	// ldap://host:389 or ldaps://host:636
+	URL                string        `toml:"url"`
+	StartTLS           bool          `toml:"start_tls"`
+	InsecureSkipVerify bool          `toml:"insecure_skip_verify"`
+	Timeout            time.Duration `toml:"timeout" default:"10s"`
+	// the DN which users bind as, %s is replaced by username, eg: uid=%s,ou=people,dc=example,dc=com
+	UserDNTemplate string `toml:"user_dn_template"`
+	EmailAttr      string `toml:"email_attr" default:"mail"`
+	NicknameAttr   string `toml:"nickname_attr" default:"displayName"`
+	// the groups of user are searched under group_base_dn, %s in group_filter is replaced by the user DN
+	GroupBaseDN string `toml:"group_base_dn"`
+	GroupFilter string `toml:"group_filter" default:"(member=%s)"`
+	GroupAttr   string `toml:"group_attr" default:"cn"`
+	// members of these groups are administrators, the admin flag isn't managed if it is empty
+	AdminGroups []string `toml:"admin_groups"`
+	// check the local password if the user can't bind, eg: the initial administrator
+	FallbackLocal bool `toml:"fallback_local"`
+	// a successful bind is reused for a while, so the requests with basic auth don't bind every time
+	CacheTTL time.Duration `toml:"cache_ttl" default:"1m"`
+	// the HMAC key of cached binds, it should be shared by all instances,
+	// a random key is used if it is empty, so every instance caches binds by itself
+	CacheSecret string `toml:"cache_secret"`
+}
+
+// TracingConfig exports the OpenTelemetry spans of requests
+type TracingConfig struct {
+	Enabled     bool   `toml:"enabled"`
+	ServiceName string `toml:"service_name" default:"vmihub"`
+	// otlp or stdout, stdout prints spans to stdout for local testing
+	Exporter string `toml:"exporter" default:"otlp"`
+	// the host:port of OTLP/HTTP receiver, the environment variables of OTLP exporter are used if it is empty
+	Endpoint string `toml:"endpoint"`
+	Insecure bool   `toml:"insecure"`
+	// the ratio of sampled traces, the sampling decision of the caller is respected
+	SampleRatio float64 `toml:"sample_ratio" default:"1"`
+}
+
 // JWTConfig JWT signingKey info
 type JWTConfig struct {
 	SigningKey string `toml:"key"`
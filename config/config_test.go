@@ -41,4 +41,8 @@ func TestLoadDefaultConfig(t *testing.T) {
 	assert.Equal(t, cfg.GlobalTimeout, 5*time.Minute)
 	assert.Equal(t, cfg.Server.RunMode, "release")
 	assert.Equal(t, cfg.MaxConcurrency, 10000)
+	assert.Equal(t, cfg.Auth.Type, "local")
+	assert.Equal(t, cfg.Auth.LDAP.GroupFilter, "(member=%s)")
+	assert.Equal(t, cfg.Tracing.Exporter, "otlp")
+	assert.Equal(t, cfg.Tracing.SampleRatio, 1.0)
 }
@@ -0,0 +1,33 @@
+package admin
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/projecteru2/vmihub/internal/middlewares"
+)
+
+func SetupRouter(r *gin.RouterGroup) {
+	adminGroup := r.Group("/admin", middlewares.AdminRequired())
+
+	// List users
+	adminGroup.GET("/users", ListUsers)
+	// Create user
+	adminGroup.POST("/users", CreateUser)
+	// Get user
+	adminGroup.GET("/users/:username", GetUser)
+	// Update user, including disabling and admin toggling
+	adminGroup.PUT("/users/:username", UpdateUser)
+	// Delete user
+	adminGroup.DELETE("/users/:username", DeleteUser)
+	// Link user to an account of the OIDC provider
+	adminGroup.PUT("/users/:username/oidc", LinkOIDC)
+
+	// Get quota and usage of user or organization
+	adminGroup.GET("/quotas/:namespace", GetQuota)
+	// Set quota of user or organization
+	adminGroup.PUT("/quotas/:namespace", SetQuota)
+	// Delete quota of user or organization
+	adminGroup.DELETE("/quotas/:namespace", DeleteQuota)
+
+	// List audit logs
+	adminGroup.GET("/audit", ListAuditLogs)
+}
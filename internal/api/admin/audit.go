@@ -0,0 +1,70 @@
+package admin
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/projecteru2/core/log"
+	"github.com/projecteru2/vmihub/internal/models"
+)
+
+// ListAuditLogs list audit logs
+//
+// @Summary list audit logs
+// @Description ListAuditLogs lists the audit logs of mutating operations from newest to oldest
+// @Tags 用户管理
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "token"
+// @Param username query string false "操作用户"
+// @Param action query string false "操作, 如 image.push"
+// @Param target query string false "操作对象前缀, 如 infra/centos"
+// @Param result query string false "success 或 failure"
+// @Param since query string false "起始时间, RFC3339 格式"
+// @Param until query string false "截止时间, RFC3339 格式"
+// @Param page query int false "页码"  default(1)
+// @Param pageSize query int false "每一页数量"  default(10)
+// @success 200 {object} types.JSONResult{data=[]models.AuditLog} "desc"
+// @Router  /admin/audit [get]
+func ListAuditLogs(c *gin.Context) {
+	pNum, err1 := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pSize, err2 := strconv.Atoi(c.DefaultQuery("pageSize", "10"))
+	if err1 != nil || err2 != nil || pNum <= 0 || pSize <= 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid page or pageSize"})
+		return
+	}
+	filter := &models.AuditLogFilter{
+		Username: c.Query("username"),
+		Action:   c.Query("action"),
+		Target:   c.Query("target"),
+		Result:   c.Query("result"),
+	}
+	var err error
+	if since := c.Query("since"); since != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid since, it should be in RFC3339 format"})
+			return
+		}
+	}
+	if until := c.Query("until"); until != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid until, it should be in RFC3339 format"})
+			return
+		}
+	}
+	logs, total, err := models.QueryAuditLogs(c, filter, pNum, pSize)
+	if err != nil {
+		log.WithFunc("ListAuditLogs").Error(c, err, "failed to query audit logs from db")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	if logs == nil {
+		logs = []models.AuditLog{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data":  logs,
+		"total": total,
+	})
+}
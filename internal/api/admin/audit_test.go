@@ -0,0 +1,87 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/projecteru2/vmihub/internal/middlewares"
+	"github.com/projecteru2/vmihub/internal/models"
+	"github.com/projecteru2/vmihub/internal/testutils"
+)
+
+var (
+	auditTableName = ((*models.AuditLog)(nil)).TableName()
+	auditColumns   = ((*models.AuditLog)(nil)).ColumnNames()
+)
+
+func (suite *adminTestSuite) TestListAuditLogs() {
+	{
+		suite.expectLogin(true)
+		since := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT count(*) FROM %s WHERE action = ? AND target LIKE CONCAT(?, '%%') AND result = ? AND created_at >= ?", auditTableName)).
+			WithArgs(models.AuditImageDelete, `infra/centos\_7`, models.AuditResultFailure, since).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(11))
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE action = ? AND target LIKE CONCAT(?, '%%') AND result = ? AND created_at >= ? ORDER BY id DESC LIMIT ?, ?", auditColumns, auditTableName)).
+			WithArgs(models.AuditImageDelete, `infra/centos\_7`, models.AuditResultFailure, since, 10, 10).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "action", "target", "status", "result"}).
+				AddRow(3, "user2", models.AuditImageDelete, "infra/centos_7:latest", http.StatusForbidden, models.AuditResultFailure))
+		w := suite.request("GET", "/api/v1/admin/audit?action=image.delete&target=infra/centos_7&result=failure&since=2026-10-01T00:00:00Z&page=2", nil)
+		suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+		resp := struct {
+			Data  []models.AuditLog `json:"data"`
+			Total int               `json:"total"`
+		}{}
+		err := json.Unmarshal(w.Body.Bytes(), &resp)
+		suite.Nil(err)
+		suite.Equal(11, resp.Total)
+		suite.Len(resp.Data, 1)
+		suite.Equal("infra/centos_7:latest", resp.Data[0].Target)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		suite.expectLogin(true)
+		w := suite.request("GET", "/api/v1/admin/audit?until=yesterday", nil)
+		suite.Equal(http.StatusBadRequest, w.Code)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+}
+
+func (suite *adminTestSuite) TestAuditMiddleware() {
+	r, err := testutils.PrepareGinEngine()
+	suite.Nil(err)
+	r.Use(middlewares.Audit())
+	SetupRouter(r.Group("/api/v1", middlewares.Authenticate()))
+
+	// the failed operations are recorded too
+	suite.expectLogin(true)
+	suite.expectUser("user2", 2)
+	models.Mock.ExpectQuery("SELECT count(*) FROM repository WHERE username = ?").
+		WithArgs("user2").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	models.Mock.ExpectBegin()
+	models.Mock.ExpectExec("INSERT INTO audit_log(username, auth_method, action, target, digest, detail, client_ip, status, result) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)").
+		WithArgs("user1", "basic", models.AuditUserDelete, "user2", "", "", "10.0.0.1", http.StatusConflict, models.AuditResultFailure).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	models.Mock.ExpectCommit()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("DELETE", "/api/v1/admin/users/user2", nil)
+	req.RemoteAddr = "10.0.0.1:40000"
+	testutils.AddAuth(req, "user1", "pass1")
+	r.ServeHTTP(w, req)
+	suite.Equal(http.StatusConflict, w.Code)
+	suite.Nil(models.Mock.ExpectationsWereMet())
+
+	// the reads aren't recorded
+	suite.expectLogin(true)
+	suite.expectUser("user2", 2)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/admin/users/user2", nil)
+	testutils.AddAuth(req, "user1", "pass1")
+	r.ServeHTTP(w, req)
+	suite.Equal(http.StatusOK, w.Code)
+	suite.Nil(models.Mock.ExpectationsWereMet())
+}
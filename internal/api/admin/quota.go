@@ -0,0 +1,147 @@
+package admin
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/projecteru2/core/log"
+	"github.com/projecteru2/vmihub/internal/common"
+	"github.com/projecteru2/vmihub/internal/models"
+	"github.com/projecteru2/vmihub/pkg/terrors"
+	"github.com/projecteru2/vmihub/pkg/types"
+)
+
+// GetQuota get quota
+//
+// @Summary get quota
+// @Description GetQuota returns the quota and usage of a user or an organization
+// @Tags 用户管理
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "token"
+// @Param namespace path string true "用户名或组织名"
+// @success 200 {object} types.JSONResult{data=types.UsageResp} "desc"
+// @Router  /admin/quotas/{namespace} [get]
+func GetQuota(c *gin.Context) {
+	logger := log.WithFunc("GetQuota")
+	namespace, err := getNamespace(c)
+	if err != nil {
+		return
+	}
+	quota, err := models.GetQuota(c, namespace)
+	if err != nil {
+		logger.Errorf(c, err, "failed to get quota of %s", namespace)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	usage, err := models.GetUsage(c, namespace, 0)
+	if err != nil {
+		logger.Error(c, err, "failed to get usage")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	resp := &types.UsageResp{
+		Namespace: namespace,
+		Size:      usage.Size,
+		Images:    usage.Images,
+	}
+	if quota != nil {
+		resp.MaxSize, resp.MaxImages = quota.MaxSize, quota.MaxImages
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": resp,
+	})
+}
+
+// SetQuota set quota
+//
+// @Summary set quota
+// @Description SetQuota limits the total bytes and number of images of a user or an organization,
+// @Description the existing images aren't affected even if they exceed the quota
+// @Tags 用户管理
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "token"
+// @Param namespace path string true "用户名或组织名"
+// @Param body body types.QuotaRequest true "配额"
+// @success 200 {object} types.JSONResult{data=models.Quota} "desc"
+// @Router  /admin/quotas/{namespace} [put]
+func SetQuota(c *gin.Context) {
+	audit := common.Audit(c, models.AuditQuotaSet, c.Param("namespace"))
+	var req types.QuotaRequest
+	if err := c.ShouldBindWith(&req, binding.JSON); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Detail = fmt.Sprintf("maxSize=%d maxImages=%d", req.MaxSize, req.MaxImages)
+	namespace, err := getNamespace(c)
+	if err != nil {
+		return
+	}
+	quota := &models.Quota{
+		Namespace: namespace,
+		MaxSize:   req.MaxSize,
+		MaxImages: req.MaxImages,
+	}
+	if err = quota.Save(nil); err != nil {
+		log.WithFunc("SetQuota").Errorf(c, err, "failed to save quota of %s", namespace)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": quota,
+	})
+}
+
+// DeleteQuota delete quota
+//
+// @Summary delete quota
+// @Description DeleteQuota removes the quota of a user or an organization, so it becomes unlimited
+// @Tags 用户管理
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "token"
+// @Param namespace path string true "用户名或组织名"
+// @success 200 {object} types.JSONResult{msg=string} "desc"
+// @Router  /admin/quotas/{namespace} [delete]
+func DeleteQuota(c *gin.Context) {
+	namespace := c.Param("namespace")
+	common.Audit(c, models.AuditQuotaDelete, namespace)
+	quota := &models.Quota{Namespace: namespace}
+	if err := quota.Delete(nil); err != nil {
+		log.WithFunc("DeleteQuota").Errorf(c, err, "failed to delete quota of %s", namespace)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "success",
+	})
+}
+
+// getNamespace returns the namespace of path if it is a user or an organization
+func getNamespace(c *gin.Context) (string, error) {
+	logger := log.WithFunc("getNamespace")
+	namespace := c.Param("namespace")
+	user, err := models.GetUser(c, namespace)
+	if err != nil {
+		logger.Error(c, err, "failed to query user from db")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return "", err
+	}
+	if user != nil {
+		return namespace, nil
+	}
+	org, err := models.QueryOrg(c, namespace)
+	if err != nil {
+		logger.Error(c, err, "failed to query organization from db")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return "", err
+	}
+	if org == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "user or organization not found"})
+		return "", terrors.ErrPlaceholder
+	}
+	return namespace, nil
+}
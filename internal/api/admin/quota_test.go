@@ -0,0 +1,85 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/projecteru2/vmihub/internal/models"
+	"github.com/projecteru2/vmihub/pkg/types"
+)
+
+var (
+	quotaColumns = ((*models.Quota)(nil)).ColumnNames()
+	orgColumns   = ((*models.Organization)(nil)).ColumnNames()
+)
+
+func (suite *adminTestSuite) TestSetQuota() {
+	{
+		suite.expectLogin(true)
+		w := suite.request("PUT", "/api/v1/admin/quotas/user2", map[string]any{"maxSize": -1})
+		suite.Equal(http.StatusBadRequest, w.Code)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		// the namespace is neither a user nor an organization
+		suite.expectLogin(true)
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ?", userColumns, userTableName)).
+			WithArgs("nobody").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username"}))
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM organization WHERE name = ?", orgColumns)).
+			WithArgs("nobody").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name"}))
+		w := suite.request("PUT", "/api/v1/admin/quotas/nobody", types.QuotaRequest{MaxSize: 1024})
+		suite.Equal(http.StatusNotFound, w.Code)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		suite.expectLogin(true)
+		suite.expectUser("user2", 2)
+		models.Mock.ExpectBegin()
+		models.Mock.ExpectExec(`INSERT INTO quota(namespace, max_size, max_images) VALUES(?, ?, ?)
+		    ON DUPLICATE KEY UPDATE max_size = ?, max_images = ?`).
+			WithArgs("user2", 1024, 10, 1024, 10).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		models.Mock.ExpectCommit()
+		w := suite.request("PUT", "/api/v1/admin/quotas/user2", types.QuotaRequest{MaxSize: 1024, MaxImages: 10})
+		suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+}
+
+func (suite *adminTestSuite) TestGetQuota() {
+	suite.expectLogin(true)
+	suite.expectUser("user2", 2)
+	models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM quota WHERE namespace = ?", quotaColumns)).
+		WithArgs("user2").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "namespace", "max_size", "max_images"}).AddRow(1, "user2", 1024, 10))
+	models.Mock.ExpectQuery(`SELECT COALESCE(SUM(i.size), 0) AS size, COUNT(*) AS images
+	    FROM image i, repository r
+	    WHERE r.id=i.repo_id AND r.username=? AND i.state != ? AND i.id != ?`).
+		WithArgs("user2", models.ImageStateFailed, 0).
+		WillReturnRows(sqlmock.NewRows([]string{"size", "images"}).AddRow(512, 3))
+	w := suite.request("GET", "/api/v1/admin/quotas/user2", nil)
+	suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+	resp := struct {
+		Data types.UsageResp `json:"data"`
+	}{}
+	err := json.Unmarshal(w.Body.Bytes(), &resp)
+	suite.Nil(err)
+	suite.Equal(types.UsageResp{Namespace: "user2", Size: 512, Images: 3, MaxSize: 1024, MaxImages: 10}, resp.Data)
+	suite.Nil(models.Mock.ExpectationsWereMet())
+}
+
+func (suite *adminTestSuite) TestDeleteQuota() {
+	suite.expectLogin(true)
+	models.Mock.ExpectBegin()
+	models.Mock.ExpectExec("DELETE FROM quota WHERE namespace = ?").
+		WithArgs("user2").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	models.Mock.ExpectCommit()
+	w := suite.request("DELETE", "/api/v1/admin/quotas/user2", nil)
+	suite.Equal(http.StatusOK, w.Code)
+	suite.Nil(models.Mock.ExpectationsWereMet())
+}
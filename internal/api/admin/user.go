@@ -0,0 +1,308 @@
+package admin
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/projecteru2/core/log"
+	"github.com/projecteru2/vmihub/internal/common"
+	"github.com/projecteru2/vmihub/internal/models"
+	"github.com/projecteru2/vmihub/internal/oidc"
+	"github.com/projecteru2/vmihub/pkg/terrors"
+	"github.com/projecteru2/vmihub/pkg/types"
+)
+
+// ListUsers list users
+//
+// @Summary list users
+// @Description ListUsers lists the users whose username contains keyword
+// @Tags 用户管理
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "token"
+// @Param keyword query string false "关键字"
+// @Param page query int false "页码"  default(1)
+// @Param pageSize query int false "每一页数量"  default(10)
+// @success 200 {object} types.JSONResult{data=[]types.UserInfoResp} "desc"
+// @Router  /admin/users [get]
+func ListUsers(c *gin.Context) {
+	pNum, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pSize, _ := strconv.Atoi(c.DefaultQuery("pageSize", "10"))
+	if pNum <= 0 || pSize <= 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid page or pageSize"})
+		return
+	}
+	users, err := models.QueryUsers(c, c.Query("keyword"), pNum, pSize)
+	if err != nil {
+		log.WithFunc("ListUsers").Error(c, err, "failed to query users from db")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	resp := make([]*types.UserInfoResp, 0, len(users))
+	for idx := range users {
+		resp = append(resp, convUserResp(&users[idx]))
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": resp,
+	})
+}
+
+// CreateUser create user
+//
+// @Summary create user
+// @Description CreateUser creates a user without verification
+// @Tags 用户管理
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "token"
+// @Param body body types.AdminCreateUserRequest true "用户结构体"
+// @success 200 {object} types.JSONResult{data=types.UserInfoResp} "desc"
+// @Failure 409
+// @Router  /admin/users [post]
+func CreateUser(c *gin.Context) {
+	var req types.AdminCreateUserRequest
+	if err := c.ShouldBindWith(&req, binding.JSON); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	common.Audit(c, models.AuditUserCreate, req.Username).Detail = fmt.Sprintf("admin=%t", req.Admin)
+	if err := common.CheckNameAvailable(c, req.Username); err != nil {
+		return
+	}
+	user := &models.User{
+		Username: req.Username,
+		Email:    req.Email,
+		Nickname: req.Nickname,
+		Admin:    req.Admin,
+	}
+	if err := models.CreateUser(nil, user, req.Password); err != nil {
+		log.WithFunc("CreateUser").Errorf(c, err, "failed to create user %s", req.Username)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": convUserResp(user),
+	})
+}
+
+// GetUser get user
+//
+// @Summary get user
+// @Description GetUser returns the user named username
+// @Tags 用户管理
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "token"
+// @Param username path string true "用户名"
+// @success 200 {object} types.JSONResult{data=types.UserInfoResp} "desc"
+// @Router  /admin/users/{username} [get]
+func GetUser(c *gin.Context) {
+	user, err := getUser(c)
+	if err != nil {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": convUserResp(user),
+	})
+}
+
+// UpdateUser update user
+//
+// @Summary update user
+// @Description UpdateUser changes the profile, password, admin and disabled flags of user,
+// @Description administrators can't demote or disable themselves
+// @Tags 用户管理
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "token"
+// @Param username path string true "用户名"
+// @Param body body types.AdminUpdateUserRequest true "用户结构体"
+// @success 200 {object} types.JSONResult{data=types.UserInfoResp} "desc"
+// @Router  /admin/users/{username} [put]
+func UpdateUser(c *gin.Context) {
+	logger := log.WithFunc("UpdateUser")
+	audit := common.Audit(c, models.AuditUserUpdate, c.Param("username"))
+	var req types.AdminUpdateUserRequest
+	if err := c.ShouldBindWith(&req, binding.JSON); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Detail = updatedFields(&req)
+	user, err := getUser(c)
+	if err != nil {
+		return
+	}
+	// otherwise there may be no administrator at all
+	if isCurrentUser(c, user) && ((req.Admin != nil && !*req.Admin) || (req.Disabled != nil && *req.Disabled)) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "you can't demote or disable yourself"})
+		return
+	}
+	// the cached user is shared, so change a copy
+	newUser := *user
+	if req.Email != nil {
+		newUser.Email = *req.Email
+	}
+	if req.Nickname != nil {
+		newUser.Nickname = *req.Nickname
+	}
+	if req.Admin != nil {
+		newUser.Admin = *req.Admin
+	}
+	if req.Disabled != nil {
+		newUser.Disabled = *req.Disabled
+	}
+	if err = newUser.Update(nil); err != nil {
+		logger.Errorf(c, err, "failed to update user %s", user.Username)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	if req.Password != "" {
+		if err = newUser.UpdatePwd(req.Password); err != nil {
+			logger.Errorf(c, err, "failed to change password of user %s", user.Username)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": convUserResp(&newUser),
+	})
+}
+
+// DeleteUser delete user
+//
+// @Summary delete user
+// @Description DeleteUser deletes user with its private tokens and memberships,
+// @Description the repositories of user must be deleted before
+// @Tags 用户管理
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "token"
+// @Param username path string true "用户名"
+// @success 200 {object} types.JSONResult{msg=string} "desc"
+// @Failure 409
+// @Router  /admin/users/{username} [delete]
+func DeleteUser(c *gin.Context) {
+	logger := log.WithFunc("DeleteUser")
+	common.Audit(c, models.AuditUserDelete, c.Param("username"))
+	user, err := getUser(c)
+	if err != nil {
+		return
+	}
+	if isCurrentUser(c, user) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "you can't delete yourself"})
+		return
+	}
+	count, err := models.CountReposByUsername(c, user.Username)
+	if err != nil {
+		logger.Errorf(c, err, "failed to count repositories of user %s", user.Username)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	if count > 0 {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "user still has repositories"})
+		return
+	}
+	if err = user.Delete(nil); err != nil {
+		logger.Errorf(c, err, "failed to delete user %s", user.Username)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "success",
+	})
+}
+
+// LinkOIDC link user to OIDC account
+//
+// @Summary link user to OIDC account
+// @Description LinkOIDC links user to the account of subject in the OIDC provider,
+// @Description so the account can login as the existing user. The previous link of user or account is replaced.
+// @Tags 用户管理
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "token"
+// @Param username path string true "用户名"
+// @Param body body types.AdminLinkOIDCRequest true "OIDC账号"
+// @success 200 {object} types.JSONResult{msg=string} "desc"
+// @Router  /admin/users/{username}/oidc [put]
+func LinkOIDC(c *gin.Context) {
+	audit := common.Audit(c, models.AuditUserUpdate, c.Param("username"))
+	if !oidc.Enabled() {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": oidc.ErrDisabled.Error()})
+		return
+	}
+	var req types.AdminLinkOIDCRequest
+	if err := c.ShouldBindWith(&req, binding.JSON); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Detail = "oidc=" + req.Subject
+	user, err := getUser(c)
+	if err != nil {
+		return
+	}
+	if err = user.LinkOIDC(nil, oidc.Issuer(), req.Subject); err != nil {
+		log.WithFunc("LinkOIDC").Errorf(c, err, "failed to link user %s to OIDC account %s", user.Username, req.Subject)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "success",
+	})
+}
+
+// updatedFields describes the changes of request for audit log, the password is omitted
+func updatedFields(req *types.AdminUpdateUserRequest) string {
+	var fields []string
+	if req.Email != nil {
+		fields = append(fields, "email")
+	}
+	if req.Nickname != nil {
+		fields = append(fields, "nickname")
+	}
+	if req.Admin != nil {
+		fields = append(fields, fmt.Sprintf("admin=%t", *req.Admin))
+	}
+	if req.Disabled != nil {
+		fields = append(fields, fmt.Sprintf("disabled=%t", *req.Disabled))
+	}
+	if req.Password != "" {
+		fields = append(fields, "password")
+	}
+	return strings.Join(fields, " ")
+}
+
+func getUser(c *gin.Context) (*models.User, error) {
+	user, err := models.GetUser(c, c.Param("username"))
+	if err != nil {
+		log.WithFunc("getUser").Error(c, err, "failed to query user from db")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return nil, err
+	}
+	if user == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "user doesn't exist"})
+		return nil, terrors.ErrPlaceholder
+	}
+	return user, nil
+}
+
+func isCurrentUser(c *gin.Context, user *models.User) bool {
+	curUser, ok := common.LoginUser(c)
+	return ok && curUser.ID == user.ID
+}
+
+func convUserResp(u *models.User) *types.UserInfoResp {
+	return &types.UserInfoResp{
+		ID:       u.ID,
+		Username: u.Username,
+		IsAdmin:  u.Admin,
+		Disabled: u.Disabled,
+		Email:    u.Email,
+		Nickname: u.Nickname,
+		Source:   u.Source,
+	}
+}
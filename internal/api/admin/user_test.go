@@ -0,0 +1,181 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/projecteru2/vmihub/config"
+	"github.com/projecteru2/vmihub/internal/middlewares"
+	"github.com/projecteru2/vmihub/internal/models"
+	"github.com/projecteru2/vmihub/internal/oidc"
+	"github.com/projecteru2/vmihub/internal/testutils"
+	"github.com/projecteru2/vmihub/internal/utils"
+	"github.com/projecteru2/vmihub/pkg/types"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+var (
+	userTableName = ((*models.User)(nil)).TableName()
+	userColumns   = ((*models.User)(nil)).ColumnNames()
+)
+
+type adminTestSuite struct {
+	suite.Suite
+	r *gin.Engine
+}
+
+func (suite *adminTestSuite) SetupTest() {
+	t := suite.T()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	err := testutils.Prepare(ctx, t)
+	require.NoError(t, err)
+
+	r, err := testutils.PrepareGinEngine()
+	require.NoError(t, err)
+	apiGroup := r.Group("/api/v1", middlewares.Authenticate())
+
+	SetupRouter(apiGroup)
+	suite.r = r
+}
+
+// expectLogin prepares user1 who authenticates the requests
+func (suite *adminTestSuite) expectLogin(admin bool) {
+	utils.MockRedis.FlushAll()
+	ePasswd, err := utils.EncryptPassword("pass1")
+	suite.Nil(err)
+	models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ?", userColumns, userTableName)).
+		WithArgs("user1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password", "admin"}).AddRow(1, "user1", ePasswd, admin))
+}
+
+func (suite *adminTestSuite) expectUser(username string, id int64) {
+	models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ?", userColumns, userTableName)).
+		WithArgs(username).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "email"}).AddRow(id, username, "user2@example.com"))
+}
+
+func (suite *adminTestSuite) request(method, url string, body any) *httptest.ResponseRecorder {
+	var bs []byte
+	if body != nil {
+		bs, _ = json.Marshal(body)
+	}
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, url, bytes.NewReader(bs))
+	testutils.AddAuth(req, "user1", "pass1")
+	suite.r.ServeHTTP(w, req)
+	return w
+}
+
+func (suite *adminTestSuite) TestAdminRequired() {
+	suite.expectLogin(false)
+	w := suite.request("GET", "/api/v1/admin/users", nil)
+	suite.Equal(http.StatusForbidden, w.Code)
+	suite.Nil(models.Mock.ExpectationsWereMet())
+}
+
+func (suite *adminTestSuite) TestUpdateUser() {
+	disabled, admin := true, false
+	{
+		// disable user and keep other fields
+		suite.expectLogin(true)
+		suite.expectUser("user2", 2)
+		models.Mock.ExpectBegin()
+		models.Mock.ExpectExec("UPDATE user SET nickname = ?, email = ?, admin = ?, disabled = ? WHERE id = ?").
+			WithArgs("", "user2@example.com", false, true, 2).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		models.Mock.ExpectCommit()
+		w := suite.request("PUT", "/api/v1/admin/users/user2", types.AdminUpdateUserRequest{Disabled: &disabled})
+		suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+		suite.Contains(w.Body.String(), `"disabled":true`)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		// administrators can't demote themselves
+		suite.expectLogin(true)
+		w := suite.request("PUT", "/api/v1/admin/users/user1", types.AdminUpdateUserRequest{Admin: &admin})
+		suite.Equal(http.StatusBadRequest, w.Code)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+}
+
+func (suite *adminTestSuite) TestDeleteUser() {
+	{
+		suite.expectLogin(true)
+		suite.expectUser("user2", 2)
+		models.Mock.ExpectQuery("SELECT count(*) FROM repository WHERE username = ?").
+			WithArgs("user2").
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+		w := suite.request("DELETE", "/api/v1/admin/users/user2", nil)
+		suite.Equal(http.StatusConflict, w.Code)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		suite.expectLogin(true)
+		suite.expectUser("user2", 2)
+		models.Mock.ExpectQuery("SELECT count(*) FROM repository WHERE username = ?").
+			WithArgs("user2").
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+		models.Mock.ExpectBegin()
+		for _, sqlStr := range []string{
+			"DELETE FROM private_token WHERE user_id = ?",
+			"DELETE FROM organization_member WHERE user_id = ?",
+			"DELETE FROM repository_member WHERE user_id = ?",
+			"DELETE FROM user_oidc WHERE user_id = ?",
+			"DELETE FROM user WHERE id = ?",
+		} {
+			models.Mock.ExpectExec(sqlStr).WithArgs(2).WillReturnResult(sqlmock.NewResult(0, 1))
+		}
+		models.Mock.ExpectCommit()
+		w := suite.request("DELETE", "/api/v1/admin/users/user2", nil)
+		suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+}
+
+func (suite *adminTestSuite) TestLinkOIDC() {
+	{
+		// OIDC is disabled
+		suite.expectLogin(true)
+		w := suite.request("PUT", "/api/v1/admin/users/user2/oidc", types.AdminLinkOIDCRequest{Subject: "sub2"})
+		suite.Equal(http.StatusNotFound, w.Code)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	idp := testutils.NewMockIdP(suite.T(), "vmihub")
+	cfg := &config.OIDCConfig{
+		Enabled:       true,
+		Issuer:        idp.URL,
+		ClientID:      "vmihub",
+		UsernameClaim: "preferred_username",
+	}
+	suite.Require().NoError(oidc.Init(context.Background(), cfg))
+	defer oidc.Init(context.Background(), &config.OIDCConfig{}) //nolint:errcheck
+	{
+		suite.expectLogin(true)
+		suite.expectUser("user2", 2)
+		models.Mock.ExpectBegin()
+		models.Mock.ExpectExec("DELETE FROM user_oidc WHERE issuer = ? AND user_id = ?").
+			WithArgs(idp.URL, 2).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		models.Mock.ExpectExec("INSERT INTO user_oidc(issuer, subject, user_id) VALUES(?, ?, ?) ON DUPLICATE KEY UPDATE user_id = ?").
+			WithArgs(idp.URL, "sub2", 2, 2).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		models.Mock.ExpectCommit()
+		w := suite.request("PUT", "/api/v1/admin/users/user2/oidc", types.AdminLinkOIDCRequest{Subject: "sub2"})
+		suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+}
+
+func TestAdminTestSuite(t *testing.T) {
+	suite.Run(t, new(adminTestSuite))
+}
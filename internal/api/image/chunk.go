@@ -8,6 +8,7 @@ import (
 	"math"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"time"
 
@@ -17,10 +18,13 @@ import (
 	"github.com/mcuadros/go-defaults"
 
 	"github.com/projecteru2/core/log"
+	"github.com/projecteru2/vmihub/config"
 	"github.com/projecteru2/vmihub/internal/common"
+	"github.com/projecteru2/vmihub/internal/imageops"
 	"github.com/projecteru2/vmihub/internal/models"
 	storFact "github.com/projecteru2/vmihub/internal/storage/factory"
 	stotypes "github.com/projecteru2/vmihub/internal/storage/types"
+	"github.com/projecteru2/vmihub/internal/task"
 	"github.com/projecteru2/vmihub/internal/utils"
 	"github.com/projecteru2/vmihub/pkg/terrors"
 	"github.com/projecteru2/vmihub/pkg/types"
@@ -28,16 +32,17 @@ import (
 )
 
 const (
-	redisInfoKey  = "/vmihub/chunk/info/%s"
-	redisSliceKey = "/vmihub/chunk/slice/%s"
+	redisInfoKey  = models.RedisUploadInfoKey
+	redisSliceKey = models.RedisUploadSliceKey
 
-	redisImageHKey    = "image"
+	redisImageHKey    = models.RedisUploadImageHKey
 	redisForceHKey    = "force"
-	redisSizeHKey     = "chunkSize"
+	redisSizeHKey     = models.RedisUploadChunkSizeHKey
 	redisDigestHkey   = "digest"
-	redisChunkNumHkey = "nChunks"
+	redisChunkNumHkey = models.RedisUploadChunkNumHKey
+	redisMergedHKey   = models.RedisUploadMergedHKey
+	redisMergingHKey  = models.RedisUploadMergingHKey
 
-	chunkRedisExpire = 60 * 60 * time.Second
 	defaultChunkSize = "50M" // 1024 * 1024 * 50
 )
 
@@ -84,6 +89,9 @@ func DownloadImageChunk(c *gin.Context) {
 	if err != nil {
 		return
 	}
+	if err := checkImageReady(c, img); err != nil {
+		return
+	}
 
 	if img.Format == models.ImageFormatRBD {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "image created from system disk doesn't support download"})
@@ -97,8 +105,16 @@ func DownloadImageChunk(c *gin.Context) {
 		return
 	}
 	sto := storFact.Instance()
+	objName, err := imageObjectName(c, img)
+	if err != nil {
+		log.WithFunc("DownloadImageChunk").Error(c, err, "failed to get image file")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+			"error": "internal error, please try again.",
+		})
+		return
+	}
 	offset := int64(uint64(cIdx) * chunkSize)
-	rc, err := sto.SeekRead(c, img.Fullname(), offset)
+	rc, err := sto.SeekRead(c, objName, offset)
 	if err != nil {
 		log.WithFunc("DownloadImageChunk").Error(c, err, "failed to get seek reader")
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
@@ -176,12 +192,16 @@ func StartImageChunkUpload(c *gin.Context) {
 	}
 
 	// if img exists and not force update, upload failed!
-	if img != nil && !force {
+	// the failed image can be uploaded again without force
+	if img != nil && img.State != models.ImageStateFailed && !force {
 		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
 			"error": "Upload failed, image already exists. You can use force upload to overwrite.",
 		})
 		return
 	}
+	if err := checkQuota(c, username, img, req.Size); err != nil {
+		return
+	}
 
 	if repo == nil {
 		repo = &models.Repository{
@@ -206,6 +226,14 @@ func StartImageChunkUpload(c *gin.Context) {
 			Description: req.Description,
 			Repo:        repo,
 		}
+	} else {
+		// force upload, overwrite the existing image with the new file
+		img.Size = req.Size
+		img.Digest = req.Digest
+		img.Format = req.Format
+	}
+	if err := reserveImage(c, img); err != nil {
+		return
 	}
 
 	rdb := utils.GetRedisConn()
@@ -220,16 +248,6 @@ func StartImageChunkUpload(c *gin.Context) {
 		return
 	}
 
-	// set redis expiration time
-	for _, fStr := range []string{redisInfoKey, redisSliceKey} {
-		rKey := fmt.Sprintf(fStr, uploadID)
-		err = rdb.Expire(c, rKey, chunkRedisExpire).Err()
-		if err != nil {
-			logger.Errorf(c, err, "Failed to set expiration for %s", rKey)
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
-			return
-		}
-	}
 	bs, err := json.Marshal(img)
 	if err != nil {
 		logger.Error(c, err, "failed marshal image tag")
@@ -252,6 +270,10 @@ func StartImageChunkUpload(c *gin.Context) {
 		})
 		return
 	}
+	// the expiration must be set after the key is created
+	if err = expireUploadSession(c, uploadID); err != nil {
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{
 		"data": map[string]any{
 			"uploadID": uploadID,
@@ -259,6 +281,22 @@ func StartImageChunkUpload(c *gin.Context) {
 	})
 }
 
+// expireUploadSession refreshes the expiration of the redis keys of an upload session on activity,
+// so the abandoned sessions can be cleaned up.
+func expireUploadSession(c *gin.Context, uploadID string) error {
+	rdb := utils.GetRedisConn()
+	ttl := config.GetCfg().Storage.UploadTTL
+	for _, fStr := range []string{redisInfoKey, redisSliceKey} {
+		rKey := fmt.Sprintf(fStr, uploadID)
+		if err := rdb.Expire(c, rKey, ttl).Err(); err != nil {
+			log.WithFunc("expireUploadSession").Errorf(c, err, "Failed to set expiration for %s", rKey)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+			return err
+		}
+	}
+	return nil
+}
+
 // UploadImageChunk  upload image chunk
 //
 // @Summary upload image chunk
@@ -319,6 +357,11 @@ func UploadImageChunk(c *gin.Context) {
 			chunkSize, err = humanize.ParseBytes(v)
 		case redisChunkNumHkey:
 			nChunks, err = strconv.Atoi(v)
+		case redisMergingHKey:
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+				"error": "the upload is being merged or aborted",
+			})
+			return
 		}
 		if err != nil {
 			logger.Errorf(c, err, "incorrect redis value: %s %s", k, v)
@@ -369,11 +412,23 @@ func UploadImageChunk(c *gin.Context) {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
 		return
 	}
+	// 计算哈希值
+	sum := h.Sum(nil)
+	contentDigest := fmt.Sprintf("%x", sum)
+
+	// check if the digest equals to user-passed digest
+	if digest != "" && contentDigest != digest {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("invalid digest: got: %s, user passed: %s", contentDigest, digest),
+		})
+		return
+	}
+	// the digest is passed to storage, so the stored chunk can be verified
 	cInfo := &stotypes.ChunkInfo{
 		Idx:       int(chunkIdx),
 		Size:      nwritten,
 		ChunkSize: int64(chunkSize),
-		Digest:    "",
+		Digest:    contentDigest,
 		In:        fp,
 	}
 	err = sto.ChunkWrite(c, img.SliceName(), uploadID, cInfo)
@@ -384,25 +439,19 @@ func UploadImageChunk(c *gin.Context) {
 		})
 		return
 	}
-
-	// 计算哈希值
-	sum := h.Sum(nil)
-	contentDigest := fmt.Sprintf("%x", sum)
-
-	// check if the digest equals to user-passed digest
-	if digest != "" && contentDigest != digest {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-			"error": fmt.Sprintf("invalid digest: got: %s, user passed: %s", img.Digest, digest),
-		})
+	// the upload may be claimed while the chunk is written,
+	// the chunk is not recorded then so the merged file never misses it
+	if err := checkUploadUnclaimed(c, uploadID); err != nil {
 		return
 	}
-	cInfo.Digest = contentDigest
-
 	if err := rdb.HSet(c, fmt.Sprintf(redisSliceKey, uploadID), chunkIdx, cInfo).Err(); err != nil {
 		logger.Errorf(c, err, "failed to save chunk info %d to redis", chunkIdx)
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error, please try again"})
 		return
 	}
+	if err := expireUploadSession(c, uploadID); err != nil {
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{
 		"msg": "upload chunk successfully",
 	})
@@ -411,7 +460,7 @@ func UploadImageChunk(c *gin.Context) {
 // MergeChunk merge chunk slice file
 //
 // @Summary merge chunk slice file
-// @Description MergeChunk merge chunk slice file
+// @Description MergeChunk merge chunk slice file, the image is saved after the file is verified by a task
 // @Tags 镜像管理
 // @Accept json
 // @Produce json
@@ -422,6 +471,7 @@ func UploadImageChunk(c *gin.Context) {
 func MergeChunk(c *gin.Context) {
 	logger := log.WithFunc("MergeChunk")
 	uploadID := c.Query("uploadID")
+	audit := common.Audit(c, models.AuditImagePush, "")
 
 	if uploadID == "" {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
@@ -432,23 +482,24 @@ func MergeChunk(c *gin.Context) {
 
 	rdb := utils.GetRedisConn()
 	kv, err := rdb.HGetAll(c, fmt.Sprintf(redisInfoKey, uploadID)).Result()
-	if err == redis.Nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-			"error": "you should start chunk upload first",
-		})
-		return
-	}
 	if err != nil {
 		logger.Error(c, err, "Failed to get information and slices")
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
 		return
 	}
+	if _, ok := kv[redisImageHKey]; !ok {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "you should start chunk upload first",
+		})
+		return
+	}
 
 	img := &models.Image{}
 	var (
 		// force   bool
 		digest  string
 		nChunks int
+		merged  bool
 	)
 	for k, v := range kv {
 		switch k {
@@ -461,6 +512,8 @@ func MergeChunk(c *gin.Context) {
 			digest = v
 		case redisChunkNumHkey:
 			nChunks, err = strconv.Atoi(v)
+		case redisMergedHKey:
+			merged, err = strconv.ParseBool(v)
 		}
 		if err != nil {
 			logger.Errorf(c, err, "incorrect redis value: %s %s", k, v)
@@ -470,8 +523,24 @@ func MergeChunk(c *gin.Context) {
 			return
 		}
 	}
-	repo := img.Repo
-
+	if merged {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error": "the upload is already merged, the image is being verified",
+		})
+		return
+	}
+	if err := claimUpload(c, uploadID); err != nil {
+		return
+	}
+	// the upload can be merged again after the client fixes the problem
+	defer func() {
+		if c.IsAborted() {
+			releaseUpload(c, uploadID)
+		}
+	}()
+	if img.Repo != nil {
+		audit.Target = img.Fullname()
+	}
 	chunkList, err := checkChunkSlices(c, uploadID, nChunks)
 	if err != nil {
 		return
@@ -503,59 +572,97 @@ func MergeChunk(c *gin.Context) {
 		})
 		return
 	}
+	audit.Digest = img.Digest
 	if digest != "" && digest != img.Digest {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
 			"error": fmt.Sprintf("invalid digest: got: %s, user passed: %s", img.Digest, digest),
 		})
 		return
 	}
-
-	if err = sto.Move(c, img.SliceName(), img.Fullname()); err != nil {
-		logger.Error(c, err, "failed move %s to %s", img.SliceName(), img.Fullname())
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-			"error": "internal error, please try again",
-		})
+	// the declared size may be smaller than the merged file
+	if err := checkQuota(c, img.Repo.Username, img, img.Size); err != nil {
 		return
 	}
 
-	tx, err := models.Instance().Beginx()
+	curUser, _ := common.LoginUser(c)
+	t, err := task.Submit(c, imageops.TaskTypeVerify, curUser.Username, &imageops.VerifyPayload{
+		UploadID: uploadID,
+		Image:    img,
+	})
 	if err != nil {
-		logger.Error(c, err, "failed get transaction")
+		logger.Error(c, err, "failed to submit verify task")
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
 			"error": "internal error, please try again",
 		})
 		return
 	}
-	if repo.ID == 0 {
-		if err = repo.Save(tx); err != nil {
-			logger.Error(c, err, "failed vsave image to db")
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-				"error": "internal error, please try again",
-			})
-			return
-		}
+	// the merged upload can't be merged or aborted again,
+	// the upload session is removed by the task after the image is saved
+	if err := rdb.HSet(c, fmt.Sprintf(redisInfoKey, uploadID), redisMergedHKey, "true").Err(); err != nil {
+		logger.Errorf(c, err, "failed to mark upload %s as merged", uploadID)
 	}
-	if err = repo.SaveImage(tx, img); err != nil {
-		logger.Error(c, err, "failed save image tag to db")
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-			"error": "internal error, please try again",
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "merge success, the image is being verified",
+		"data": map[string]any{
+			"taskID": t.ID,
+		},
+	})
+}
+
+// claimScript sets the claim field only if the upload session exists, HSETNX alone
+// would recreate an expired session without expiration.
+// It returns -1 if the session doesn't exist, 0 if it is claimed already.
+var claimScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return -1
+end
+return redis.call("HSETNX", KEYS[1], ARGV[1], ARGV[2])
+`)
+
+// claimUpload claims the upload session for merging or aborting, so the two never run concurrently
+// and no chunk is accepted any more. 409 is returned if the session is claimed already.
+func claimUpload(c *gin.Context, uploadID string) error {
+	res, err := claimScript.Run(c, utils.GetRedisConn(), []string{fmt.Sprintf(redisInfoKey, uploadID)}, redisMergingHKey, "true").Int()
+	if err != nil {
+		log.WithFunc("claimUpload").Errorf(c, err, "failed to claim upload %s", uploadID)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error, please try again"})
+		return terrors.ErrPlaceholder
+	}
+	switch res {
+	case -1:
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "upload session not found"})
+		return terrors.ErrPlaceholder
+	case 0:
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error": "the upload is being merged or aborted",
 		})
-		return
+		return terrors.ErrPlaceholder
 	}
-	_ = tx.Commit()
-	err = rdb.Del(c, fmt.Sprintf(redisInfoKey, uploadID), fmt.Sprintf(redisSliceKey, uploadID)).Err()
-	if err != nil {
-		// just log error
-		logger.Error(c, err, "Failed to delete chunk keys in redis for %d", uploadID)
+	return nil
+}
+
+// releaseUpload releases the claim of a failed merge or abort
+func releaseUpload(c *gin.Context, uploadID string) {
+	if err := utils.GetRedisConn().HDel(c, fmt.Sprintf(redisInfoKey, uploadID), redisMergingHKey).Err(); err != nil {
+		log.WithFunc("releaseUpload").Errorf(c, err, "failed to release upload %s", uploadID)
 	}
-	// if err := task.SendImageTask(img.ID, force); err != nil {
-	// 	logger.Warnf(c, "failed to sned image preparation task")
-	// }
-	c.JSON(http.StatusOK, gin.H{
-		"msg":  "merge success",
-		"data": "",
-	})
+}
 
+// checkUploadUnclaimed returns 409 if the upload session is claimed by a merge or abort
+func checkUploadUnclaimed(c *gin.Context, uploadID string) error {
+	claimed, err := utils.GetRedisConn().HExists(c, fmt.Sprintf(redisInfoKey, uploadID), redisMergingHKey).Result()
+	if err != nil {
+		log.WithFunc("checkUploadUnclaimed").Errorf(c, err, "failed to check claim of upload %s", uploadID)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error, please try again"})
+		return terrors.ErrPlaceholder
+	}
+	if claimed {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error": "the upload is being merged or aborted",
+		})
+		return terrors.ErrPlaceholder
+	}
+	return nil
 }
 
 func checkChunkSlices(c *gin.Context, uploadID string, nChunks int) (ans []*stotypes.ChunkInfo, err error) {
@@ -617,3 +724,194 @@ func checkChunkSlices(c *gin.Context, uploadID string, nChunks int) (ans []*stot
 	}
 	return ans, nil
 }
+
+// AbortChunkUpload abort chunk upload session
+//
+// @Summary abort chunk upload
+// @Description AbortChunkUpload discards the uploaded chunks, the image reserved by the upload is marked as failed
+// @Tags 镜像管理
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "token"
+// @Param uploadID path string true "上传uploadID"
+// @Success  200
+// @Router  /image/chunk/{uploadID} [delete]
+func AbortChunkUpload(c *gin.Context) {
+	logger := log.WithFunc("AbortChunkUpload")
+	uploadID := c.Param("uploadID")
+	audit := common.Audit(c, models.AuditImageUploadAbort, "")
+
+	sess, err := getUploadSession(c, uploadID)
+	if err != nil {
+		return
+	}
+	img := sess.Image
+	audit.Target = img.Fullname()
+	if sess.Merged {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error": "the upload is already merged, the image is being verified",
+		})
+		return
+	}
+	if err := claimUpload(c, uploadID); err != nil {
+		return
+	}
+	defer func() {
+		if c.IsAborted() {
+			releaseUpload(c, uploadID)
+		}
+	}()
+	sto := storFact.Instance()
+	if err := sto.AbortChunkWrite(c, img.SliceName(), uploadID); err != nil {
+		logger.Error(c, err, "Failed to abort chunk write")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	if err := models.RemoveUploadSession(c, uploadID); err != nil {
+		logger.Errorf(c, err, "failed to remove upload session %s", uploadID)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	failImage(c, img)
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "abort upload successfully",
+	})
+}
+
+// GetChunkUploadStatus get the progress of chunk upload
+//
+// @Summary get chunk upload status
+// @Description GetChunkUploadStatus returns the received chunks, so an interrupted upload can be resumed by uploading the missing ones
+// @Tags 镜像管理
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "token"
+// @Param uploadID path string true "上传uploadID"
+// @success 200 {object} types.JSONResult{data=types.UploadStatusResp} "desc"
+// @Router  /image/chunk/{uploadID}/status [get]
+func GetChunkUploadStatus(c *gin.Context) {
+	logger := log.WithFunc("GetChunkUploadStatus")
+	uploadID := c.Param("uploadID")
+
+	sess, err := getUploadSession(c, uploadID)
+	if err != nil {
+		return
+	}
+	kv, err := utils.GetRedisConn().HGetAll(c, fmt.Sprintf(redisSliceKey, uploadID)).Result()
+	if err != nil && err != redis.Nil {
+		logger.Error(c, err, "Failed to get slices from redis")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	chunks := make([]*types.UploadChunkResp, 0, len(kv))
+	for k, v := range kv {
+		cInfo := &stotypes.ChunkInfo{}
+		if err = json.Unmarshal([]byte(v), cInfo); err != nil {
+			logger.Errorf(c, err, "invalid slice value %s %s", k, v)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error, please try again"})
+			return
+		}
+		chunks = append(chunks, &types.UploadChunkResp{
+			Idx:    cInfo.Idx,
+			Size:   cInfo.Size,
+			Digest: cInfo.Digest,
+		})
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].Idx < chunks[j].Idx
+	})
+	// the client is going to resume the upload
+	if err := expireUploadSession(c, uploadID); err != nil {
+		return
+	}
+	sess.ExpiresAt = time.Now().Add(config.GetCfg().Storage.UploadTTL)
+	c.JSON(http.StatusOK, gin.H{
+		"data": &types.UploadStatusResp{
+			UploadSessionResp: *convUploadSessionResp(sess),
+			Chunks:            chunks,
+		},
+	})
+}
+
+// ListUploads list unfinished chunk uploads
+//
+// @Summary list chunk uploads
+// @Description ListUploads list the unfinished chunk uploads which the current user can write
+// @Tags 镜像管理
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "token"
+// @Param username query string false "用户名或组织名"
+// @success 200 {object} types.JSONResult{data=[]types.UploadSessionResp} "desc"
+// @Router  /image/uploads [get]
+func ListUploads(c *gin.Context) {
+	username := c.Query("username")
+	if _, ok := common.LoginUser(c); !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "please login or authenticate first"})
+		return
+	}
+	sessions, err := models.ListUploadSessions(c)
+	if err != nil {
+		log.WithFunc("ListUploads").Error(c, err, "failed to list upload sessions")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	resps := []*types.UploadSessionResp{}
+	for _, sess := range sessions {
+		repo := sess.Image.Repo
+		if repo == nil || (username != "" && repo.Username != username) {
+			continue
+		}
+		if !common.CheckRepoWritePermByName(c, repo.Username, repo.Name) {
+			continue
+		}
+		resps = append(resps, convUploadSessionResp(sess))
+	}
+	// redis scans in random order
+	sort.Slice(resps, func(i, j int) bool {
+		if resps[i].Image != resps[j].Image {
+			return resps[i].Image < resps[j].Image
+		}
+		return resps[i].UploadID < resps[j].UploadID
+	})
+	c.JSON(http.StatusOK, gin.H{
+		"data":  resps,
+		"total": len(resps),
+	})
+}
+
+// getUploadSession returns the upload session which the login user can write
+func getUploadSession(c *gin.Context, uploadID string) (*models.UploadSession, error) {
+	sess, err := models.GetUploadSession(c, uploadID)
+	if err != nil {
+		log.WithFunc("getUploadSession").Error(c, err, "failed to get upload session")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return nil, terrors.ErrPlaceholder
+	}
+	if sess == nil || sess.Image.Repo == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "upload session not found"})
+		return nil, terrors.ErrPlaceholder
+	}
+	repo := sess.Image.Repo
+	if !common.CheckRepoWritePermByName(c, repo.Username, repo.Name) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"error": "you don't have permission to access this upload",
+		})
+		return nil, terrors.ErrPlaceholder
+	}
+	return sess, nil
+}
+
+func convUploadSessionResp(sess *models.UploadSession) *types.UploadSessionResp {
+	return &types.UploadSessionResp{
+		UploadID:  sess.ID,
+		Image:     sess.Image.Fullname(),
+		Size:      sess.Image.Size,
+		Digest:    sess.Image.Digest,
+		ChunkSize: sess.ChunkSize,
+		NChunks:   sess.NChunks,
+		Received:  sess.Received,
+		Merged:    sess.Merged,
+		ExpiresAt: sess.ExpiresAt,
+	}
+}
@@ -2,16 +2,23 @@ package image
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/projecteru2/vmihub/config"
+	"github.com/projecteru2/vmihub/internal/imageops"
 	"github.com/projecteru2/vmihub/internal/models"
+	stotypes "github.com/projecteru2/vmihub/internal/storage/types"
 	"github.com/projecteru2/vmihub/internal/testutils"
 	"github.com/projecteru2/vmihub/internal/utils"
 	"github.com/projecteru2/vmihub/pkg/types"
@@ -67,8 +74,8 @@ func (suite *imageTestSuite) TestDownloadImageChunk() {
 			WithArgs("user1", "name1").
 			WillReturnRows(wantRows)
 
-		wantRows = sqlmock.NewRows([]string{"id", "repo_id", "tag", "size", "os"}).
-			AddRow(2, 1, "tag1", len(testContent), []byte("{}"))
+		wantRows = sqlmock.NewRows([]string{"id", "repo_id", "tag", "state", "size", "os"}).
+			AddRow(2, 1, "tag1", models.ImageStateReady, len(testContent), []byte("{}"))
 		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? AND tag = ?", imgColumns, imgTableName)).
 			WithArgs(1, "tag1").
 			WillReturnRows(wantRows)
@@ -76,6 +83,7 @@ func (suite *imageTestSuite) TestDownloadImageChunk() {
 		defer sto.AssertExpectations(suite.T())
 
 		offset := chunkIdx * chunkSize
+		sto.On("Exists", mock.Anything, mock.Anything).Return(true, nil).Once()
 		sto.On("SeekRead", mock.Anything, mock.Anything, mock.Anything, mock.Anything).
 			Return(io.NopCloser(bytes.NewBufferString(testContent[offset:])), nil).Once()
 
@@ -176,6 +184,7 @@ func (suite *imageTestSuite) TestStartChunkUpload() {
 		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? AND name = ?", repoColumns, repoTableName)).
 			WithArgs("user1", "name1").
 			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name", "private"}))
+		expectReserveImage(digest, "qcow2")
 
 		sto := testutils.GetMockStorage()
 		sto.On("CreateChunkWrite", mock.Anything, mock.Anything).Return(mock.Anything, nil)
@@ -230,6 +239,7 @@ func (suite *imageTestSuite) TestUploadChunk() {
 		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? AND name = ?", repoColumns, repoTableName)).
 			WithArgs("user1", "name1").
 			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name", "private"}))
+		expectReserveImage(digest, "qcow2")
 
 		sto := testutils.GetMockStorage()
 		defer sto.AssertExpectations(suite.T())
@@ -299,23 +309,16 @@ func (suite *imageTestSuite) TestUploadChunk() {
 
 func (suite *imageTestSuite) testMergeChunk(uploadID, digest string) {
 	user, pass := "user1", "pass1"
+	expectNoQuota("user1")
 	models.Mock.ExpectBegin()
-	models.Mock.ExpectExec("INSERT INTO repository(username, name, private) VALUES(?, ?, ?)").
-		WithArgs("user1", "name1", false).
-		WillReturnResult(sqlmock.NewResult(1234, 1))
-
-	models.Mock.ExpectExec("INSERT INTO image(repo_id, tag, labels, size, format, os, digest, snapshot, description) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)").
-		WithArgs(1234, "tag1", sqlmock.AnyArg(), len(testContent), "qcow2", sqlmock.AnyArg(), digest, sqlmock.AnyArg(), sqlmock.AnyArg()).
-		WillReturnResult(sqlmock.NewResult(1234, 1))
+	models.Mock.ExpectExec("INSERT INTO task(type, username, status, payload) VALUES(?, ?, ?, ?)").
+		WithArgs(imageops.TaskTypeVerify, "user1", types.TaskStatusPending, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(10, 1))
 	models.Mock.ExpectCommit()
 
 	sto := testutils.GetMockStorage()
-	// defer sto.AssertExpectations(suite.T())
-
-	sto.On("Move", mock.Anything, mock.Anything, mock.Anything).Return(nil)
 	sto.On("GetSize", mock.Anything, mock.Anything).Return(int64(len(testContent)), nil)
 	sto.On("GetDigest", mock.Anything, mock.Anything).Return(digest, nil)
-
 	sto.On("CompleteChunkWrite", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
 
 	w := httptest.NewRecorder()
@@ -326,4 +329,302 @@ func (suite *imageTestSuite) testMergeChunk(uploadID, digest string) {
 
 	fmt.Printf("+++++++++ merge: %s\n", w.Body.String())
 	suite.Equal(http.StatusOK, w.Code)
+	suite.Contains(w.Body.String(), `"taskID":10`)
+	suite.Nil(models.Mock.ExpectationsWereMet())
+}
+
+// startUploadSession saves an upload session of img in redis as StartImageChunkUpload does
+func (suite *imageTestSuite) startUploadSession(uploadID string, img *models.Image, nChunks, received int) {
+	ctx := context.Background()
+	rdb := utils.GetRedisConn()
+	bs, err := json.Marshal(img)
+	suite.Nil(err)
+	err = rdb.HSet(ctx, fmt.Sprintf(redisInfoKey, uploadID),
+		redisImageHKey, string(bs),
+		redisForceHKey, "false",
+		redisSizeHKey, "2",
+		redisDigestHkey, img.Digest,
+		redisChunkNumHkey, nChunks,
+	).Err()
+	suite.Nil(err)
+	for idx := 0; idx < received; idx++ {
+		cInfo := &stotypes.ChunkInfo{Idx: idx, Size: 2, ChunkSize: 2, Digest: fmt.Sprintf("digest%d", idx)}
+		err = rdb.HSet(ctx, fmt.Sprintf(redisSliceKey, uploadID), idx, cInfo).Err()
+		suite.Nil(err)
+	}
+	for _, fStr := range []string{redisInfoKey, redisSliceKey} {
+		suite.Nil(rdb.Expire(ctx, fmt.Sprintf(fStr, uploadID), config.GetCfg().Storage.UploadTTL).Err())
+	}
+}
+
+func (suite *imageTestSuite) TestAbortChunkUpload() {
+	utils.MockRedis.FlushAll()
+	user, pass := "user1", "pass1"
+	err := testutils.PrepareUserData(user, pass)
+	suite.Nil(err)
+	img := &models.Image{
+		ID:     2,
+		RepoID: 1234,
+		Tag:    "tag1",
+		State:  models.ImageStateCreating,
+		Repo:   &models.Repository{ID: 1234, Username: "user1", Name: "name1"},
+	}
+	suite.startUploadSession("upload1", img, 3, 1)
+	sto := testutils.GetMockStorage()
+	defer sto.AssertExpectations(suite.T())
+
+	abort := func(uploadID string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodDelete, "/api/v1/image/chunk/"+uploadID, nil)
+		testutils.AddAuth(req, user, pass)
+		suite.r.ServeHTTP(w, req)
+		return w
+	}
+	{
+		// upload session doesn't exist
+		w := abort("nonexistent")
+		suite.Equal(http.StatusNotFound, w.Code)
+	}
+	{
+		// the chunks are discarded and the reserved image becomes failed
+		sto.On("AbortChunkWrite", mock.Anything, img.SliceName(), "upload1").Return(nil).Once()
+		models.Mock.ExpectBegin()
+		models.Mock.ExpectExec("UPDATE image SET state = ? WHERE id = ? AND state = ?").
+			WithArgs(models.ImageStateFailed, 2, models.ImageStateCreating).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		models.Mock.ExpectCommit()
+		w := abort("upload1")
+		suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+		suite.Nil(models.Mock.ExpectationsWereMet())
+		n, err := utils.GetRedisConn().Exists(context.Background(),
+			fmt.Sprintf(redisInfoKey, "upload1"), fmt.Sprintf(redisSliceKey, "upload1")).Result()
+		suite.Nil(err)
+		suite.Equal(int64(0), n)
+	}
+	{
+		// the merged upload is being verified
+		suite.startUploadSession("upload2", img, 3, 3)
+		err := utils.GetRedisConn().HSet(context.Background(), fmt.Sprintf(redisInfoKey, "upload2"), redisMergedHKey, "true").Err()
+		suite.Nil(err)
+		w := abort("upload2")
+		suite.Equal(http.StatusConflict, w.Code)
+	}
+	{
+		// no permission on the repository of others
+		other := &models.Image{
+			ID:    3,
+			Tag:   "latest",
+			State: models.ImageStateCreating,
+			Repo:  &models.Repository{ID: 4321, Username: "user2", Name: "name2"},
+		}
+		suite.startUploadSession("upload3", other, 3, 0)
+		expectNoOrgRole("user2")
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? AND name = ?", repoColumns, repoTableName)).
+			WithArgs("user2", "name2").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name", "private"}))
+		w := abort("upload3")
+		suite.Equal(http.StatusForbidden, w.Code)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+}
+
+func (suite *imageTestSuite) TestClaimedChunkUpload() {
+	utils.MockRedis.FlushAll()
+	user, pass := "user1", "pass1"
+	err := testutils.PrepareUserData(user, pass)
+	suite.Nil(err)
+	img := &models.Image{
+		ID:     2,
+		RepoID: 1234,
+		Tag:    "tag1",
+		State:  models.ImageStateCreating,
+		Repo:   &models.Repository{ID: 1234, Username: "user1", Name: "name1"},
+	}
+	sto := testutils.GetMockStorage()
+	defer sto.AssertExpectations(suite.T())
+	ctx := context.Background()
+	rdb := utils.GetRedisConn()
+
+	serve := func(method, url string, body io.Reader, contentType string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, body)
+		testutils.AddAuth(req, user, pass)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		suite.r.ServeHTTP(w, req)
+		return w
+	}
+	uploadChunk := func(uploadID string) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("file", "/tmp/haha")
+		suite.Nil(err)
+		_, err = part.Write([]byte("ab"))
+		suite.Nil(err)
+		writer.Close()
+		return serve(http.MethodPost, fmt.Sprintf("/api/v1/image/chunk/0/upload?uploadID=%s", uploadID), body, writer.FormDataContentType())
+	}
+	{
+		// the upload is being merged or aborted by another request
+		suite.startUploadSession("upload1", img, 3, 1)
+		suite.Nil(rdb.HSet(ctx, fmt.Sprintf(redisInfoKey, "upload1"), redisMergingHKey, "true").Err())
+
+		w := serve(http.MethodDelete, "/api/v1/image/chunk/upload1", nil, "")
+		suite.Equalf(http.StatusConflict, w.Code, "error: %s", w.Body.String())
+		w = serve(http.MethodPost, "/api/v1/image/chunk/merge?uploadID=upload1", nil, "")
+		suite.Equalf(http.StatusConflict, w.Code, "error: %s", w.Body.String())
+		w = uploadChunk("upload1")
+		suite.Equalf(http.StatusConflict, w.Code, "error: %s", w.Body.String())
+		// the claim is kept by its owner
+		claimed, err := rdb.HExists(ctx, fmt.Sprintf(redisInfoKey, "upload1"), redisMergingHKey).Result()
+		suite.Nil(err)
+		suite.True(claimed)
+	}
+	{
+		// a failed merge releases the claim, so chunks can be uploaded again
+		suite.startUploadSession("upload2", img, 3, 1)
+		w := serve(http.MethodPost, "/api/v1/image/chunk/merge?uploadID=upload2", nil, "")
+		suite.Equalf(http.StatusBadRequest, w.Code, "error: %s", w.Body.String())
+		claimed, err := rdb.HExists(ctx, fmt.Sprintf(redisInfoKey, "upload2"), redisMergingHKey).Result()
+		suite.Nil(err)
+		suite.False(claimed)
+
+		sto.On("ChunkWrite", mock.Anything, img.SliceName(), "upload2", mock.Anything).Return(nil).Once()
+		w = uploadChunk("upload2")
+		suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+	}
+	{
+		// a failed abort releases the claim too
+		sto.On("AbortChunkWrite", mock.Anything, img.SliceName(), "upload2").Return(errors.New("storage error")).Once()
+		w := serve(http.MethodDelete, "/api/v1/image/chunk/upload2", nil, "")
+		suite.Equal(http.StatusInternalServerError, w.Code)
+		claimed, err := rdb.HExists(ctx, fmt.Sprintf(redisInfoKey, "upload2"), redisMergingHKey).Result()
+		suite.Nil(err)
+		suite.False(claimed)
+	}
+	{
+		// the session expired before claiming isn't recreated
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		suite.NotNil(claimUpload(c, "expired"))
+		suite.Equal(http.StatusNotFound, w.Code)
+		n, err := rdb.Exists(ctx, fmt.Sprintf(redisInfoKey, "expired")).Result()
+		suite.Nil(err)
+		suite.Equal(int64(0), n)
+	}
+}
+
+func (suite *imageTestSuite) TestGetChunkUploadStatus() {
+	utils.MockRedis.FlushAll()
+	user, pass := "user1", "pass1"
+	err := testutils.PrepareUserData(user, pass)
+	suite.Nil(err)
+	suite.startUploadSession("upload1", &models.Image{
+		Tag:  "tag1",
+		Size: 5,
+		Repo: &models.Repository{Username: "user1", Name: "name1"},
+	}, 3, 2)
+	// the session is about to expire
+	ctx := context.Background()
+	for _, fStr := range []string{redisInfoKey, redisSliceKey} {
+		suite.Nil(utils.GetRedisConn().Expire(ctx, fmt.Sprintf(fStr, "upload1"), time.Minute).Err())
+	}
+
+	status := func(uploadID string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("/api/v1/image/chunk/%s/status", uploadID), nil)
+		testutils.AddAuth(req, user, pass)
+		suite.r.ServeHTTP(w, req)
+		return w
+	}
+	{
+		w := status("nonexistent")
+		suite.Equal(http.StatusNotFound, w.Code)
+	}
+	{
+		w := status("upload1")
+		suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+		raw := struct {
+			Data *types.UploadStatusResp `json:"data"`
+		}{}
+		suite.Nil(json.Unmarshal(w.Body.Bytes(), &raw))
+		suite.Equal("upload1", raw.Data.UploadID)
+		suite.Equal(3, raw.Data.NChunks)
+		suite.Equal(2, raw.Data.Received)
+		suite.Equal([]*types.UploadChunkResp{
+			{Idx: 0, Size: 2, Digest: "digest0"},
+			{Idx: 1, Size: 2, Digest: "digest1"},
+		}, raw.Data.Chunks)
+
+		// the expiration is refreshed
+		ttl := config.GetCfg().Storage.UploadTTL
+		suite.WithinDuration(time.Now().Add(ttl), raw.Data.ExpiresAt, time.Minute)
+		for _, fStr := range []string{redisInfoKey, redisSliceKey} {
+			suite.Equal(ttl, utils.MockRedis.TTL(fmt.Sprintf(fStr, "upload1")))
+		}
+	}
+}
+
+func (suite *imageTestSuite) TestListUploads() {
+	utils.MockRedis.FlushAll()
+	user, pass := "user1", "pass1"
+	err := testutils.PrepareUserData(user, pass)
+	suite.Nil(err)
+	suite.startUploadSession("upload1", &models.Image{
+		Tag:    "tag1",
+		Size:   5,
+		Digest: "digest1",
+		Repo:   &models.Repository{Username: "user1", Name: "name1"},
+	}, 3, 2)
+	suite.startUploadSession("upload2", &models.Image{
+		Tag:  "latest",
+		Repo: &models.Repository{ID: 4321, Username: "user2", Name: "name2"},
+	}, 3, 0)
+
+	list := func(query string) (resps []*types.UploadSessionResp, total int) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/api/v1/image/uploads"+query, nil)
+		testutils.AddAuth(req, user, pass)
+		suite.r.ServeHTTP(w, req)
+		suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+		raw := struct {
+			Data  []*types.UploadSessionResp `json:"data"`
+			Total int                        `json:"total"`
+		}{}
+		suite.Nil(json.Unmarshal(w.Body.Bytes(), &raw))
+		return raw.Data, raw.Total
+	}
+	{
+		// the uploads to repositories of others are invisible
+		expectNoOrgRole("user2")
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? AND name = ?", repoColumns, repoTableName)).
+			WithArgs("user2", "name2").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name", "private"}))
+		resps, total := list("")
+		suite.Nil(models.Mock.ExpectationsWereMet())
+		suite.Equal(1, total)
+		suite.Equal("upload1", resps[0].UploadID)
+		suite.Equal("user1/name1:tag1", resps[0].Image)
+		suite.Equal(int64(5), resps[0].Size)
+		suite.Equal("digest1", resps[0].Digest)
+		suite.Equal(uint64(2), resps[0].ChunkSize)
+		suite.Equal(3, resps[0].NChunks)
+		suite.Equal(2, resps[0].Received)
+		suite.False(resps[0].Merged)
+		suite.WithinDuration(time.Now().Add(config.GetCfg().Storage.UploadTTL), resps[0].ExpiresAt, time.Minute)
+	}
+	{
+		// filtered by namespace
+		resps, total := list("?username=user3")
+		suite.Equal(0, total)
+		suite.Len(resps, 0)
+	}
+}
+
+// expectNoOrgRole expects the login user to have no role in organization
+func expectNoOrgRole(org string) {
+	models.Mock.ExpectQuery("SELECT m.role FROM organization_member m, organization o WHERE o.id=m.org_id AND o.name=? AND m.user_id=?").
+		WithArgs(org, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"role"}))
 }
@@ -0,0 +1,102 @@
+package image
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/projecteru2/core/log"
+	"github.com/projecteru2/vmihub/internal/common"
+	"github.com/projecteru2/vmihub/internal/imageops"
+	"github.com/projecteru2/vmihub/internal/models"
+	"github.com/projecteru2/vmihub/internal/rbd"
+	"github.com/projecteru2/vmihub/internal/task"
+	"github.com/projecteru2/vmihub/internal/utils"
+)
+
+// ConvertImage convert image to another format
+//
+// @Summary convert image to another format
+// @Description ConvertImage converts image in background and saves the result as a new tag,
+// @Description the image converted to rbd is imported to the configured ceph pool and referenced by a protected snapshot
+// @Tags 镜像管理
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "token"
+// @Param username path string true "仓库用户名"
+// @Param name path string true "仓库名"
+// @Param tag query string false "镜像标签" default("latest")
+// @Param format query string true "目标格式, qcow2, raw 或 rbd"
+// @Param destTag query string false "转换后的镜像标签, 默认为 <tag>-<format>"
+// @Success 202 {object} types.Task "the status of task can be polled by /tasks/{id}"
+// @Router /image/{username}/{name}/convert [post]
+func ConvertImage(c *gin.Context) {
+	logger := log.WithFunc("ConvertImage")
+	username := c.Param("username")
+	name := c.Param("name")
+	tag := c.DefaultQuery("tag", defaultTag)
+	format := c.Query("format")
+	audit := common.Audit(c, models.AuditImageConvert, fmt.Sprintf("%s/%s:%s", username, name, tag))
+	if format != models.ImageFormatQcow2 && format != models.ImageFormatRaw && format != models.ImageFormatRBD {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unsupported format %s", format)})
+		return
+	}
+	if format == models.ImageFormatRBD && rbd.Pool() == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "rbd is not configured"})
+		return
+	}
+	if err := validateRepoName(username, name); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid name"})
+		return
+	}
+	repo, err := getRepo(c, username, name, "write")
+	if err != nil {
+		return
+	}
+	img, err := getRepoImage(c, repo, tag)
+	if err != nil {
+		return
+	}
+	if err := checkImageReady(c, img); err != nil {
+		return
+	}
+	if img.Format == models.ImageFormatRBD {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "image created from system disk doesn't support convert"})
+		return
+	}
+	destTag := c.DefaultQuery("destTag", fmt.Sprintf("%s-%s", img.Tag, format))
+	audit.Digest = img.Digest
+	audit.Detail = fmt.Sprintf("%s %s", destTag, format)
+	if utils.IsDefaultTag(destTag) || checkNames(destTag) != nil || len(destTag) > maxTagLength {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid destTag %s", destTag)})
+		return
+	}
+	destImg, err := repo.GetImage(c, destTag)
+	if err != nil {
+		logger.Errorf(c, err, "failed to get image %s:%s", repo.Fullname(), destTag)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	if destImg != nil {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("tag %s already exists", destTag)})
+		return
+	}
+
+	curUser, _ := common.LoginUser(c)
+	t, err := task.Submit(c, imageops.TaskTypeConvert, curUser.Username, &imageops.ConvertPayload{
+		Username: repo.Username,
+		Name:     repo.Name,
+		Tag:      img.Tag,
+		DestTag:  destTag,
+		Format:   format,
+	})
+	if err != nil {
+		logger.Error(c, err, "failed to submit convert task")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{
+		"msg":  "convert task is submitted",
+		"data": t.ToResp(),
+	})
+}
@@ -0,0 +1,117 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/projecteru2/vmihub/internal/imageops"
+	"github.com/projecteru2/vmihub/internal/models"
+	"github.com/projecteru2/vmihub/internal/testutils"
+	"github.com/projecteru2/vmihub/internal/utils"
+	"github.com/projecteru2/vmihub/pkg/types"
+)
+
+func (suite *imageTestSuite) TestConvertImage() {
+	user, pass := "user1", "pass1"
+	{
+		// unsupported format
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/image/user1/name1/convert?tag=v1&format=vmdk", nil)
+		testutils.AddAuth(req, user, pass)
+		suite.r.ServeHTTP(w, req)
+		suite.Equal(http.StatusBadRequest, w.Code)
+	}
+	{
+		// other users can't convert
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData("user2", "pass2")
+		suite.Nil(err)
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? AND name = ?", repoColumns, repoTableName)).
+			WithArgs("user1", "name1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name", "private"}).AddRow(1, "user1", "name1", false))
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/image/user1/name1/convert?tag=v1&format=raw", nil)
+		testutils.AddAuth(req, "user2", "pass2")
+		suite.r.ServeHTTP(w, req)
+		suite.Equal(http.StatusForbidden, w.Code)
+	}
+	{
+		// the destination tag exists
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? AND name = ?", repoColumns, repoTableName)).
+			WithArgs("user1", "name1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name", "private"}).AddRow(1, "user1", "name1", false))
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? AND tag = ?", imgColumns, imgTableName)).
+			WithArgs(1, "v1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "repo_id", "tag", "state", "format"}).AddRow(1, 1, "v1", models.ImageStateReady, "qcow2"))
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? AND tag = ?", imgColumns, imgTableName)).
+			WithArgs(1, "v1-raw").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "repo_id", "tag", "format"}).AddRow(2, 1, "v1-raw", "raw"))
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/image/user1/name1/convert?tag=v1&format=raw", nil)
+		testutils.AddAuth(req, user, pass)
+		suite.r.ServeHTTP(w, req)
+		suite.Equal(http.StatusConflict, w.Code)
+	}
+	{
+		// the default destination tag is too long
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		longTag := strings.Repeat("v", maxTagLength-2)
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? AND name = ?", repoColumns, repoTableName)).
+			WithArgs("user1", "name1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name", "private"}).AddRow(1, "user1", "name1", false))
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? AND tag = ?", imgColumns, imgTableName)).
+			WithArgs(1, longTag).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "repo_id", "tag", "state", "format"}).AddRow(1, 1, longTag, models.ImageStateReady, "qcow2"))
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/image/user1/name1/convert?format=raw&tag="+longTag, nil)
+		testutils.AddAuth(req, user, pass)
+		suite.r.ServeHTTP(w, req)
+		suite.Equalf(http.StatusBadRequest, w.Code, "error: %s", w.Body.String())
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		// normal case
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? AND name = ?", repoColumns, repoTableName)).
+			WithArgs("user1", "name1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name", "private"}).AddRow(1, "user1", "name1", false))
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? AND tag = ?", imgColumns, imgTableName)).
+			WithArgs(1, "v1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "repo_id", "tag", "state", "format"}).AddRow(1, 1, "v1", models.ImageStateReady, "qcow2"))
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? AND tag = ?", imgColumns, imgTableName)).
+			WithArgs(1, "v1-raw").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "repo_id", "tag", "format"}))
+		models.Mock.ExpectBegin()
+		models.Mock.ExpectExec("INSERT INTO task(type, username, status, payload) VALUES(?, ?, ?, ?)").
+			WithArgs(imageops.TaskTypeConvert, "user1", types.TaskStatusPending, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(10, 1))
+		models.Mock.ExpectCommit()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/image/user1/name1/convert?tag=v1&format=raw", nil)
+		testutils.AddAuth(req, user, pass)
+		suite.r.ServeHTTP(w, req)
+		suite.Equalf(http.StatusAccepted, w.Code, "error: %s", w.Body.String())
+		resp := struct {
+			Data types.Task `json:"data"`
+		}{}
+		err = json.Unmarshal(w.Body.Bytes(), &resp)
+		suite.Nil(err)
+		suite.Equal(int64(10), resp.Data.ID)
+		suite.JSONEq(`{"username":"user1","name":"name1","tag":"v1","destTag":"v1-raw","format":"raw"}`, string(resp.Data.Payload))
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+}
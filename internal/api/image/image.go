@@ -9,14 +9,18 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"path"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 
 	"github.com/projecteru2/core/log"
 	"github.com/projecteru2/vmihub/internal/common"
+	"github.com/projecteru2/vmihub/internal/imageops"
 	storFact "github.com/projecteru2/vmihub/internal/storage/factory"
 	storTypes "github.com/projecteru2/vmihub/internal/storage/types"
+	"github.com/projecteru2/vmihub/internal/task"
 
 	"github.com/projecteru2/vmihub/internal/utils"
 	"github.com/projecteru2/vmihub/pkg/terrors"
@@ -34,6 +38,7 @@ import (
 const (
 	defaultTag     = "latest"
 	chunkThreshold = 4 * utils.GB
+	maxTagLength   = 40
 )
 
 func SetupRouter(r *gin.RouterGroup) {
@@ -44,6 +49,9 @@ func SetupRouter(r *gin.RouterGroup) {
 	imageGroup.POST("/:username/:name/startChunkUpload", StartImageChunkUpload)
 	imageGroup.POST("/chunk/:chunkIdx/upload", UploadImageChunk)
 	imageGroup.POST("/chunk/merge", MergeChunk)
+	imageGroup.DELETE("/chunk/:uploadID", AbortChunkUpload)
+	imageGroup.GET("/chunk/:uploadID/status", GetChunkUploadStatus)
+	imageGroup.GET("/uploads", ListUploads)
 	imageGroup.GET("/:username/:name/chunk/:chunkIdx/download", DownloadImageChunk)
 
 	// Get image information
@@ -58,6 +66,13 @@ func SetupRouter(r *gin.RouterGroup) {
 	// delete image info form db and file from store
 	imageGroup.DELETE("/:username/:name", DeleteImage)
 
+	// convert image to another format
+	imageGroup.POST("/:username/:name/convert", ConvertImage)
+	// deprecate image or make it ready again
+	imageGroup.PUT("/:username/:name/state", SetImageState)
+	// create a tag referring to an existing image, or move latest to it
+	imageGroup.PUT("/:username/:name/tags/:tag", TagImage)
+
 	// Return image Info list of current user
 	r.GET("/repositories", ListRepositories)
 	// List image
@@ -65,6 +80,12 @@ func SetupRouter(r *gin.RouterGroup) {
 	// Return image list of specified repository.
 	repoGroup.GET("/:username/:name/images", ListRepoImages)
 	repoGroup.DELETE("/:username/:name", DeleteRepository)
+	// set immutable tags and protected tag patterns
+	repoGroup.PUT("/:username/:name/protection", SetTagProtection)
+	// grant users out of the namespace read or write permission on repository
+	repoGroup.GET("/:username/:name/members", ListRepoMembers)
+	repoGroup.POST("/:username/:name/members", AddRepoMember)
+	repoGroup.DELETE("/:username/:name/members", RemoveRepoMember)
 }
 
 // ListRepositories get repository list of specified user or current user
@@ -105,7 +126,7 @@ func ListRepositories(c *gin.Context) {
 	if username == "" {
 		repos, err = models.QueryRepoList(curUser.Username, pNum, pSize)
 	} else {
-		if curUser != nil && (curUser.Admin || curUser.Username == username) {
+		if common.CheckNamespacePerm(c, username, common.PermRead) {
 			repos, err = models.QueryRepoList(username, pNum, pSize)
 		} else {
 			repos, err = models.QueryPublicRepoList(username, pNum, pSize)
@@ -222,13 +243,14 @@ func ListRepoImages(c *gin.Context) {
 func DeleteRepository(c *gin.Context) {
 	name := c.Param("name")
 	username := c.Param("username")
+	common.Audit(c, models.AuditRepoDelete, username+"/"+name)
 
 	err := validateRepoName(username, name)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid name"})
 		return
 	}
-	repo, err := getRepo(c, username, name, "write")
+	repo, err := getRepo(c, username, name, "delete")
 	if err != nil {
 		return
 	}
@@ -239,14 +261,13 @@ func DeleteRepository(c *gin.Context) {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
 			"msg": "internal error",
 		})
+		return
 	}
-	stor := storFact.Instance()
-	for _, img := range images {
-		err = stor.Delete(context.Background(), img.Fullname(), true)
-		if err != nil {
-			// Try best bahavior, so just log error
-			log.WithFunc("DeleteImage").Errorf(c, err, "failed to remove image %s from storage", img.Fullname())
-		}
+	if err = checkImagesDeletable(c, repo, images...); err != nil {
+		return
+	}
+	if err = checkSnapshotsUnused(c, images...); err != nil {
+		return
 	}
 
 	tx, err := models.Instance().Beginx()
@@ -255,21 +276,204 @@ func DeleteRepository(c *gin.Context) {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
 			"msg": "internal error",
 		})
+		return
 	}
 	if err = repo.Delete(tx); err != nil {
 		log.WithFunc("DeleteImage").Error(c, err, "internal error")
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
 			"msg": "internal error",
 		})
+		return
 	}
 	_ = tx.Commit()
 
+	// the blobs may still be referenced by other repositories,
+	// so release them after the database records are deleted
+	for idx := range images {
+		releaseImageFile(c, &images[idx])
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"msg":  "delete success",
 		"data": "",
 	})
 }
 
+// SetTagProtection set tag protection rules of repository
+//
+// @Summary set tag protection rules
+// @Description SetTagProtection makes the tags of repository immutable or protects the tags matching the glob patterns,
+// @Description only administrators can relax the existing rules
+// @Tags 镜像管理
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "token"
+// @Param username path string true "用户名"
+// @Param name path string true "仓库名"
+// @Param body body types.TagProtectionRequest true "标签保护规则"
+// @Success 200 {object} models.Repository
+// @Router /repository/{username}/{name}/protection [put]
+func SetTagProtection(c *gin.Context) {
+	logger := log.WithFunc("SetTagProtection")
+	username := c.Param("username")
+	name := c.Param("name")
+	audit := common.Audit(c, models.AuditRepoProtection, username+"/"+name)
+	var req types.TagProtectionRequest
+	if err := c.ShouldBindWith(&req, binding.JSON); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Detail = fmt.Sprintf("immutable=%t patterns=%s", req.Immutable, strings.Join(req.Patterns, ","))
+	if err := validateRepoName(username, name); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid name"})
+		return
+	}
+	repo, err := getRepo(c, username, name, "write")
+	if err != nil {
+		return
+	}
+	newRepo := *repo
+	newRepo.ImmutableTags = req.Immutable
+	newRepo.ProtectedTags = strings.Join(req.Patterns, ",")
+	// otherwise the owner can delete the protected tags by removing the rules first
+	curUser, _ := common.LoginUser(c)
+	if !curUser.Admin && relaxTagProtection(repo, &newRepo) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "only administrators can relax tag protection"})
+		return
+	}
+	if len(newRepo.ProtectedTags) > 255 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "too many tag patterns"})
+		return
+	}
+	if err = newRepo.SaveTagProtection(nil); err != nil {
+		if errors.Is(err, path.ErrBadPattern) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		logger.Errorf(c, err, "failed to save tag protection of repository %s", repo.Fullname())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": newRepo,
+	})
+}
+
+// ListRepoMembers list collaborators of repository
+//
+// @Summary list collaborators of repository
+// @Description ListRepoMembers returns the users who are granted permission on repository
+// @Tags 镜像管理
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "token"
+// @Param username path string true "用户名"
+// @Param name path string true "仓库名"
+// @Success 200 {object} []models.RepoMember
+// @Router /repository/{username}/{name}/members [get]
+func ListRepoMembers(c *gin.Context) {
+	username := c.Param("username")
+	name := c.Param("name")
+	if err := validateRepoName(username, name); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid name"})
+		return
+	}
+	repo, err := getRepo(c, username, name, "delete")
+	if err != nil {
+		return
+	}
+	members, err := repo.GetMembers(c)
+	if err != nil {
+		log.WithFunc("ListRepoMembers").Errorf(c, err, "failed to get members of repository %s", repo.Fullname())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": members,
+	})
+}
+
+// AddRepoMember grant permission on repository to user
+//
+// @Summary grant permission on repository
+// @Description AddRepoMember grants read or write permission on repository to user,
+// @Description the existing permission of user is replaced
+// @Tags 镜像管理
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "token"
+// @Param username path string true "用户名"
+// @Param name path string true "仓库名"
+// @Param body body types.RepoMemberRequest true "用户和权限"
+// @Success 200 {object} models.RepoMember
+// @Router /repository/{username}/{name}/members [post]
+func AddRepoMember(c *gin.Context) {
+	logger := log.WithFunc("AddRepoMember")
+	audit := common.Audit(c, models.AuditRepoMemberAdd, c.Param("username")+"/"+c.Param("name"))
+	var req types.RepoMemberRequest
+	if err := c.ShouldBindWith(&req, binding.JSON); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Detail = fmt.Sprintf("%s %s", req.Username, req.Perm)
+	if !models.ValidRepoPerm(req.Perm) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid permission %s", req.Perm)})
+		return
+	}
+	repo, user, err := getRepoMember(c, req.Username)
+	if err != nil {
+		return
+	}
+	if err = repo.SetMember(nil, user.ID, req.Perm); err != nil {
+		logger.Errorf(c, err, "failed to set member %s of repository %s", user.Username, repo.Fullname())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": models.RepoMember{
+			RepoID:   repo.ID,
+			UserID:   user.ID,
+			Username: user.Username,
+			Perm:     req.Perm,
+		},
+	})
+}
+
+// RemoveRepoMember revoke permission on repository from user
+//
+// @Summary revoke permission on repository
+// @Description RemoveRepoMember revokes the permission granted to user on repository
+// @Tags 镜像管理
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "token"
+// @Param username path string true "用户名"
+// @Param name path string true "仓库名"
+// @Param body body types.RepoMemberRequest true "用户"
+// @success 200 {object} types.JSONResult{msg=string} "desc"
+// @Router /repository/{username}/{name}/members [delete]
+func RemoveRepoMember(c *gin.Context) {
+	audit := common.Audit(c, models.AuditRepoMemberRemove, c.Param("username")+"/"+c.Param("name"))
+	var req types.RepoMemberRequest
+	if err := c.ShouldBindWith(&req, binding.JSON); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Detail = req.Username
+	repo, user, err := getRepoMember(c, req.Username)
+	if err != nil {
+		return
+	}
+	if err = repo.RemoveMember(nil, user.ID); err != nil {
+		log.WithFunc("RemoveRepoMember").Errorf(c, err, "failed to remove member %s of repository %s", user.Username, repo.Fullname())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "success",
+	})
+}
+
 // StartUpload  start single file upload session
 //
 // @Summary upload image file
@@ -300,6 +504,10 @@ func StartImageUpload(c *gin.Context) {
 		return
 	}
 	tag := utils.NormalizeTag(req.Tag, req.Digest)
+	// the file uploaded later is audited as a push, only the imports are audited here
+	if req.URL != "" {
+		common.Audit(c, models.AuditImageImport, fmt.Sprintf("%s/%s:%s", username, name, tag)).Digest = req.Digest
+	}
 	if err := validateRepoName(username, name); err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid name"})
 		return
@@ -310,12 +518,16 @@ func StartImageUpload(c *gin.Context) {
 	}
 
 	// if img exists and not force update, upload failed!
-	if img != nil && !force {
+	// the failed image can be uploaded again without force
+	if img != nil && img.State != models.ImageStateFailed && !force {
 		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
 			"error": "Upload failed, image already exists. You can use force upload to overwrite.",
 		})
 		return
 	}
+	if err := checkQuota(c, username, img, req.Size); err != nil {
+		return
+	}
 
 	if repo == nil {
 		repo = &models.Repository{
@@ -340,21 +552,32 @@ func StartImageUpload(c *gin.Context) {
 			Description: req.Description,
 			Repo:        repo,
 		}
-
+	} else {
+		// force upload, overwrite the existing image with the new file
+		img.Size = req.Size
+		img.Digest = req.Digest
+		img.Format = req.Format
+	}
+	if err := reserveImage(c, img); err != nil {
+		return
 	}
 
 	if req.URL != "" {
-		if err := processRemoteImageFile(c, img, req.URL); err != nil {
+		curUser, _ := common.LoginUser(c)
+		t, err := task.Submit(c, imageops.TaskTypeImport, curUser.Username, &imageops.ImportPayload{
+			Image: img,
+			URL:   req.URL,
+		})
+		if err != nil {
+			logger.Error(c, err, "failed to submit import task")
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
 			return
 		}
-		// logger.Debugf(c, "send image task")
-		// if err := task.SendImageTask(img.ID, force); err != nil {
-		// 	logger.Warnf(c, "failed to send image preparation task")
-		// }
 		c.JSON(http.StatusOK, gin.H{
-			"msg": "upload remote file successfully",
+			"msg": "import task is submitted",
 			"data": map[string]any{
 				"uploadID": "",
+				"taskID":   t.ID,
 			},
 		})
 		return
@@ -379,6 +602,9 @@ func StartImageUpload(c *gin.Context) {
 		})
 		return
 	}
+	if err := expireUploadSession(c, uploadID); err != nil {
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{
 		"data": map[string]any{
 			"uploadID": uploadID,
@@ -404,6 +630,7 @@ func UploadImage(c *gin.Context) {
 	logger := log.WithFunc("UploadImage")
 	username := c.Param("username")
 	name := c.Param("name")
+	common.Audit(c, models.AuditImagePush, username+"/"+name)
 
 	uploadID := c.Query("uploadID")
 	if uploadID == "" {
@@ -478,6 +705,7 @@ func UploadImage(c *gin.Context) {
 		})
 		return
 	}
+	common.Audit(c, models.AuditImagePush, img.Fullname()).Digest = img.Digest
 
 	// 这里之所以要写入一个临时文件是因为文件很大的时候需要分片上传
 	// 分片上传为了加快进度是做了并发处理的，这时候需要并发的open， seek，用一个本地文件更方便
@@ -490,12 +718,20 @@ func UploadImage(c *gin.Context) {
 	defer os.Remove(fp.Name())
 	defer fp.Close()
 
-	nwritten, err := io.Copy(fp, fileOpen)
+	h := sha256.New()
+	nwritten, err := io.Copy(fp, io.TeeReader(fileOpen, h))
 	if err != nil {
 		logger.Errorf(c, err, "failed to save upload file to local")
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "bad request"})
 		return
 	}
+	// the file is stored by digest, so never trust the digest passed by user
+	if digest := fmt.Sprintf("%x", h.Sum(nil)); digest != img.Digest {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("invalid digest: got: %s, user passed: %s", digest, img.Digest),
+		})
+		return
+	}
 	if err = writeDataToStorage(c, img, fp.Name(), nwritten); err != nil {
 		return
 	}
@@ -521,7 +757,11 @@ func UploadImage(c *gin.Context) {
 // @Param username path string true "仓库用户名"
 // @Param name path string true "仓库名"
 // @Param tag query string false "镜像标签" default("latest")
+// @Param Range header string false "字节范围, eg: bytes=100-"
+// @Param If-Range header string false "ETag, 不匹配时返回整个文件"
 // @Success 200
+// @Success 206
+// @Failure 416
 // @Router /image/{username}/{name}/download [get]
 func DownloadImage(c *gin.Context) {
 	username := c.Param("username")
@@ -541,13 +781,15 @@ func DownloadImage(c *gin.Context) {
 	if err != nil {
 		return
 	}
+	if err := checkImageReady(c, img); err != nil {
+		return
+	}
 	if img.Format == models.ImageFormatRBD {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "image created from system disk doesn't support download"})
+		downloadSnapshot(c, img)
 		return
 	}
 	sto := storFact.Instance()
-
-	file, err := sto.Get(context.Background(), img.Fullname())
+	objName, err := imageObjectName(c, img)
 	if err != nil {
 		log.WithFunc("DownloadImage").Error(c, err, "Failed to get image file")
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
@@ -555,18 +797,54 @@ func DownloadImage(c *gin.Context) {
 		})
 		return
 	}
-	defer file.Close()
 
+	etag := imageETag(img)
+	c.Header("Accept-Ranges", "bytes")
+	c.Header("ETag", etag)
 	c.Header("Content-Type", "application/octet-stream")
 	c.Header("Content-Disposition", "attachment; filename="+img.Fullname())
-	c.Header("Content-Length", fmt.Sprintf("%d", img.Size))
+
+	rangeHeader := c.GetHeader("Range")
+	// the file is changed since the client got the partial content, so send the whole file
+	if ifRange := c.GetHeader("If-Range"); ifRange != "" && ifRange != etag {
+		rangeHeader = ""
+	}
+	start, end, partial, err := parseRange(rangeHeader, img.Size)
+	if err != nil {
+		c.Header("Content-Range", fmt.Sprintf("bytes */%d", img.Size))
+		c.AbortWithStatusJSON(http.StatusRequestedRangeNotSatisfiable, gin.H{"error": err.Error()})
+		return
+	}
+
+	var file io.ReadCloser
+	if partial {
+		file, err = sto.SeekRead(context.Background(), objName, start)
+	} else {
+		file, err = sto.Get(context.Background(), objName)
+	}
+	if err != nil {
+		log.WithFunc("DownloadImage").Error(c, err, "Failed to get image file")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+			"msg": "Failed to get image file",
+		})
+		return
+	}
+	defer file.Close()
 
 	// write content to response
-	_, err = io.Copy(c.Writer, file)
+	if partial {
+		c.Header("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, img.Size))
+		c.Header("Content-Length", fmt.Sprintf("%d", end-start+1))
+		c.Status(http.StatusPartialContent)
+		_, err = io.CopyN(c.Writer, file, end-start+1)
+	} else {
+		c.Header("Content-Length", fmt.Sprintf("%d", img.Size))
+		c.Status(http.StatusOK)
+		_, err = io.Copy(c.Writer, file)
+	}
 	if err != nil {
+		// the headers are already sent, so just log the error
 		log.WithFunc("DownloadImage").Error(c, err, "Failed to get copy file form storage")
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to download file"})
 		return
 	}
 }
@@ -589,13 +867,14 @@ func DeleteImage(c *gin.Context) {
 	name := c.Param("name")
 	username := c.Param("username")
 	tag := c.DefaultQuery("tag", defaultTag)
+	audit := common.Audit(c, models.AuditImageDelete, fmt.Sprintf("%s/%s:%s", username, name, tag))
 
 	err := validateRepoName(username, name)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid name"})
 		return
 	}
-	repo, err := getRepo(c, username, name, "write")
+	repo, err := getRepo(c, username, name, "delete")
 	if err != nil {
 		return
 	}
@@ -603,22 +882,203 @@ func DeleteImage(c *gin.Context) {
 	if err != nil {
 		return
 	}
-
-	sto := storFact.Instance()
-	if err = sto.Delete(c, img.Fullname(), true); err != nil {
-		// Try best bahavior, so just log error
-		logger.Errorf(c, err, "failed to remove image %s from storage", img.Fullname())
+	audit.Digest = img.Digest
+	if err = checkImagesDeletable(c, repo, *img); err != nil {
+		return
+	}
+	if err = checkSnapshotsUnused(c, *img); err != nil {
+		return
 	}
+
 	if err = repo.DeleteImage(nil, img.Tag); err != nil {
 		logger.Error(c, err, "failed to delete image")
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
 	}
+	releaseImageFile(c, img)
 
 	c.JSON(http.StatusOK, gin.H{
 		"msg": "delete image successfully",
 	})
 }
 
+// SetImageState set image state
+//
+// @Summary set image state
+// @Description SetImageState deprecates an image or makes a deprecated image ready again
+// @Tags 镜像管理
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "token"
+// @Param username path string true "仓库用户名"
+// @Param name path string true "仓库名"
+// @Param tag query string false "镜像标签" default("latest")
+// @Param body body types.ImageStateRequest true "镜像状态"
+// @Success 200 {object} types.ImageInfoResp
+// @Failure 409
+// @Router /image/{username}/{name}/state [put]
+func SetImageState(c *gin.Context) {
+	logger := log.WithFunc("SetImageState")
+	username := c.Param("username")
+	name := c.Param("name")
+	tag := c.DefaultQuery("tag", defaultTag)
+	audit := common.Audit(c, models.AuditImageState, fmt.Sprintf("%s/%s:%s", username, name, tag))
+	var req types.ImageStateRequest
+	if err := c.ShouldBindWith(&req, binding.JSON); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Detail = req.State
+	// creating and failed are managed by uploads
+	if req.State != models.ImageStateReady && req.State != models.ImageStateDeprecated {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid state %s", req.State)})
+		return
+	}
+	if err := validateRepoName(username, name); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid name"})
+		return
+	}
+	repo, err := getRepo(c, username, name, "write")
+	if err != nil {
+		return
+	}
+	img, err := getRepoImage(c, repo, tag)
+	if err != nil {
+		return
+	}
+	if img.State != req.State {
+		err = repo.SetImageState(nil, img, req.State)
+	}
+	if errors.Is(err, terrors.ErrInvalidImageState) {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		logger.Errorf(c, err, "failed to set state of image %s", img.Fullname())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": convImageInfoResp(img),
+	})
+}
+
+// TagImage create a tag referring to an existing image
+//
+// @Summary tag image
+// @Description TagImage creates a tag which shares the file of the source image in the same repository,
+// @Description when the tag is latest, latest is pinned to the source image instead of the newest image
+// @Tags 镜像管理
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "token"
+// @Param username path string true "仓库用户名"
+// @Param name path string true "仓库名"
+// @Param tag path string true "新标签"
+// @Param force query bool false "覆盖已存在的标签" default("false")
+// @Param body body types.TagImageRequest true "源镜像标签"
+// @Success 200 {object} types.ImageInfoResp
+// @Failure 409
+// @Router /image/{username}/{name}/tags/{tag} [put]
+func TagImage(c *gin.Context) {
+	logger := log.WithFunc("TagImage")
+	username := c.Param("username")
+	name := c.Param("name")
+	tag := c.Param("tag")
+	force := utils.GetBooleanQuery(c, "force", false)
+	audit := common.Audit(c, models.AuditImageTag, fmt.Sprintf("%s/%s:%s", username, name, tag))
+	var req types.TagImageRequest
+	if err := c.ShouldBindWith(&req, binding.JSON); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Detail = "source " + req.Source
+	if err := validateRepoName(username, name); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid name"})
+		return
+	}
+	if err := checkNames(tag); err != nil || len(tag) > maxTagLength {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid tag %s", tag)})
+		return
+	}
+	if utils.IsDefaultTag(tag) {
+		setLatestTag(c, username, name, req.Source)
+		return
+	}
+	repo, dest, err := common.GetRepoImageForUpload(c, username, name, tag)
+	if err != nil {
+		return
+	}
+	if repo == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "image doesn't exist"})
+		return
+	}
+	src, err := getRepoImage(c, repo, req.Source)
+	if err != nil {
+		return
+	}
+	audit.Digest = src.Digest
+	if err = checkImageReady(c, src); err != nil {
+		return
+	}
+	if dest != nil {
+		switch {
+		case dest.ID == src.ID:
+			c.JSON(http.StatusOK, gin.H{"data": convImageInfoResp(dest)})
+			return
+		case dest.State == models.ImageStateCreating:
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("image %s is being uploaded", dest.Fullname())})
+			return
+		case dest.State != models.ImageStateFailed && !force:
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+				"error": "tag already exists. You can use force to overwrite.",
+			})
+			return
+		}
+	}
+	// the blob is shared, but the new tag is counted like other images
+	if err = checkQuota(c, username, dest, src.Size); err != nil {
+		return
+	}
+	// the new tag refers to the blob, so the file of source must be in blob store
+	if err = ensureImageBlob(c, src); err != nil {
+		return
+	}
+	img := &models.Image{
+		RepoID:      repo.ID,
+		Tag:         tag,
+		Labels:      src.Labels,
+		State:       models.ImageStateReady,
+		Size:        src.Size,
+		VirtualSize: src.VirtualSize,
+		ClusterSize: src.ClusterSize,
+		Digest:      src.Digest,
+		Format:      src.Format,
+		OS:          src.OS,
+		Snapshot:    src.Snapshot,
+		Description: src.Description,
+		OCIManifest: src.OCIManifest,
+		Repo:        repo,
+	}
+	err = linkImageBlob(c, img, func() error {
+		if err := saveTaggedImage(repo, dest, img); err != nil {
+			logger.Errorf(c, err, "failed to tag image %s as %s", src.Fullname(), tag)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	if dest != nil {
+		releaseImageFile(c, dest)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": convImageInfoResp(img),
+	})
+}
+
 // ListImages get image list of current user or specified user
 //
 // @Summary get image list
@@ -629,6 +1089,7 @@ func DeleteImage(c *gin.Context) {
 // @Param Authorization header string true "token"
 // @Param keyword query string false "搜索关键字"  default()
 // @Param username query string false "用户名"
+// @Param state query string false "镜像状态, 为空时返回所有状态的镜像"
 // @Param page query int false "页码"  default(1)
 // @Param pageSize query int false "每一页数量"  default(10)
 // @success 200 {object} types.JSONResult{data=[]types.ImageInfoResp} "desc"
@@ -668,8 +1129,15 @@ func ListImages(c *gin.Context) {
 		username = curUser.Username
 	}
 	regionCode := c.DefaultQuery("regionCode", "ap-yichang-1")
-	req := types.ImagesByUsernameRequest{Username: username, Keyword: keyword, PageNum: pNum, PageSize: pSize, RegionCode: regionCode}
-	if curUser != nil && (curUser.Admin || curUser.Username == username) {
+	req := types.ImagesByUsernameRequest{
+		Username:   username,
+		Keyword:    keyword,
+		State:      c.Query("state"),
+		PageNum:    pNum,
+		PageSize:   pSize,
+		RegionCode: regionCode,
+	}
+	if common.CheckNamespacePerm(c, username, common.PermRead) {
 		imgs, total, err = models.QueryImagesByUsername(req)
 	} else {
 		imgs, total, err = models.QueryPublicImagesByUsername(req)
@@ -698,16 +1166,47 @@ func writeDataToStorage(c *gin.Context, img *models.Image, fname string, size in
 	logger.Debugf(c, "starting to write file to storage, size %d", size)
 	defer logger.Debugf(c, "exit writing file to storage, err: %s", err)
 
-	if size < chunkThreshold {
+	if err := inspectImageFile(c, img, fname); err != nil {
+		return err
+	}
+	img.Size = size
+	sto := storFact.Instance()
+	// the blob is shared by all images with the same digest, so skip writing if it already exists
+	exists, err := sto.Exists(c, img.BlobName())
+	if err != nil {
+		logger.Errorf(c, err, "failed to check blob %s", img.BlobName())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return err
+	}
+	switch {
+	case exists:
+		logger.Debugf(c, "blob %s already exists", img.BlobName())
+	case size < chunkThreshold:
 		if err := writeSingleFile(c, img, fname); err != nil {
 			return err
 		}
-	} else {
+	default:
 		if err := writeSingleFileWithChunk(c, img, fname, size); err != nil {
 			return err
 		}
 	}
+	oldImg, err := getOverwrittenImage(c, img)
+	if err != nil {
+		return err
+	}
+	if err = linkImageBlob(c, img, func() error { return saveUploadedImage(c, img) }); err != nil {
+		return err
+	}
+	// the reserved image has no file
+	if oldImg != nil && oldImg.State != models.ImageStateCreating && oldImg.Digest != img.Digest {
+		releaseImageFile(c, oldImg)
+	}
+	return nil
+}
 
+// saveUploadedImage saves the repository and the uploaded image in a transaction, the reserved image becomes ready
+func saveUploadedImage(c *gin.Context, img *models.Image) error {
+	logger := log.WithFunc("saveUploadedImage")
 	repo := img.Repo
 	tx, err := models.Instance().Beginx()
 	if err != nil {
@@ -732,82 +1231,48 @@ func writeDataToStorage(c *gin.Context, img *models.Image, fname string, size in
 		})
 		return err
 	}
+	if img.State == models.ImageStateCreating {
+		if err = repo.SetImageState(tx, img, models.ImageStateReady); err != nil {
+			logger.Error(c, err, "failed to set image ready")
+			if errors.Is(err, terrors.ErrInvalidImageState) {
+				c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "the image is changed by others, please try again"})
+			} else {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+			}
+			return err
+		}
+	}
 	if err := tx.Commit(); err != nil {
 		logger.Error(c, err, "failed to commit transaction")
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
 		return err
 	}
-
 	return nil
 }
 
-func processRemoteImageFile(c *gin.Context, img *models.Image, url string) error {
-	logger := log.WithFunc("processRremoteImageFile")
-	resp, err := http.Get(url) //nolint
-	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("failed to download remote file %s", url)})
-		return err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "failed to download url"})
-		return fmt.Errorf("failed to get remote file, http code: %v", resp.StatusCode)
-	}
-	fp, err := os.CreateTemp("/tmp", "download-remote-")
-	if err != nil {
-		logger.Error(c, err, "failed to create temp file")
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
-		return err
-	}
-	defer os.Remove(fp.Name())
-	defer fp.Close()
-
-	h := sha256.New()
-	reader := io.TeeReader(resp.Body, h)
-	nwritten, err := io.Copy(fp, reader)
-	if err != nil {
-		logger.Error(c, err, "failed to download file")
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "failed to download url"})
-		return err
-	}
-	if err := fp.Sync(); err != nil {
-		logger.Error(c, err, "failed to sync file")
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
-		return err
-	}
-	// check size
-	if img.Size == 0 {
-		img.Size = nwritten
-	}
-	if img.Size != nwritten {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "size mismatch"})
-		return terrors.ErrPlaceholder
-	}
-	// check digest
-	digest := fmt.Sprintf("%x", h.Sum(nil))
-	if img.Digest == "" {
-		img.Digest = digest
-	}
-	if digest != img.Digest {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "digest mismatch"})
+// inspectImageFile checks the image file with qemu-img, since the format passed by user can't be trusted,
+// and fills the image with the detected information.
+func inspectImageFile(c *gin.Context, img *models.Image, fname string) error {
+	info, err := imageops.Inspect(c, fname, img.Format)
+	if errors.Is(err, terrors.ErrInvalidImage) {
+		failImage(c, img)
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return terrors.ErrPlaceholder
 	}
-	if img.Tag == utils.FakeTag {
-		img.Tag = digest[:10]
-	}
-	// set file pointer to start
-	if _, err := fp.Seek(0, 0); err != nil {
-		logger.Error(c, err, "failed to seek file")
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+	if err != nil {
+		log.WithFunc("inspectImageFile").Errorf(c, err, "failed to inspect image file %s", fname)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
 		return err
 	}
-	return writeDataToStorage(c, img, fp.Name(), nwritten)
+	img.VirtualSize = info.VirtualSize
+	img.ClusterSize = info.ClusterSize
+	return nil
 }
 
 func writeSingleFileWithChunk(c *gin.Context, img *models.Image, fname string, size int64) error {
 	logger := log.WithFunc("writeSingleFileWithChunk")
 	sto := storFact.Instance()
-	uploadID, err := sto.CreateChunkWrite(c, img.Fullname())
+	uploadID, err := sto.CreateChunkWrite(c, img.BlobName())
 	if err != nil {
 		logger.Error(c, err, "Failed to save file to storage [CreateChunkWrite]")
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
@@ -849,7 +1314,7 @@ func writeSingleFileWithChunk(c *gin.Context, img *models.Image, fname string, s
 			In:        sReader,
 		}
 		chunkList[chunkIdx] = cInfo
-		if err = sto.ChunkWrite(c, img.Fullname(), uploadID, cInfo); err != nil {
+		if err = sto.ChunkWrite(c, img.BlobName(), uploadID, cInfo); err != nil {
 			errList[chunkIdx] = fmt.Errorf("%w failed to write chunk %d", err, chunkIdx)
 			logger.Errorf(c, errList[chunkIdx], "failed to write chunk %d", chunkIdx)
 			hasErr.Store(true)
@@ -880,7 +1345,7 @@ func writeSingleFileWithChunk(c *gin.Context, img *models.Image, fname string, s
 		return outErr
 	}
 	logger.Debug(c, "completing chunk write")
-	err = sto.CompleteChunkWrite(c, img.Fullname(), uploadID, chunkList)
+	err = sto.CompleteChunkWrite(c, img.BlobName(), uploadID, chunkList)
 	if err != nil {
 		logger.Error(c, err, "Failed to save file to storage [CompleteChunkWrite]")
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
@@ -900,7 +1365,8 @@ func writeSingleFile(c *gin.Context, img *models.Image, fname string) error {
 	if err != nil {
 		return err
 	}
-	if err := sto.Put(c, img.Fullname(), digest, fp); err != nil {
+	defer fp.Close()
+	if err := sto.Put(c, img.BlobName(), digest, fp); err != nil {
 		logger.Error(c, err, "Failed to save file to storage")
 		if errors.Is(err, terrors.ErrInvalidDigest) {
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
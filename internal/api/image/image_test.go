@@ -15,12 +15,16 @@ import (
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/gin-gonic/gin"
+	"github.com/projecteru2/vmihub/internal/imageops"
 	"github.com/projecteru2/vmihub/internal/middlewares"
 	"github.com/projecteru2/vmihub/internal/models"
 	"github.com/projecteru2/vmihub/internal/testutils"
 	"github.com/projecteru2/vmihub/internal/utils"
+	"github.com/projecteru2/vmihub/internal/utils/sh"
+	shMocks "github.com/projecteru2/vmihub/internal/utils/sh/mocks"
 	"github.com/projecteru2/vmihub/pkg/types"
 	pkgutils "github.com/projecteru2/vmihub/pkg/utils"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
@@ -35,11 +39,14 @@ var (
 	repoColumns   = ((*models.Repository)(nil)).ColumnNames()
 	imgTableName  = ((*models.Image)(nil)).TableName()
 	imgColumns    = ((*models.Image)(nil)).ColumnNames()
+	quotaColumns  = ((*models.Quota)(nil)).ColumnNames()
 )
 
 type imageTestSuite struct {
 	suite.Suite
-	r *gin.Engine
+	r            *gin.Engine
+	shell        *shMocks.Shell
+	restoreShell func()
 }
 
 // func (suite *imageTestSuite) SetupSuite() {
@@ -59,6 +66,22 @@ func (suite *imageTestSuite) SetupTest() {
 
 	SetupRouter(apiGroup)
 	suite.r = r
+	testutils.ResetMockStorage()
+	suite.shell = &shMocks.Shell{}
+	suite.restoreShell = sh.NewMockShell(suite.shell)
+}
+
+func (suite *imageTestSuite) TearDownTest() {
+	suite.restoreShell()
+}
+
+// mockQemuImg makes qemu-img report every file as a healthy image in format
+func (suite *imageTestSuite) mockQemuImg(format string) {
+	info := fmt.Sprintf(`{"format":%q,"virtual-size":1024,"cluster-size":65536}`, format)
+	suite.shell.On("ExecInOut", mock.Anything, mock.Anything, mock.Anything, "qemu-img", "info", "--output=json", mock.Anything).
+		Return([]byte(info), nil, nil)
+	suite.shell.On("ExecInOut", mock.Anything, mock.Anything, mock.Anything, "qemu-img", "check", "--output=json", "-f", "qcow2", mock.Anything).
+		Return([]byte(`{"check-errors":0}`), nil, nil)
 }
 
 func (suite *imageTestSuite) TestGetRepoList() {
@@ -110,8 +133,8 @@ func (suite *imageTestSuite) TestGetRepoList() {
 		wantRows := sqlmock.NewRows([]string{"id", "username", "name"}).
 			AddRow(1, "user1", "name1").
 			AddRow(2, "user1", "name2")
-		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? ORDER BY updated_at DESC LIMIT ?, ?", repoColumns, repoTableName)).
-			WithArgs("user1", 0, 10).
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? OR id IN (SELECT m.repo_id FROM repository_member m, user u WHERE u.id=m.user_id AND u.username=?) ORDER BY updated_at DESC LIMIT ?, ?", repoColumns, repoTableName)).
+			WithArgs("user1", "user1", 0, 10).
 			WillReturnRows(wantRows)
 		w := httptest.NewRecorder()
 		req, _ := http.NewRequest("GET", "/api/v1/repositories", nil)
@@ -161,8 +184,8 @@ func (suite *imageTestSuite) TestGetImageInfo() {
 			WillReturnRows(wantRows)
 
 		// image doesn't exist
-		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? ORDER BY created_at DESC LIMIT 1", imgColumns, imgTableName)).
-			WithArgs(1).
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? AND state = ? ORDER BY created_at DESC LIMIT 1", imgColumns, imgTableName)).
+			WithArgs(1, models.ImageStateReady).
 			WillReturnRows(sqlmock.NewRows([]string{"id", "repo_id", "tag"}))
 
 		w := httptest.NewRecorder()
@@ -183,8 +206,8 @@ func (suite *imageTestSuite) TestGetImageInfo() {
 			WithArgs("user1", "name1").
 			WillReturnRows(wantRows)
 
-		wantRows = sqlmock.NewRows([]string{"id", "repo_id", "tag", "os", "created_at"}).
-			AddRow(2, 1, "tag1", []byte("{}"), time.Now())
+		wantRows = sqlmock.NewRows([]string{"id", "repo_id", "tag", "state", "os", "created_at"}).
+			AddRow(2, 1, "tag1", models.ImageStateCreating, []byte("{}"), time.Now())
 		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? AND tag = ?", imgColumns, imgTableName)).
 			WithArgs(1, "tag1").
 			WillReturnRows(wantRows)
@@ -204,6 +227,7 @@ func (suite *imageTestSuite) TestGetImageInfo() {
 		suite.Nil(err)
 		suite.Equal(resp.Username, "user1")
 		suite.Equal(resp.Name, "name1")
+		suite.Equal(models.ImageStateCreating, resp.State)
 	}
 }
 
@@ -215,10 +239,10 @@ func (suite *imageTestSuite) TestCache() {
 		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? AND name = ?", repoColumns, repoTableName)).
 			WithArgs("user1", "name1").
 			WillReturnRows(wantRows)
-		wantRows = sqlmock.NewRows([]string{"id", "repo_id", "tag", "os"}).
-			AddRow(2, 1, "tag1", []byte("{}"))
-		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? ORDER BY created_at DESC LIMIT 1", imgColumns, imgTableName)).
-			WithArgs(1).
+		wantRows = sqlmock.NewRows([]string{"id", "repo_id", "tag", "state", "os"}).
+			AddRow(2, 1, "tag1", models.ImageStateReady, []byte("{}"))
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? AND state = ? ORDER BY created_at DESC LIMIT 1", imgColumns, imgTableName)).
+			WithArgs(1, models.ImageStateReady).
 			WillReturnRows(wantRows)
 
 		w := httptest.NewRecorder()
@@ -302,15 +326,17 @@ func (suite *imageTestSuite) TestDownloadImage() {
 			WithArgs("user1", "name1").
 			WillReturnRows(wantRows)
 
-		wantRows = sqlmock.NewRows([]string{"id", "repo_id", "tag"}).
-			AddRow(2, 1, "tag1")
+		digest, _ := pkgutils.CalcDigestOfStr(testContent)
+		wantRows = sqlmock.NewRows([]string{"id", "repo_id", "tag", "state", "digest"}).
+			AddRow(2, 1, "tag1", models.ImageStateReady, digest)
 		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? AND tag = ?", imgColumns, imgTableName)).
 			WithArgs(1, "tag1").
 			WillReturnRows(wantRows)
 		sto := testutils.GetMockStorage()
 		defer sto.AssertExpectations(suite.T())
 
-		sto.On("Get", mock.Anything, mock.Anything).Return(io.NopCloser(bytes.NewBufferString(testContent)), nil).Once()
+		sto.On("Exists", mock.Anything, models.BlobName(digest)).Return(true, nil).Once()
+		sto.On("Get", mock.Anything, models.BlobName(digest)).Return(io.NopCloser(bytes.NewBufferString(testContent)), nil).Once()
 
 		w := httptest.NewRecorder()
 		req, _ := http.NewRequest("GET", "/api/v1/image/user1/name1/download?tag=tag1", nil)
@@ -320,11 +346,113 @@ func (suite *imageTestSuite) TestDownloadImage() {
 		suite.Equal(http.StatusOK, w.Code)
 		suite.Equal(testContent, w.Body.String())
 	}
+	{
+		// resume with range
+		user, pass := "user1", "pass1"
+		digest, _ := pkgutils.CalcDigestOfStr(testContent)
+		for _, ifRange := range []string{"", fmt.Sprintf("%q", digest), `"stale"`} {
+			utils.MockRedis.FlushAll()
+			err := testutils.PrepareUserData(user, pass)
+			suite.Nil(err)
+			models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? AND name = ?", repoColumns, repoTableName)).
+				WithArgs("user1", "name1").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name", "private"}).AddRow(1, "user1", "name1", true))
+			models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? AND tag = ?", imgColumns, imgTableName)).
+				WithArgs(1, "tag1").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "repo_id", "tag", "state", "size", "digest"}).
+					AddRow(2, 1, "tag1", models.ImageStateReady, len(testContent), digest))
+			sto := testutils.ResetMockStorage()
+			sto.On("Exists", mock.Anything, models.BlobName(digest)).Return(true, nil).Once()
+			if ifRange == `"stale"` {
+				sto.On("Get", mock.Anything, models.BlobName(digest)).Return(io.NopCloser(bytes.NewBufferString(testContent)), nil).Once()
+			} else {
+				sto.On("SeekRead", mock.Anything, models.BlobName(digest), int64(5)).Return(io.NopCloser(bytes.NewBufferString(testContent[5:])), nil).Once()
+			}
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/api/v1/image/user1/name1/download?tag=tag1", nil)
+			req.Header.Set("Range", "bytes=5-")
+			if ifRange != "" {
+				req.Header.Set("If-Range", ifRange)
+			}
+			testutils.AddAuth(req, user, pass)
+			suite.r.ServeHTTP(w, req)
+
+			suite.Equal(fmt.Sprintf("%q", digest), w.Header().Get("ETag"))
+			suite.Equal("bytes", w.Header().Get("Accept-Ranges"))
+			if ifRange == `"stale"` {
+				suite.Equal(http.StatusOK, w.Code)
+				suite.Equal(testContent, w.Body.String())
+			} else {
+				suite.Equal(http.StatusPartialContent, w.Code)
+				suite.Equal(fmt.Sprintf("bytes 5-%d/%d", len(testContent)-1, len(testContent)), w.Header().Get("Content-Range"))
+				suite.Equal(testContent[5:], w.Body.String())
+			}
+			sto.AssertExpectations(suite.T())
+		}
+	}
+	{
+		// the image is still being uploaded
+		utils.MockRedis.FlushAll()
+		user, pass := "user1", "pass1"
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? AND name = ?", repoColumns, repoTableName)).
+			WithArgs("user1", "name1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name", "private"}).AddRow(1, "user1", "name1", true))
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? AND tag = ?", imgColumns, imgTableName)).
+			WithArgs(1, "tag1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "repo_id", "tag", "state"}).
+				AddRow(2, 1, "tag1", models.ImageStateCreating))
+		sto := testutils.ResetMockStorage()
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/image/user1/name1/download?tag=tag1", nil)
+		testutils.AddAuth(req, user, pass)
+		suite.r.ServeHTTP(w, req)
+
+		suite.Equal(http.StatusConflict, w.Code)
+		suite.Contains(w.Body.String(), "is creating")
+		sto.AssertNotCalled(suite.T(), "Get", mock.Anything, mock.Anything)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	cases := []struct {
+		header     string
+		start, end int64
+		partial    bool
+		hasErr     bool
+	}{
+		{"", 0, 0, false, false},
+		{"bytes=0-0,5-6", 0, 0, false, false},
+		{"bytes=10-", 10, 99, true, false},
+		{"bytes=10-19", 10, 19, true, false},
+		{"bytes=10-1000", 10, 99, true, false},
+		{"bytes=-10", 90, 99, true, false},
+		{"bytes=-1000", 0, 99, true, false},
+		{"bytes=100-", 0, 0, false, true},
+		{"bytes=20-10", 0, 0, false, true},
+		{"bytes=abc", 0, 0, false, true},
+	}
+	for _, c := range cases {
+		start, end, partial, err := parseRange(c.header, 100)
+		if c.hasErr {
+			assert.Error(t, err, c.header)
+			continue
+		}
+		assert.Nil(t, err, c.header)
+		assert.Equal(t, c.partial, partial, c.header)
+		assert.Equal(t, c.start, start, c.header)
+		assert.Equal(t, c.end, end, c.header)
+	}
 }
 
 func (suite *imageTestSuite) TestUploadImage() {
 	digest, err := pkgutils.CalcDigestOfStr(testContent)
 	suite.Nil(err)
+	suite.mockQemuImg("qcow2")
 
 	// gomonkey.ApplyFuncReturn(task.SendImageTask, nil)
 
@@ -373,6 +501,34 @@ func (suite *imageTestSuite) TestUploadImage() {
 
 		suite.Equal(http.StatusForbidden, w.Code)
 	}
+	{
+		utils.MockRedis.FlushAll()
+		// quota exceeded
+		user, pass := "user1", "pass1"
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? AND name = ?", repoColumns, repoTableName)).
+			WithArgs("user1", "name1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name", "private"}))
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM quota WHERE namespace = ?", quotaColumns)).
+			WithArgs("user1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "namespace", "max_size", "max_images"}).
+				AddRow(1, "user1", 100, 0))
+		models.Mock.ExpectQuery(`SELECT COALESCE(SUM(i.size), 0) AS size, COUNT(*) AS images
+		    FROM image i, repository r
+		    WHERE r.id=i.repo_id AND r.username=? AND i.state != ? AND i.id != ?`).
+			WithArgs("user1", models.ImageStateFailed, 0).
+			WillReturnRows(sqlmock.NewRows([]string{"size", "images"}).AddRow(100-len(testContent)+1, 3))
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/image/user1/name1/startUpload", bytes.NewReader(bs))
+		testutils.AddAuth(req, user, pass)
+		suite.r.ServeHTTP(w, req)
+
+		suite.Equal(http.StatusForbidden, w.Code)
+		suite.Contains(w.Body.String(), "quota exceeded")
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
 	{
 		utils.MockRedis.FlushAll()
 		// normal case
@@ -387,22 +543,15 @@ func (suite *imageTestSuite) TestUploadImage() {
 		// 	WithArgs(1, "latest").
 		// 	WillReturnRows(sqlmock.NewRows([]string{"id", "repo_id", "tag"}))
 
-		models.Mock.ExpectBegin()
-		models.Mock.ExpectExec("INSERT INTO repository(username, name, private) VALUES(?, ?, ?)").
-			WithArgs("user1", "name1", false).
-			WillReturnResult(sqlmock.NewResult(1234, 1))
-
-		osBytes, _ := json.Marshal(body.OS)
-		models.Mock.ExpectExec("INSERT INTO image(repo_id, tag, labels, size, format, os, digest, snapshot, description) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)").
-			WithArgs(1234, "tag1", sqlmock.AnyArg(), len(testContent), "qcow2", osBytes, digest, sqlmock.AnyArg(), sqlmock.AnyArg()).
-			WillReturnResult(sqlmock.NewResult(1234, 1))
-		models.Mock.ExpectCommit()
+		expectReserveImage(digest, "qcow2")
+		expectImageReady(digest)
 
 		stor := testutils.GetMockStorage()
 		defer stor.AssertExpectations(suite.T())
 
+		stor.On("Exists", mock.Anything, models.BlobName(digest)).Return(false, nil).Once()
 		var once sync.Once
-		stor.On("Put", mock.Anything, mock.Anything, mock.Anything, mock.MatchedBy(func(reader io.ReadSeeker) bool {
+		stor.On("Put", mock.Anything, models.BlobName(digest), digest, mock.MatchedBy(func(reader io.ReadSeeker) bool {
 			// AssertExpectations will call this function second time
 			once.Do(func() {
 				bs, err := io.ReadAll(reader)
@@ -411,6 +560,8 @@ func (suite *imageTestSuite) TestUploadImage() {
 			})
 			return true
 		})).Return(nil)
+		// checked again with the blob locked before saving image
+		stor.On("Exists", mock.Anything, models.BlobName(digest)).Return(true, nil).Once()
 
 		w := httptest.NewRecorder()
 		req, _ := http.NewRequest("POST", "/api/v1/image/user1/name1/startUpload", bytes.NewReader(bs))
@@ -445,9 +596,677 @@ func (suite *imageTestSuite) TestUploadImage() {
 
 		suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
 	}
+	{
+		utils.MockRedis.FlushAll()
+		// the file is already stored by other image, so don't write it again
+		user, pass := "user1", "pass1"
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? AND name = ?", repoColumns, repoTableName)).
+			WithArgs("user1", "name1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name", "private"}))
+
+		expectReserveImage(digest, "qcow2")
+		expectImageReady(digest)
+
+		stor := testutils.ResetMockStorage()
+		defer stor.AssertExpectations(suite.T())
+		stor.On("Exists", mock.Anything, models.BlobName(digest)).Return(true, nil).Twice()
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/image/user1/name1/startUpload", bytes.NewReader(bs))
+		testutils.AddAuth(req, user, pass)
+		suite.r.ServeHTTP(w, req)
+		suite.Equal(http.StatusOK, w.Code)
+		uploadID := suite.getUploadID(w)
+
+		w = httptest.NewRecorder()
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("file", "/tmp/haha")
+		suite.Nil(err)
+		_, err = part.Write([]byte(testContent))
+		suite.Nil(err)
+		writer.Close()
+
+		req, _ = http.NewRequest("POST", fmt.Sprintf("/api/v1/image/user1/name1/upload?uploadID=%s", uploadID), body)
+		testutils.AddAuth(req, user, pass)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		suite.r.ServeHTTP(w, req)
+
+		suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+		stor.AssertNotCalled(suite.T(), "Put", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		utils.MockRedis.FlushAll()
+		// the declared format doesn't match the real one
+		user, pass := "user1", "pass1"
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? AND name = ?", repoColumns, repoTableName)).
+			WithArgs("user1", "name1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name", "private"}))
+		expectReserveImage(digest, "raw")
+		// the reserved image fails
+		models.Mock.ExpectBegin()
+		models.Mock.ExpectExec("UPDATE image SET state = ? WHERE id = ? AND state = ?").
+			WithArgs(models.ImageStateFailed, 2, models.ImageStateCreating).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		models.Mock.ExpectCommit()
+		stor := testutils.ResetMockStorage()
+
+		rawBody := body
+		rawBody.Format = "raw"
+		bs, _ := json.Marshal(rawBody)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/image/user1/name1/startUpload", bytes.NewReader(bs))
+		testutils.AddAuth(req, user, pass)
+		suite.r.ServeHTTP(w, req)
+		suite.Equal(http.StatusOK, w.Code)
+		uploadID := suite.getUploadID(w)
+
+		w = httptest.NewRecorder()
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("file", "/tmp/haha")
+		suite.Nil(err)
+		_, err = part.Write([]byte(testContent))
+		suite.Nil(err)
+		writer.Close()
+
+		req, _ = http.NewRequest("POST", fmt.Sprintf("/api/v1/image/user1/name1/upload?uploadID=%s", uploadID), body)
+		testutils.AddAuth(req, user, pass)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		suite.r.ServeHTTP(w, req)
+
+		suite.Equalf(http.StatusBadRequest, w.Code, "error: %s", w.Body.String())
+		suite.Contains(w.Body.String(), "format is qcow2")
+		stor.AssertNotCalled(suite.T(), "Put", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		utils.MockRedis.FlushAll()
+		// the remote file is imported by a task
+		user, pass := "user1", "pass1"
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? AND name = ?", repoColumns, repoTableName)).
+			WithArgs("user1", "name1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name", "private"}))
+		expectReserveImage(digest, "qcow2")
+		models.Mock.ExpectBegin()
+		models.Mock.ExpectExec("INSERT INTO task(type, username, status, payload) VALUES(?, ?, ?, ?)").
+			WithArgs(imageops.TaskTypeImport, "user1", types.TaskStatusPending, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(10, 1))
+		models.Mock.ExpectCommit()
+
+		urlBody := body
+		urlBody.URL = "http://127.0.0.1/image.qcow2"
+		bs, _ := json.Marshal(urlBody)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/image/user1/name1/startUpload", bytes.NewReader(bs))
+		testutils.AddAuth(req, user, pass)
+		suite.r.ServeHTTP(w, req)
+		suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+		suite.Contains(w.Body.String(), `"taskID":10`)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+}
+
+// expectReserveImage expects the new image to be saved in creating state when the upload starts
+func expectReserveImage(digest, format string) {
+	expectNoQuota("user1")
+	models.Mock.ExpectBegin()
+	models.Mock.ExpectExec("INSERT INTO repository(username, name, private) VALUES(?, ?, ?)").
+		WithArgs("user1", "name1", false).
+		WillReturnResult(sqlmock.NewResult(1234, 1))
+	models.Mock.ExpectExec("INSERT INTO image(repo_id, tag, labels, state, size, virtual_size, cluster_size, format, os, digest, snapshot, description) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)").
+		WithArgs(1234, "tag1", sqlmock.AnyArg(), models.ImageStateCreating, len(testContent), 0, 0, format, sqlmock.AnyArg(), digest, "", "").
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	models.Mock.ExpectCommit()
+}
+
+// expectNoQuota expects the quota of namespace to be queried and it is unlimited
+func expectNoQuota(namespace string) {
+	models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM quota WHERE namespace = ?", quotaColumns)).
+		WithArgs(namespace).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "namespace", "max_size", "max_images"}))
+}
+
+// expectImageReady expects the reserved image to be updated and become ready after its file is verified
+func expectImageReady(digest string) {
+	models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s where id = ?", imgColumns, imgTableName)).
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "repo_id", "tag", "state", "digest"}).
+			AddRow(2, 1234, "tag1", models.ImageStateCreating, digest))
+	models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE id = ?", repoColumns, repoTableName)).
+		WithArgs(1234).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name"}).AddRow(1234, "user1", "name1"))
+	models.Mock.ExpectBegin()
+	models.Mock.ExpectExec("UPDATE repository SET private = ? WHERE username = ? and name = ?").
+		WithArgs(false, "user1", "name1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	models.Mock.ExpectExec("UPDATE image SET digest = ?, size=?, virtual_size=?, cluster_size=?, format=?, snapshot=? WHERE id = ?").
+		WithArgs(digest, len(testContent), 1024, 65536, "qcow2", "", 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	models.Mock.ExpectExec("UPDATE image SET state = ? WHERE id = ? AND state = ?").
+		WithArgs(models.ImageStateReady, 2, models.ImageStateCreating).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	models.Mock.ExpectCommit()
+}
+
+func (suite *imageTestSuite) getUploadID(w *httptest.ResponseRecorder) string {
+	raw := map[string]any{}
+	err := json.Unmarshal(w.Body.Bytes(), &raw)
+	suite.Nil(err)
+	var resp map[string]string
+	bs, _ := json.Marshal(raw["data"])
+	err = json.Unmarshal(bs, &resp)
+	suite.Nil(err)
+	return resp["uploadID"]
 }
 
 func (suite *imageTestSuite) TestDeleteImage() {
+	digest, err := pkgutils.CalcDigestOfStr(testContent)
+	suite.Nil(err)
+	user, pass := "user1", "pass1"
+	for _, refs := range []int{0, 1} {
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? AND name = ?", repoColumns, repoTableName)).
+			WithArgs("user1", "name1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name", "private"}).AddRow(1, "user1", "name1", true))
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? AND tag = ?", imgColumns, imgTableName)).
+			WithArgs(1, "tag1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "repo_id", "tag", "digest", "format"}).AddRow(2, 1, "tag1", digest, "qcow2"))
+		models.Mock.ExpectBegin()
+		models.Mock.ExpectExec("DELETE FROM image WHERE repo_id = ? AND tag = ?").
+			WithArgs(1, "tag1").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		models.Mock.ExpectCommit()
+		models.Mock.ExpectQuery("SELECT count(*) FROM image WHERE digest = ?").
+			WithArgs(digest).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(refs))
+
+		stor := testutils.ResetMockStorage()
+		// the blob is only removed when the last reference goes away
+		if refs == 0 {
+			stor.On("Delete", mock.Anything, models.BlobName(digest), true).Return(nil).Once()
+		}
+		stor.On("Delete", mock.Anything, "user1/name1:tag1", true).Return(nil).Once()
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("DELETE", "/api/v1/image/user1/name1?tag=tag1", nil)
+		testutils.AddAuth(req, user, pass)
+		suite.r.ServeHTTP(w, req)
+
+		suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+		stor.AssertExpectations(suite.T())
+		if refs > 0 {
+			stor.AssertNotCalled(suite.T(), "Delete", mock.Anything, models.BlobName(digest), true)
+		}
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+}
+
+func (suite *imageTestSuite) TestSetImageState() {
+	user, pass := "user1", "pass1"
+	expectImage := func(state string) {
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? AND name = ?", repoColumns, repoTableName)).
+			WithArgs("user1", "name1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name", "private"}).AddRow(1, "user1", "name1", false))
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? AND tag = ?", imgColumns, imgTableName)).
+			WithArgs(1, "tag1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "repo_id", "tag", "state", "os"}).AddRow(2, 1, "tag1", state, []byte("{}")))
+	}
+	setState := func(state string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		bs, _ := json.Marshal(types.ImageStateRequest{State: state})
+		req, _ := http.NewRequest("PUT", "/api/v1/image/user1/name1/state?tag=tag1", bytes.NewReader(bs))
+		testutils.AddAuth(req, user, pass)
+		suite.r.ServeHTTP(w, req)
+		return w
+	}
+	{
+		// deprecate image
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		expectImage(models.ImageStateReady)
+		models.Mock.ExpectBegin()
+		models.Mock.ExpectExec("UPDATE image SET state = ? WHERE id = ? AND state = ?").
+			WithArgs(models.ImageStateDeprecated, 2, models.ImageStateReady).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		models.Mock.ExpectCommit()
+		w := setState(models.ImageStateDeprecated)
+		suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+		suite.Contains(w.Body.String(), `"state":"deprecated"`)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		// the states managed by uploads can't be set
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		w := setState(models.ImageStateFailed)
+		suite.Equal(http.StatusBadRequest, w.Code)
+	}
+	{
+		// the image being uploaded can't be deprecated
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		expectImage(models.ImageStateCreating)
+		w := setState(models.ImageStateDeprecated)
+		suite.Equal(http.StatusConflict, w.Code)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+}
+
+func (suite *imageTestSuite) TestTagProtection() {
+	user, pass := "user1", "pass1"
+	expectRepo := func(immutable bool, patterns string) {
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? AND name = ?", repoColumns, repoTableName)).
+			WithArgs("user1", "name1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name", "private", "immutable_tags", "protected_tags"}).
+				AddRow(1, "user1", "name1", false, immutable, patterns))
+	}
+	expectImage := func(tag string) {
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? AND tag = ?", imgColumns, imgTableName)).
+			WithArgs(1, tag).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "repo_id", "tag", "state", "format"}).
+				AddRow(2, 1, tag, models.ImageStateReady, "qcow2"))
+	}
+	digest, err := pkgutils.CalcDigestOfStr(testContent)
+	suite.Nil(err)
+	startUpload := func(tag string) *httptest.ResponseRecorder {
+		bs, _ := json.Marshal(types.ImageCreateRequest{
+			Tag:    tag,
+			Size:   int64(len(testContent)),
+			Digest: digest,
+			Format: "qcow2",
+			OS:     types.OSInfo{Arch: "amd64", Type: "linux", Distrib: "ubuntu", Version: "22.04"},
+		})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/image/user1/name1/startUpload?force=true", bytes.NewReader(bs))
+		testutils.AddAuth(req, user, pass)
+		suite.r.ServeHTTP(w, req)
+		return w
+	}
+	setProtection := func(immutable bool, patterns ...string) *httptest.ResponseRecorder {
+		bs, _ := json.Marshal(types.TagProtectionRequest{Immutable: immutable, Patterns: patterns})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/api/v1/repository/user1/name1/protection", bytes.NewReader(bs))
+		testutils.AddAuth(req, user, pass)
+		suite.r.ServeHTTP(w, req)
+		return w
+	}
+	{
+		// the protected tag can't be overwritten
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		expectRepo(false, "release-*")
+		expectImage("release-1")
+		w := startUpload("release-1")
+		suite.Equalf(http.StatusForbidden, w.Code, "error: %s", w.Body.String())
+		suite.Contains(w.Body.String(), "tag is protected")
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		// the tags of immutable repository can't be overwritten even if force is set
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		expectRepo(true, "")
+		expectImage("tag1")
+		w := startUpload("tag1")
+		suite.Equalf(http.StatusConflict, w.Code, "error: %s", w.Body.String())
+		suite.Contains(w.Body.String(), "tag is immutable")
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		// the protected tag can't be deleted
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		expectRepo(false, "release-*")
+		expectImage("release-1")
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("DELETE", "/api/v1/image/user1/name1?tag=release-1", nil)
+		testutils.AddAuth(req, user, pass)
+		suite.r.ServeHTTP(w, req)
+		suite.Equalf(http.StatusForbidden, w.Code, "error: %s", w.Body.String())
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		// set protection rules
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		expectRepo(false, "release-*")
+		models.Mock.ExpectBegin()
+		models.Mock.ExpectExec("UPDATE repository SET immutable_tags = ?, protected_tags = ? WHERE id = ?").
+			WithArgs(true, "release-*,v*", 1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		models.Mock.ExpectCommit()
+		w := setProtection(true, "release-*", "v*")
+		suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+		suite.Contains(w.Body.String(), `"protectedTags":"release-*,v*"`)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		// only administrators can relax the rules
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		expectRepo(false, "release-*")
+		w := setProtection(false, "v*")
+		suite.Equal(http.StatusForbidden, w.Code)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		// invalid pattern
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		expectRepo(false, "")
+		w := setProtection(false, "release-[")
+		suite.Equal(http.StatusBadRequest, w.Code)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+}
+
+func (suite *imageTestSuite) TestTagImage() {
+	user, pass := "user1", "pass1"
+	digest, err := pkgutils.CalcDigestOfStr(testContent)
+	suite.Nil(err)
+	expectRepo := func() {
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? AND name = ?", repoColumns, repoTableName)).
+			WithArgs("user1", "name1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name", "private"}).AddRow(1, "user1", "name1", false))
+	}
+	expectImage := func(id int, tag string) {
+		rows := sqlmock.NewRows([]string{"id", "repo_id", "tag", "state", "size", "digest", "format", "os"})
+		if id > 0 {
+			rows.AddRow(id, 1, tag, models.ImageStateReady, len(testContent), digest, "qcow2", []byte("{}"))
+		}
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? AND tag = ?", imgColumns, imgTableName)).
+			WithArgs(1, tag).
+			WillReturnRows(rows)
+	}
+	tagImage := func(tag, source string, force bool) *httptest.ResponseRecorder {
+		bs, _ := json.Marshal(types.TagImageRequest{Source: source})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", fmt.Sprintf("/api/v1/image/user1/name1/tags/%s?force=%v", tag, force), bytes.NewReader(bs))
+		testutils.AddAuth(req, user, pass)
+		suite.r.ServeHTTP(w, req)
+		return w
+	}
+	{
+		// the new tag refers to the blob of source image
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		expectRepo()
+		expectImage(0, "tag2")
+		expectImage(2, "tag1")
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM quota WHERE namespace = ?", quotaColumns)).
+			WithArgs("user1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "namespace"}))
+		stor := testutils.ResetMockStorage()
+		stor.On("Exists", mock.Anything, models.BlobName(digest)).Return(true, nil).Once()
+		// checked again with the blob locked before saving image
+		stor.On("Exists", mock.Anything, models.BlobName(digest)).Return(true, nil).Once()
+		models.Mock.ExpectBegin()
+		models.Mock.ExpectExec("INSERT INTO image(repo_id, tag, labels, state, size, virtual_size, cluster_size, format, os, digest, snapshot, description) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)").
+			WithArgs(1, "tag2", sqlmock.AnyArg(), models.ImageStateReady, len(testContent), 0, 0, "qcow2", sqlmock.AnyArg(), digest, "", "").
+			WillReturnResult(sqlmock.NewResult(3, 1))
+		models.Mock.ExpectCommit()
+		w := tagImage("tag2", "tag1", false)
+		suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+		suite.Contains(w.Body.String(), `"tag":"tag2"`)
+		stor.AssertExpectations(suite.T())
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		// the existing tag can't be overwritten without force
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		expectRepo()
+		expectImage(3, "tag2")
+		expectImage(2, "tag1")
+		w := tagImage("tag2", "tag1", false)
+		suite.Equalf(http.StatusConflict, w.Code, "error: %s", w.Body.String())
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		// the new tag is counted by quota
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		expectRepo()
+		expectImage(0, "tag3")
+		expectImage(2, "tag1")
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM quota WHERE namespace = ?", quotaColumns)).
+			WithArgs("user1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "namespace", "max_size", "max_images"}).AddRow(1, "user1", 0, 2))
+		models.Mock.ExpectQuery(`SELECT COALESCE(SUM(i.size), 0) AS size, COUNT(*) AS images
+		    FROM image i, repository r
+		    WHERE r.id=i.repo_id AND r.username=? AND i.state != ? AND i.id != ?`).
+			WithArgs("user1", models.ImageStateFailed, 0).
+			WillReturnRows(sqlmock.NewRows([]string{"size", "images"}).AddRow(2*len(testContent), 2))
+		w := tagImage("tag3", "tag1", false)
+		suite.Equalf(http.StatusForbidden, w.Code, "error: %s", w.Body.String())
+		suite.Contains(w.Body.String(), "quota exceeded")
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		// pin latest to tag1
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		expectRepo()
+		expectImage(2, "tag1")
+		models.Mock.ExpectBegin()
+		models.Mock.ExpectExec("UPDATE repository SET latest_tag = ? WHERE id = ?").
+			WithArgs("tag1", 1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		models.Mock.ExpectCommit()
+		w := tagImage("latest", "tag1", false)
+		suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+		suite.Contains(w.Body.String(), `"tag":"tag1"`)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	for _, tc := range []struct {
+		immutable bool
+		protected string
+		code      int
+	}{
+		{false, "latest,release-*", http.StatusForbidden},
+		{true, "", http.StatusConflict},
+	} {
+		// latest is protected like other tags
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? AND name = ?", repoColumns, repoTableName)).
+			WithArgs("user1", "name1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name", "private", "immutable_tags", "protected_tags"}).
+				AddRow(1, "user1", "name1", false, tc.immutable, tc.protected))
+		expectImage(2, "tag1")
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? AND state = ? ORDER BY created_at DESC LIMIT 1", imgColumns, imgTableName)).
+			WithArgs(1, models.ImageStateReady).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "repo_id", "tag", "state", "size", "digest", "format", "os"}).
+				AddRow(3, 1, "tag3", models.ImageStateReady, len(testContent), digest, "qcow2", []byte("{}")))
+		w := tagImage("latest", "tag1", false)
+		suite.Equalf(tc.code, w.Code, "error: %s", w.Body.String())
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+}
+
+func (suite *imageTestSuite) TestOrgRepoPerm() {
+	user, pass := "user1", "pass1"
+	expectRepo := func() {
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? AND name = ?", repoColumns, repoTableName)).
+			WithArgs("infra", "name1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name", "private"}).AddRow(1, "infra", "name1", true))
+	}
+	expectRole := func(role string) {
+		models.Mock.ExpectQuery("SELECT m.role FROM organization_member m, organization o WHERE o.id=m.org_id AND o.name=? AND m.user_id=?").
+			WithArgs("infra", 1).
+			WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(role))
+	}
+	{
+		// readers can read the private repository of organization
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		expectRepo()
+		expectRole(models.OrgRoleReader)
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? AND tag = ?", imgColumns, imgTableName)).
+			WithArgs(1, "tag1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "repo_id", "tag", "state", "os"}).AddRow(2, 1, "tag1", models.ImageStateReady, []byte("{}")))
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/image/infra/name1/info?tag=tag1", nil)
+		testutils.AddAuth(req, user, pass)
+		suite.r.ServeHTTP(w, req)
+		suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		// developers can't delete images
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		expectRepo()
+		expectRole(models.OrgRoleDeveloper)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("DELETE", "/api/v1/image/infra/name1?tag=tag1", nil)
+		testutils.AddAuth(req, user, pass)
+		suite.r.ServeHTTP(w, req)
+		suite.Equal(http.StatusForbidden, w.Code)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+}
+
+func (suite *imageTestSuite) TestRepoMember() {
+	user, pass := "user1", "pass1"
+	{
+		// collaborators can read the private repository
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? AND name = ?", repoColumns, repoTableName)).
+			WithArgs("user2", "name1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name", "private"}).AddRow(3, "user2", "name1", true))
+		models.Mock.ExpectQuery("SELECT m.role FROM organization_member m, organization o WHERE o.id=m.org_id AND o.name=? AND m.user_id=?").
+			WithArgs("user2", 1).
+			WillReturnRows(sqlmock.NewRows([]string{"role"}))
+		models.Mock.ExpectQuery("SELECT perm FROM repository_member WHERE repo_id = ? AND user_id = ?").
+			WithArgs(3, 1).
+			WillReturnRows(sqlmock.NewRows([]string{"perm"}).AddRow(models.RepoPermRead))
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? AND tag = ?", imgColumns, imgTableName)).
+			WithArgs(3, "tag1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "repo_id", "tag", "state", "os"}).AddRow(2, 3, "tag1", models.ImageStateReady, []byte("{}")))
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/image/user2/name1/info?tag=tag1", nil)
+		testutils.AddAuth(req, user, pass)
+		suite.r.ServeHTTP(w, req)
+		suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		// the owner grants write permission
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? AND name = ?", repoColumns, repoTableName)).
+			WithArgs("user1", "name1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name", "private"}).AddRow(1, "user1", "name1", true))
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ?", ((*models.User)(nil)).ColumnNames(), ((*models.User)(nil)).TableName())).
+			WithArgs("user2").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow(2, "user2"))
+		models.Mock.ExpectBegin()
+		models.Mock.ExpectExec("INSERT INTO repository_member(repo_id, user_id, perm) VALUES(?, ?, ?) ON DUPLICATE KEY UPDATE perm = ?").
+			WithArgs(1, 2, models.RepoPermWrite, models.RepoPermWrite).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		models.Mock.ExpectCommit()
+		bs, _ := json.Marshal(types.RepoMemberRequest{Username: "user2", Perm: models.RepoPermWrite})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/repository/user1/name1/members", bytes.NewReader(bs))
+		testutils.AddAuth(req, user, pass)
+		suite.r.ServeHTTP(w, req)
+		suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+		suite.Contains(w.Body.String(), `"perm":"write"`)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		// invalid permission
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		bs, _ := json.Marshal(types.RepoMemberRequest{Username: "user2", Perm: "delete"})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/repository/user1/name1/members", bytes.NewReader(bs))
+		testutils.AddAuth(req, user, pass)
+		suite.r.ServeHTTP(w, req)
+		suite.Equal(http.StatusBadRequest, w.Code)
+	}
+}
+
+func (suite *imageTestSuite) TestScopedPrivateToken() {
+	expectToken := func(scopes, repos string) {
+		utils.MockRedis.FlushAll()
+		models.Mock.ExpectQuery("SELECT id, name, user_id, token, scopes, repos, expired_at, created_at, last_used FROM private_token WHERE token = ?").
+			WithArgs("token1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name", "user_id", "token", "scopes", "repos", "expired_at"}).
+				AddRow(1, "ci", 1, "token1", scopes, repos, time.Now().Add(time.Hour)))
+		models.Mock.ExpectExec("UPDATE private_token SET last_used = ? WHERE id = ?").
+			WithArgs(sqlmock.AnyArg(), 1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT * FROM %s WHERE id = ?", ((*models.User)(nil)).TableName())).
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow(1, "user1"))
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? AND name = ?", repoColumns, repoTableName)).
+			WithArgs("user1", "name1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name", "private"}).AddRow(1, "user1", "name1", true))
+	}
+	{
+		// read-only token can't delete images
+		expectToken(models.ScopeImageRead, "")
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("DELETE", "/api/v1/image/user1/name1?tag=tag1", nil)
+		req.Header.Set("PRIVATE-TOKEN", "token1")
+		suite.r.ServeHTTP(w, req)
+		suite.Equal(http.StatusForbidden, w.Code)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		// the repository doesn't match the token
+		expectToken(models.ScopeImageRead, "infra/*")
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/image/user1/name1/info?tag=tag1", nil)
+		req.Header.Set("PRIVATE-TOKEN", "token1")
+		suite.r.ServeHTTP(w, req)
+		suite.Equal(http.StatusForbidden, w.Code)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		expectToken(models.ScopeImageRead, "user1/*")
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? AND tag = ?", imgColumns, imgTableName)).
+			WithArgs(1, "tag1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "repo_id", "tag", "state", "os"}).AddRow(2, 1, "tag1", models.ImageStateReady, []byte("{}")))
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/image/user1/name1/info?tag=tag1", nil)
+		req.Header.Set("PRIVATE-TOKEN", "token1")
+		suite.r.ServeHTTP(w, req)
+		suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
 }
 
 func TestImageTestSuite(t *testing.T) {
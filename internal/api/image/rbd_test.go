@@ -0,0 +1,124 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/projecteru2/vmihub/internal/models"
+	"github.com/projecteru2/vmihub/internal/testutils"
+	"github.com/projecteru2/vmihub/internal/utils"
+	"github.com/stretchr/testify/mock"
+)
+
+func (suite *imageTestSuite) TestRBDImage() {
+	user, pass := "user1", "pass1"
+	snapshot := "eru/user1.name1-tag1@v1"
+	expectImage := func() {
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? AND name = ?", repoColumns, repoTableName)).
+			WithArgs("user1", "name1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name", "private"}).AddRow(1, "user1", "name1", true))
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? AND tag = ?", imgColumns, imgTableName)).
+			WithArgs(1, "tag1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "repo_id", "tag", "state", "size", "format", "digest", "snapshot"}).
+				AddRow(2, 1, "tag1", models.ImageStateReady, len(testContent), models.ImageFormatRBD, "abcd", snapshot))
+	}
+	expectRefs := func(refs int) {
+		models.Mock.ExpectQuery("SELECT count(*) FROM image WHERE snapshot = ?").
+			WithArgs(snapshot).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(refs))
+	}
+	rbdCall := func(args ...any) *mock.Call {
+		args = append([]any{mock.Anything, mock.Anything, mock.Anything, "rbd", "--id", "eru"}, args...)
+		return suite.shell.On("ExecInOut", args...)
+	}
+	request := func(method, url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, nil)
+		testutils.AddAuth(req, user, pass)
+		suite.r.ServeHTTP(w, req)
+		return w
+	}
+	{
+		// the snapshot is exported
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		expectImage()
+		suite.shell.On("ExecStream", mock.Anything, "rbd", "--id", "eru", "export", snapshot, "-").
+			Return(io.NopCloser(strings.NewReader(testContent)), nil).Once()
+		w := request("GET", "/api/v1/image/user1/name1/download?tag=tag1")
+		suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+		suite.Equal(testContent, w.Body.String())
+		suite.Equal("none", w.Header().Get("Accept-Ranges"))
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		// the cloned snapshot can't be deleted
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		expectImage()
+		expectRefs(1)
+		rbdCall("children", snapshot).Return([]byte("eru/vm1\n"), nil, nil).Once()
+		w := request("DELETE", "/api/v1/image/user1/name1?tag=tag1")
+		suite.Equal(http.StatusConflict, w.Code)
+		suite.Contains(w.Body.String(), "eru/vm1")
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		// the snapshot and its image are removed with the last image referencing them
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		expectImage()
+		expectRefs(1)
+		rbdCall("children", snapshot).Return(nil, nil, nil).Once()
+		models.Mock.ExpectBegin()
+		models.Mock.ExpectExec("DELETE FROM image WHERE repo_id = ? AND tag = ?").
+			WithArgs(1, "tag1").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		models.Mock.ExpectCommit()
+		expectRefs(0)
+		rbdCall("snap", "unprotect", snapshot).Return(nil, nil, nil).Once()
+		rbdCall("snap", "rm", snapshot).Return(nil, nil, nil).Once()
+		rbdCall("rm", "eru/user1.name1-tag1").Return(nil, nil, nil).Once()
+		w := request("DELETE", "/api/v1/image/user1/name1?tag=tag1")
+		suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+		suite.Nil(models.Mock.ExpectationsWereMet())
+		suite.shell.AssertExpectations(suite.T())
+	}
+	{
+		// the snapshot shared with other tags is kept
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		expectImage()
+		expectRefs(2)
+		models.Mock.ExpectBegin()
+		models.Mock.ExpectExec("DELETE FROM image WHERE repo_id = ? AND tag = ?").
+			WithArgs(1, "tag1").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		models.Mock.ExpectCommit()
+		expectRefs(1)
+		w := request("DELETE", "/api/v1/image/user1/name1?tag=tag1")
+		suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		// rbd fails
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		expectImage()
+		suite.shell.On("ExecStream", mock.Anything, "rbd", "--id", "eru", "export", snapshot, "-").
+			Return(nil, errors.New("exec: rbd: not found")).Once()
+		w := request("GET", "/api/v1/image/user1/name1/download?tag=tag1")
+		suite.Equal(http.StatusInternalServerError, w.Code)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"regexp"
 	"strconv"
@@ -12,12 +13,17 @@ import (
 	"github.com/dustin/go-humanize"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
 	"github.com/projecteru2/core/log"
+	"github.com/projecteru2/vmihub/internal/blob"
 	"github.com/projecteru2/vmihub/internal/common"
 	"github.com/projecteru2/vmihub/internal/models"
+	"github.com/projecteru2/vmihub/internal/rbd"
+	storFact "github.com/projecteru2/vmihub/internal/storage/factory"
 	"github.com/projecteru2/vmihub/internal/utils"
 	"github.com/projecteru2/vmihub/pkg/terrors"
 	"github.com/projecteru2/vmihub/pkg/types"
+	"github.com/samber/lo"
 )
 
 func newUploadID() (string, error) {
@@ -28,31 +34,6 @@ func newUploadID() (string, error) {
 	return hex.EncodeToString(raw[:]), nil
 }
 
-func checkRepoReadPerm(c *gin.Context, repo *models.Repository) bool {
-	if !repo.Private {
-		return true
-	}
-	curUser, exists := common.LoginUser(c)
-	if !exists {
-		return false
-	}
-	if curUser.Admin {
-		return true
-	}
-	return strings.EqualFold(curUser.Username, repo.Username)
-}
-
-func checkRepoWritePerm(c *gin.Context, repo *models.Repository) bool {
-	curUser, exists := common.LoginUser(c)
-	if !exists {
-		return false
-	}
-	if curUser.Admin {
-		return true
-	}
-	return strings.EqualFold(curUser.Username, repo.Username)
-}
-
 func getRepo(c *gin.Context, username, name string, perm string) (repo *models.Repository, err error) {
 	repo, err = models.QueryRepo(c, username, name)
 	if err != nil {
@@ -72,7 +53,7 @@ func getRepo(c *gin.Context, username, name string, perm string) (repo *models.R
 
 	switch perm {
 	case "read":
-		if !checkRepoReadPerm(c, repo) {
+		if !common.CheckRepoReadPerm(c, repo) {
 			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
 				"error": "you don't have perssion",
 			})
@@ -80,7 +61,15 @@ func getRepo(c *gin.Context, username, name string, perm string) (repo *models.R
 			return
 		}
 	case "write":
-		if !checkRepoWritePerm(c, repo) {
+		if !common.CheckRepoWritePerm(c, repo) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": "you don't have perssion",
+			})
+			err = errors.New("placeholder")
+			return
+		}
+	case "delete":
+		if !common.CheckRepoDeletePerm(c, repo) {
 			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
 				"error": "you don't have perssion",
 			})
@@ -91,6 +80,31 @@ func getRepo(c *gin.Context, username, name string, perm string) (repo *models.R
 	return
 }
 
+// getRepoMember returns the repository in path and the user whose permission is managed,
+// only the users who can delete the repository can manage its collaborators.
+func getRepoMember(c *gin.Context, memberName string) (repo *models.Repository, user *models.User, err error) {
+	username := c.Param("username")
+	name := c.Param("name")
+	if err = validateRepoName(username, name); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid name"})
+		return
+	}
+	if repo, err = getRepo(c, username, name, "delete"); err != nil {
+		return
+	}
+	user, err = models.GetUser(c, memberName)
+	if err != nil {
+		log.WithFunc("getRepoMember").Error(c, err, "failed to query user from db")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	if user == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "user doesn't exist"})
+		err = terrors.ErrPlaceholder
+	}
+	return
+}
+
 func getRepoImage(c *gin.Context, repo *models.Repository, tag string) (img *models.Image, err error) {
 	img, err = repo.GetImage(c, tag)
 	if err != nil {
@@ -180,10 +194,12 @@ func convImageInfoResp(img *models.Image) *types.ImageInfoResp {
 		Username:    img.Repo.Username,
 		Name:        img.Repo.Name,
 		Tag:         img.Tag,
+		State:       img.State,
 		Private:     img.Repo.Private,
 		Format:      img.Format,
 		OS:          *img.OS.Get(),
 		Size:        img.Size,
+		VirtualSize: img.VirtualSize,
 		Digest:      img.Digest,
 		Snapshot:    img.Snapshot,
 		Description: img.Description,
@@ -214,3 +230,350 @@ func convImageListResp(repos []models.Repository, imgs []models.Image) ([]*types
 	}
 	return resps, nil
 }
+
+// checkImageReady aborts the request if the file of img can't be used
+func checkImageReady(c *gin.Context, img *models.Image) error {
+	if !img.Ready() {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error": fmt.Sprintf("image %s is %s", img.Fullname(), img.State),
+		})
+		return terrors.ErrPlaceholder
+	}
+	return nil
+}
+
+// checkImagesDeletable aborts the request if one of images is protected, administrators can delete any image
+func checkImagesDeletable(c *gin.Context, repo *models.Repository, images ...models.Image) error {
+	if curUser, ok := common.LoginUser(c); ok && curUser.Admin {
+		return nil
+	}
+	for idx := range images {
+		if err := repo.CheckDelete(&images[idx]); err != nil {
+			common.AbortWithTagProtectionError(c, err)
+			return terrors.ErrPlaceholder
+		}
+	}
+	return nil
+}
+
+// checkSnapshotsUnused aborts the request if the rbd snapshot of one of images is cloned,
+// the snapshots still referenced by other images are skipped since they are kept.
+func checkSnapshotsUnused(c *gin.Context, images ...models.Image) error {
+	logger := log.WithFunc("checkSnapshotsUnused")
+	refs := map[string]int{}
+	for idx := range images {
+		if img := &images[idx]; img.Format == models.ImageFormatRBD && img.Snapshot != "" {
+			refs[img.Snapshot]++
+		}
+	}
+	for snapshot, n := range refs {
+		count, err := models.CountImagesBySnapshot(c, snapshot)
+		if err != nil {
+			logger.Errorf(c, err, "failed to count references of snapshot %s", snapshot)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+			return err
+		}
+		if count > n {
+			continue
+		}
+		children, err := rbd.Children(c, snapshot)
+		if err != nil {
+			logger.Error(c, err, "failed to list children of snapshot")
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+			return err
+		}
+		if len(children) > 0 {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+				"error": fmt.Sprintf("snapshot %s is cloned by %s", snapshot, strings.Join(children, ", ")),
+			})
+			return terrors.ErrPlaceholder
+		}
+	}
+	return nil
+}
+
+// relaxTagProtection returns true if newRepo protects less tags than repo
+func relaxTagProtection(repo, newRepo *models.Repository) bool {
+	if repo.ImmutableTags && !newRepo.ImmutableTags {
+		return true
+	}
+	_, removed := lo.Difference(newRepo.ProtectedTagPatterns(), repo.ProtectedTagPatterns())
+	return len(removed) > 0
+}
+
+// reserveImage saves a new image in creating state before its file is uploaded,
+// so the uploads are visible to users even if they fail.
+// The existing images are kept as they are until the new file is verified, except the failed ones.
+func reserveImage(c *gin.Context, img *models.Image) (err error) {
+	logger := log.WithFunc("reserveImage")
+	repo := img.Repo
+	switch {
+	case img.ID > 0:
+		if img.State == models.ImageStateFailed {
+			err = repo.SetImageState(nil, img, models.ImageStateCreating)
+		}
+	case img.Tag == utils.FakeTag:
+		// the tag is generated from the digest of the imported file, so the image can't be reserved
+		return nil
+	default:
+		img.State = models.ImageStateCreating
+		var tx *sqlx.Tx
+		if tx, err = models.Instance().Beginx(); err != nil {
+			break
+		}
+		if repo.ID == 0 {
+			if err = repo.Save(tx); err != nil {
+				break
+			}
+		}
+		if err = repo.SaveImage(tx, img); err != nil {
+			break
+		}
+		err = tx.Commit()
+	}
+	if errors.Is(err, terrors.ErrInvalidImageState) {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "the image is changed by others, please try again"})
+		return terrors.ErrPlaceholder
+	}
+	if err != nil {
+		logger.Errorf(c, err, "failed to reserve image %s", img.Fullname())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return err
+	}
+	return nil
+}
+
+// checkQuota aborts with 403 if the namespace has no room for an image of size,
+// img is the image to be replaced or reserved, it is nil if the image is new.
+func checkQuota(c *gin.Context, namespace string, img *models.Image, size int64) error {
+	var imgID int64
+	if img != nil {
+		imgID = img.ID
+	}
+	err := models.CheckQuota(c, namespace, imgID, size)
+	if errors.Is(err, terrors.ErrQuotaExceeded) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return terrors.ErrPlaceholder
+	}
+	if err != nil {
+		log.WithFunc("checkQuota").Errorf(c, err, "failed to check quota of %s", namespace)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return err
+	}
+	return nil
+}
+
+// failImage marks the image reserved by an upload as failed, it just logs the error
+func failImage(c *gin.Context, img *models.Image) {
+	if img.State != models.ImageStateCreating {
+		return
+	}
+	if err := img.Repo.SetImageState(nil, img, models.ImageStateFailed); err != nil {
+		log.WithFunc("failImage").Errorf(c, err, "failed to mark image %s as failed", img.Fullname())
+	}
+}
+
+// linkImageBlob runs commit, which saves img, with the blob of img locked, see blob.Link.
+// commit aborts the request itself when it fails.
+func linkImageBlob(c *gin.Context, img *models.Image, commit func() error) error {
+	err := blob.Link(c, storFact.Instance(), img, commit)
+	if err == nil || c.IsAborted() {
+		return err
+	}
+	if errors.Is(err, terrors.ErrBlobNotFound) {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "the file of image is removed by others, please try again"})
+		return err
+	}
+	log.WithFunc("linkImageBlob").Errorf(c, err, "failed to link blob of image %s", img.Fullname())
+	c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+	return err
+}
+
+// imageObjectName returns the storage object of image
+func imageObjectName(c *gin.Context, img *models.Image) (string, error) {
+	return blob.ObjectName(c, storFact.Instance(), img)
+}
+
+// downloadSnapshot writes the content of the rbd snapshot of img in raw format,
+// ranges are not supported since it is exported as a stream.
+func downloadSnapshot(c *gin.Context, img *models.Image) {
+	logger := log.WithFunc("downloadSnapshot")
+	if img.Snapshot == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "image created from system disk doesn't support download"})
+		return
+	}
+	rc, err := rbd.Export(c, img.Snapshot)
+	if err != nil {
+		logger.Error(c, err, "failed to export snapshot")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	defer func() {
+		if err := rc.Close(); err != nil {
+			logger.Errorf(c, err, "failed to export snapshot %s", img.Snapshot)
+		}
+	}()
+
+	c.Header("Accept-Ranges", "none")
+	c.Header("ETag", imageETag(img))
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("Content-Disposition", "attachment; filename="+img.Fullname())
+	// the size of images created from system disk may be unknown
+	if img.Size > 0 {
+		c.Header("Content-Length", fmt.Sprintf("%d", img.Size))
+	}
+	c.Status(http.StatusOK)
+	if _, err := io.Copy(c.Writer, rc); err != nil {
+		// the headers are already sent, so just log the error
+		logger.Errorf(c, err, "failed to write snapshot %s", img.Snapshot)
+	}
+}
+
+// releaseImageFile removes the file of a deleted or overwritten image from storage,
+// the blob is kept if other images still reference it.
+func releaseImageFile(c *gin.Context, img *models.Image) {
+	// Try best bahavior, so just log error
+	if err := blob.ReleaseImage(c, storFact.Instance(), img); err != nil {
+		log.WithFunc("releaseImageFile").Errorf(c, err, "failed to release file of image %s", img.Fullname())
+	}
+}
+
+// getOverwrittenImage returns the stored version of img when a force upload
+// overwrites an existing image, otherwise it returns nil.
+func getOverwrittenImage(c *gin.Context, img *models.Image) (*models.Image, error) {
+	if img.ID <= 0 {
+		return nil, nil //nolint:nilnil
+	}
+	oldImg, err := models.GetImageByID(c, img.ID)
+	if err != nil {
+		log.WithFunc("getOverwrittenImage").Errorf(c, err, "failed to get image %d from db", img.ID)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return nil, err
+	}
+	return oldImg, nil
+}
+
+// imageETag returns the entity tag of the image file
+func imageETag(img *models.Image) string {
+	return fmt.Sprintf("%q", img.Digest)
+}
+
+// parseRange parses the Range header against a file of size bytes, the returned end is inclusive.
+// partial is false when the whole file should be sent, multiple ranges are not supported
+// and are ignored like an absent Range header.
+func parseRange(s string, size int64) (start, end int64, partial bool, err error) {
+	spec, found := strings.CutPrefix(s, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false, nil
+	}
+	startStr, endStr, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false, fmt.Errorf("invalid range %s", s)
+	}
+	if startStr == "" {
+		// suffix range: the last n bytes
+		n, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, false, fmt.Errorf("invalid range %s", s)
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, true, nil
+	}
+	start, err = strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false, fmt.Errorf("invalid range %s", s)
+	}
+	end = size - 1
+	if endStr != "" {
+		end, err = strconv.ParseInt(endStr, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false, fmt.Errorf("invalid range %s", s)
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end, true, nil
+}
+
+// setLatestTag pins the latest tag of repository to the ready image of source tag
+func setLatestTag(c *gin.Context, username, name, source string) {
+	repo, err := getRepo(c, username, name, "write")
+	if err != nil {
+		return
+	}
+	img, err := getRepoImage(c, repo, source)
+	if err != nil {
+		return
+	}
+	if err = checkImageReady(c, img); err != nil {
+		return
+	}
+	// administrators can repoint latest of any repository
+	curUser, _ := common.LoginUser(c)
+	if !curUser.Admin && (repo.ImmutableTags || repo.TagProtected("latest")) {
+		cur, err := repo.GetImage(c, "latest")
+		if err != nil {
+			log.WithFunc("setLatestTag").Errorf(c, err, "failed to get latest image of %s", repo.Fullname())
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+			return
+		}
+		if cur != nil && cur.ID != img.ID {
+			if err := repo.CheckSetLatest(cur); err != nil {
+				common.AbortWithTagProtectionError(c, err)
+				return
+			}
+		}
+	}
+	if err = repo.SetLatestTag(nil, img.Tag); err != nil {
+		log.WithFunc("setLatestTag").Errorf(c, err, "failed to set latest tag of %s", repo.Fullname())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": convImageInfoResp(img),
+	})
+}
+
+// ensureImageBlob moves the file of an image which isn't migrated yet to the blob store,
+// so it can be referenced by other tags.
+func ensureImageBlob(c *gin.Context, img *models.Image) error {
+	// rbd images are not stored in storage
+	if img.Format == models.ImageFormatRBD {
+		return nil
+	}
+	objName, err := imageObjectName(c, img)
+	if err == nil && objName != img.BlobName() {
+		err = storFact.Instance().Move(c, objName, img.BlobName())
+	}
+	if err != nil {
+		log.WithFunc("ensureImageBlob").Errorf(c, err, "failed to move file of image %s to blob store", img.Fullname())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return err
+	}
+	return nil
+}
+
+// saveTaggedImage replaces the overwritten image dest with img in a transaction, dest can be nil
+func saveTaggedImage(repo *models.Repository, dest, img *models.Image) error {
+	tx, err := models.Instance().Beginx()
+	if err != nil {
+		return err
+	}
+	if dest != nil {
+		if err = repo.DeleteImage(tx, dest.Tag); err != nil {
+			return err
+		}
+	}
+	if err = repo.SaveImage(tx, img); err != nil {
+		return err
+	}
+	if manifest := img.OCIManifest.Get(); manifest != nil && manifest.Manifest != "" {
+		if err = repo.SaveOCIManifest(tx, img); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
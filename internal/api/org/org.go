@@ -0,0 +1,361 @@
+package org
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/projecteru2/core/log"
+	"github.com/projecteru2/vmihub/internal/common"
+	"github.com/projecteru2/vmihub/internal/middlewares"
+	"github.com/projecteru2/vmihub/internal/models"
+	"github.com/projecteru2/vmihub/pkg/terrors"
+	"github.com/projecteru2/vmihub/pkg/types"
+	"github.com/samber/lo"
+)
+
+func SetupRouter(r *gin.RouterGroup) {
+	// organizations are managed with the account
+	orgGroup := r.Group("/orgs", middlewares.RequireScope(models.ScopeUserAdmin))
+
+	// Create organization
+	orgGroup.POST("", CreateOrg)
+	// List the organizations of current user
+	orgGroup.GET("", ListOrgs)
+	// Get organization
+	orgGroup.GET("/:org", GetOrg)
+	// Delete organization
+	orgGroup.DELETE("/:org", DeleteOrg)
+	// List members
+	orgGroup.GET("/:org/members", ListMembers)
+	// Add member or change the role of member
+	orgGroup.PUT("/:org/members/:username", SetMember)
+	// Remove member
+	orgGroup.DELETE("/:org/members/:username", RemoveMember)
+}
+
+// CreateOrg create organization
+//
+// @Summary create organization
+// @Description CreateOrg creates an organization whose name can be used as the username of repositories,
+// @Description the creator becomes its owner
+// @Tags 组织管理
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "token"
+// @Param body body types.OrgCreateRequest true "组织"
+// @Success 200 {object} models.Organization
+// @Failure 409
+// @Router /orgs [post]
+func CreateOrg(c *gin.Context) {
+	logger := log.WithFunc("CreateOrg")
+	curUser, ok := common.LoginUser(c)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "please login"})
+		return
+	}
+	var req types.OrgCreateRequest
+	if err := c.ShouldBindWith(&req, binding.JSON); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	common.Audit(c, models.AuditOrgCreate, req.Name)
+	// organizations share the namespace of repositories with users
+	if err := common.CheckNameAvailable(c, req.Name); err != nil {
+		return
+	}
+	org := &models.Organization{
+		Name:        req.Name,
+		Description: req.Description,
+	}
+	if err := models.CreateOrg(nil, org, curUser); err != nil {
+		logger.Errorf(c, err, "failed to create organization %s", req.Name)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": org,
+	})
+}
+
+// ListOrgs list organizations
+//
+// @Summary list organizations
+// @Description ListOrgs lists the organizations which current user is a member of
+// @Tags 组织管理
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "token"
+// @Success 200 {object} []models.Organization
+// @Router /orgs [get]
+func ListOrgs(c *gin.Context) {
+	curUser, ok := common.LoginUser(c)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "please login"})
+		return
+	}
+	orgs, err := models.QueryOrgsByUser(c, curUser.ID)
+	if err != nil {
+		log.WithFunc("ListOrgs").Error(c, err, "failed to query organizations from db")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": orgs,
+	})
+}
+
+// GetOrg get organization
+//
+// @Summary get organization
+// @Description GetOrg get organization, only members can see it
+// @Tags 组织管理
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "token"
+// @Param org path string true "组织名"
+// @Success 200 {object} models.Organization
+// @Router /orgs/{org} [get]
+func GetOrg(c *gin.Context) {
+	org, err := getOrg(c, models.OrgRoleReader)
+	if err != nil {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": org,
+	})
+}
+
+// DeleteOrg delete organization
+//
+// @Summary delete organization
+// @Description DeleteOrg deletes organization and its members, the repositories of organization must be deleted first
+// @Tags 组织管理
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "token"
+// @Param org path string true "组织名"
+// @Success 200
+// @Failure 409
+// @Router /orgs/{org} [delete]
+func DeleteOrg(c *gin.Context) {
+	logger := log.WithFunc("DeleteOrg")
+	common.Audit(c, models.AuditOrgDelete, c.Param("org"))
+	org, err := getOrg(c, models.OrgRoleOwner)
+	if err != nil {
+		return
+	}
+	count, err := models.CountReposByUsername(c, org.Name)
+	if err != nil {
+		logger.Error(c, err, "failed to count repositories")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	if count > 0 {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("organization %s still has %d repositories", org.Name, count)})
+		return
+	}
+	if err = org.Delete(nil); err != nil {
+		logger.Errorf(c, err, "failed to delete organization %s", org.Name)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "delete organization successfully",
+	})
+}
+
+// ListMembers list members of organization
+//
+// @Summary list members
+// @Description ListMembers lists the members of organization and their roles
+// @Tags 组织管理
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "token"
+// @Param org path string true "组织名"
+// @Success 200 {object} []models.OrgMember
+// @Router /orgs/{org}/members [get]
+func ListMembers(c *gin.Context) {
+	org, err := getOrg(c, models.OrgRoleReader)
+	if err != nil {
+		return
+	}
+	members, err := org.GetMembers(c)
+	if err != nil {
+		log.WithFunc("ListMembers").Errorf(c, err, "failed to get members of organization %s", org.Name)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": members,
+	})
+}
+
+// SetMember add member or change role of member
+//
+// @Summary set member
+// @Description SetMember adds user to organization or changes the role of member, only owners can manage members
+// @Tags 组织管理
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "token"
+// @Param org path string true "组织名"
+// @Param username path string true "用户名"
+// @Param body body types.OrgMemberRequest true "角色"
+// @Success 200
+// @Router /orgs/{org}/members/{username} [put]
+func SetMember(c *gin.Context) {
+	logger := log.WithFunc("SetMember")
+	audit := common.Audit(c, models.AuditOrgMemberSet, c.Param("org"))
+	var req types.OrgMemberRequest
+	if err := c.ShouldBindWith(&req, binding.JSON); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Detail = fmt.Sprintf("%s %s", c.Param("username"), req.Role)
+	if !models.ValidOrgRole(req.Role) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid role %s", req.Role)})
+		return
+	}
+	org, err := getOrg(c, models.OrgRoleOwner)
+	if err != nil {
+		return
+	}
+	user, err := getMemberUser(c)
+	if err != nil {
+		return
+	}
+	if req.Role != models.OrgRoleOwner {
+		if err = checkLastOwner(c, org, user); err != nil {
+			return
+		}
+	}
+	if err = org.SetMember(nil, user.ID, req.Role); err != nil {
+		logger.Errorf(c, err, "failed to set member %s of organization %s", user.Username, org.Name)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": models.OrgMember{
+			OrgID:    org.ID,
+			UserID:   user.ID,
+			Username: user.Username,
+			Role:     req.Role,
+		},
+	})
+}
+
+// RemoveMember remove member from organization
+//
+// @Summary remove member
+// @Description RemoveMember removes user from organization, owners can remove anyone and members can leave by themselves
+// @Tags 组织管理
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "token"
+// @Param org path string true "组织名"
+// @Param username path string true "用户名"
+// @Success 200
+// @Router /orgs/{org}/members/{username} [delete]
+func RemoveMember(c *gin.Context) {
+	common.Audit(c, models.AuditOrgMemberRemove, c.Param("org")).Detail = c.Param("username")
+	minRole := models.OrgRoleOwner
+	if curUser, ok := common.LoginUser(c); ok && curUser.Username == c.Param("username") {
+		minRole = models.OrgRoleReader
+	}
+	org, err := getOrg(c, minRole)
+	if err != nil {
+		return
+	}
+	user, err := getMemberUser(c)
+	if err != nil {
+		return
+	}
+	if err = checkLastOwner(c, org, user); err != nil {
+		return
+	}
+	if err = org.RemoveMember(nil, user.ID); err != nil {
+		log.WithFunc("RemoveMember").Errorf(c, err, "failed to remove member %s of organization %s", user.Username, org.Name)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "remove member successfully",
+	})
+}
+
+// getOrg returns the organization of path if the login user has minRole in it, administrators can access all organizations
+func getOrg(c *gin.Context, minRole string) (*models.Organization, error) {
+	logger := log.WithFunc("getOrg")
+	curUser, ok := common.LoginUser(c)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "please login"})
+		return nil, terrors.ErrPlaceholder
+	}
+	name := c.Param("org")
+	org, err := models.QueryOrg(c, name)
+	if err != nil {
+		logger.Error(c, err, "failed to query organization from db")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return nil, err
+	}
+	if org == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "organization doesn't exist"})
+		return nil, terrors.ErrPlaceholder
+	}
+	if curUser.Admin {
+		return org, nil
+	}
+	role, err := models.GetOrgRole(c, name, curUser.ID)
+	if err != nil {
+		logger.Error(c, err, "failed to query role from db")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return nil, err
+	}
+	// don't reveal the organizations to others
+	if role == "" {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "organization doesn't exist"})
+		return nil, terrors.ErrPlaceholder
+	}
+	if !models.OrgRoleAtLeast(role, minRole) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "you don't have permission"})
+		return nil, terrors.ErrPlaceholder
+	}
+	return org, nil
+}
+
+// getMemberUser returns the user of path
+func getMemberUser(c *gin.Context) (*models.User, error) {
+	user, err := models.GetUser(c, c.Param("username"))
+	if err != nil {
+		log.WithFunc("getMemberUser").Error(c, err, "failed to query user from db")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return nil, err
+	}
+	if user == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "user doesn't exist"})
+		return nil, terrors.ErrPlaceholder
+	}
+	return user, nil
+}
+
+// checkLastOwner aborts the request if user is the last owner of organization,
+// who can't be removed or demoted.
+func checkLastOwner(c *gin.Context, org *models.Organization, user *models.User) error {
+	members, err := org.GetMembers(c)
+	if err != nil {
+		log.WithFunc("checkLastOwner").Errorf(c, err, "failed to get members of organization %s", org.Name)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return err
+	}
+	owners := lo.Filter(members, func(m models.OrgMember, _ int) bool {
+		return m.Role == models.OrgRoleOwner
+	})
+	if len(owners) == 1 && owners[0].UserID == user.ID {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "the last owner of organization can't be removed"})
+		return terrors.ErrPlaceholder
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package org
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/projecteru2/vmihub/internal/middlewares"
+	"github.com/projecteru2/vmihub/internal/models"
+	"github.com/projecteru2/vmihub/internal/testutils"
+	"github.com/projecteru2/vmihub/internal/utils"
+	"github.com/projecteru2/vmihub/pkg/types"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+var (
+	orgTableName  = ((*models.Organization)(nil)).TableName()
+	orgColumns    = ((*models.Organization)(nil)).ColumnNames()
+	userTableName = ((*models.User)(nil)).TableName()
+	userColumns   = ((*models.User)(nil)).ColumnNames()
+)
+
+type orgTestSuite struct {
+	suite.Suite
+	r *gin.Engine
+}
+
+func (suite *orgTestSuite) SetupTest() {
+	t := suite.T()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	err := testutils.Prepare(ctx, t)
+	require.NoError(t, err)
+
+	r, err := testutils.PrepareGinEngine()
+	require.NoError(t, err)
+	apiGroup := r.Group("/api/v1", middlewares.Authenticate())
+
+	SetupRouter(apiGroup)
+	suite.r = r
+}
+
+func (suite *orgTestSuite) expectOrg(name string) {
+	models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE name = ?", orgColumns, orgTableName)).
+		WithArgs(name).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(10, name))
+}
+
+func (suite *orgTestSuite) expectRole(name string, userID int64, role string) {
+	rows := sqlmock.NewRows([]string{"role"})
+	if role != "" {
+		rows.AddRow(role)
+	}
+	models.Mock.ExpectQuery("SELECT m.role FROM organization_member m, organization o WHERE o.id=m.org_id AND o.name=? AND m.user_id=?").
+		WithArgs(name, userID).
+		WillReturnRows(rows)
+}
+
+func (suite *orgTestSuite) expectMembers(owners ...int64) {
+	rows := sqlmock.NewRows([]string{"org_id", "user_id", "username", "role"})
+	for _, id := range owners {
+		rows.AddRow(10, id, fmt.Sprintf("user%d", id), models.OrgRoleOwner)
+	}
+	models.Mock.ExpectQuery("SELECT m.org_id, m.user_id, u.username, m.role, m.created_at FROM organization_member m, user u WHERE u.id=m.user_id AND m.org_id=? ORDER BY u.username").
+		WithArgs(10).
+		WillReturnRows(rows)
+}
+
+func (suite *orgTestSuite) expectUser(username string, id int64) {
+	models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ?", userColumns, userTableName)).
+		WithArgs(username).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow(id, username))
+}
+
+func (suite *orgTestSuite) request(method, url string, body any) *httptest.ResponseRecorder {
+	var bs []byte
+	if body != nil {
+		bs, _ = json.Marshal(body)
+	}
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, url, bytes.NewReader(bs))
+	testutils.AddAuth(req, "user1", "pass1")
+	suite.r.ServeHTTP(w, req)
+	return w
+}
+
+func (suite *orgTestSuite) TestCreateOrg() {
+	{
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData("user1", "pass1")
+		suite.Nil(err)
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ?", userColumns, userTableName)).
+			WithArgs("infra").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username"}))
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE name = ?", orgColumns, orgTableName)).
+			WithArgs("infra").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name"}))
+		models.Mock.ExpectBegin()
+		models.Mock.ExpectExec("INSERT INTO organization(name, description) VALUES(?, ?)").
+			WithArgs("infra", "platform team").
+			WillReturnResult(sqlmock.NewResult(10, 1))
+		models.Mock.ExpectExec("INSERT INTO organization_member(org_id, user_id, role) VALUES(?, ?, ?)").
+			WithArgs(10, 1, models.OrgRoleOwner).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		models.Mock.ExpectCommit()
+		w := suite.request("POST", "/api/v1/orgs", types.OrgCreateRequest{Name: "infra", Description: "platform team"})
+		suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+		suite.Contains(w.Body.String(), `"name":"infra"`)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		// the name is used by a user
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData("user1", "pass1")
+		suite.Nil(err)
+		suite.expectUser("user2", 2)
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE name = ?", orgColumns, orgTableName)).
+			WithArgs("user2").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name"}))
+		w := suite.request("POST", "/api/v1/orgs", types.OrgCreateRequest{Name: "user2"})
+		suite.Equal(http.StatusConflict, w.Code)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+}
+
+func (suite *orgTestSuite) TestSetMember() {
+	{
+		// owner adds a developer
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData("user1", "pass1")
+		suite.Nil(err)
+		suite.expectOrg("infra")
+		suite.expectRole("infra", 1, models.OrgRoleOwner)
+		suite.expectUser("user2", 2)
+		suite.expectMembers(1)
+		models.Mock.ExpectBegin()
+		models.Mock.ExpectExec("INSERT INTO organization_member(org_id, user_id, role) VALUES(?, ?, ?) ON DUPLICATE KEY UPDATE role = ?").
+			WithArgs(10, 2, models.OrgRoleDeveloper, models.OrgRoleDeveloper).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		models.Mock.ExpectCommit()
+		w := suite.request("PUT", "/api/v1/orgs/infra/members/user2", types.OrgMemberRequest{Role: models.OrgRoleDeveloper})
+		suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		// only owners can manage members
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData("user1", "pass1")
+		suite.Nil(err)
+		suite.expectOrg("infra")
+		suite.expectRole("infra", 1, models.OrgRoleMaintainer)
+		w := suite.request("PUT", "/api/v1/orgs/infra/members/user2", types.OrgMemberRequest{Role: models.OrgRoleDeveloper})
+		suite.Equal(http.StatusForbidden, w.Code)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		// the organization is invisible to others
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData("user1", "pass1")
+		suite.Nil(err)
+		suite.expectOrg("infra")
+		suite.expectRole("infra", 1, "")
+		w := suite.request("GET", "/api/v1/orgs/infra", nil)
+		suite.Equal(http.StatusNotFound, w.Code)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		// invalid role
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData("user1", "pass1")
+		suite.Nil(err)
+		w := suite.request("PUT", "/api/v1/orgs/infra/members/user2", types.OrgMemberRequest{Role: "guest"})
+		suite.Equal(http.StatusBadRequest, w.Code)
+	}
+}
+
+func (suite *orgTestSuite) TestRemoveMember() {
+	{
+		// the last owner can't leave
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData("user1", "pass1")
+		suite.Nil(err)
+		suite.expectOrg("infra")
+		suite.expectRole("infra", 1, models.OrgRoleOwner)
+		// user1 is cached by authentication
+		suite.expectMembers(1)
+		w := suite.request("DELETE", "/api/v1/orgs/infra/members/user1", nil)
+		suite.Equal(http.StatusConflict, w.Code)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		// members can leave by themselves
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData("user1", "pass1")
+		suite.Nil(err)
+		suite.expectOrg("infra")
+		suite.expectRole("infra", 1, models.OrgRoleReader)
+		// user1 is cached by authentication
+		suite.expectMembers(2)
+		models.Mock.ExpectBegin()
+		models.Mock.ExpectExec("DELETE FROM organization_member WHERE org_id = ? AND user_id = ?").
+			WithArgs(10, 1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		models.Mock.ExpectCommit()
+		w := suite.request("DELETE", "/api/v1/orgs/infra/members/user1", nil)
+		suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+}
+
+func TestOrgTestSuite(t *testing.T) {
+	suite.Run(t, new(orgTestSuite))
+}
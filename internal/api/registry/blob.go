@@ -0,0 +1,155 @@
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/opencontainers/go-digest"
+	"github.com/projecteru2/vmihub/internal/blob"
+	"github.com/projecteru2/vmihub/internal/common"
+	"github.com/projecteru2/vmihub/internal/models"
+	storFact "github.com/projecteru2/vmihub/internal/storage/factory"
+	"github.com/projecteru2/vmihub/internal/utils"
+)
+
+const blobContentType = "application/octet-stream"
+
+func parseDigest(c *gin.Context, s string) (digest.Digest, bool) {
+	dgst, err := digest.Parse(s)
+	if err != nil || dgst.Algorithm() != digest.SHA256 {
+		abortWithError(c, http.StatusBadRequest, errCodeDigestInvalid, "only sha256 digest is supported")
+		return "", false
+	}
+	return dgst, true
+}
+
+// getBlob serves the image files and config blobs of a repository.
+// Other blobs are only visible to the users who can push to the repository
+// and can access the blobs, so they can skip pushing the existing blobs.
+func getBlob(c *gin.Context, rt *route) {
+	dgst, ok := parseDigest(c, rt.ref)
+	if !ok {
+		return
+	}
+	repo, err := models.QueryRepo(c, rt.username, rt.name)
+	if err != nil {
+		abortWithInternalError(c, err, "failed to get repo from db")
+		return
+	}
+	if repo != nil {
+		if !common.CheckRepoReadPerm(c, repo) {
+			abortWithPermError(c)
+			return
+		}
+		arts, err := listArtifacts(repo)
+		if err != nil {
+			abortWithInternalError(c, err, "failed to get images from db")
+			return
+		}
+		for _, art := range arts {
+			if art.img.Digest == dgst.Encoded() {
+				name, err := blob.ObjectName(c, storFact.Instance(), art.img)
+				if err != nil {
+					abortWithInternalError(c, err, "failed to get object of image")
+					return
+				}
+				serveObject(c, dgst, name, art.img.Size)
+				return
+			}
+			if art.configDigest == dgst {
+				serveBytes(c, dgst, art.config)
+				return
+			}
+		}
+	}
+	if canWrite(c, rt) {
+		exists, err := blobAccessible(c, dgst)
+		if err != nil {
+			abortWithInternalError(c, err, "failed to check blob")
+			return
+		}
+		if exists {
+			name := models.BlobName(dgst.Encoded())
+			size, err := storFact.Instance().GetSize(c, name)
+			if err != nil {
+				abortWithInternalError(c, err, "failed to get size of blob")
+				return
+			}
+			serveObject(c, dgst, name, size)
+			return
+		}
+	}
+	abortWithError(c, http.StatusNotFound, errCodeBlobUnknown, "blob unknown to registry")
+}
+
+// canAccessBlob returns true if the login user uploaded the blob recently or can read
+// a repository whose images use it, so a private blob can't be reached by its digest only.
+func canAccessBlob(c *gin.Context, dgst digest.Digest) (bool, error) {
+	if curUser, ok := common.LoginUser(c); ok {
+		n, err := utils.GetRedisConn().Exists(c, fmt.Sprintf(redisBlobGrantKey, curUser.Username, dgst.Encoded())).Result()
+		if err != nil {
+			return false, err
+		}
+		if n > 0 {
+			return true, nil
+		}
+	}
+	repos, err := models.QueryReposByDigest(c, dgst.Encoded())
+	if err != nil {
+		return false, err
+	}
+	for idx := range repos {
+		if common.CheckRepoReadPerm(c, &repos[idx]) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// blobAccessible returns true if the blob exists and the login user can access it
+func blobAccessible(c *gin.Context, dgst digest.Digest) (bool, error) {
+	ok, err := canAccessBlob(c, dgst)
+	if err != nil || !ok {
+		return false, err
+	}
+	return storFact.Instance().Exists(c, models.BlobName(dgst.Encoded()))
+}
+
+// grantBlob allows the login user to use the blob uploaded by the user for a while
+func grantBlob(c *gin.Context, dgst digest.Digest) error {
+	curUser, ok := common.LoginUser(c)
+	if !ok {
+		return nil
+	}
+	return utils.GetRedisConn().Set(c, fmt.Sprintf(redisBlobGrantKey, curUser.Username, dgst.Encoded()), 1, uploadRedisExpire).Err()
+}
+
+func serveObject(c *gin.Context, dgst digest.Digest, name string, size int64) {
+	c.Header(contentDigestHeader, dgst.String())
+	if c.Request.Method == http.MethodHead {
+		c.Header("Content-Type", blobContentType)
+		c.Header("Content-Length", strconv.FormatInt(size, 10))
+		c.Status(http.StatusOK)
+		return
+	}
+	rc, err := storFact.Instance().Get(c, name)
+	if err != nil {
+		abortWithInternalError(c, err, "failed to read blob from storage")
+		return
+	}
+	defer rc.Close()
+	c.DataFromReader(http.StatusOK, size, blobContentType, rc, nil)
+}
+
+func serveBytes(c *gin.Context, dgst digest.Digest, bs []byte) {
+	c.Header(contentDigestHeader, dgst.String())
+	if c.Request.Method == http.MethodHead {
+		c.Header("Content-Type", blobContentType)
+		c.Header("Content-Length", strconv.Itoa(len(bs)))
+		c.Status(http.StatusOK)
+		return
+	}
+	c.Data(http.StatusOK, blobContentType, bs)
+}
@@ -0,0 +1,91 @@
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/projecteru2/vmihub/internal/common"
+	"github.com/projecteru2/vmihub/internal/models"
+)
+
+// paginate returns the names after the `last` query parameter, at most `n` names are returned.
+// The Link header points to the next page if there are more names.
+func paginate(c *gin.Context, names []string) ([]string, bool) {
+	sort.Strings(names)
+	if last := c.Query("last"); last != "" {
+		idx := sort.SearchStrings(names, last)
+		if idx < len(names) && names[idx] == last {
+			idx++
+		}
+		names = names[idx:]
+	}
+	nStr := c.Query("n")
+	if nStr == "" {
+		return names, true
+	}
+	n, err := strconv.Atoi(nStr)
+	if err != nil || n < 0 {
+		abortWithError(c, http.StatusBadRequest, errCodeUnsupported, fmt.Sprintf("invalid n %s", nStr))
+		return nil, false
+	}
+	if n < len(names) {
+		names = names[:n]
+		if n > 0 {
+			q := url.Values{}
+			q.Set("n", nStr)
+			q.Set("last", names[n-1])
+			c.Header("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, c.Request.URL.Path, q.Encode()))
+		}
+	}
+	return names, true
+}
+
+// getCatalog lists the repositories which the login user can read
+func getCatalog(c *gin.Context) {
+	repos, err := models.QueryAllRepos(c)
+	if err != nil {
+		abortWithInternalError(c, err, "failed to get repositories from db")
+		return
+	}
+	names := make([]string, 0, len(repos))
+	for idx := range repos {
+		repo := &repos[idx]
+		if !common.CheckRepoReadPerm(c, repo) {
+			continue
+		}
+		rt := &route{username: repo.Username, name: repo.Name}
+		names = append(names, rt.repoPath())
+	}
+	names, ok := paginate(c, names)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"repositories": names})
+}
+
+func getTags(c *gin.Context, rt *route) {
+	repo, err := getRepo(c, rt)
+	if err != nil {
+		return
+	}
+	images, err := repo.GetImages()
+	if err != nil {
+		abortWithInternalError(c, err, "failed to get images from db")
+		return
+	}
+	tags := make([]string, 0, len(images))
+	for idx := range images {
+		if pullable(&images[idx]) {
+			tags = append(tags, images[idx].Tag)
+		}
+	}
+	tags, ok := paginate(c, tags)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"name": rt.repoPath(), "tags": tags})
+}
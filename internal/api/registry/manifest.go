@@ -0,0 +1,489 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/projecteru2/core/log"
+	"github.com/projecteru2/vmihub/internal/blob"
+	"github.com/projecteru2/vmihub/internal/common"
+	"github.com/projecteru2/vmihub/internal/imageops"
+	"github.com/projecteru2/vmihub/internal/models"
+	storFact "github.com/projecteru2/vmihub/internal/storage/factory"
+	"github.com/projecteru2/vmihub/internal/task"
+	"github.com/projecteru2/vmihub/internal/utils"
+	"github.com/projecteru2/vmihub/pkg/terrors"
+	"github.com/projecteru2/vmihub/pkg/types"
+)
+
+const (
+	maxManifestSize = 4 * utils.MB
+	maxConfigSize   = 4 * utils.MB
+)
+
+var tagRegex = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+
+// artifact is the OCI view of an image
+type artifact struct {
+	img            *models.Image
+	manifest       []byte
+	manifestDigest digest.Digest
+	config         []byte
+	configDigest   digest.Digest
+}
+
+// newArtifact returns the OCI manifest of an image. The manifest pushed through
+// the OCI API is returned as is, otherwise a manifest is built from the image.
+func newArtifact(img *models.Image) (*artifact, error) {
+	if stored := img.OCIManifest.Get(); stored != nil && stored.Manifest != "" {
+		manifest := ocispec.Manifest{}
+		if err := json.Unmarshal([]byte(stored.Manifest), &manifest); err == nil &&
+			len(manifest.Layers) == 1 && manifest.Layers[0].Digest.Encoded() == img.Digest {
+			return &artifact{
+				img:            img,
+				manifest:       []byte(stored.Manifest),
+				manifestDigest: digest.FromString(stored.Manifest),
+				config:         []byte(stored.Config),
+				configDigest:   manifest.Config.Digest,
+			}, nil
+		}
+		// the image is overwritten by the image API, so the stored manifest is stale
+	}
+	imgCfg := &types.OCIImageConfig{
+		Format:      img.Format,
+		VirtualSize: img.VirtualSize,
+	}
+	if osInfo := img.OS.Get(); osInfo != nil {
+		imgCfg.OS = *osInfo
+	}
+	config, err := json.Marshal(imgCfg)
+	if err != nil {
+		return nil, err
+	}
+	configDigest := digest.FromBytes(config)
+	manifest := ocispec.Manifest{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: types.OCIArtifactType,
+		Config: ocispec.Descriptor{
+			MediaType: types.OCIConfigMediaType,
+			Digest:    configDigest,
+			Size:      int64(len(config)),
+		},
+		Layers: []ocispec.Descriptor{
+			{
+				MediaType: types.OCILayerMediaTypePrefix + img.Format,
+				Digest:    digest.NewDigestFromEncoded(digest.SHA256, img.Digest),
+				Size:      img.Size,
+				Annotations: map[string]string{
+					ocispec.AnnotationTitle: fmt.Sprintf("%s.%s", img.Repo.Name, img.Format),
+				},
+			},
+		},
+	}
+	manifest.SchemaVersion = 2
+	bs, err := json.Marshal(&manifest)
+	if err != nil {
+		return nil, err
+	}
+	return &artifact{
+		img:            img,
+		manifest:       bs,
+		manifestDigest: digest.FromBytes(bs),
+		config:         config,
+		configDigest:   configDigest,
+	}, nil
+}
+
+// pullable returns false for the images which don't have a usable file in storage
+func pullable(img *models.Image) bool {
+	return img.Ready() && img.Format != models.ImageFormatRBD && img.Digest != ""
+}
+
+// listArtifacts returns the artifacts of all pullable images in repo
+func listArtifacts(repo *models.Repository) ([]*artifact, error) {
+	images, err := repo.GetImages()
+	if err != nil {
+		return nil, err
+	}
+	ans := make([]*artifact, 0, len(images))
+	for idx := range images {
+		img := &images[idx]
+		if !pullable(img) {
+			continue
+		}
+		art, err := newArtifact(img)
+		if err != nil {
+			return nil, err
+		}
+		ans = append(ans, art)
+	}
+	return ans, nil
+}
+
+// getArtifact returns the artifact referenced by a tag or a manifest digest
+func getArtifact(c *gin.Context, repo *models.Repository, ref string) (*artifact, error) {
+	if dgst, err := digest.Parse(ref); err == nil {
+		arts, err := listArtifacts(repo)
+		if err != nil {
+			abortWithInternalError(c, err, "failed to get images from db")
+			return nil, err
+		}
+		for _, art := range arts {
+			if art.manifestDigest == dgst {
+				return art, nil
+			}
+		}
+		abortWithError(c, http.StatusNotFound, errCodeManifestUnknown, "manifest unknown")
+		return nil, terrors.ErrPlaceholder
+	}
+	img, err := repo.GetImage(c, ref)
+	if err != nil {
+		abortWithInternalError(c, err, "failed to get image from db")
+		return nil, err
+	}
+	if img == nil || !pullable(img) {
+		abortWithError(c, http.StatusNotFound, errCodeManifestUnknown, "manifest unknown")
+		return nil, terrors.ErrPlaceholder
+	}
+	img.Repo = repo
+	art, err := newArtifact(img)
+	if err != nil {
+		abortWithInternalError(c, err, "failed to build manifest")
+		return nil, err
+	}
+	return art, nil
+}
+
+func getManifest(c *gin.Context, rt *route) {
+	repo, err := getRepo(c, rt)
+	if err != nil {
+		return
+	}
+	art, err := getArtifact(c, repo, rt.ref)
+	if err != nil {
+		return
+	}
+	c.Header(contentDigestHeader, art.manifestDigest.String())
+	if c.Request.Method == http.MethodHead {
+		c.Header("Content-Type", ocispec.MediaTypeImageManifest)
+		c.Header("Content-Length", strconv.Itoa(len(art.manifest)))
+		c.Status(http.StatusOK)
+		return
+	}
+	c.Data(http.StatusOK, ocispec.MediaTypeImageManifest, art.manifest)
+}
+
+// putManifest creates or overwrites the image tagged by the manifest,
+// the config and the image file must be pushed as blobs in advance.
+// The image is saved after its file is verified by a task, so it can't be pulled at once.
+func putManifest(c *gin.Context, rt *route) {
+	logger := log.WithFunc("registry.putManifest")
+	audit := common.Audit(c, models.AuditImagePush, rt.repoPath()+":"+rt.ref)
+	if err := checkWritePerm(c, rt); err != nil {
+		return
+	}
+	if !tagRegex.MatchString(rt.ref) {
+		abortWithError(c, http.StatusBadRequest, errCodeManifestInvalid, "manifests can only be pushed by tag")
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxManifestSize+1))
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, errCodeManifestInvalid, "failed to read manifest")
+		return
+	}
+	if len(body) > maxManifestSize {
+		abortWithError(c, http.StatusRequestEntityTooLarge, errCodeSizeInvalid, "manifest is too large")
+		return
+	}
+	manifest := ocispec.Manifest{}
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		abortWithError(c, http.StatusBadRequest, errCodeManifestInvalid, "invalid manifest")
+		return
+	}
+	if manifest.SchemaVersion != 2 || manifest.Config.MediaType != types.OCIConfigMediaType || len(manifest.Layers) != 1 {
+		abortWithError(c, http.StatusBadRequest, errCodeManifestInvalid,
+			fmt.Sprintf("manifest must have a %s config and exactly one layer", types.OCIConfigMediaType))
+		return
+	}
+	layer := manifest.Layers[0]
+	audit.Digest = layer.Digest.Encoded()
+	format := strings.TrimPrefix(layer.MediaType, types.OCILayerMediaTypePrefix)
+	if format == layer.MediaType || (format != models.ImageFormatQcow2 && format != models.ImageFormatRaw) {
+		abortWithError(c, http.StatusBadRequest, errCodeManifestInvalid, fmt.Sprintf("unsupported layer media type %s", layer.MediaType))
+		return
+	}
+	if layer.Digest.Algorithm() != digest.SHA256 || layer.Digest.Validate() != nil {
+		abortWithError(c, http.StatusBadRequest, errCodeDigestInvalid, "only sha256 layer is supported")
+		return
+	}
+	repo, err := models.QueryRepo(c, rt.username, rt.name)
+	if err != nil {
+		abortWithInternalError(c, err, "failed to get repo from db")
+		return
+	}
+	if repo == nil {
+		repo = &models.Repository{Username: rt.username, Name: rt.name}
+	}
+	config, imgCfg, err := readConfigBlob(c, repo, manifest.Config)
+	if err != nil {
+		return
+	}
+	if imgCfg.Format != "" && imgCfg.Format != format {
+		abortWithError(c, http.StatusBadRequest, errCodeManifestInvalid, "format of config doesn't match the layer")
+		return
+	}
+	if err := checkLayerBlob(c, layer); err != nil {
+		return
+	}
+	var img *models.Image
+	if repo.ID > 0 {
+		if img, err = repo.GetImage(c, rt.ref); err != nil {
+			abortWithInternalError(c, err, "failed to get image from db")
+			return
+		}
+	}
+	if img != nil && img.Format == models.ImageFormatRBD {
+		abortWithError(c, http.StatusConflict, errCodeDenied, "can't overwrite rbd image")
+		return
+	}
+	if img != nil && img.State == models.ImageStateCreating {
+		abortWithError(c, http.StatusConflict, errCodeDenied, "the image is being uploaded")
+		return
+	}
+	if img != nil && !isAdmin(c) {
+		if err = repo.CheckOverwrite(img); err != nil {
+			abortWithTagProtectionError(c, err)
+			return
+		}
+	}
+	if img == nil {
+		img = &models.Image{
+			Tag:    rt.ref,
+			Format: format,
+			OS:     models.NewJSONColumn(&imgCfg.OS),
+		}
+	}
+	img.Repo = repo
+	img.Format = format
+	img.Size = layer.Size
+	img.Digest = layer.Digest.Encoded()
+	img.OCIManifest = models.NewJSONColumn(&models.OCIManifest{
+		Manifest: string(body),
+		Config:   string(config),
+	})
+
+	if err := checkQuota(c, img); err != nil {
+		return
+	}
+	// the image is saved by the verify task after the layer is inspected like an uploaded file,
+	// an existing image is kept as it is until then
+	if err := reserveManifestImage(c, img); err != nil {
+		return
+	}
+	curUser, _ := common.LoginUser(c)
+	if _, err := task.Submit(c, imageops.TaskTypeVerify, curUser.Username, &imageops.VerifyPayload{Image: img}); err != nil {
+		if img.State == models.ImageStateCreating {
+			if err := repo.SetImageState(nil, img, models.ImageStateFailed); err != nil {
+				logger.Errorf(c, err, "failed to mark image %s as failed", img.Fullname())
+			}
+		}
+		abortWithInternalError(c, err, "failed to submit verify task")
+		return
+	}
+	dgst := digest.FromBytes(body)
+	c.Header("Location", fmt.Sprintf("/v2/%s/manifests/%s", rt.repoPath(), dgst))
+	c.Header(contentDigestHeader, dgst.String())
+	c.Status(http.StatusCreated)
+}
+
+// checkQuota aborts with DENIED if the namespace has no room for img,
+// the existing image of the tag isn't counted since it is going to be replaced.
+func checkQuota(c *gin.Context, img *models.Image) error {
+	err := models.CheckQuota(c, img.Repo.Username, img.ID, img.Size)
+	if errors.Is(err, terrors.ErrQuotaExceeded) {
+		abortWithError(c, http.StatusForbidden, errCodeDenied, err.Error())
+		return err
+	}
+	if err != nil {
+		abortWithInternalError(c, err, "failed to check quota")
+	}
+	return err
+}
+
+// reserveManifestImage reserves a new or failed image in creating state, so the tag
+// can't be pushed by others before the image is verified.
+func reserveManifestImage(c *gin.Context, img *models.Image) error {
+	repo := img.Repo
+	if img.ID > 0 {
+		if img.State != models.ImageStateFailed {
+			return nil
+		}
+		err := repo.SetImageState(nil, img, models.ImageStateCreating)
+		if errors.Is(err, terrors.ErrInvalidImageState) {
+			abortWithError(c, http.StatusConflict, errCodeDenied, "the image is changed by others, please try again")
+			return err
+		}
+		if err != nil {
+			abortWithInternalError(c, err, "failed to set state of image")
+		}
+		return err
+	}
+	img.State = models.ImageStateCreating
+	tx, err := models.Instance().Beginx()
+	if err != nil {
+		abortWithInternalError(c, err, "failed to get transaction")
+		return err
+	}
+	if repo.ID == 0 {
+		if err = repo.Save(tx); err != nil {
+			abortWithInternalError(c, err, "failed to save repository to db")
+			return err
+		}
+	}
+	if err = repo.SaveImage(tx, img); err != nil {
+		abortWithInternalError(c, err, "failed to save image to db")
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		abortWithInternalError(c, err, "failed to commit transaction")
+		return err
+	}
+	return nil
+}
+
+// readConfigBlob reads and verifies the config blob pushed by client,
+// the config of an image in repo is used as well, since it is served to client as a blob.
+func readConfigBlob(c *gin.Context, repo *models.Repository, desc ocispec.Descriptor) ([]byte, *types.OCIImageConfig, error) {
+	if desc.Size > maxConfigSize || desc.Digest.Validate() != nil {
+		abortWithError(c, http.StatusBadRequest, errCodeManifestInvalid, "invalid config descriptor")
+		return nil, nil, terrors.ErrPlaceholder
+	}
+	config, err := getConfigOfRepo(repo, desc.Digest)
+	if err != nil {
+		abortWithInternalError(c, err, "failed to get images from db")
+		return nil, nil, err
+	}
+	if config == nil {
+		if config, err = readBlob(c, desc.Digest, maxConfigSize); err != nil {
+			return nil, nil, err
+		}
+	}
+	if int64(len(config)) != desc.Size || digest.FromBytes(config) != desc.Digest {
+		abortWithError(c, http.StatusBadRequest, errCodeManifestInvalid, "config doesn't match its descriptor")
+		return nil, nil, terrors.ErrPlaceholder
+	}
+	imgCfg := &types.OCIImageConfig{}
+	if err := json.Unmarshal(config, imgCfg); err != nil {
+		abortWithError(c, http.StatusBadRequest, errCodeManifestInvalid, "invalid config")
+		return nil, nil, terrors.ErrPlaceholder
+	}
+	return config, imgCfg, nil
+}
+
+// getConfigOfRepo returns the config of dgst used by the images in repo, nil is returned if there isn't one
+func getConfigOfRepo(repo *models.Repository, dgst digest.Digest) ([]byte, error) {
+	if repo.ID == 0 {
+		return nil, nil
+	}
+	arts, err := listArtifacts(repo)
+	if err != nil {
+		return nil, err
+	}
+	for _, art := range arts {
+		if art.configDigest == dgst {
+			return art.config, nil
+		}
+	}
+	return nil, nil
+}
+
+// readBlob reads at most limit+1 bytes of a blob which the login user can access
+func readBlob(c *gin.Context, dgst digest.Digest, limit int64) ([]byte, error) {
+	exists, err := blobAccessible(c, dgst)
+	if err != nil {
+		abortWithInternalError(c, err, "failed to check blob")
+		return nil, err
+	}
+	if !exists {
+		abortWithError(c, http.StatusBadRequest, errCodeManifestBlobUnknown, fmt.Sprintf("blob %s unknown", dgst))
+		return nil, terrors.ErrPlaceholder
+	}
+	rc, err := storFact.Instance().Get(c, models.BlobName(dgst.Encoded()))
+	if err != nil {
+		abortWithInternalError(c, err, "failed to read blob")
+		return nil, err
+	}
+	defer rc.Close()
+	bs, err := io.ReadAll(io.LimitReader(rc, limit+1))
+	if err != nil {
+		abortWithInternalError(c, err, "failed to read blob")
+		return nil, err
+	}
+	return bs, nil
+}
+
+// checkLayerBlob checks the layer blob can be linked by the login user
+func checkLayerBlob(c *gin.Context, desc ocispec.Descriptor) error {
+	sto := storFact.Instance()
+	name := models.BlobName(desc.Digest.Encoded())
+	exists, err := blobAccessible(c, desc.Digest)
+	if err != nil {
+		abortWithInternalError(c, err, "failed to check layer blob")
+		return err
+	}
+	if !exists {
+		abortWithError(c, http.StatusBadRequest, errCodeManifestBlobUnknown, fmt.Sprintf("blob %s unknown", desc.Digest))
+		return terrors.ErrPlaceholder
+	}
+	size, err := sto.GetSize(c, name)
+	if err != nil {
+		abortWithInternalError(c, err, "failed to get size of layer blob")
+		return err
+	}
+	if size != desc.Size {
+		abortWithError(c, http.StatusBadRequest, errCodeSizeInvalid, "layer size doesn't match its descriptor")
+		return terrors.ErrPlaceholder
+	}
+	return nil
+}
+
+func deleteManifest(c *gin.Context, rt *route) {
+	audit := common.Audit(c, models.AuditImageDelete, rt.repoPath()+":"+rt.ref)
+	repo, err := getRepo(c, rt)
+	if err != nil {
+		return
+	}
+	if err := checkDeletePerm(c, repo); err != nil {
+		return
+	}
+	art, err := getArtifact(c, repo, rt.ref)
+	if err != nil {
+		return
+	}
+	// the reference may be a digest
+	audit.Target, audit.Digest = art.img.Fullname(), art.img.Digest
+	if !isAdmin(c) {
+		if err := repo.CheckDelete(art.img); err != nil {
+			abortWithTagProtectionError(c, err)
+			return
+		}
+	}
+	if err := repo.DeleteImage(nil, art.img.Tag); err != nil {
+		abortWithInternalError(c, err, "failed to delete image from db")
+		return
+	}
+	// Try best bahavior, so just log error
+	if err := blob.ReleaseImage(c, storFact.Instance(), art.img); err != nil {
+		log.WithFunc("registry.deleteManifest").Errorf(c, err, "failed to release file of image %s", art.img.Fullname())
+	}
+	c.Status(http.StatusAccepted)
+}
@@ -0,0 +1,285 @@
+package registry
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/projecteru2/core/log"
+	"github.com/projecteru2/vmihub/internal/common"
+	"github.com/projecteru2/vmihub/internal/middlewares"
+	"github.com/projecteru2/vmihub/internal/models"
+	"github.com/projecteru2/vmihub/internal/utils"
+	"github.com/projecteru2/vmihub/pkg/terrors"
+)
+
+const (
+	apiVersionHeader    = "Docker-Distribution-API-Version"
+	contentDigestHeader = "Docker-Content-Digest"
+	uploadUUIDHeader    = "Docker-Upload-UUID"
+
+	// namespace of the repositories which don't belong to a user, eg: ubuntu:22.04
+	publicNamespace = "_"
+)
+
+// error codes defined by OCI distribution spec
+const (
+	errCodeBlobUnknown         = "BLOB_UNKNOWN"
+	errCodeBlobUploadInvalid   = "BLOB_UPLOAD_INVALID"
+	errCodeBlobUploadUnknown   = "BLOB_UPLOAD_UNKNOWN"
+	errCodeDigestInvalid       = "DIGEST_INVALID"
+	errCodeManifestBlobUnknown = "MANIFEST_BLOB_UNKNOWN"
+	errCodeManifestInvalid     = "MANIFEST_INVALID"
+	errCodeManifestUnknown     = "MANIFEST_UNKNOWN"
+	errCodeNameInvalid         = "NAME_INVALID"
+	errCodeNameUnknown         = "NAME_UNKNOWN"
+	errCodeSizeInvalid         = "SIZE_INVALID"
+	errCodeUnauthorized        = "UNAUTHORIZED"
+	errCodeDenied              = "DENIED"
+	errCodeUnsupported         = "UNSUPPORTED"
+	errCodeRangeInvalid        = "RANGE_INVALID"
+	errCodeInternal            = "INTERNAL_ERROR"
+)
+
+var (
+	nameRegex      = regexp.MustCompile(utils.NameRegex)
+	errInvalidName = errors.New("invalid repository name")
+)
+
+type routeKind int
+
+const (
+	routeBase routeKind = iota
+	routeCatalog
+	routeTags
+	routeManifest
+	routeBlob
+	routeUpload
+)
+
+type route struct {
+	kind     routeKind
+	username string
+	name     string
+	// tag or digest for manifest, digest for blob and upload id for upload
+	ref string
+}
+
+func (rt *route) repoPath() string {
+	if rt.username == publicNamespace {
+		return rt.name
+	}
+	return rt.username + "/" + rt.name
+}
+
+// SetupRouter registers OCI distribution API, see https://github.com/opencontainers/distribution-spec
+func SetupRouter(r *gin.Engine) {
+	r.Any("/v2/*path", middlewares.Authenticate(), dispatch)
+}
+
+func dispatch(c *gin.Context) {
+	c.Header(apiVersionHeader, "registry/2.0")
+	rt, err := parseRoute(c.Param("path"))
+	if err != nil {
+		abortWithError(c, http.StatusNotFound, errCodeNameInvalid, err.Error())
+		return
+	}
+	method := c.Request.Method
+	switch rt.kind {
+	case routeBase:
+		if method != http.MethodGet && method != http.MethodHead {
+			break
+		}
+		if _, ok := common.LoginUser(c); !ok {
+			abortWithError(c, http.StatusUnauthorized, errCodeUnauthorized, "authentication required")
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{})
+		return
+	case routeCatalog:
+		if method == http.MethodGet {
+			getCatalog(c)
+			return
+		}
+	case routeTags:
+		if method == http.MethodGet {
+			getTags(c, rt)
+			return
+		}
+	case routeManifest:
+		switch method {
+		case http.MethodGet, http.MethodHead:
+			getManifest(c, rt)
+			return
+		case http.MethodPut:
+			putManifest(c, rt)
+			return
+		case http.MethodDelete:
+			deleteManifest(c, rt)
+			return
+		}
+	case routeBlob:
+		switch method {
+		case http.MethodGet, http.MethodHead:
+			getBlob(c, rt)
+			return
+		case http.MethodDelete:
+			abortWithError(c, http.StatusMethodNotAllowed, errCodeUnsupported, "blobs are deleted with images")
+			return
+		}
+	case routeUpload:
+		switch {
+		case method == http.MethodPost && rt.ref == "":
+			startUpload(c, rt)
+			return
+		case rt.ref == "":
+		case method == http.MethodPatch:
+			patchUpload(c, rt)
+			return
+		case method == http.MethodPut:
+			completeUpload(c, rt)
+			return
+		case method == http.MethodGet:
+			getUploadStatus(c, rt)
+			return
+		case method == http.MethodDelete:
+			cancelUpload(c, rt)
+			return
+		}
+	}
+	abortWithError(c, http.StatusMethodNotAllowed, errCodeUnsupported, "unsupported operation")
+}
+
+func parseRoute(p string) (*route, error) {
+	p = strings.TrimPrefix(p, "/")
+	if p == "" {
+		return &route{kind: routeBase}, nil
+	}
+	if p == "_catalog" {
+		return &route{kind: routeCatalog}, nil
+	}
+	var (
+		rt   = &route{}
+		repo string
+	)
+	switch {
+	case strings.HasSuffix(p, "/tags/list"):
+		rt.kind = routeTags
+		repo = strings.TrimSuffix(p, "/tags/list")
+	case strings.Contains(p, "/manifests/"):
+		rt.kind = routeManifest
+		idx := strings.LastIndex(p, "/manifests/")
+		repo, rt.ref = p[:idx], p[idx+len("/manifests/"):]
+	case strings.HasSuffix(p, "/blobs/uploads"):
+		rt.kind = routeUpload
+		repo = strings.TrimSuffix(p, "/blobs/uploads")
+	case strings.Contains(p, "/blobs/uploads/"):
+		rt.kind = routeUpload
+		idx := strings.LastIndex(p, "/blobs/uploads/")
+		repo, rt.ref = p[:idx], p[idx+len("/blobs/uploads/"):]
+	case strings.Contains(p, "/blobs/"):
+		rt.kind = routeBlob
+		idx := strings.LastIndex(p, "/blobs/")
+		repo, rt.ref = p[:idx], p[idx+len("/blobs/"):]
+	default:
+		return nil, errInvalidName
+	}
+	parts := strings.Split(repo, "/")
+	switch len(parts) {
+	case 1:
+		rt.username, rt.name = publicNamespace, parts[0]
+	case 2:
+		rt.username, rt.name = parts[0], parts[1]
+	default:
+		return nil, errInvalidName
+	}
+	if rt.username != publicNamespace && !nameRegex.MatchString(rt.username) {
+		return nil, errInvalidName
+	}
+	if !nameRegex.MatchString(rt.name) {
+		return nil, errInvalidName
+	}
+	return rt, nil
+}
+
+func abortWithError(c *gin.Context, status int, code, msg string) {
+	if status == http.StatusUnauthorized {
+		c.Header("WWW-Authenticate", `Basic realm="vmihub"`)
+	}
+	c.AbortWithStatusJSON(status, gin.H{
+		"errors": []gin.H{
+			{"code": code, "message": msg},
+		},
+	})
+}
+
+// abortWithPermError distinguishes anonymous users from the users without permission,
+// so the clients know they should send credentials.
+func abortWithPermError(c *gin.Context) {
+	if _, ok := common.LoginUser(c); !ok {
+		abortWithError(c, http.StatusUnauthorized, errCodeUnauthorized, "authentication required")
+		return
+	}
+	abortWithError(c, http.StatusForbidden, errCodeDenied, "requested access to the resource is denied")
+}
+
+// abortWithTagProtectionError aborts the request with 409 for immutable tags and 403 for protected tags
+func abortWithTagProtectionError(c *gin.Context, err error) {
+	code := http.StatusForbidden
+	if errors.Is(err, terrors.ErrImmutableTag) {
+		code = http.StatusConflict
+	}
+	abortWithError(c, code, errCodeDenied, err.Error())
+}
+
+func abortWithInternalError(c *gin.Context, err error, msg string) {
+	log.WithFunc("registry").Error(c, err, msg)
+	abortWithError(c, http.StatusInternalServerError, errCodeInternal, "internal error, please try again")
+}
+
+// getRepo returns the repository which the login user can read
+func getRepo(c *gin.Context, rt *route) (*models.Repository, error) {
+	repo, err := models.QueryRepo(c, rt.username, rt.name)
+	if err != nil {
+		abortWithInternalError(c, err, "failed to get repo from db")
+		return nil, err
+	}
+	if repo == nil {
+		abortWithError(c, http.StatusNotFound, errCodeNameUnknown, "repository name not known to registry")
+		return nil, terrors.ErrPlaceholder
+	}
+	if !common.CheckRepoReadPerm(c, repo) {
+		abortWithPermError(c)
+		return nil, terrors.ErrPlaceholder
+	}
+	return repo, nil
+}
+
+// canWrite returns true if the login user can push to the repository, the repository may not exist
+func canWrite(c *gin.Context, rt *route) bool {
+	return common.CheckRepoWritePermByName(c, rt.username, rt.name)
+}
+
+// isAdmin returns true if the login user is an administrator, who isn't restricted by tag protection
+func isAdmin(c *gin.Context) bool {
+	curUser, ok := common.LoginUser(c)
+	return ok && curUser.Admin
+}
+
+func checkDeletePerm(c *gin.Context, repo *models.Repository) error {
+	if !common.CheckRepoDeletePerm(c, repo) {
+		abortWithPermError(c)
+		return terrors.ErrPlaceholder
+	}
+	return nil
+}
+
+func checkWritePerm(c *gin.Context, rt *route) error {
+	if !canWrite(c, rt) {
+		abortWithPermError(c)
+		return terrors.ErrPlaceholder
+	}
+	return nil
+}
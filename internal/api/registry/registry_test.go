@@ -0,0 +1,478 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/projecteru2/vmihub/internal/imageops"
+	"github.com/projecteru2/vmihub/internal/models"
+	stotypes "github.com/projecteru2/vmihub/internal/storage/types"
+	"github.com/projecteru2/vmihub/internal/testutils"
+	"github.com/projecteru2/vmihub/internal/utils"
+	"github.com/projecteru2/vmihub/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+const testContent = "test content"
+
+var (
+	repoTableName = ((*models.Repository)(nil)).TableName()
+	repoColumns   = ((*models.Repository)(nil)).ColumnNames()
+	imgTableName  = ((*models.Image)(nil)).TableName()
+	imgColumns    = ((*models.Image)(nil)).ColumnNames()
+	quotaColumns  = ((*models.Quota)(nil)).ColumnNames()
+)
+
+func TestParseRoute(t *testing.T) {
+	cases := []struct {
+		path string
+		want *route
+	}{
+		{"/", &route{kind: routeBase}},
+		{"/_catalog", &route{kind: routeCatalog}},
+		{"/ubuntu/tags/list", &route{kind: routeTags, username: publicNamespace, name: "ubuntu"}},
+		{"/user1/name1/manifests/v1", &route{kind: routeManifest, username: "user1", name: "name1", ref: "v1"}},
+		{"/user1/name1/blobs/sha256:abc", &route{kind: routeBlob, username: "user1", name: "name1", ref: "sha256:abc"}},
+		{"/user1/name1/blobs/uploads/", &route{kind: routeUpload, username: "user1", name: "name1"}},
+		{"/user1/name1/blobs/uploads/123", &route{kind: routeUpload, username: "user1", name: "name1", ref: "123"}},
+	}
+	for _, c := range cases {
+		rt, err := parseRoute(c.path)
+		assert.Nil(t, err, c.path)
+		assert.Equal(t, c.want, rt, c.path)
+	}
+	for _, p := range []string{"/a/b/c/tags/list", "/User1/name1/manifests/v1", "/user1/name1"} {
+		_, err := parseRoute(p)
+		assert.Error(t, err, p)
+	}
+}
+
+type registryTestSuite struct {
+	suite.Suite
+	r *gin.Engine
+}
+
+func (suite *registryTestSuite) SetupTest() {
+	t := suite.T()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	err := testutils.Prepare(ctx, t)
+	require.NoError(t, err)
+
+	r, err := testutils.PrepareGinEngine()
+	require.NoError(t, err)
+	SetupRouter(r)
+	suite.r = r
+	testutils.ResetMockStorage()
+}
+
+func (suite *registryTestSuite) expectRepo(username, name string, private bool) {
+	models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? AND name = ?", repoColumns, repoTableName)).
+		WithArgs(username, name).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name", "private"}).
+			AddRow(1, username, name, private))
+}
+
+func (suite *registryTestSuite) TestBase() {
+	{
+		// anonymous user
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/v2/", nil)
+		suite.r.ServeHTTP(w, req)
+		suite.Equal(http.StatusUnauthorized, w.Code)
+		suite.Equal(`Basic realm="vmihub"`, w.Header().Get("WWW-Authenticate"))
+		suite.Equal("registry/2.0", w.Header().Get(apiVersionHeader))
+	}
+	{
+		utils.MockRedis.FlushAll()
+		user, pass := "user1", "pass1"
+		err := testutils.PrepareUserData(user, pass)
+		suite.Nil(err)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/v2/", nil)
+		testutils.AddAuth(req, user, pass)
+		suite.r.ServeHTTP(w, req)
+		suite.Equal(http.StatusOK, w.Code)
+	}
+}
+
+func (suite *registryTestSuite) TestGetManifest() {
+	dgst := digest.FromString(testContent)
+	imgRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "repo_id", "tag", "state", "size", "digest", "format", "os"}).
+			AddRow(1, 1, "v1", models.ImageStateReady, len(testContent), dgst.Encoded(), "qcow2", []byte(`{"type":"linux","distrib":"ubuntu","version":"22.04","arch":"amd64"}`))
+	}
+	{
+		// private repository
+		utils.MockRedis.FlushAll()
+		suite.expectRepo("user1", "name1", true)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/v2/user1/name1/manifests/v1", nil)
+		suite.r.ServeHTTP(w, req)
+		suite.Equal(http.StatusUnauthorized, w.Code)
+	}
+	utils.MockRedis.FlushAll()
+	suite.expectRepo("user1", "name1", false)
+	models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? AND tag = ?", imgColumns, imgTableName)).
+		WithArgs(1, "v1").
+		WillReturnRows(imgRows())
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/v2/user1/name1/manifests/v1", nil)
+	suite.r.ServeHTTP(w, req)
+	suite.Equal(http.StatusOK, w.Code)
+	suite.Equal(ocispec.MediaTypeImageManifest, w.Header().Get("Content-Type"))
+	suite.Equal(digest.FromBytes(w.Body.Bytes()).String(), w.Header().Get(contentDigestHeader))
+
+	manifest := ocispec.Manifest{}
+	err := json.Unmarshal(w.Body.Bytes(), &manifest)
+	suite.Nil(err)
+	suite.Equal(types.OCIArtifactType, manifest.ArtifactType)
+	suite.Equal(types.OCIConfigMediaType, manifest.Config.MediaType)
+	suite.Len(manifest.Layers, 1)
+	suite.Equal(dgst, manifest.Layers[0].Digest)
+	suite.Equal(types.OCILayerMediaTypePrefix+"qcow2", manifest.Layers[0].MediaType)
+	suite.Equal(int64(len(testContent)), manifest.Layers[0].Size)
+
+	// the config blob
+	models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? ORDER BY updated_at DESC", imgColumns, imgTableName)).
+		WithArgs(1).
+		WillReturnRows(imgRows())
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, fmt.Sprintf("/v2/user1/name1/blobs/%s", manifest.Config.Digest), nil)
+	suite.r.ServeHTTP(w, req)
+	suite.Equal(http.StatusOK, w.Code)
+	imgCfg := &types.OCIImageConfig{}
+	err = json.Unmarshal(w.Body.Bytes(), imgCfg)
+	suite.Nil(err)
+	suite.Equal("qcow2", imgCfg.Format)
+	suite.Equal("ubuntu", imgCfg.OS.Distrib)
+
+	// the image file
+	sto := testutils.GetMockStorage()
+	sto.On("Exists", mock.Anything, models.BlobName(dgst.Encoded())).Return(true, nil).Once()
+	sto.On("Get", mock.Anything, models.BlobName(dgst.Encoded())).Return(io.NopCloser(bytes.NewBufferString(testContent)), nil).Once()
+	models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? ORDER BY updated_at DESC", imgColumns, imgTableName)).
+		WithArgs(1).
+		WillReturnRows(imgRows())
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, fmt.Sprintf("/v2/user1/name1/blobs/%s", dgst), nil)
+	suite.r.ServeHTTP(w, req)
+	suite.Equal(http.StatusOK, w.Code)
+	suite.Equal(testContent, w.Body.String())
+	sto.AssertExpectations(suite.T())
+}
+
+func (suite *registryTestSuite) TestChunkedUpload() {
+	utils.MockRedis.FlushAll()
+	user, pass := "user1", "pass1"
+	err := testutils.PrepareUserData(user, pass)
+	suite.Nil(err)
+
+	sto := testutils.GetMockStorage()
+	sto.On("CreateChunkWrite", mock.Anything, mock.Anything).Return("tx1", nil).Once()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/v2/user1/name1/blobs/uploads/", nil)
+	testutils.AddAuth(req, user, pass)
+	suite.r.ServeHTTP(w, req)
+	suite.Equal(http.StatusAccepted, w.Code)
+	location := w.Header().Get("Location")
+	suite.NotEmpty(w.Header().Get(uploadUUIDHeader))
+	suite.Equal("0-0", w.Header().Get("Range"))
+
+	// other users can't write to the upload
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPatch, location, bytes.NewBufferString(testContent[:4]))
+	suite.r.ServeHTTP(w, req)
+	suite.Equal(http.StatusUnauthorized, w.Code)
+
+	// each request is written as a chunk
+	sto.On("ChunkWrite", mock.Anything, mock.Anything, "tx1", mock.MatchedBy(func(info *stotypes.ChunkInfo) bool {
+		return info.Idx == 0 && info.Size == 4
+	})).Return(nil).Once()
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPatch, location, bytes.NewBufferString(testContent[:4]))
+	req.Header.Set("Content-Range", "0-3")
+	testutils.AddAuth(req, user, pass)
+	suite.r.ServeHTTP(w, req)
+	suite.Equal(http.StatusAccepted, w.Code)
+	suite.Equal("0-3", w.Header().Get("Range"))
+
+	// wrong offset
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPatch, location, bytes.NewBufferString(testContent[4:]))
+	req.Header.Set("Content-Range", "0-7")
+	testutils.AddAuth(req, user, pass)
+	suite.r.ServeHTTP(w, req)
+	suite.Equal(http.StatusRequestedRangeNotSatisfiable, w.Code)
+
+	// wrong digest
+	sto.On("ChunkWrite", mock.Anything, mock.Anything, "tx1", mock.MatchedBy(func(info *stotypes.ChunkInfo) bool {
+		return info.Idx == 1
+	})).Return(nil).Once()
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPut, location+"?digest="+digest.FromString("other").String(), bytes.NewBufferString(testContent[4:]))
+	testutils.AddAuth(req, user, pass)
+	suite.r.ServeHTTP(w, req)
+	suite.Equal(http.StatusBadRequest, w.Code)
+
+	// start over
+	sto.On("AbortChunkWrite", mock.Anything, mock.Anything, "tx1").Return(nil).Once()
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodDelete, location, nil)
+	testutils.AddAuth(req, user, pass)
+	suite.r.ServeHTTP(w, req)
+	suite.Equal(http.StatusNoContent, w.Code)
+
+	sto.On("CreateChunkWrite", mock.Anything, mock.Anything).Return("tx2", nil).Once()
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/v2/user1/name1/blobs/uploads/", nil)
+	testutils.AddAuth(req, user, pass)
+	suite.r.ServeHTTP(w, req)
+	suite.Equal(http.StatusAccepted, w.Code)
+	location = w.Header().Get("Location")
+	staged := path.Join(uploadObjectDir, w.Header().Get(uploadUUIDHeader))
+
+	dgst := digest.FromString(testContent)
+	sto.On("ChunkWrite", mock.Anything, staged, "tx2", mock.Anything).Return(nil).Once()
+	sto.On("CompleteChunkWrite", mock.Anything, staged, "tx2", mock.MatchedBy(func(chunks []*stotypes.ChunkInfo) bool {
+		return len(chunks) == 1 && chunks[0].Size == int64(len(testContent))
+	})).Return(nil).Once()
+	sto.On("Exists", mock.Anything, models.BlobName(dgst.Encoded())).Return(false, nil).Once()
+	sto.On("Move", mock.Anything, staged, models.BlobName(dgst.Encoded())).Return(nil).Once()
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPut, location+"?digest="+dgst.String(), bytes.NewBufferString(testContent))
+	testutils.AddAuth(req, user, pass)
+	suite.r.ServeHTTP(w, req)
+	suite.Equal(http.StatusCreated, w.Code)
+	suite.Equal(dgst.String(), w.Header().Get(contentDigestHeader))
+	suite.Equal("/v2/user1/name1/blobs/"+dgst.String(), w.Header().Get("Location"))
+	sto.AssertExpectations(suite.T())
+
+	// the upload is finished
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, location, nil)
+	testutils.AddAuth(req, user, pass)
+	suite.r.ServeHTTP(w, req)
+	suite.Equal(http.StatusNotFound, w.Code)
+}
+
+func (suite *registryTestSuite) TestBlobAccess() {
+	utils.MockRedis.FlushAll()
+	user, pass := "user2", "pass2"
+	err := testutils.PrepareUserData(user, pass)
+	suite.Nil(err)
+	dgst := digest.FromString(testContent)
+	// the blob is used by a private repository of user1, user2 isn't a member of it
+	expectRepos := func() {
+		models.Mock.ExpectQuery(`SELECT DISTINCT r.id, r.username, r.name, r.private
+	           FROM repository r, image i
+	           WHERE r.id=i.repo_id AND i.digest = ? AND i.state IN (?, ?)`).
+			WithArgs(dgst.Encoded(), models.ImageStateReady, models.ImageStateDeprecated).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name", "private"}).
+				AddRow(3, "user1", "name1", true))
+		models.Mock.ExpectQuery(`SELECT m.role
+		           FROM organization_member m, organization o
+		           WHERE o.id=m.org_id AND o.name=? AND m.user_id=?`).
+			WithArgs("user1", 1).
+			WillReturnRows(sqlmock.NewRows([]string{"role"}))
+		models.Mock.ExpectQuery("SELECT perm FROM repository_member WHERE repo_id = ? AND user_id = ?").
+			WithArgs(3, 1).
+			WillReturnRows(sqlmock.NewRows([]string{"perm"}))
+	}
+
+	models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? AND name = ?", repoColumns, repoTableName)).
+		WithArgs("user2", "name2").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	expectRepos()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodHead, fmt.Sprintf("/v2/user2/name2/blobs/%s", dgst), nil)
+	testutils.AddAuth(req, user, pass)
+	suite.r.ServeHTTP(w, req)
+	suite.Equal(http.StatusNotFound, w.Code)
+
+	// it can't be mounted either, so a real upload is started
+	expectRepos()
+	sto := testutils.GetMockStorage()
+	sto.On("CreateChunkWrite", mock.Anything, mock.Anything).Return("tx1", nil).Once()
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, fmt.Sprintf("/v2/user2/name2/blobs/uploads/?mount=%s&from=user1/name1", dgst), nil)
+	testutils.AddAuth(req, user, pass)
+	suite.r.ServeHTTP(w, req)
+	suite.Equal(http.StatusAccepted, w.Code)
+	suite.NotEmpty(w.Header().Get(uploadUUIDHeader))
+	suite.Nil(models.Mock.ExpectationsWereMet())
+
+	// the blob uploaded by the user
+	utils.MockRedis.FlushAll()
+	err = testutils.PrepareUserData(user, pass)
+	suite.Nil(err)
+	err = utils.GetRedisConn().Set(context.Background(), fmt.Sprintf(redisBlobGrantKey, user, dgst.Encoded()), 1, time.Minute).Err()
+	suite.Nil(err)
+	models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? AND name = ?", repoColumns, repoTableName)).
+		WithArgs("user2", "name2").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	sto.On("Exists", mock.Anything, models.BlobName(dgst.Encoded())).Return(true, nil).Once()
+	sto.On("GetSize", mock.Anything, models.BlobName(dgst.Encoded())).Return(int64(len(testContent)), nil).Once()
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodHead, fmt.Sprintf("/v2/user2/name2/blobs/%s", dgst), nil)
+	testutils.AddAuth(req, user, pass)
+	suite.r.ServeHTTP(w, req)
+	suite.Equal(http.StatusOK, w.Code)
+	suite.Equal(dgst.String(), w.Header().Get(contentDigestHeader))
+	sto.AssertExpectations(suite.T())
+	suite.Nil(models.Mock.ExpectationsWereMet())
+}
+
+func (suite *registryTestSuite) TestPutManifest() {
+	utils.MockRedis.FlushAll()
+	user, pass := "user1", "pass1"
+	err := testutils.PrepareUserData(user, pass)
+	suite.Nil(err)
+
+	config := []byte(`{"format":"qcow2"}`)
+	configDigest := digest.FromBytes(config)
+	layerDigest := digest.FromString(testContent)
+	manifest := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config: ocispec.Descriptor{
+			MediaType: types.OCIConfigMediaType,
+			Digest:    configDigest,
+			Size:      int64(len(config)),
+		},
+		Layers: []ocispec.Descriptor{
+			{
+				MediaType: types.OCILayerMediaTypePrefix + "qcow2",
+				Digest:    layerDigest,
+				Size:      int64(len(testContent)),
+			},
+		},
+	}
+	manifest.SchemaVersion = 2
+	body, err := json.Marshal(&manifest)
+	suite.Nil(err)
+	// both blobs are pushed by user
+	for _, dgst := range []digest.Digest{configDigest, layerDigest} {
+		err = utils.GetRedisConn().Set(context.Background(), fmt.Sprintf(redisBlobGrantKey, user, dgst.Encoded()), 1, time.Minute).Err()
+		suite.Nil(err)
+	}
+
+	sto := testutils.GetMockStorage()
+	expectBlobs := func() {
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? AND name = ?", repoColumns, repoTableName)).
+			WithArgs("user1", "name1").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}))
+		sto.On("Exists", mock.Anything, models.BlobName(configDigest.Encoded())).Return(true, nil).Once()
+		sto.On("Get", mock.Anything, models.BlobName(configDigest.Encoded())).Return(io.NopCloser(bytes.NewReader(config)), nil).Once()
+		sto.On("Exists", mock.Anything, models.BlobName(layerDigest.Encoded())).Return(true, nil).Once()
+		sto.On("GetSize", mock.Anything, models.BlobName(layerDigest.Encoded())).Return(int64(len(testContent)), nil).Once()
+	}
+	putManifest := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPut, "/v2/user1/name1/manifests/v1", bytes.NewReader(body))
+		testutils.AddAuth(req, user, pass)
+		suite.r.ServeHTTP(w, req)
+		return w
+	}
+
+	// quota exceeded
+	expectBlobs()
+	models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM quota WHERE namespace = ?", quotaColumns)).
+		WithArgs("user1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "namespace", "max_size", "max_images"}).AddRow(1, "user1", len(testContent), 0))
+	models.Mock.ExpectQuery(`SELECT COALESCE(SUM(i.size), 0) AS size, COUNT(*) AS images
+		    FROM image i, repository r
+		    WHERE r.id=i.repo_id AND r.username=? AND i.state != ? AND i.id != ?`).
+		WithArgs("user1", models.ImageStateFailed, 0).
+		WillReturnRows(sqlmock.NewRows([]string{"size", "images"}).AddRow(1, 1))
+	w := putManifest()
+	suite.Equalf(http.StatusForbidden, w.Code, "error: %s", w.Body.String())
+	suite.Contains(w.Body.String(), errCodeDenied)
+	suite.Nil(models.Mock.ExpectationsWereMet())
+
+	expectBlobs()
+	models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM quota WHERE namespace = ?", quotaColumns)).
+		WithArgs("user1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "namespace"}))
+	// the image is reserved until it is verified
+	models.Mock.ExpectBegin()
+	models.Mock.ExpectExec("INSERT INTO repository(username, name, private) VALUES(?, ?, ?)").
+		WithArgs("user1", "name1", false).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	models.Mock.ExpectExec("INSERT INTO image(repo_id, tag, labels, state, size, virtual_size, cluster_size, format, os, digest, snapshot, description) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)").
+		WithArgs(1, "v1", sqlmock.AnyArg(), models.ImageStateCreating, len(testContent), 0, 0, "qcow2", sqlmock.AnyArg(), layerDigest.Encoded(), "", "").
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	models.Mock.ExpectCommit()
+	models.Mock.ExpectBegin()
+	models.Mock.ExpectExec("INSERT INTO task(type, username, status, payload) VALUES(?, ?, ?, ?)").
+		WithArgs(imageops.TaskTypeVerify, "user1", types.TaskStatusPending, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(10, 1))
+	models.Mock.ExpectCommit()
+
+	w = putManifest()
+	suite.Equalf(http.StatusCreated, w.Code, "error: %s", w.Body.String())
+	suite.Equal(digest.FromBytes(body).String(), w.Header().Get(contentDigestHeader))
+	sto.AssertExpectations(suite.T())
+	suite.Nil(models.Mock.ExpectationsWereMet())
+}
+
+func (suite *registryTestSuite) TestPushDenied() {
+	utils.MockRedis.FlushAll()
+	user, pass := "user2", "pass2"
+	err := testutils.PrepareUserData(user, pass)
+	suite.Nil(err)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPut, "/v2/user1/name1/manifests/v1", bytes.NewBufferString("{}"))
+	testutils.AddAuth(req, user, pass)
+	suite.r.ServeHTTP(w, req)
+	suite.Equal(http.StatusForbidden, w.Code)
+	resp := map[string][]map[string]string{}
+	err = json.Unmarshal(w.Body.Bytes(), &resp)
+	suite.Nil(err)
+	suite.Equal(errCodeDenied, resp["errors"][0]["code"])
+}
+
+func (suite *registryTestSuite) TestDeleteProtectedTag() {
+	utils.MockRedis.FlushAll()
+	user, pass := "user1", "pass1"
+	err := testutils.PrepareUserData(user, pass)
+	suite.Nil(err)
+	models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? AND name = ?", repoColumns, repoTableName)).
+		WithArgs("user1", "name1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name", "private", "protected_tags"}).
+			AddRow(1, "user1", "name1", false, "release-*"))
+	models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? AND tag = ?", imgColumns, imgTableName)).
+		WithArgs(1, "release-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "repo_id", "tag", "state", "digest", "format", "os"}).
+			AddRow(2, 1, "release-1", models.ImageStateReady, digest.FromString(testContent).Encoded(), "qcow2", []byte("{}")))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodDelete, "/v2/user1/name1/manifests/release-1", nil)
+	testutils.AddAuth(req, user, pass)
+	suite.r.ServeHTTP(w, req)
+	suite.Equalf(http.StatusForbidden, w.Code, "error: %s", w.Body.String())
+	resp := map[string][]map[string]string{}
+	err = json.Unmarshal(w.Body.Bytes(), &resp)
+	suite.Nil(err)
+	suite.Equal(errCodeDenied, resp["errors"][0]["code"])
+	suite.Nil(models.Mock.ExpectationsWereMet())
+}
+
+func TestRegistryTestSuite(t *testing.T) {
+	suite.Run(t, new(registryTestSuite))
+}
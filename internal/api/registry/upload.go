@@ -0,0 +1,442 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/opencontainers/go-digest"
+	"github.com/projecteru2/core/log"
+	"github.com/projecteru2/vmihub/internal/blob"
+	"github.com/projecteru2/vmihub/internal/common"
+	"github.com/projecteru2/vmihub/internal/models"
+	storFact "github.com/projecteru2/vmihub/internal/storage/factory"
+	stotypes "github.com/projecteru2/vmihub/internal/storage/types"
+	"github.com/projecteru2/vmihub/internal/utils"
+	"github.com/projecteru2/vmihub/pkg/terrors"
+)
+
+const (
+	redisUploadKey       = "/vmihub/oci/upload/%s"
+	redisUploadChunksKey = "/vmihub/oci/upload/%s/chunks"
+	redisRepoHKey        = "repo"
+	redisUserHKey        = "user"
+	redisSizeHKey        = "size"
+	redisTxHKey          = "transaction"
+	redisNChunksHKey     = "nChunks"
+	redisHashHKey        = "hash"
+	uploadRedisExpire    = 60 * 60 * time.Second
+	// the blobs uploaded by a user recently, they can be used by the user before they are referenced
+	redisBlobGrantKey = "/vmihub/oci/blob/%s/%s"
+	// the uploaded blobs are staged under this directory of storage before they are verified
+	uploadObjectDir = "_oci_uploads"
+)
+
+// uploadSession is a blob upload in progress, the body of each request is written to storage
+// as a chunk of a chunk write, so the requests of an upload can reach any server.
+// The chunk write of an expired session is reclaimed by gc.
+type uploadSession struct {
+	id      string
+	user    string
+	size    int64
+	txID    string
+	nChunks int
+	// the marshaled state of the sha256 hash of uploaded data
+	hashState []byte
+}
+
+func (sess *uploadSession) objectName() string {
+	return path.Join(uploadObjectDir, sess.id)
+}
+
+// hash returns the sha256 hash which has consumed the uploaded data
+func (sess *uploadSession) hash() (hash.Hash, error) {
+	h := sha256.New()
+	if len(sess.hashState) == 0 {
+		return h, nil
+	}
+	if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(sess.hashState); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (sess *uploadSession) rangeHeader() string {
+	if sess.size == 0 {
+		return "0-0"
+	}
+	return fmt.Sprintf("0-%d", sess.size-1)
+}
+
+func uploadLocation(rt *route, id string) string {
+	return fmt.Sprintf("/v2/%s/blobs/uploads/%s", rt.repoPath(), id)
+}
+
+func blobLocation(rt *route, dgst digest.Digest) string {
+	return fmt.Sprintf("/v2/%s/blobs/%s", rt.repoPath(), dgst)
+}
+
+func newUploadID() (string, error) {
+	raw, err := uuid.NewUUID()
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw[:]), nil
+}
+
+// startUpload starts a chunked upload, or finishes a monolithic upload when digest is given.
+func startUpload(c *gin.Context, rt *route) {
+	if err := checkWritePerm(c, rt); err != nil {
+		return
+	}
+	if mount := c.Query("mount"); mount != "" {
+		// blobs are shared by all repositories, but only the accessible ones can be mounted,
+		// otherwise the client falls back to a real upload
+		if dgst, err := digest.Parse(mount); err == nil && dgst.Algorithm() == digest.SHA256 {
+			exists, err := blobAccessible(c, dgst)
+			if err != nil {
+				abortWithInternalError(c, err, "failed to check blob")
+				return
+			}
+			if exists {
+				c.Header("Location", blobLocation(rt, dgst))
+				c.Header(contentDigestHeader, dgst.String())
+				c.Status(http.StatusCreated)
+				return
+			}
+		}
+	}
+	if d := c.Query("digest"); d != "" {
+		dgst, ok := parseDigest(c, d)
+		if !ok {
+			return
+		}
+		fp, err := os.CreateTemp("", "vmihub-oci-upload-")
+		if err != nil {
+			abortWithInternalError(c, err, "failed to create temp file")
+			return
+		}
+		defer os.Remove(fp.Name())
+		defer fp.Close()
+		if _, err := io.Copy(fp, c.Request.Body); err != nil {
+			abortWithError(c, http.StatusBadRequest, errCodeBlobUploadInvalid, "failed to read blob")
+			return
+		}
+		if err := storeBlob(c, fp.Name(), dgst); err != nil {
+			return
+		}
+		c.Header("Location", blobLocation(rt, dgst))
+		c.Header(contentDigestHeader, dgst.String())
+		c.Status(http.StatusCreated)
+		return
+	}
+
+	curUser, _ := common.LoginUser(c)
+	id, err := newUploadID()
+	if err != nil {
+		abortWithInternalError(c, err, "failed to generate upload id")
+		return
+	}
+	sess := &uploadSession{id: id, user: curUser.Username}
+	if sess.txID, err = storFact.Instance().CreateChunkWrite(c, sess.objectName()); err != nil {
+		abortWithInternalError(c, err, "failed to create chunk write")
+		return
+	}
+	if err := saveUploadSession(c, rt, sess); err != nil {
+		abortWithInternalError(c, err, "failed to save upload session")
+		return
+	}
+	writeUploadHeaders(c, rt, sess)
+	c.Status(http.StatusAccepted)
+}
+
+func writeUploadHeaders(c *gin.Context, rt *route, sess *uploadSession) {
+	c.Header("Location", uploadLocation(rt, sess.id))
+	c.Header("Range", sess.rangeHeader())
+	c.Header(uploadUUIDHeader, sess.id)
+	c.Header("Content-Length", "0")
+}
+
+// saveUploadSession saves the session and refreshes its expiration
+func saveUploadSession(c *gin.Context, rt *route, sess *uploadSession) error {
+	rdb := utils.GetRedisConn()
+	rKey := fmt.Sprintf(redisUploadKey, sess.id)
+	err := rdb.HSet(c, rKey,
+		redisRepoHKey, rt.repoPath(),
+		redisUserHKey, sess.user,
+		redisSizeHKey, sess.size,
+		redisTxHKey, sess.txID,
+		redisNChunksHKey, sess.nChunks,
+		redisHashHKey, sess.hashState,
+	).Err()
+	if err != nil {
+		return err
+	}
+	if err = rdb.Expire(c, rKey, uploadRedisExpire).Err(); err != nil {
+		return err
+	}
+	return rdb.Expire(c, fmt.Sprintf(redisUploadChunksKey, sess.id), uploadRedisExpire).Err()
+}
+
+func getUploadSession(c *gin.Context, rt *route) (*uploadSession, error) {
+	vals, err := utils.GetRedisConn().HGetAll(c, fmt.Sprintf(redisUploadKey, rt.ref)).Result()
+	if err != nil {
+		abortWithInternalError(c, err, "failed to get upload session")
+		return nil, err
+	}
+	if len(vals) == 0 || vals[redisRepoHKey] != rt.repoPath() {
+		abortWithError(c, http.StatusNotFound, errCodeBlobUploadUnknown, "blob upload unknown to registry")
+		return nil, terrors.ErrPlaceholder
+	}
+	curUser, ok := common.LoginUser(c)
+	if !ok || curUser.Username != vals[redisUserHKey] {
+		abortWithPermError(c)
+		return nil, terrors.ErrPlaceholder
+	}
+	size, _ := strconv.ParseInt(vals[redisSizeHKey], 10, 64)
+	nChunks, _ := strconv.Atoi(vals[redisNChunksHKey])
+	return &uploadSession{
+		id:        rt.ref,
+		user:      vals[redisUserHKey],
+		size:      size,
+		txID:      vals[redisTxHKey],
+		nChunks:   nChunks,
+		hashState: []byte(vals[redisHashHKey]),
+	}, nil
+}
+
+// getUploadChunks returns the chunks written by session in order
+func getUploadChunks(c *gin.Context, sess *uploadSession) ([]*stotypes.ChunkInfo, error) {
+	kv, err := utils.GetRedisConn().HGetAll(c, fmt.Sprintf(redisUploadChunksKey, sess.id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(kv) != sess.nChunks {
+		return nil, fmt.Errorf("need %d chunks, but only got %d chunks", sess.nChunks, len(kv))
+	}
+	ans := make([]*stotypes.ChunkInfo, sess.nChunks)
+	for k, v := range kv {
+		idx, err := strconv.Atoi(k)
+		if err != nil || idx < 0 || idx >= sess.nChunks {
+			return nil, fmt.Errorf("invalid chunk %s", k)
+		}
+		cInfo := &stotypes.ChunkInfo{}
+		if err := cInfo.UnmarshalBinary([]byte(v)); err != nil {
+			return nil, err
+		}
+		ans[idx] = cInfo
+	}
+	return ans, nil
+}
+
+// appendData writes the request body to storage as the next chunk and updates the size of session.
+// Every chunk except the last must be large enough for the storage, eg: 5MiB for S3.
+func appendData(c *gin.Context, rt *route, sess *uploadSession) error {
+	if cr := c.GetHeader("Content-Range"); cr != "" {
+		start, _, found := strings.Cut(cr, "-")
+		if offset, err := strconv.ParseInt(start, 10, 64); !found || err != nil || offset != sess.size {
+			c.Header("Location", uploadLocation(rt, sess.id))
+			c.Header("Range", sess.rangeHeader())
+			abortWithError(c, http.StatusRequestedRangeNotSatisfiable, errCodeRangeInvalid, "invalid content range")
+			return terrors.ErrPlaceholder
+		}
+	}
+	h, err := sess.hash()
+	if err != nil {
+		abortWithInternalError(c, err, "failed to restore digest of upload")
+		return err
+	}
+	fp, err := os.CreateTemp("", "vmihub-oci-chunk-")
+	if err != nil {
+		abortWithInternalError(c, err, "failed to create temp file")
+		return err
+	}
+	defer os.Remove(fp.Name())
+	defer fp.Close()
+	chunkHash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(fp, h, chunkHash), c.Request.Body)
+	if err != nil {
+		// the partial data is dropped, so the client can retry from the last range
+		abortWithError(c, http.StatusBadRequest, errCodeBlobUploadInvalid, "failed to read blob")
+		return err
+	}
+	if n == 0 {
+		return nil
+	}
+	if _, err := fp.Seek(0, io.SeekStart); err != nil {
+		abortWithInternalError(c, err, "failed to seek temp file")
+		return err
+	}
+	cInfo := &stotypes.ChunkInfo{
+		Idx:       sess.nChunks,
+		Size:      n,
+		ChunkSize: n,
+		Digest:    hex.EncodeToString(chunkHash.Sum(nil)),
+		In:        fp,
+	}
+	if err := storFact.Instance().ChunkWrite(c, sess.objectName(), sess.txID, cInfo); err != nil {
+		abortWithInternalError(c, err, "failed to write chunk to storage")
+		return err
+	}
+	if err := utils.GetRedisConn().HSet(c, fmt.Sprintf(redisUploadChunksKey, sess.id), cInfo.Idx, cInfo).Err(); err != nil {
+		abortWithInternalError(c, err, "failed to save chunk info")
+		return err
+	}
+	if sess.hashState, err = h.(encoding.BinaryMarshaler).MarshalBinary(); err != nil {
+		abortWithInternalError(c, err, "failed to save digest of upload")
+		return err
+	}
+	sess.size += n
+	sess.nChunks++
+	if err := saveUploadSession(c, rt, sess); err != nil {
+		abortWithInternalError(c, err, "failed to save upload session")
+		return err
+	}
+	return nil
+}
+
+func patchUpload(c *gin.Context, rt *route) {
+	sess, err := getUploadSession(c, rt)
+	if err != nil {
+		return
+	}
+	if err := appendData(c, rt, sess); err != nil {
+		return
+	}
+	writeUploadHeaders(c, rt, sess)
+	c.Status(http.StatusAccepted)
+}
+
+func completeUpload(c *gin.Context, rt *route) {
+	sess, err := getUploadSession(c, rt)
+	if err != nil {
+		return
+	}
+	dgst, ok := parseDigest(c, c.Query("digest"))
+	if !ok {
+		return
+	}
+	if err := appendData(c, rt, sess); err != nil {
+		return
+	}
+	if err := storeUpload(c, sess, dgst); err != nil {
+		return
+	}
+	removeUploadSession(c, sess)
+	c.Header("Location", blobLocation(rt, dgst))
+	c.Header(contentDigestHeader, dgst.String())
+	c.Status(http.StatusCreated)
+}
+
+func getUploadStatus(c *gin.Context, rt *route) {
+	sess, err := getUploadSession(c, rt)
+	if err != nil {
+		return
+	}
+	writeUploadHeaders(c, rt, sess)
+	c.Status(http.StatusNoContent)
+}
+
+func cancelUpload(c *gin.Context, rt *route) {
+	sess, err := getUploadSession(c, rt)
+	if err != nil {
+		return
+	}
+	if err := storFact.Instance().AbortChunkWrite(c, sess.objectName(), sess.txID); err != nil {
+		log.WithFunc("registry.cancelUpload").Errorf(c, err, "failed to abort chunk write of upload %s", sess.id)
+	}
+	removeUploadSession(c, sess)
+	c.Status(http.StatusNoContent)
+}
+
+func removeUploadSession(c *gin.Context, sess *uploadSession) {
+	rdb := utils.GetRedisConn()
+	if err := rdb.Del(c, fmt.Sprintf(redisUploadKey, sess.id), fmt.Sprintf(redisUploadChunksKey, sess.id)).Err(); err != nil {
+		log.WithFunc("registry.removeUploadSession").Errorf(c, err, "failed to delete upload session %s", sess.id)
+	}
+}
+
+// storeUpload verifies the data of session, then completes the chunk write and moves it to the blob store
+func storeUpload(c *gin.Context, sess *uploadSession, dgst digest.Digest) error {
+	h, err := sess.hash()
+	if err != nil {
+		abortWithInternalError(c, err, "failed to restore digest of upload")
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != dgst.Encoded() {
+		abortWithError(c, http.StatusBadRequest, errCodeDigestInvalid, "provided digest did not match uploaded content")
+		return terrors.ErrInvalidDigest
+	}
+	sto := storFact.Instance()
+	if sess.nChunks == 0 {
+		// nothing is staged for an empty blob
+		if err := sto.AbortChunkWrite(c, sess.objectName(), sess.txID); err != nil {
+			log.WithFunc("registry.storeUpload").Errorf(c, err, "failed to abort chunk write of upload %s", sess.id)
+		}
+		if err := sto.Put(c, models.BlobName(dgst.Encoded()), dgst.Encoded(), bytes.NewReader(nil)); err != nil {
+			abortWithInternalError(c, err, "failed to write blob to storage")
+			return err
+		}
+	} else {
+		chunks, err := getUploadChunks(c, sess)
+		if err != nil {
+			abortWithInternalError(c, err, "failed to get chunks of upload")
+			return err
+		}
+		if err := sto.CompleteChunkWrite(c, sess.objectName(), sess.txID, chunks); err != nil {
+			abortWithInternalError(c, err, "failed to complete chunk write")
+			return err
+		}
+		// the staged object is reclaimed by gc if it isn't moved
+		if err := blob.PutObject(c, sto, sess.objectName(), dgst.Encoded()); err != nil {
+			abortWithInternalError(c, err, "failed to write blob to storage")
+			return err
+		}
+	}
+	if err := grantBlob(c, dgst); err != nil {
+		abortWithInternalError(c, err, "failed to save uploaded blob")
+		return err
+	}
+	return nil
+}
+
+// storeBlob verifies the local file of a monolithic upload and writes it to the blob store
+func storeBlob(c *gin.Context, fname string, dgst digest.Digest) error {
+	fp, err := os.Open(fname)
+	if err != nil {
+		abortWithInternalError(c, err, "failed to open upload file")
+		return err
+	}
+	defer fp.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, fp); err != nil {
+		abortWithInternalError(c, err, "failed to calculate digest")
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != dgst.Encoded() {
+		abortWithError(c, http.StatusBadRequest, errCodeDigestInvalid, "provided digest did not match uploaded content")
+		return terrors.ErrInvalidDigest
+	}
+
+	if err := blob.PutFile(c, storFact.Instance(), fname, dgst.Encoded()); err != nil {
+		abortWithInternalError(c, err, "failed to write blob to storage")
+		return err
+	}
+	if err := grantBlob(c, dgst); err != nil {
+		abortWithInternalError(c, err, "failed to save uploaded blob")
+		return err
+	}
+	return nil
+}
@@ -11,9 +11,15 @@ import (
 	ginSwagger "github.com/swaggo/gin-swagger"
 
 	"github.com/projecteru2/vmihub/assets"
+	"github.com/projecteru2/vmihub/internal/api/admin"
 	"github.com/projecteru2/vmihub/internal/api/image"
+	"github.com/projecteru2/vmihub/internal/api/org"
+	"github.com/projecteru2/vmihub/internal/api/registry"
+	"github.com/projecteru2/vmihub/internal/api/task"
 	"github.com/projecteru2/vmihub/internal/api/user"
+	"github.com/projecteru2/vmihub/internal/metrics"
 	"github.com/projecteru2/vmihub/internal/middlewares"
+	"github.com/projecteru2/vmihub/internal/models"
 	"github.com/projecteru2/vmihub/internal/utils"
 	"github.com/projecteru2/vmihub/internal/utils/redissession"
 	"golang.org/x/text/language"
@@ -23,6 +29,9 @@ import (
 // SetupRouter initialize routing information
 func SetupRouter() (*gin.Engine, error) {
 	r := gin.New()
+	// the handlers use gin.Context as the context of models, storage and redis,
+	// so the values of request context such as the span are needed
+	r.ContextWithFallback = true
 	redisCli := utils.GetRedisConn()
 	sessStor, err := redissession.NewStore(context.TODO(), redisCli)
 	if err != nil {
@@ -45,19 +54,29 @@ func SetupRouter() (*gin.Engine, error) {
 		Loader:           &ginI18n.EmbedLoader{FS: assets.Assets},
 	})))
 
+	r.Use(middlewares.Tracing("vmihub"))
 	r.Use(middlewares.Cors())
 	r.Use(middlewares.Logger("vmihub"))
+	r.Use(middlewares.Metrics())
+	r.Use(middlewares.Audit())
 
 	r.GET("/healthz", func(c *gin.Context) {
 		c.String(http.StatusOK, ginI18n.MustGetMessage(c, "healthy"))
 	})
 
+	metrics.SetUploadSessionCounter(models.CountUploadSessions)
+	r.GET("/metrics", gin.WrapH(metrics.Handler()))
+
 	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 
 	basePath := "/api/v1"
 	apiGroup := r.Group(basePath, middlewares.Authenticate())
 
 	image.SetupRouter(apiGroup)
+	task.SetupRouter(apiGroup)
+	org.SetupRouter(apiGroup)
+	admin.SetupRouter(apiGroup)
 	user.SetupRouter(basePath, r)
+	registry.SetupRouter(r)
 	return r, nil
 }
@@ -7,9 +7,14 @@ import (
 	"testing"
 	"time"
 
+	"github.com/projecteru2/vmihub/config"
 	"github.com/projecteru2/vmihub/internal/testutils"
+	"github.com/projecteru2/vmihub/internal/tracing"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 func TestHealthz(t *testing.T) {
@@ -31,3 +36,60 @@ func TestHealthz(t *testing.T) {
 	assert.Equal(t, 200, w.Code)
 	assert.Equal(t, "Healthy", w.Body.String())
 }
+
+func TestMetrics(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	err := testutils.Prepare(ctx, t)
+	assert.Nil(t, err)
+	router, err := SetupRouter()
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/healthz", nil)
+	require.NoError(t, err)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/metrics", nil)
+	require.NoError(t, err)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	body := w.Body.String()
+	assert.Contains(t, body, `vmihub_http_requests_total{method="GET",route="/healthz",status="200"}`)
+	assert.Contains(t, body, `vmihub_http_downloaded_bytes_total{method="GET",route="/healthz"}`)
+	assert.Contains(t, body, "vmihub_chunk_upload_sessions 0")
+}
+
+func TestTracing(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	err := testutils.Prepare(ctx, t)
+	assert.Nil(t, err)
+	_, err = tracing.Init(ctx, &config.TracingConfig{})
+	require.NoError(t, err)
+	sr := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	router, err := SetupRouter()
+	require.NoError(t, err)
+
+	// the span continues the trace of caller
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/api/v1/user/info", nil)
+	require.NoError(t, err)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	spans := sr.Ended()
+	require.Len(t, spans, 1)
+	assert.Equal(t, "/api/v1/user/info", spans[0].Name())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spans[0].SpanContext().TraceID().String())
+
+	// the probes aren't traced
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/healthz", nil)
+	require.NoError(t, err)
+	router.ServeHTTP(w, req)
+	assert.Len(t, sr.Ended(), 1)
+}
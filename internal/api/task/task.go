@@ -0,0 +1,105 @@
+package task
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/projecteru2/core/log"
+	"github.com/projecteru2/vmihub/internal/common"
+	"github.com/projecteru2/vmihub/internal/models"
+	"github.com/projecteru2/vmihub/pkg/types"
+)
+
+func SetupRouter(r *gin.RouterGroup) {
+	taskGroup := r.Group("/tasks")
+
+	// List tasks
+	taskGroup.GET("", ListTasks)
+	// Get task
+	taskGroup.GET("/:id", GetTask)
+}
+
+// GetTask get task
+//
+// @Summary get task
+// @Description GetTask get status and result of a background task
+// @Tags 任务管理
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "token"
+// @Param id path int true "任务ID"
+// @Success 200 {object} types.Task
+// @Router /tasks/{id} [get]
+func GetTask(c *gin.Context) {
+	curUser, ok := common.LoginUser(c)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "please login"})
+		return
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid task id"})
+		return
+	}
+	t, err := models.GetTask(c, id)
+	if err != nil {
+		log.WithFunc("GetTask").Errorf(c, err, "failed to get task %d", id)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	// don't reveal the tasks of other users
+	if t == nil || (!curUser.Admin && curUser.Username != t.Username) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "task doesn't exist"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": t.ToResp(),
+	})
+}
+
+// ListTasks list tasks
+//
+// @Summary list tasks
+// @Description ListTasks list the tasks of current user, administrator can list the tasks of all users
+// @Tags 任务管理
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "token"
+// @Param username query string false "用户名, 仅管理员可用, 为空时返回所有用户的任务"
+// @Param status query string false "任务状态"
+// @Param page query int false "页码" default(1)
+// @Param pageSize query int false "每一页数量" default(10)
+// @Success 200 {object} []types.Task
+// @Router /tasks [get]
+func ListTasks(c *gin.Context) {
+	curUser, ok := common.LoginUser(c)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "please login"})
+		return
+	}
+	pNum, err1 := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pSize, err2 := strconv.Atoi(c.DefaultQuery("pageSize", "10"))
+	if err1 != nil || err2 != nil || pNum <= 0 || pSize <= 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid page or page size"})
+		return
+	}
+	username := curUser.Username
+	if curUser.Admin {
+		username = c.Query("username")
+	}
+	tasks, total, err := models.QueryTasks(c, username, c.Query("status"), pNum, pSize)
+	if err != nil {
+		log.WithFunc("ListTasks").Error(c, err, "failed to query tasks")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	resps := make([]*types.Task, 0, len(tasks))
+	for idx := range tasks {
+		resps = append(resps, tasks[idx].ToResp())
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data":  resps,
+		"total": total,
+	})
+}
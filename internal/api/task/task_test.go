@@ -0,0 +1,129 @@
+package task
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/projecteru2/vmihub/internal/middlewares"
+	"github.com/projecteru2/vmihub/internal/models"
+	"github.com/projecteru2/vmihub/internal/testutils"
+	"github.com/projecteru2/vmihub/internal/utils"
+	"github.com/projecteru2/vmihub/pkg/types"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+var (
+	taskTableName = ((*models.Task)(nil)).TableName()
+	taskColumns   = ((*models.Task)(nil)).ColumnNames()
+)
+
+type taskTestSuite struct {
+	suite.Suite
+	r *gin.Engine
+}
+
+func (suite *taskTestSuite) SetupTest() {
+	t := suite.T()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	err := testutils.Prepare(ctx, t)
+	require.NoError(t, err)
+
+	r, err := testutils.PrepareGinEngine()
+	require.NoError(t, err)
+	apiGroup := r.Group("/api/v1", middlewares.Authenticate())
+
+	SetupRouter(apiGroup)
+	suite.r = r
+}
+
+func (suite *taskTestSuite) expectTask(id int64, username string) {
+	models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE id = ?", taskColumns, taskTableName)).
+		WithArgs(id).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "type", "username", "status", "payload"}).
+			AddRow(id, "convert", username, types.TaskStatusPending, []byte(`{"tag":"v1"}`)))
+}
+
+func (suite *taskTestSuite) TestGetTask() {
+	{
+		utils.MockRedis.FlushAll()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/tasks/1", nil)
+		suite.r.ServeHTTP(w, req)
+		suite.Equal(http.StatusUnauthorized, w.Code)
+	}
+	{
+		// normal case
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData("user1", "pass1")
+		suite.Nil(err)
+		suite.expectTask(1, "user1")
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/tasks/1", nil)
+		testutils.AddAuth(req, "user1", "pass1")
+		suite.r.ServeHTTP(w, req)
+		suite.Equal(http.StatusOK, w.Code)
+		resp := struct {
+			Data types.Task `json:"data"`
+		}{}
+		err = json.Unmarshal(w.Body.Bytes(), &resp)
+		suite.Nil(err)
+		suite.Equal(int64(1), resp.Data.ID)
+		suite.Equal(types.TaskStatusPending, resp.Data.Status)
+		suite.JSONEq(`{"tag":"v1"}`, string(resp.Data.Payload))
+	}
+	{
+		// the task of other user
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData("user2", "pass2")
+		suite.Nil(err)
+		suite.expectTask(1, "user1")
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/tasks/1", nil)
+		testutils.AddAuth(req, "user2", "pass2")
+		suite.r.ServeHTTP(w, req)
+		suite.Equal(http.StatusNotFound, w.Code)
+	}
+	suite.Nil(models.Mock.ExpectationsWereMet())
+}
+
+func (suite *taskTestSuite) TestListTasks() {
+	utils.MockRedis.FlushAll()
+	err := testutils.PrepareUserData("user1", "pass1")
+	suite.Nil(err)
+	models.Mock.ExpectQuery(fmt.Sprintf("SELECT count(*) FROM %s WHERE username = ? AND status = ?", taskTableName)).
+		WithArgs("user1", types.TaskStatusFailed).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(11))
+	models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? AND status = ? ORDER BY id DESC LIMIT ?, ?", taskColumns, taskTableName)).
+		WithArgs("user1", types.TaskStatusFailed, 10, 10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "type", "username", "status", "error"}).
+			AddRow(1, "import", "user1", types.TaskStatusFailed, "size mismatch"))
+	w := httptest.NewRecorder()
+	// non-admin users can't list tasks of others
+	req, _ := http.NewRequest("GET", "/api/v1/tasks?username=user2&status=failed&page=2", nil)
+	testutils.AddAuth(req, "user1", "pass1")
+	suite.r.ServeHTTP(w, req)
+	suite.Equal(http.StatusOK, w.Code)
+	resp := struct {
+		Data  []types.Task `json:"data"`
+		Total int          `json:"total"`
+	}{}
+	err = json.Unmarshal(w.Body.Bytes(), &resp)
+	suite.Nil(err)
+	suite.Equal(11, resp.Total)
+	suite.Len(resp.Data, 1)
+	suite.Equal("size mismatch", resp.Data[0].Error)
+	suite.Nil(models.Mock.ExpectationsWereMet())
+}
+
+func TestTaskTestSuite(t *testing.T) {
+	suite.Run(t, new(taskTestSuite))
+}
@@ -0,0 +1,165 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"github.com/projecteru2/core/log"
+	"github.com/projecteru2/vmihub/internal/common"
+	"github.com/projecteru2/vmihub/internal/models"
+	"github.com/projecteru2/vmihub/internal/oidc"
+	"github.com/projecteru2/vmihub/pkg/terrors"
+	"github.com/samber/lo"
+)
+
+// OIDCLogin redirect to identity provider
+//
+// @Summary login with OpenID Connect
+// @Description OIDCLogin redirects the browser to the login page of identity provider
+// @Tags 用户管理
+// @success 302
+// @Router  /user/oidc/login [get]
+func OIDCLogin(c *gin.Context) {
+	if !oidc.Enabled() {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": oidc.ErrDisabled.Error()})
+		return
+	}
+	u, err := oidc.AuthCodeURL(c)
+	if err != nil {
+		log.WithFunc("OIDCLogin").Error(c, err, "failed to create OIDC state")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.Redirect(http.StatusFound, u)
+}
+
+// OIDCCallback finish login with identity provider
+//
+// @Summary OpenID Connect callback
+// @Description OIDCCallback verifies the authorization code returned by identity provider,
+// @Description the user is created on first login, then the session is saved and tokens are returned like /user/token
+// @Tags 用户管理
+// @Produce json
+// @Param code query string true "authorization code"
+// @Param state query string true "state"
+// @success 200 {object} types.JSONResult{data=types.TokenResponse} "desc"
+// @Router  /user/oidc/callback [get]
+func OIDCCallback(c *gin.Context) {
+	logger := log.WithFunc("OIDCCallback")
+	if !oidc.Enabled() {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": oidc.ErrDisabled.Error()})
+		return
+	}
+	if errMsg := c.Query("error"); errMsg != "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": errMsg})
+		return
+	}
+	identity, err := oidc.Exchange(c, c.Query("state"), c.Query("code"))
+	if err != nil {
+		switch {
+		case errors.Is(err, oidc.ErrInvalidState):
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, oidc.ErrAuthFailed):
+			logger.Warnf(c, "%s", err)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": oidc.ErrAuthFailed.Error()})
+		default:
+			logger.Error(c, err, "failed to exchange OIDC code")
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		}
+		return
+	}
+	user, err := provisionOIDCUser(c, identity)
+	if err != nil {
+		return
+	}
+	if user.Disabled {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": terrors.ErrUserDisabled.Error()})
+		return
+	}
+	if err := syncOIDCOrgs(c, user, identity); err != nil {
+		return
+	}
+	tokens, err := newTokenPair(user.ID, user.Username, nil, nil)
+	if err != nil {
+		logger.Error(c, err, "failed to sign token")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to sign token"})
+		return
+	}
+	if err := common.SaveUserSession(c, user); err != nil {
+		logger.Errorf(c, err, "failed to save user session")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": tokens,
+		"msg":  "login successfully",
+	})
+}
+
+// provisionOIDCUser returns the user linked to identity, it is created on first login.
+// An existing user is only used if an administrator has linked it to identity.
+func provisionOIDCUser(c *gin.Context, identity *oidc.Identity) (*models.User, error) {
+	admin, adminManaged := identity.IsAdmin()
+	account := &models.User{
+		Username: identity.Username,
+		Email:    identity.Email,
+		Nickname: identity.Nickname,
+		Admin:    admin,
+		Source:   models.UserSourceOIDC,
+	}
+	user, err := models.ProvisionOIDCUser(c, identity.Issuer, identity.Subject, account, adminManaged)
+	if err != nil {
+		switch {
+		case errors.Is(err, terrors.ErrInvalidUserName):
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid username %s", identity.Username)})
+		case errors.Is(err, terrors.ErrNameTaken):
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+				"error": fmt.Sprintf("name %s is already taken, an administrator must link it to your account", identity.Username),
+			})
+		default:
+			log.WithFunc("provisionOIDCUser").Errorf(c, err, "failed to provision user %s", identity.Username)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// syncOIDCOrgs sets the roles of user in the organizations managed by identity provider,
+// the organizations must be created before.
+func syncOIDCOrgs(c *gin.Context, user *models.User, identity *oidc.Identity) error {
+	roles := identity.OrgRoles()
+	orgNames := lo.Keys(roles)
+	sort.Strings(orgNames)
+	for _, orgName := range orgNames {
+		if err := syncOIDCOrg(c, user, orgName, roles[orgName]); err != nil {
+			log.WithFunc("syncOIDCOrgs").Errorf(c, err, "failed to sync member %s of organization %s", user.Username, orgName)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+			return err
+		}
+	}
+	return nil
+}
+
+func syncOIDCOrg(ctx context.Context, user *models.User, orgName, role string) error {
+	org, err := models.QueryOrg(ctx, orgName)
+	if err != nil {
+		return err
+	}
+	if org == nil {
+		log.WithFunc("syncOIDCOrg").Warnf(ctx, "organization %s mapped by OIDC groups doesn't exist", orgName)
+		return nil
+	}
+	current, err := models.GetOrgRole(ctx, orgName, user.ID)
+	if err != nil || role == current {
+		return err
+	}
+	if role == "" {
+		return org.RemoveMember(nil, user.ID)
+	}
+	return org.SetMember(nil, user.ID, role)
+}
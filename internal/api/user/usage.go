@@ -0,0 +1,68 @@
+package user
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/projecteru2/core/log"
+	"github.com/projecteru2/vmihub/internal/common"
+	"github.com/projecteru2/vmihub/internal/models"
+	"github.com/projecteru2/vmihub/pkg/types"
+)
+
+// GetUsage get usage
+//
+// @Summary get usage
+// @Description GetUsage reports the images consumption and quota of current user,
+// @Description or an organization which current user is a member of
+// @Tags 用户管理
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "token"
+// @Param namespace query string false "组织名, 为空时返回当前用户的用量"
+// @success 200 {object} types.JSONResult{data=types.UsageResp} "desc"
+// @Router /user/usage [get]
+func GetUsage(c *gin.Context) {
+	logger := log.WithFunc("GetUsage")
+	curUser, ok := common.LoginUser(c)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "please login"})
+		return
+	}
+	namespace := c.DefaultQuery("namespace", curUser.Username)
+	if namespace != curUser.Username && !curUser.Admin {
+		role, err := models.GetOrgRole(c, namespace, curUser.ID)
+		if err != nil {
+			logger.Errorf(c, err, "failed to get role in organization %s", namespace)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+			return
+		}
+		if role == "" {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "organization not found"})
+			return
+		}
+	}
+	usage, err := models.GetUsage(c, namespace, 0)
+	if err != nil {
+		logger.Error(c, err, "failed to get usage")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	quota, err := models.GetQuota(c, namespace)
+	if err != nil {
+		logger.Errorf(c, err, "failed to get quota of %s", namespace)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	resp := &types.UsageResp{
+		Namespace: namespace,
+		Size:      usage.Size,
+		Images:    usage.Images,
+	}
+	if quota != nil {
+		resp.MaxSize, resp.MaxImages = quota.MaxSize, quota.MaxImages
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": resp,
+	})
+}
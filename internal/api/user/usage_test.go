@@ -0,0 +1,80 @@
+package user
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/projecteru2/vmihub/internal/models"
+	"github.com/projecteru2/vmihub/internal/testutils"
+	"github.com/projecteru2/vmihub/internal/utils"
+	"github.com/projecteru2/vmihub/pkg/types"
+)
+
+var quotaColumns = ((*models.Quota)(nil)).ColumnNames()
+
+func (suite *userTestSuite) TestGetUsage() {
+	getUsage := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", url, nil)
+		testutils.AddAuth(req, "user1", "pass1")
+		suite.r.ServeHTTP(w, req)
+		return w
+	}
+	expectUsage := func(namespace string, size, images int64) {
+		models.Mock.ExpectQuery(`SELECT COALESCE(SUM(i.size), 0) AS size, COUNT(*) AS images
+		    FROM image i, repository r
+		    WHERE r.id=i.repo_id AND r.username=? AND i.state != ? AND i.id != ?`).
+			WithArgs(namespace, models.ImageStateFailed, 0).
+			WillReturnRows(sqlmock.NewRows([]string{"size", "images"}).AddRow(size, images))
+	}
+	{
+		// the namespace without quota is unlimited
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData("user1", "pass1")
+		suite.Nil(err)
+		expectUsage("user1", 1024, 2)
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM quota WHERE namespace = ?", quotaColumns)).
+			WithArgs("user1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "namespace", "max_size", "max_images"}))
+		w := getUsage("/api/v1/user/usage")
+		suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+		resp := struct {
+			Data types.UsageResp `json:"data"`
+		}{}
+		err = json.Unmarshal(w.Body.Bytes(), &resp)
+		suite.Nil(err)
+		suite.Equal(types.UsageResp{Namespace: "user1", Size: 1024, Images: 2}, resp.Data)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		// the usage of an organization is visible to its members only
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData("user1", "pass1")
+		suite.Nil(err)
+		models.Mock.ExpectQuery("SELECT m.role FROM organization_member m, organization o WHERE o.id=m.org_id AND o.name=? AND m.user_id=?").
+			WithArgs("infra", 1).
+			WillReturnRows(sqlmock.NewRows([]string{"role"}))
+		w := getUsage("/api/v1/user/usage?namespace=infra")
+		suite.Equal(http.StatusNotFound, w.Code)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		utils.MockRedis.FlushAll()
+		err := testutils.PrepareUserData("user1", "pass1")
+		suite.Nil(err)
+		models.Mock.ExpectQuery("SELECT m.role FROM organization_member m, organization o WHERE o.id=m.org_id AND o.name=? AND m.user_id=?").
+			WithArgs("infra", 1).
+			WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(models.OrgRoleDeveloper))
+		expectUsage("infra", 4096, 5)
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM quota WHERE namespace = ?", quotaColumns)).
+			WithArgs("infra").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "namespace", "max_size", "max_images"}).AddRow(1, "infra", 8192, 0))
+		w := getUsage("/api/v1/user/usage?namespace=infra")
+		suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+		suite.Contains(w.Body.String(), `"maxSize":8192`)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+}
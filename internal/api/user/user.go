@@ -2,20 +2,22 @@ package user
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 	"path"
 	"strings"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
 	"github.com/projecteru2/core/log"
 	"github.com/projecteru2/vmihub/config"
+	"github.com/projecteru2/vmihub/internal/auth"
 	"github.com/projecteru2/vmihub/internal/common"
 	"github.com/projecteru2/vmihub/internal/middlewares"
 	"github.com/projecteru2/vmihub/internal/models"
 	"github.com/projecteru2/vmihub/internal/utils"
+	"github.com/projecteru2/vmihub/internal/verification"
 	"github.com/projecteru2/vmihub/pkg/terrors"
 	"github.com/projecteru2/vmihub/pkg/types"
 )
@@ -29,8 +31,15 @@ func SetupRouter(basePath string, r *gin.Engine) {
 
 	// userGroup.Use(AuthRequired)
 
+	// Register user
+	userGroup.POST("/register", Register)
+	// Send verification code for registration
+	userGroup.POST("/verificationCode", SendVerificationCode)
 	// Login user
 	userGroup.POST("/login", LoginUser)
+	// Login with OpenID Connect identity provider
+	userGroup.GET("/oidc/login", OIDCLogin)
+	userGroup.GET("/oidc/callback", OIDCCallback)
 	// Logout user
 	userGroup.POST("/logout", LogoutUser)
 	// Get token
@@ -39,19 +48,112 @@ func SetupRouter(basePath string, r *gin.Engine) {
 	userGroup.POST("/refreshToken", RefreshToken)
 	// Get user information
 	userGroup.GET("/info", middlewares.Authenticate(), GetUserInfo)
+	// Get usage and quota of images
+	userGroup.GET("/usage", middlewares.Authenticate(), GetUsage)
 	// Update user
-	userGroup.POST("/info", middlewares.Authenticate(), UpdateUser)
+	userGroup.POST("/info", middlewares.Authenticate(), middlewares.RequireScope(models.ScopeUserAdmin), UpdateUser)
 
 	// change password
-	userGroup.POST("/changePwd", middlewares.Authenticate(), changePwd)
+	userGroup.POST("/changePwd", middlewares.Authenticate(), middlewares.RequireScope(models.ScopeUserAdmin), changePwd)
 	// reset password
 	userGroup.POST("/resetPwd", resetPwd)
 	// Create private token
-	userGroup.POST("/privateToken", middlewares.Authenticate(), CreatePrivateToken)
+	userGroup.POST("/privateToken", middlewares.Authenticate(), middlewares.RequireScope(models.ScopeUserAdmin), CreatePrivateToken)
 	// List private tokens
-	userGroup.GET("/privateTokens", middlewares.Authenticate(), ListPrivateToken)
+	userGroup.GET("/privateTokens", middlewares.Authenticate(), middlewares.RequireScope(models.ScopeUserAdmin), ListPrivateToken)
 	// Delete private token
-	userGroup.DELETE("/privateToken", middlewares.Authenticate(), DeletePrivateToken)
+	userGroup.DELETE("/privateToken", middlewares.Authenticate(), middlewares.RequireScope(models.ScopeUserAdmin), DeletePrivateToken)
+}
+
+// SendVerificationCode send verification code
+//
+// @Summary send verification code
+// @Description SendVerificationCode sends a verification code for registration to email or phone,
+// @Description the returned smsId is used by register
+// @Tags 用户管理
+// @Accept json
+// @Produce json
+// @Param body body types.VerificationCodeRequest true "邮箱或手机号"
+// @success 200 {object} types.JSONResult{data=types.VerificationCodeResp} "desc"
+// @Router  /user/verificationCode [post]
+func SendVerificationCode(c *gin.Context) {
+	if !config.GetCfg().Register.Enabled {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "registration is disabled"})
+		return
+	}
+	var req types.VerificationCodeRequest
+	if err := c.ShouldBindWith(&req, binding.JSON); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	id, err := verification.SendCode(c, req.Target)
+	if err != nil {
+		if errors.Is(err, verification.ErrTooFrequent) {
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+			return
+		}
+		log.WithFunc("SendVerificationCode").Errorf(c, err, "failed to send verification code to %s", req.Target)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to send verification code"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": types.VerificationCodeResp{SMSID: id},
+	})
+}
+
+// Register register user
+//
+// @Summary register user
+// @Description Register creates a user after the verification code is checked,
+// @Description the code is sent to the email, or the username if email is empty
+// @Tags 用户管理
+// @Accept json
+// @Produce json
+// @Param body body types.RegisterRequest true "用户结构体"
+// @success 200 {object} types.JSONResult{data=types.UserInfoResp} "desc"
+// @Failure 409
+// @Router  /user/register [post]
+func Register(c *gin.Context) {
+	logger := log.WithFunc("Register")
+	if !config.GetCfg().Register.Enabled {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "registration is disabled"})
+		return
+	}
+	var req types.RegisterRequest
+	if err := c.ShouldBindWith(&req, binding.JSON); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := req.Check(); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := common.CheckNameAvailable(c, req.Username); err != nil {
+		return
+	}
+	if err := verification.CheckCode(c, req.SMSID, req.VerificationCodeTarget(), req.Code); err != nil {
+		if errors.Is(err, verification.ErrInvalidCode) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		logger.Error(c, err, "failed to check verification code")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	user := &models.User{
+		Username: req.Username,
+		Email:    req.Email,
+		Nickname: req.Nickname,
+	}
+	if err := models.CreateUser(nil, user, req.Password); err != nil {
+		logger.Errorf(c, err, "failed to create user %s", req.Username)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"msg":  "register successfully",
+		"data": convUserResp(user),
+	})
 }
 
 // LoginUser login the user
@@ -77,12 +179,15 @@ func LoginUser(c *gin.Context) {
 		return
 	}
 
-	user, err := models.CheckAndGetUser(c, req.Username, req.Password)
+	user, err := auth.Authenticate(c, req.Username, req.Password)
 	// query user
 	if err != nil {
-		if errors.Is(err, terrors.ErrInvalidUserPass) {
+		switch {
+		case errors.Is(err, terrors.ErrInvalidUserPass):
 			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
-		} else {
+		case errors.Is(err, terrors.ErrUserDisabled):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		default:
 			logger.Error(c, err, "failed query user from db")
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
 		}
@@ -239,12 +344,15 @@ func GetUserToken(c *gin.Context) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	user, err := models.CheckAndGetUser(c, req.Username, req.Password)
+	user, err := auth.Authenticate(c, req.Username, req.Password)
 	// query user
 	if err != nil {
-		if errors.Is(err, terrors.ErrInvalidUserPass) {
+		switch {
+		case errors.Is(err, terrors.ErrInvalidUserPass):
 			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
-		} else {
+		case errors.Is(err, terrors.ErrUserDisabled):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		default:
 			logger.Error(c, err, "failed query user from db")
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
 		}
@@ -254,50 +362,26 @@ func GetUserToken(c *gin.Context) {
 		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "user not found"})
 		return
 	}
-	j := common.NewJWT(config.GetCfg().JWT.SigningKey)
-
-	// generate access token
-	accessClaims := models.CustomClaims{
-		ID:       user.ID,
-		UserName: user.Username,
-		StandardClaims: jwt.StandardClaims{
-			NotBefore: time.Now().Unix(),           // signature takes effect time
-			ExpiresAt: time.Now().Unix() + 60*60*2, // 2 hours later expires
-			Issuer:    "eru",
-			Subject:   "access",
-		},
-	}
-	accessTokenString, err := j.CreateToken(accessClaims)
-
-	if err != nil {
-		logger.Error(c, err, "failed to sign token")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to sign token"})
+	scope := models.NewTokenScope(req.Scopes, req.Repos)
+	if err := scope.Check(); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-
-	// generate refresh token
-	refreshClaims := models.CustomClaims{
-		ID:       user.ID,
-		UserName: user.Username,
-		StandardClaims: jwt.StandardClaims{
-			NotBefore: time.Now().Unix(),            // signature takes effect time
-			ExpiresAt: time.Now().Unix() + 60*60*24, // 24 hours later expires
-			Issuer:    "eru",
-			Subject:   refreshPrefix + accessTokenString,
-		},
-	}
-	refreshTokenString, err := j.CreateToken(refreshClaims)
+	tokens, err := newTokenPair(user.ID, user.Username, req.Scopes, req.Repos)
 	if err != nil {
 		logger.Error(c, err, "failed to sign token")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to sign token"})
 		return
 	}
-	if err := common.SaveUserSession(c, user); err != nil {
-		logger.Warnf(c, "failed to save user session: %s", err)
+	// the session isn't restricted, so only save it for the unscoped tokens
+	if scope == nil {
+		if err := common.SaveUserSession(c, user); err != nil {
+			logger.Warnf(c, "failed to save user session: %s", err)
+		}
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"data": types.TokenResponse{AccessToken: accessTokenString, RefreshToken: refreshTokenString},
+		"data": tokens,
 		"msg":  "Success",
 	})
 }
@@ -350,37 +434,7 @@ func RefreshToken(c *gin.Context) {
 		return
 	}
 
-	// generate access token
-	accessClaims := models.CustomClaims{
-		ID:       token.ID,
-		UserName: token.UserName,
-		StandardClaims: jwt.StandardClaims{
-			NotBefore: time.Now().Unix(),           // signature takes effect time
-			ExpiresAt: time.Now().Unix() + 60*60*2, // 2 hours later expires
-			Issuer:    "eru",
-			Subject:   "access",
-		},
-	}
-	accessTokenString, err := j.CreateToken(accessClaims)
-
-	if err != nil {
-		log.WithFunc("RefreshToken").Error(c, err, "failed to sign token")
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to sign token"})
-		return
-	}
-
-	// generate refresh token
-	refreshClaims := models.CustomClaims{
-		ID:       token.ID,
-		UserName: token.UserName,
-		StandardClaims: jwt.StandardClaims{
-			NotBefore: time.Now().Unix(),            // signature takes effect time
-			ExpiresAt: time.Now().Unix() + 60*60*24, // 24 hours later expires
-			Issuer:    "eru",
-			Subject:   refreshPrefix + accessTokenString,
-		},
-	}
-	refreshTokenString, err := j.CreateToken(refreshClaims)
+	tokens, err := newTokenPair(token.ID, token.UserName, token.Scopes, token.Repos)
 	if err != nil {
 		log.WithFunc("RefreshToken").Error(c, err, "failed to sign token")
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to sign token"})
@@ -388,7 +442,7 @@ func RefreshToken(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"data": types.TokenResponse{AccessToken: accessTokenString, RefreshToken: refreshTokenString},
+		"data": tokens,
 	})
 }
 
@@ -480,6 +534,7 @@ func CreatePrivateToken(c *gin.Context) {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
+	audit := common.Audit(c, models.AuditTokenCreate, req.Name)
 	if req.ExpiredAt.Before(time.Now()) {
 		req.ExpiredAt = time.Now().AddDate(1, 0, 0)
 	}
@@ -489,6 +544,22 @@ func CreatePrivateToken(c *gin.Context) {
 		return
 	}
 	user := value.(*models.User) //nolint
+	scope := models.NewTokenScope(req.Scopes, req.Repos)
+	if err := scope.Check(); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// a scoped token can't create tokens with more permissions
+	if !common.LoginScope(c).Contains(scope) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "the scopes exceed the current token"})
+		return
+	}
+	scopes, repos := strings.Join(req.Scopes, ","), strings.Join(req.Repos, ",")
+	audit.Detail = fmt.Sprintf("scopes=%s repos=%s", scopes, repos)
+	if len(scopes) > 255 || len(repos) > 255 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "too many scopes or repositories"})
+		return
+	}
 
 	token, err := utils.GetUniqueStr()
 	if err != nil {
@@ -500,6 +571,8 @@ func CreatePrivateToken(c *gin.Context) {
 		Name:      req.Name,
 		UserID:    user.ID,
 		Token:     token,
+		Scopes:    scopes,
+		Repos:     repos,
 		ExpiredAt: req.ExpiredAt,
 	}
 	if err := tokenObj.Save(nil); err != nil {
@@ -558,6 +631,7 @@ func DeletePrivateToken(c *gin.Context) {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
+	common.Audit(c, models.AuditTokenDelete, req.Name)
 	value, exists := c.Get("user")
 	if !exists {
 		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "please login"})
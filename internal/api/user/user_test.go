@@ -1,18 +1,37 @@
 package user
 
 import (
+	"bytes"
 	"context"
 	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
+	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/gin-gonic/gin"
+	"github.com/projecteru2/vmihub/config"
+	"github.com/projecteru2/vmihub/internal/models"
+	"github.com/projecteru2/vmihub/internal/oidc"
 	"github.com/projecteru2/vmihub/internal/testutils"
+	"github.com/projecteru2/vmihub/internal/utils"
+	"github.com/projecteru2/vmihub/internal/verification"
+	"github.com/projecteru2/vmihub/pkg/types"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 	"golang.org/x/crypto/bcrypt"
 )
 
+var (
+	userTableName = ((*models.User)(nil)).TableName()
+	userColumns   = ((*models.User)(nil)).ColumnNames()
+	orgTableName  = ((*models.Organization)(nil)).TableName()
+	orgColumns    = ((*models.Organization)(nil)).ColumnNames()
+)
+
 type userTestSuite struct {
 	suite.Suite
 	r *gin.Engine
@@ -47,33 +66,229 @@ func (a passwdMatcher) Match(v driver.Value) bool {
 	return true
 }
 
-// func (suite *userTestSuite) TestRegistr() {
-// 	obj := types.RegisterRequest{
-// 		Username: "user11",
-// 		Password: "pass11",
-// 		Email:    "haha@qq.com",
-// 		Phone:    "12345678901",
-// 	}
-// 	sqlStr := "SELECT * FROM user WHERE phone = ?"
-// 	models.Mock.ExpectQuery(sqlStr).
-// 		WithArgs(obj.Phone).
-// 		WillReturnError(sql.ErrNoRows)
-// 	sqlStr = "INSERT INTO user (username, phone, password, email, namespace, nickname) VALUES (?, ?, ?, ?, ?, ?)"
-
-// 	models.Mock.ExpectExec(sqlStr).
-// 		WithArgs(obj.Username, obj.Phone, passwdMatcher{obj.Password}, obj.Email, obj.Username, obj.Username).
-// 		WillReturnResult(sqlmock.NewResult(1234, 1))
-// 	models.Mock.ExpectCommit()
-// 	bs, err := json.Marshal(obj)
-// 	suite.Nil(err)
-// 	w := httptest.NewRecorder()
-// 	req, _ := http.NewRequest("POST", "/api/v1/user/register", bytes.NewBuffer(bs))
-// 	req.Header.Set("Content-Type", "application/json")
-// 	suite.r.ServeHTTP(w, req)
-
-// 	// fmt.Printf("+++++++++ %s\n", w.Body.String())
-// 	suite.Equal(http.StatusCreated, w.Code)
-// }
+type memSender struct {
+	codes map[string]string
+}
+
+func (s *memSender) Send(_ context.Context, target, code string) error {
+	s.codes[target] = code
+	return nil
+}
+
+func (suite *userTestSuite) request(method, url string, body any) *httptest.ResponseRecorder {
+	bs, err := json.Marshal(body)
+	suite.Nil(err)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, url, bytes.NewBuffer(bs))
+	req.Header.Set("Content-Type", "application/json")
+	suite.r.ServeHTTP(w, req)
+	return w
+}
+
+func (suite *userTestSuite) TestRegister() {
+	sender := &memSender{codes: map[string]string{}}
+	verification.SetSender(sender)
+	defer verification.SetSender(verification.LogSender{})
+
+	w := suite.request("POST", "/api/v1/user/verificationCode", types.VerificationCodeRequest{Target: "haha@qq.com"})
+	suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+	var resp struct {
+		Data types.VerificationCodeResp `json:"data"`
+	}
+	suite.Nil(json.Unmarshal(w.Body.Bytes(), &resp))
+
+	obj := types.RegisterRequest{
+		Username: "user11",
+		Password: "pass11",
+		Email:    "haha@qq.com",
+		SMSID:    resp.Data.SMSID,
+		Code:     "000000",
+	}
+	expectNameAvailable := func() {
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ?", userColumns, userTableName)).
+			WithArgs(obj.Username).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username"}))
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE name = ?", orgColumns, orgTableName)).
+			WithArgs(obj.Username).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name"}))
+	}
+	{
+		// wrong code
+		expectNameAvailable()
+		w = suite.request("POST", "/api/v1/user/register", obj)
+		suite.Equal(http.StatusBadRequest, w.Code)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		obj.Code = sender.codes["haha@qq.com"]
+		expectNameAvailable()
+		models.Mock.ExpectBegin()
+		models.Mock.ExpectExec("INSERT INTO user (username, password, email, nickname, admin, source) VALUES (?, ?, ?, ?, ?, ?)").
+			WithArgs(obj.Username, passwdMatcher{obj.Password}, obj.Email, "", false, models.UserSourceLocal).
+			WillReturnResult(sqlmock.NewResult(1234, 1))
+		models.Mock.ExpectCommit()
+		w = suite.request("POST", "/api/v1/user/register", obj)
+		suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+		suite.Contains(w.Body.String(), `"id":1234`)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+}
+
+func (suite *userTestSuite) TestDisabledUser() {
+	ePasswd, err := utils.EncryptPassword("pass1")
+	suite.Nil(err)
+	models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ?", userColumns, userTableName)).
+		WithArgs("user1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password", "disabled"}).AddRow(1, "user1", ePasswd, true))
+	w := suite.request("POST", "/api/v1/user/token", types.LoginRequest{Username: "user1", Password: "pass1"})
+	suite.Equal(http.StatusForbidden, w.Code)
+	suite.Nil(models.Mock.ExpectationsWereMet())
+}
+
+func (suite *userTestSuite) TestOIDCLogin() {
+	t := suite.T()
+	idp := testutils.NewMockIdP(t, "vmihub")
+	cfg := &config.OIDCConfig{
+		Enabled:       true,
+		Issuer:        idp.URL,
+		ClientID:      "vmihub",
+		ClientSecret:  "secret",
+		RedirectURL:   "http://vmihub.test/api/v1/user/oidc/callback",
+		UsernameClaim: "preferred_username",
+		GroupsClaim:   "groups",
+		AdminGroups:   []string{"vmihub-admins"},
+		GroupRoles:    []config.OIDCGroupRole{{Group: "infra-dev", Org: "infra", Role: models.OrgRoleDeveloper}},
+	}
+	suite.Require().NoError(oidc.Init(context.Background(), cfg))
+	defer oidc.Init(context.Background(), &config.OIDCConfig{}) //nolint:errcheck
+
+	login := func() *httptest.ResponseRecorder {
+		w := suite.request("GET", "/api/v1/user/oidc/login", nil)
+		suite.Require().Equal(http.StatusFound, w.Code)
+		callback := idp.Login(t, w.Header().Get("Location"))
+		return suite.request("GET", callback.RequestURI(), nil)
+	}
+	expectOrgRole := func(role string) {
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE name = ?", orgColumns, orgTableName)).
+			WithArgs("infra").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(10, "infra"))
+		rows := sqlmock.NewRows([]string{"role"})
+		if role != "" {
+			rows.AddRow(role)
+		}
+		models.Mock.ExpectQuery("SELECT m.role FROM organization_member m, organization o WHERE o.id=m.org_id AND o.name=? AND m.user_id=?").
+			WithArgs("infra", 1234).
+			WillReturnRows(rows)
+	}
+	{
+		// the user is created on first login
+		idp.Claims = map[string]any{
+			"preferred_username": "sso1",
+			"email":              "sso1@example.com",
+			"name":               "SSO User",
+			"groups":             []string{"vmihub-admins", "infra-dev"},
+		}
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE id = (SELECT user_id FROM user_oidc WHERE issuer = ? AND subject = ?)", userColumns, userTableName)).
+			WithArgs(idp.URL, "mock-subject").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username"}))
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ?", userColumns, userTableName)).
+			WithArgs("sso1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username"}))
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE name = ?", orgColumns, orgTableName)).
+			WithArgs("sso1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name"}))
+		models.Mock.ExpectBegin()
+		models.Mock.ExpectExec("INSERT INTO user (username, password, email, nickname, admin, source) VALUES (?, ?, ?, ?, ?, ?)").
+			WithArgs("sso1", sqlmock.AnyArg(), "sso1@example.com", "SSO User", true, models.UserSourceOIDC).
+			WillReturnResult(sqlmock.NewResult(1234, 1))
+		models.Mock.ExpectExec("DELETE FROM user_oidc WHERE issuer = ? AND user_id = ?").
+			WithArgs(idp.URL, 1234).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		models.Mock.ExpectExec("INSERT INTO user_oidc(issuer, subject, user_id) VALUES(?, ?, ?) ON DUPLICATE KEY UPDATE user_id = ?").
+			WithArgs(idp.URL, "mock-subject", 1234, 1234).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		models.Mock.ExpectCommit()
+		expectOrgRole("")
+		models.Mock.ExpectBegin()
+		models.Mock.ExpectExec("INSERT INTO organization_member(org_id, user_id, role) VALUES(?, ?, ?) ON DUPLICATE KEY UPDATE role = ?").
+			WithArgs(10, 1234, models.OrgRoleDeveloper, models.OrgRoleDeveloper).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		models.Mock.ExpectCommit()
+		w := login()
+		suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+		suite.Nil(models.Mock.ExpectationsWereMet())
+
+		// the returned token is accepted by JWT authentication
+		var resp struct {
+			Data types.TokenResponse `json:"data"`
+		}
+		suite.Nil(json.Unmarshal(w.Body.Bytes(), &resp))
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ?", userColumns, userTableName)).
+			WithArgs("sso1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "admin"}).AddRow(1234, "sso1", true))
+		req, _ := http.NewRequest("GET", "/api/v1/user/info", nil)
+		req.Header.Set("Authorization", "Bearer "+resp.Data.AccessToken)
+		w = httptest.NewRecorder()
+		suite.r.ServeHTTP(w, req)
+		suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+		suite.Contains(w.Body.String(), `"username":"sso1"`)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		// the roles are revoked when the user leaves the groups
+		utils.MockRedis.FlushAll()
+		idp.Claims["groups"] = []string{"others"}
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE id = (SELECT user_id FROM user_oidc WHERE issuer = ? AND subject = ?)", userColumns, userTableName)).
+			WithArgs(idp.URL, "mock-subject").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "email", "nickname", "admin"}).
+				AddRow(1234, "sso1", "sso1@example.com", "SSO User", true))
+		models.Mock.ExpectBegin()
+		models.Mock.ExpectExec("UPDATE user SET nickname = ?, email = ?, admin = ?, disabled = ? WHERE id = ?").
+			WithArgs("SSO User", "sso1@example.com", false, false, 1234).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		models.Mock.ExpectCommit()
+		expectOrgRole(models.OrgRoleDeveloper)
+		models.Mock.ExpectBegin()
+		models.Mock.ExpectExec("DELETE FROM organization_member WHERE org_id = ? AND user_id = ?").
+			WithArgs(10, 1234).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		models.Mock.ExpectCommit()
+		w := login()
+		suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		// a state can't be reused
+		w := suite.request("GET", "/api/v1/user/oidc/login", nil)
+		suite.Require().Equal(http.StatusFound, w.Code)
+		callback := idp.Login(t, w.Header().Get("Location"))
+		idp.Claims["groups"] = []string{}
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE id = (SELECT user_id FROM user_oidc WHERE issuer = ? AND subject = ?)", userColumns, userTableName)).
+			WithArgs(idp.URL, "mock-subject").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "email", "nickname"}).
+				AddRow(1234, "sso1", "sso1@example.com", "SSO User"))
+		expectOrgRole("")
+		w = suite.request("GET", callback.RequestURI(), nil)
+		suite.Equalf(http.StatusOK, w.Code, "error: %s", w.Body.String())
+		w = suite.request("GET", callback.RequestURI(), nil)
+		suite.Equal(http.StatusBadRequest, w.Code)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+	{
+		// an existing user isn't taken over by an account which isn't linked to it
+		utils.MockRedis.FlushAll()
+		idp.Claims["preferred_username"] = "user1"
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE id = (SELECT user_id FROM user_oidc WHERE issuer = ? AND subject = ?)", userColumns, userTableName)).
+			WithArgs(idp.URL, "mock-subject").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username"}))
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ?", userColumns, userTableName)).
+			WithArgs("user1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "admin"}).AddRow(1, "user1", true))
+		w := login()
+		suite.Equal(http.StatusConflict, w.Code)
+		suite.Nil(models.Mock.ExpectationsWereMet())
+	}
+}
 
 func TestUserTestSuite(t *testing.T) {
 	suite.Run(t, new(userTestSuite))
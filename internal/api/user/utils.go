@@ -1,6 +1,11 @@
 package user
 
 import (
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/projecteru2/vmihub/config"
+	"github.com/projecteru2/vmihub/internal/common"
 	"github.com/projecteru2/vmihub/internal/models"
 	"github.com/projecteru2/vmihub/pkg/types"
 )
@@ -10,7 +15,51 @@ func convUserResp(u *models.User) *types.UserInfoResp {
 		ID:       u.ID,
 		Username: u.Username,
 		IsAdmin:  u.Admin,
+		Disabled: u.Disabled,
 		Email:    u.Email,
 		Nickname: u.Nickname,
 	}
 }
+
+// newTokenPair signs an access token and the refresh token of it,
+// the tokens are restricted by scopes and repos if they aren't empty.
+func newTokenPair(userID int64, username string, scopes, repos []string) (*types.TokenResponse, error) {
+	j := common.NewJWT(config.GetCfg().JWT.SigningKey)
+
+	// generate access token
+	accessClaims := models.CustomClaims{
+		ID:       userID,
+		UserName: username,
+		Scopes:   scopes,
+		Repos:    repos,
+		StandardClaims: jwt.StandardClaims{
+			NotBefore: time.Now().Unix(),           // signature takes effect time
+			ExpiresAt: time.Now().Unix() + 60*60*2, // 2 hours later expires
+			Issuer:    "eru",
+			Subject:   "access",
+		},
+	}
+	accessTokenString, err := j.CreateToken(accessClaims)
+	if err != nil {
+		return nil, err
+	}
+
+	// generate refresh token
+	refreshClaims := models.CustomClaims{
+		ID:       userID,
+		UserName: username,
+		Scopes:   scopes,
+		Repos:    repos,
+		StandardClaims: jwt.StandardClaims{
+			NotBefore: time.Now().Unix(),            // signature takes effect time
+			ExpiresAt: time.Now().Unix() + 60*60*24, // 24 hours later expires
+			Issuer:    "eru",
+			Subject:   refreshPrefix + accessTokenString,
+		},
+	}
+	refreshTokenString, err := j.CreateToken(refreshClaims)
+	if err != nil {
+		return nil, err
+	}
+	return &types.TokenResponse{AccessToken: accessTokenString, RefreshToken: refreshTokenString}, nil
+}
@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/projecteru2/vmihub/config"
+	"github.com/projecteru2/vmihub/internal/models"
+)
+
+// Authenticator checks the username and password of user,
+// terrors.ErrInvalidUserPass or terrors.ErrUserDisabled is returned if the user can't login.
+type Authenticator interface {
+	Authenticate(ctx context.Context, username, password string) (*models.User, error)
+}
+
+// Local checks the password hashes stored in user table
+type Local struct{}
+
+func (Local) Authenticate(ctx context.Context, username, password string) (*models.User, error) {
+	return models.CheckAndGetUser(ctx, username, password)
+}
+
+var authenticator Authenticator = Local{}
+
+// Init sets the authenticator according to config
+func Init(cfg *config.AuthConfig) error {
+	switch cfg.Type {
+	case "", "local":
+		authenticator = Local{}
+	case "ldap":
+		a, err := NewLDAP(&cfg.LDAP)
+		if err != nil {
+			return err
+		}
+		authenticator = a
+	default:
+		return fmt.Errorf("invalid authenticator %s", cfg.Type)
+	}
+	return nil
+}
+
+// SetAuthenticator replaces the authenticator, eg: by a custom implementation
+func SetAuthenticator(a Authenticator) {
+	authenticator = a
+}
+
+// Authenticate checks username and password by the authenticator
+func Authenticate(ctx context.Context, username, password string) (*models.User, error) {
+	return authenticator.Authenticate(ctx, username, password)
+}
@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/projecteru2/core/log"
+	"github.com/projecteru2/vmihub/config"
+	"github.com/projecteru2/vmihub/internal/models"
+	"github.com/projecteru2/vmihub/internal/utils"
+	"github.com/projecteru2/vmihub/pkg/terrors"
+	"github.com/redis/go-redis/v9"
+	"github.com/samber/lo"
+)
+
+// the user id of a successful bind, keyed by the HMAC of username and password
+const redisBindKey = "/vmihub/ldap/bind/%s"
+
+// ldapConn is the part of *ldap.Conn used by LDAP
+type ldapConn interface {
+	Bind(username, password string) error
+	Search(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+// LDAP binds to LDAP server as the user, the local user is created on first login
+type LDAP struct {
+	cfg  *config.LDAPConfig
+	dial func() (ldapConn, error)
+	// the HMAC key of bind cache
+	secret []byte
+}
+
+func NewLDAP(cfg *config.LDAPConfig) (*LDAP, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("LDAP url is empty")
+	}
+	if strings.Count(cfg.UserDNTemplate, "%s") != 1 {
+		return nil, fmt.Errorf("invalid LDAP user DN template %s", cfg.UserDNTemplate)
+	}
+	l := &LDAP{cfg: cfg, secret: []byte(cfg.CacheSecret)}
+	l.dial = l.dialServer
+	if len(l.secret) == 0 {
+		l.secret = make([]byte, 32)
+		if _, err := rand.Read(l.secret); err != nil {
+			return nil, fmt.Errorf("failed to generate the key of bind cache: %w", err)
+		}
+	}
+	return l, nil
+}
+
+func (l *LDAP) dialServer() (ldapConn, error) {
+	tlsCfg := &tls.Config{InsecureSkipVerify: l.cfg.InsecureSkipVerify} //nolint:gosec
+	conn, err := ldap.DialURL(l.cfg.URL, ldap.DialWithTLSConfig(tlsCfg))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(l.cfg.Timeout)
+	if l.cfg.StartTLS {
+		if err := conn.StartTLS(tlsCfg); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (l *LDAP) Authenticate(ctx context.Context, username, password string) (*models.User, error) {
+	// the server treats a bind without password as an anonymous bind
+	if username == "" || password == "" {
+		return nil, terrors.ErrInvalidUserPass
+	}
+	key := l.bindKey(username, password)
+	if user, err := cachedUser(ctx, key); err != nil || user != nil {
+		return user, err
+	}
+	conn, err := l.dial()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect LDAP server: %w", err)
+	}
+	defer conn.Close()
+
+	userDN := fmt.Sprintf(l.cfg.UserDNTemplate, ldap.EscapeDN(username))
+	if err := conn.Bind(userDN, password); err != nil {
+		if !ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, fmt.Errorf("failed to bind %s: %w", userDN, err)
+		}
+		if l.cfg.FallbackLocal {
+			return models.CheckAndGetUser(ctx, username, password)
+		}
+		return nil, terrors.ErrInvalidUserPass
+	}
+	account, err := l.lookupAccount(conn, userDN, username)
+	if err != nil {
+		return nil, err
+	}
+	user, err := models.ProvisionUser(ctx, account, len(l.cfg.AdminGroups) > 0)
+	if errors.Is(err, terrors.ErrNameTaken) {
+		// a local user or organization has the same name, the directory account never logs in as it
+		log.WithFunc("LDAP.Authenticate").Warnf(ctx, "LDAP user %s conflicts with a local name", username)
+		if l.cfg.FallbackLocal {
+			return models.CheckAndGetUser(ctx, username, password)
+		}
+		return nil, terrors.ErrInvalidUserPass
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.Disabled {
+		return nil, terrors.ErrUserDisabled
+	}
+	if err := utils.GetRedisConn().Set(ctx, key, user.ID, l.cfg.CacheTTL).Err(); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// bindKey returns the redis key of the bind of username and password, the password isn't stored
+// and can't be brute-forced from the key without the secret
+func (l *LDAP) bindKey(username, password string) string {
+	mac := hmac.New(sha256.New, l.secret)
+	mac.Write([]byte(username + "\x00" + password))
+	return fmt.Sprintf(redisBindKey, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// cachedUser returns the user of a successful bind which isn't expired yet,
+// nil is returned if there is no such bind or the user is deleted.
+func cachedUser(ctx context.Context, key string) (*models.User, error) {
+	id, err := utils.GetRedisConn().Get(ctx, key).Int64()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil //nolint:nilnil
+	}
+	if err != nil {
+		return nil, err
+	}
+	user, err := models.GetUserByID(ctx, id)
+	if err != nil || user == nil || user.Source != models.UserSourceLDAP {
+		return nil, err
+	}
+	if user.Disabled {
+		return nil, terrors.ErrUserDisabled
+	}
+	return user, nil
+}
+
+// lookupAccount reads the attributes and groups of user from LDAP server
+func (l *LDAP) lookupAccount(conn ldapConn, userDN, username string) (*models.User, error) {
+	account := &models.User{Username: username, Source: models.UserSourceLDAP}
+	res, err := conn.Search(ldap.NewSearchRequest(
+		userDN, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 0, false,
+		"(objectClass=*)", []string{l.cfg.EmailAttr, l.cfg.NicknameAttr}, nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to search user %s: %w", userDN, err)
+	}
+	if len(res.Entries) > 0 {
+		account.Email = res.Entries[0].GetAttributeValue(l.cfg.EmailAttr)
+		account.Nickname = res.Entries[0].GetAttributeValue(l.cfg.NicknameAttr)
+	}
+	if len(l.cfg.AdminGroups) == 0 {
+		return account, nil
+	}
+	res, err = conn.Search(ldap.NewSearchRequest(
+		l.cfg.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf(l.cfg.GroupFilter, ldap.EscapeFilter(userDN)), []string{l.cfg.GroupAttr}, nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to search groups of %s: %w", userDN, err)
+	}
+	for _, entry := range res.Entries {
+		if lo.Contains(l.cfg.AdminGroups, entry.GetAttributeValue(l.cfg.GroupAttr)) {
+			account.Admin = true
+			break
+		}
+	}
+	return account, nil
+}
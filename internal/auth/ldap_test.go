@@ -0,0 +1,232 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/projecteru2/vmihub/config"
+	"github.com/projecteru2/vmihub/internal/models"
+	"github.com/projecteru2/vmihub/internal/utils"
+	"github.com/projecteru2/vmihub/pkg/terrors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	userTableName = ((*models.User)(nil)).TableName()
+	userColumns   = ((*models.User)(nil)).ColumnNames()
+	orgTableName  = ((*models.Organization)(nil)).TableName()
+	orgColumns    = ((*models.Organization)(nil)).ColumnNames()
+)
+
+// fakeConn is a LDAP server with a few users and groups
+type fakeConn struct {
+	binds     int
+	passwords map[string]string
+	users     []*ldap.Entry
+	groups    []*ldap.Entry
+}
+
+func (c *fakeConn) Bind(dn, password string) error {
+	c.binds++
+	if pw, ok := c.passwords[dn]; ok && pw == password {
+		return nil
+	}
+	return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+}
+
+func (c *fakeConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	res := &ldap.SearchResult{}
+	for _, e := range c.users {
+		if e.DN == req.BaseDN {
+			res.Entries = append(res.Entries, e)
+		}
+	}
+	if req.BaseDN == "ou=groups,dc=example,dc=com" {
+		for _, e := range c.groups {
+			for _, member := range e.GetAttributeValues("member") {
+				if req.Filter == fmt.Sprintf("(member=%s)", ldap.EscapeFilter(member)) {
+					res.Entries = append(res.Entries, e)
+				}
+			}
+		}
+	}
+	return res, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func newTestLDAP(t *testing.T) *LDAP {
+	utils.SetupRedis(nil, t)
+	require.NoError(t, models.Init(nil, t))
+
+	cfg := &config.LDAPConfig{
+		URL:            "ldap://127.0.0.1:389",
+		UserDNTemplate: "uid=%s,ou=people,dc=example,dc=com",
+		EmailAttr:      "mail",
+		NicknameAttr:   "displayName",
+		GroupBaseDN:    "ou=groups,dc=example,dc=com",
+		GroupFilter:    "(member=%s)",
+		GroupAttr:      "cn",
+		AdminGroups:    []string{"vmihub-admins"},
+		CacheTTL:       time.Minute,
+	}
+	l, err := NewLDAP(cfg)
+	require.NoError(t, err)
+	conn := &fakeConn{
+		passwords: map[string]string{
+			"uid=alice,ou=people,dc=example,dc=com": "alicepw",
+			"uid=bob,ou=people,dc=example,dc=com":   "bobpw",
+			"uid=root,ou=people,dc=example,dc=com":  "ldaprootpw",
+		},
+		users: []*ldap.Entry{
+			ldap.NewEntry("uid=alice,ou=people,dc=example,dc=com", map[string][]string{
+				"mail":        {"alice@example.com"},
+				"displayName": {"Alice"},
+			}),
+		},
+		groups: []*ldap.Entry{
+			ldap.NewEntry("cn=vmihub-admins,ou=groups,dc=example,dc=com", map[string][]string{
+				"cn":     {"vmihub-admins"},
+				"member": {"uid=alice,ou=people,dc=example,dc=com"},
+			}),
+		},
+	}
+	l.dial = func() (ldapConn, error) { return conn, nil }
+	return l
+}
+
+func getFakeConn(t *testing.T, l *LDAP) *fakeConn {
+	conn, err := l.dial()
+	require.NoError(t, err)
+	return conn.(*fakeConn)
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	l := newTestLDAP(t)
+	ctx := context.Background()
+
+	// the user is created on first login
+	models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ?", userColumns, userTableName)).
+		WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username"}))
+	models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE name = ?", orgColumns, orgTableName)).
+		WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}))
+	models.Mock.ExpectBegin()
+	models.Mock.ExpectExec("INSERT INTO user (username, password, email, nickname, admin, source) VALUES (?, ?, ?, ?, ?, ?)").
+		WithArgs("alice", sqlmock.AnyArg(), "alice@example.com", "Alice", true, models.UserSourceLDAP).
+		WillReturnResult(sqlmock.NewResult(100, 1))
+	models.Mock.ExpectCommit()
+	user, err := l.Authenticate(ctx, "alice", "alicepw")
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), user.ID)
+	assert.True(t, user.Admin)
+	assert.Nil(t, models.Mock.ExpectationsWereMet())
+
+	// the bind is cached
+	conn := getFakeConn(t, l)
+	binds := conn.binds
+	models.Mock.ExpectQuery(fmt.Sprintf("SELECT * FROM %s WHERE id = ?", userTableName)).
+		WithArgs(100).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "admin", "source"}).AddRow(100, "alice", true, models.UserSourceLDAP))
+	user, err = l.Authenticate(ctx, "alice", "alicepw")
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), user.ID)
+	assert.Equal(t, binds, conn.binds)
+	assert.Nil(t, models.Mock.ExpectationsWereMet())
+
+	_, err = l.Authenticate(ctx, "alice", "wrong")
+	assert.ErrorIs(t, err, terrors.ErrInvalidUserPass)
+	_, err = l.Authenticate(ctx, "alice", "")
+	assert.ErrorIs(t, err, terrors.ErrInvalidUserPass)
+
+	// bob left the admin group and is disabled
+	models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ?", userColumns, userTableName)).
+		WithArgs("bob").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "admin", "disabled", "source"}).
+			AddRow(101, "bob", true, true, models.UserSourceLDAP))
+	models.Mock.ExpectBegin()
+	models.Mock.ExpectExec("UPDATE user SET nickname = ?, email = ?, admin = ?, disabled = ? WHERE id = ?").
+		WithArgs("", "", false, true, 101).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	models.Mock.ExpectCommit()
+	_, err = l.Authenticate(ctx, "bob", "bobpw")
+	assert.ErrorIs(t, err, terrors.ErrUserDisabled)
+	assert.Nil(t, models.Mock.ExpectationsWereMet())
+}
+
+func TestLDAPFallbackLocal(t *testing.T) {
+	l := newTestLDAP(t)
+	l.cfg.FallbackLocal = true
+	ePasswd, err := utils.EncryptPassword("rootpw")
+	require.NoError(t, err)
+
+	models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ?", userColumns, userTableName)).
+		WithArgs("root").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password", "admin"}).AddRow(1, "root", ePasswd, true))
+	user, err := l.Authenticate(context.Background(), "root", "rootpw")
+	require.NoError(t, err)
+	assert.Equal(t, "root", user.Username)
+	assert.Nil(t, models.Mock.ExpectationsWereMet())
+}
+
+func TestLDAPLocalNameTaken(t *testing.T) {
+	l := newTestLDAP(t)
+	ctx := context.Background()
+	ePasswd, err := utils.EncryptPassword("rootpw")
+	require.NoError(t, err)
+	expectRoot := func() {
+		utils.MockRedis.FlushAll()
+		models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ?", userColumns, userTableName)).
+			WithArgs("root").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password", "admin", "source"}).
+				AddRow(1, "root", ePasswd, true, models.UserSourceLocal))
+	}
+
+	// the directory account never logs in as the local user with the same name
+	expectRoot()
+	_, err = l.Authenticate(ctx, "root", "ldaprootpw")
+	assert.ErrorIs(t, err, terrors.ErrInvalidUserPass)
+	assert.Nil(t, models.Mock.ExpectationsWereMet())
+
+	// only the local password is accepted when falling back to local users
+	l.cfg.FallbackLocal = true
+	expectRoot()
+	_, err = l.Authenticate(ctx, "root", "ldaprootpw")
+	assert.ErrorIs(t, err, terrors.ErrInvalidUserPass)
+	assert.Nil(t, models.Mock.ExpectationsWereMet())
+}
+
+func TestLDAPBindKey(t *testing.T) {
+	cfg := &config.LDAPConfig{
+		URL:            "ldap://127.0.0.1:389",
+		UserDNTemplate: "uid=%s,ou=people,dc=example,dc=com",
+		CacheSecret:    "secret",
+	}
+	l1, err := NewLDAP(cfg)
+	require.NoError(t, err)
+	l2, err := NewLDAP(cfg)
+	require.NoError(t, err)
+	// the instances sharing the secret share the cached binds
+	assert.Equal(t, l1.bindKey("alice", "alicepw"), l2.bindKey("alice", "alicepw"))
+	assert.NotEqual(t, l1.bindKey("alice", "alicepw"), l1.bindKey("alice", "other"))
+
+	// the key can't be computed from username and password only
+	sum := sha256.Sum256([]byte("alice\x00alicepw"))
+	assert.NotEqual(t, fmt.Sprintf(redisBindKey, hex.EncodeToString(sum[:])), l1.bindKey("alice", "alicepw"))
+	cfg2 := *cfg
+	cfg2.CacheSecret = ""
+	l3, err := NewLDAP(&cfg2)
+	require.NoError(t, err)
+	assert.NotEqual(t, l1.bindKey("alice", "alicepw"), l3.bindKey("alice", "alicepw"))
+}
@@ -0,0 +1,262 @@
+package blob
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/projecteru2/core/log"
+	"github.com/projecteru2/vmihub/internal/models"
+	"github.com/projecteru2/vmihub/internal/rbd"
+	"github.com/projecteru2/vmihub/internal/storage"
+	"github.com/projecteru2/vmihub/internal/utils"
+	"github.com/projecteru2/vmihub/pkg/terrors"
+)
+
+const (
+	migrateBatchSize = 100
+	// files bigger than chunkThreshold are written with PutWithChunk
+	chunkThreshold = 4 * utils.GB
+	chunkSize      = 300 * utils.MB
+	// the critical sections under the lock of a blob are a database commit or a deletion
+	lockExpiry = time.Minute
+)
+
+// lock locks the blob of digest across all instances
+func lock(ctx context.Context, digest string) (func(), error) {
+	unlock, err := utils.LockRedisKey(ctx, fmt.Sprintf(models.RedisBlobLockKey, digest), lockExpiry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock blob %s: %w", digest, err)
+	}
+	return unlock, nil
+}
+
+// Link runs commit, which saves img referencing the blob of its digest, with the blob locked,
+// so the blob can't be deleted by Release between checking its existence and committing the image.
+// ErrBlobNotFound is returned without calling commit if the blob is deleted already, eg: by a concurrent Release.
+func Link(ctx context.Context, sto storage.Storage, img *models.Image, commit func() error) error {
+	// rbd images are not stored in storage
+	if img.Format == models.ImageFormatRBD || img.Digest == "" {
+		return commit()
+	}
+	unlock, err := lock(ctx, img.Digest)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	exists, err := sto.Exists(ctx, img.BlobName())
+	if err != nil {
+		return fmt.Errorf("failed to check blob %s: %w", img.Digest, err)
+	}
+	if !exists {
+		return fmt.Errorf("%w: %s", terrors.ErrBlobNotFound, img.Digest)
+	}
+	return commit()
+}
+
+// Release removes the blob of digest from storage when no image references it any more.
+// It should be called after the image rows which referenced the blob are deleted or updated.
+// The blob is locked while counting and deleting, so an image linked by Link concurrently is never left dangling.
+func Release(ctx context.Context, sto storage.Storage, digest string) (deleted bool, err error) {
+	if digest == "" {
+		return false, nil
+	}
+	unlock, err := lock(ctx, digest)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	count, err := models.CountImagesByDigest(ctx, digest)
+	if err != nil {
+		return false, fmt.Errorf("failed to count references of blob %s: %w", digest, err)
+	}
+	if count > 0 {
+		return false, nil
+	}
+	if err = sto.Delete(ctx, models.BlobName(digest), true); err != nil {
+		return false, fmt.Errorf("failed to delete blob %s: %w", digest, err)
+	}
+	return true, nil
+}
+
+// ReleaseImage removes the file of a deleted or overwritten image from storage,
+// the blob is kept if other images still reference it.
+func ReleaseImage(ctx context.Context, sto storage.Storage, img *models.Image) error {
+	// rbd images are not stored in storage
+	if img.Format == models.ImageFormatRBD {
+		return ReleaseSnapshot(ctx, img.Snapshot)
+	}
+	if _, err := Release(ctx, sto, img.Digest); err != nil {
+		return err
+	}
+	// the image may not be migrated to blob store yet
+	return sto.Delete(ctx, img.Fullname(), true)
+}
+
+// ReleaseSnapshot removes the rbd snapshot and its image when no image references it any more.
+func ReleaseSnapshot(ctx context.Context, snapshot string) error {
+	if snapshot == "" {
+		return nil
+	}
+	count, err := models.CountImagesBySnapshot(ctx, snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to count references of snapshot %s: %w", snapshot, err)
+	}
+	if count > 0 {
+		return nil
+	}
+	return rbd.Remove(ctx, snapshot)
+}
+
+// PutFile writes a local file to the blob store, it does nothing if the blob already exists.
+// digest must be verified by caller.
+func PutFile(ctx context.Context, sto storage.Storage, fname, digest string) error {
+	name := models.BlobName(digest)
+	exists, err := sto.Exists(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to check blob %s: %w", digest, err)
+	}
+	if exists {
+		return nil
+	}
+	fp, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	fi, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() < chunkThreshold {
+		err = sto.Put(ctx, name, digest, fp)
+	} else {
+		err = sto.PutWithChunk(ctx, name, digest, int(fi.Size()), chunkSize, fp)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write blob %s: %w", digest, err)
+	}
+	return nil
+}
+
+// PutObject moves an object in storage to the blob store, the object is removed
+// if the blob already exists. digest must be verified by caller.
+func PutObject(ctx context.Context, sto storage.Storage, src, digest string) error {
+	name := models.BlobName(digest)
+	exists, err := sto.Exists(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to check blob %s: %w", digest, err)
+	}
+	if exists {
+		return sto.Delete(ctx, src, true)
+	}
+	if err := sto.Move(ctx, src, name); err != nil {
+		return fmt.Errorf("failed to move %s to blob %s: %w", src, digest, err)
+	}
+	return nil
+}
+
+// ObjectName returns the storage object of image, images which are not
+// migrated to the blob store yet are still stored under their full name.
+func ObjectName(ctx context.Context, sto storage.Storage, img *models.Image) (string, error) {
+	exists, err := sto.Exists(ctx, img.BlobName())
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return img.BlobName(), nil
+	}
+	return img.Fullname(), nil
+}
+
+type MigrateStats struct {
+	Moved   int
+	Deduped int
+	Skipped int
+	Missing int
+	Failed  int
+}
+
+func (st *MigrateStats) String() string {
+	return fmt.Sprintf("moved: %d, deduped: %d, skipped: %d, missing: %d, failed: %d",
+		st.Moved, st.Deduped, st.Skipped, st.Missing, st.Failed)
+}
+
+// Migrate moves the image files which are still stored under "user/name:tag"
+// to the content-addressed blob store. When the blob already exists the legacy
+// object is simply removed. It is safe to run Migrate multiple times.
+func Migrate(ctx context.Context, sto storage.Storage, dryRun bool) (*MigrateStats, error) {
+	logger := log.WithFunc("blob.Migrate")
+	stats := &MigrateStats{}
+	var lastID int64
+	for {
+		images, err := models.QueryImagesAfterID(ctx, lastID, migrateBatchSize)
+		if err != nil {
+			return stats, err
+		}
+		if len(images) == 0 {
+			return stats, nil
+		}
+		for idx := range images {
+			img := &images[idx]
+			lastID = img.ID
+			if err := migrateImage(ctx, sto, img, dryRun, stats); err != nil {
+				stats.Failed++
+				logger.Errorf(ctx, err, "failed to migrate image %s", img.Fullname())
+			}
+		}
+	}
+}
+
+func migrateImage(ctx context.Context, sto storage.Storage, img *models.Image, dryRun bool, stats *MigrateStats) error {
+	logger := log.WithFunc("blob.migrateImage")
+	// rbd images are not stored in storage
+	if img.Format == models.ImageFormatRBD || img.Digest == "" {
+		stats.Skipped++
+		return nil
+	}
+	legacyName, blobName := img.Fullname(), img.BlobName()
+	legacyExists, err := sto.Exists(ctx, legacyName)
+	if err != nil {
+		return err
+	}
+	blobExists, err := sto.Exists(ctx, blobName)
+	if err != nil {
+		return err
+	}
+	switch {
+	case !legacyExists && blobExists:
+		stats.Skipped++
+		return nil
+	case !legacyExists:
+		stats.Missing++
+		logger.Warnf(ctx, "image %s has neither legacy object nor blob", img.Fullname())
+		return nil
+	}
+
+	digest, err := sto.GetDigest(ctx, legacyName)
+	if err != nil {
+		return err
+	}
+	if digest != img.Digest {
+		return fmt.Errorf("digest mismatch, expected %s, got %s", img.Digest, digest)
+	}
+	logger.Infof(ctx, "migrating %s to %s(blob exists: %v, dry run: %v)", legacyName, blobName, blobExists, dryRun)
+	if blobExists {
+		if !dryRun {
+			if err = sto.Delete(ctx, legacyName, true); err != nil {
+				return err
+			}
+		}
+		stats.Deduped++
+		return nil
+	}
+	if !dryRun {
+		if err = sto.Move(ctx, legacyName, blobName); err != nil {
+			return err
+		}
+	}
+	stats.Moved++
+	return nil
+}
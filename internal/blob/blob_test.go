@@ -0,0 +1,128 @@
+package blob
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/projecteru2/vmihub/internal/models"
+	"github.com/projecteru2/vmihub/internal/storage/mocks"
+	"github.com/projecteru2/vmihub/internal/utils"
+	"github.com/projecteru2/vmihub/pkg/terrors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const (
+	digest1 = "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72"
+	digest2 = "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+)
+
+func TestRelease(t *testing.T) {
+	err := models.Init(nil, t)
+	assert.Nil(t, err)
+	utils.SetupRedis(nil, t)
+	defer func() {
+		assert.Nil(t, models.Mock.ExpectationsWereMet())
+	}()
+	ctx := context.Background()
+	sto := &mocks.Storage{}
+	defer sto.AssertExpectations(t)
+
+	// still referenced by other images
+	models.Mock.ExpectQuery("SELECT count(*) FROM image WHERE digest = ?").
+		WithArgs(digest1).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	deleted, err := Release(ctx, sto, digest1)
+	assert.Nil(t, err)
+	assert.False(t, deleted)
+
+	// the last reference goes away
+	models.Mock.ExpectQuery("SELECT count(*) FROM image WHERE digest = ?").
+		WithArgs(digest1).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	sto.On("Delete", mock.Anything, models.BlobName(digest1), true).Return(nil).Once()
+	deleted, err = Release(ctx, sto, digest1)
+	assert.Nil(t, err)
+	assert.True(t, deleted)
+}
+
+func TestLink(t *testing.T) {
+	utils.SetupRedis(nil, t)
+	ctx := context.Background()
+	sto := &mocks.Storage{}
+	defer sto.AssertExpectations(t)
+
+	img := &models.Image{Digest: digest1, Format: models.ImageFormatQcow2}
+	lockKey := fmt.Sprintf(models.RedisBlobLockKey, digest1)
+	// whether the blob is locked during each commit
+	var locked []bool
+	commit := func() error {
+		locked = append(locked, utils.MockRedis.Exists(lockKey))
+		return nil
+	}
+	sto.On("Exists", mock.Anything, models.BlobName(digest1)).Return(true, nil).Once()
+	err := Link(ctx, sto, img, commit)
+	assert.Nil(t, err)
+	assert.Equal(t, []bool{true}, locked)
+	assert.False(t, utils.MockRedis.Exists(lockKey))
+
+	// the blob is released before the image is committed
+	sto.On("Exists", mock.Anything, models.BlobName(digest1)).Return(false, nil).Once()
+	err = Link(ctx, sto, img, commit)
+	assert.ErrorIs(t, err, terrors.ErrBlobNotFound)
+	assert.Len(t, locked, 1)
+
+	// rbd images are not stored in storage
+	img.Format = models.ImageFormatRBD
+	err = Link(ctx, sto, img, commit)
+	assert.Nil(t, err)
+	assert.Equal(t, []bool{true, false}, locked)
+}
+
+func TestMigrate(t *testing.T) {
+	err := models.Init(nil, t)
+	assert.Nil(t, err)
+	defer func() {
+		assert.Nil(t, models.Mock.ExpectationsWereMet())
+	}()
+	ctx := context.Background()
+	sto := &mocks.Storage{}
+	defer sto.AssertExpectations(t)
+
+	sqlStr := `SELECT i.id, i.repo_id, r.username, r.name, r.private, i.tag, i.size, i.digest, i.format, i.snapshot
+	           FROM image i, repository r
+	           WHERE r.id=i.repo_id AND i.id > ?
+	           ORDER BY i.id LIMIT ?`
+	columns := []string{"id", "repo_id", "username", "name", "private", "tag", "size", "digest", "format", "snapshot"}
+	models.Mock.ExpectQuery(sqlStr).
+		WithArgs(0, migrateBatchSize).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(1, 1, "user1", "name1", false, "v1", 10, digest1, "qcow2", "").
+			AddRow(2, 2, "user2", "name2", false, "v1", 10, digest1, "qcow2", "").
+			AddRow(3, 2, "user2", "name2", false, "v2", 10, digest2, "qcow2", "").
+			AddRow(4, 2, "user2", "name2", false, "v3", 0, "", "rbd", "eru/name2@v3"))
+	models.Mock.ExpectQuery(sqlStr).
+		WithArgs(4, migrateBatchSize).
+		WillReturnRows(sqlmock.NewRows(columns))
+
+	// moved to blob store
+	sto.On("Exists", mock.Anything, "user1/name1:v1").Return(true, nil).Once()
+	sto.On("Exists", mock.Anything, models.BlobName(digest1)).Return(false, nil).Once()
+	sto.On("GetDigest", mock.Anything, "user1/name1:v1").Return(digest1, nil).Once()
+	sto.On("Move", mock.Anything, "user1/name1:v1", models.BlobName(digest1)).Return(nil).Once()
+	// same file, just remove the legacy object
+	sto.On("Exists", mock.Anything, "user2/name2:v1").Return(true, nil).Once()
+	sto.On("Exists", mock.Anything, models.BlobName(digest1)).Return(true, nil).Once()
+	sto.On("GetDigest", mock.Anything, "user2/name2:v1").Return(digest1, nil).Once()
+	sto.On("Delete", mock.Anything, "user2/name2:v1", true).Return(nil).Once()
+	// file is broken
+	sto.On("Exists", mock.Anything, "user2/name2:v2").Return(true, nil).Once()
+	sto.On("Exists", mock.Anything, models.BlobName(digest2)).Return(false, nil).Once()
+	sto.On("GetDigest", mock.Anything, "user2/name2:v2").Return(digest1, nil).Once()
+
+	stats, err := Migrate(ctx, sto, false)
+	assert.Nil(t, err)
+	assert.Equal(t, &MigrateStats{Moved: 1, Deduped: 1, Skipped: 1, Failed: 1}, stats)
+}
@@ -0,0 +1,30 @@
+package common
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/projecteru2/vmihub/internal/models"
+)
+
+const auditKey = "auditLog"
+
+// Audit marks the request to be recorded by audit log after it is handled,
+// the returned log can be filled with digest and detail later,
+// and calling it again replaces the target.
+func Audit(c *gin.Context, action, target string) *models.AuditLog {
+	if l := GetAudit(c); l != nil {
+		l.Action, l.Target = action, target
+		return l
+	}
+	l := &models.AuditLog{Action: action, Target: target}
+	c.Set(auditKey, l)
+	return l
+}
+
+// GetAudit returns the audit log of request, nil is returned if the request isn't audited
+func GetAudit(c *gin.Context) *models.AuditLog {
+	value, exists := c.Get(auditKey)
+	if !exists {
+		return nil
+	}
+	return value.(*models.AuditLog) //nolint
+}
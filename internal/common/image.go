@@ -1,7 +1,10 @@
 package common
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/projecteru2/core/log"
@@ -19,7 +22,7 @@ func GetRepoImageForUpload(c *gin.Context, imgUser, name, tag string) (repo *mod
 		err = terrors.ErrPlaceholder
 		return
 	}
-	if !curUser.Admin && curUser.Username != imgUser {
+	if !CheckRepoWritePermByName(c, imgUser, name) {
 		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
 			"error": "you don't have permission to upload to this image",
 		})
@@ -45,5 +48,142 @@ func GetRepoImageForUpload(c *gin.Context, imgUser, name, tag string) (repo *mod
 		})
 		return
 	}
+	// administrators can overwrite any tag
+	if img != nil && !curUser.Admin {
+		if err = repo.CheckOverwrite(img); err != nil {
+			AbortWithTagProtectionError(c, err)
+			err = terrors.ErrPlaceholder
+		}
+	}
 	return
 }
+
+// AbortWithTagProtectionError aborts the request with 409 for immutable tags and 403 for protected tags
+func AbortWithTagProtectionError(c *gin.Context, err error) {
+	code := http.StatusForbidden
+	if errors.Is(err, terrors.ErrImmutableTag) {
+		code = http.StatusConflict
+	}
+	c.AbortWithStatusJSON(code, gin.H{
+		"error": err.Error(),
+	})
+}
+
+// the permissions on the repositories of a namespace
+const (
+	PermRead   = "read"
+	PermWrite  = "write"
+	PermDelete = "delete"
+)
+
+// permOrgRoles is the minimal role of organization members which has each permission
+var permOrgRoles = map[string]string{
+	PermRead:   models.OrgRoleReader,
+	PermWrite:  models.OrgRoleDeveloper,
+	PermDelete: models.OrgRoleMaintainer,
+}
+
+// CheckNamespacePerm returns true if the login user has perm on the repositories of namespace,
+// namespace is either a username or the name of an organization.
+func CheckNamespacePerm(c *gin.Context, namespace, perm string) bool {
+	curUser, exists := LoginUser(c)
+	if !exists {
+		return false
+	}
+	if curUser.Admin || strings.EqualFold(curUser.Username, namespace) {
+		return true
+	}
+	role, err := getOrgRole(c, curUser, namespace)
+	if err != nil {
+		log.WithFunc("CheckNamespacePerm").Errorf(c, err, "failed to get role of %s in %s", curUser.Username, namespace)
+		return false
+	}
+	return models.OrgRoleAtLeast(role, permOrgRoles[perm])
+}
+
+// getOrgRole returns the role of user in organization, it is cached in the context of request
+func getOrgRole(c *gin.Context, user *models.User, org string) (string, error) {
+	key := fmt.Sprintf("orgRole/%s", org)
+	if role, ok := c.Get(key); ok {
+		return role.(string), nil
+	}
+	role, err := models.GetOrgRole(c, org, user.ID)
+	if err != nil {
+		return "", err
+	}
+	c.Set(key, role)
+	return role, nil
+}
+
+// getRepoPerm returns the permission granted to the login user on repository,
+// it is cached in the context of request
+func getRepoPerm(c *gin.Context, repo *models.Repository) string {
+	curUser, exists := LoginUser(c)
+	if !exists {
+		return ""
+	}
+	key := fmt.Sprintf("repoPerm/%d", repo.ID)
+	if perm, ok := c.Get(key); ok {
+		return perm.(string)
+	}
+	perm, err := models.GetRepoPerm(c, repo.ID, curUser.ID)
+	if err != nil {
+		log.WithFunc("getRepoPerm").Errorf(c, err, "failed to get permission of %s on %s", curUser.Username, repo.Fullname())
+		return ""
+	}
+	c.Set(key, perm)
+	return perm
+}
+
+// CheckRepoReadPerm returns true if the login user can read the repository,
+// the CheckRepo* functions also check the scope of credential.
+func CheckRepoReadPerm(c *gin.Context, repo *models.Repository) bool {
+	if !repo.Private {
+		return true
+	}
+	if !LoginScope(c).HasRepo(models.ScopeImageRead, repo.Fullname()) {
+		return false
+	}
+	if CheckNamespacePerm(c, repo.Username, PermRead) {
+		return true
+	}
+	// both read and write grants allow pulling
+	return getRepoPerm(c, repo) != ""
+}
+
+// CheckRepoWritePerm returns true if the login user can write the repository
+func CheckRepoWritePerm(c *gin.Context, repo *models.Repository) bool {
+	if !LoginScope(c).HasRepo(models.ScopeImageWrite, repo.Fullname()) {
+		return false
+	}
+	if CheckNamespacePerm(c, repo.Username, PermWrite) {
+		return true
+	}
+	return getRepoPerm(c, repo) == models.RepoPermWrite
+}
+
+// CheckRepoWritePermByName is like CheckRepoWritePerm but the repository may not exist,
+// only the users who have write permission on namespace can create repositories.
+func CheckRepoWritePermByName(c *gin.Context, username, name string) bool {
+	if !LoginScope(c).HasRepo(models.ScopeImageWrite, fmt.Sprintf("%s/%s", username, name)) {
+		return false
+	}
+	if CheckNamespacePerm(c, username, PermWrite) {
+		return true
+	}
+	repo, err := models.QueryRepo(c, username, name)
+	if err != nil {
+		log.WithFunc("CheckRepoWritePermByName").Errorf(c, err, "can't query repository: %s/%s", username, name)
+		return false
+	}
+	return repo != nil && getRepoPerm(c, repo) == models.RepoPermWrite
+}
+
+// CheckRepoDeletePerm returns true if the login user can delete the repository and its images,
+// collaborators can't delete.
+func CheckRepoDeletePerm(c *gin.Context, repo *models.Repository) bool {
+	if !LoginScope(c).HasRepo(models.ScopeImageDelete, repo.Fullname()) {
+		return false
+	}
+	return CheckNamespacePerm(c, repo.Username, PermDelete)
+}
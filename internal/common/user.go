@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"regexp"
 	"strings"
 	"time"
 
@@ -12,7 +13,9 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/projecteru2/core/log"
 	"github.com/projecteru2/vmihub/config"
+	"github.com/projecteru2/vmihub/internal/auth"
 	"github.com/projecteru2/vmihub/internal/models"
+	"github.com/projecteru2/vmihub/internal/utils"
 	"github.com/projecteru2/vmihub/pkg/terrors"
 )
 
@@ -20,6 +23,42 @@ const (
 	userIDSessionKey = "userID"
 )
 
+// the methods which users are authenticated by
+const (
+	AuthMethodSession      = "session"
+	AuthMethodJWT          = "jwt"
+	AuthMethodPrivateToken = "private_token"
+	AuthMethodBasic        = "basic"
+)
+
+var nameRegex = regexp.MustCompile(utils.NameRegex)
+
+// CheckNameAvailable aborts the request if name can't be used by a new user or organization,
+// users and organizations share the namespace of repositories.
+func CheckNameAvailable(c *gin.Context, name string) error {
+	if !nameRegex.MatchString(name) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid name %s", name)})
+		return terrors.ErrPlaceholder
+	}
+	user, err := models.GetUser(c, name)
+	if err != nil {
+		log.WithFunc("CheckNameAvailable").Error(c, err, "failed to query user from db")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return err
+	}
+	org, err := models.QueryOrg(c, name)
+	if err != nil {
+		log.WithFunc("CheckNameAvailable").Error(c, err, "failed to query organization from db")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return err
+	}
+	if user != nil || org != nil {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("name %s is already taken", name)})
+		return terrors.ErrPlaceholder
+	}
+	return nil
+}
+
 func SaveUserSession(c *gin.Context, u *models.User) error {
 	// set session
 	session := sessions.Default(c)
@@ -46,9 +85,12 @@ func AuthWithSession(c *gin.Context) (err error) {
 	if user == nil {
 		return fmt.Errorf("can't find user %d", userID)
 	}
+	if user.Disabled {
+		return terrors.ErrUserDisabled
+	}
 	log.WithFunc("authWithSession").Debugf(c, "authenticate with session successfully %s", user.Username)
 
-	attachUserToCtx(c, user)
+	attachUserToCtx(c, user, AuthMethodSession)
 	return nil
 }
 
@@ -68,13 +110,18 @@ func AuthWithBasic(c *gin.Context, bs64Token string) error {
 		return terrors.ErrPlaceholder
 	}
 	username, password := parts[0], parts[1]
-	user, err := models.CheckAndGetUser(c, username, password)
+	user, err := auth.Authenticate(c, username, password)
 	if err != nil {
-		if errors.Is(err, terrors.ErrInvalidUserPass) {
+		switch {
+		case errors.Is(err, terrors.ErrInvalidUserPass):
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
 				"error": err.Error(),
 			})
-		} else {
+		case errors.Is(err, terrors.ErrUserDisabled):
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": err.Error(),
+			})
+		default:
 			log.WithFunc("authWithUserPass").Error(c, err, "failed query user from db")
 			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
 				"error": "internal error, please try again",
@@ -82,7 +129,7 @@ func AuthWithBasic(c *gin.Context, bs64Token string) error {
 		}
 		return terrors.ErrPlaceholder
 	}
-	attachUserToCtx(c, user)
+	attachUserToCtx(c, user, AuthMethodBasic)
 	return nil
 }
 
@@ -124,7 +171,10 @@ func AuthWithPrivateToken(c *gin.Context, token string) error {
 		})
 		return terrors.ErrPlaceholder
 	}
-	attachUserToCtx(c, user)
+	if err = checkUserEnabled(c, user); err != nil {
+		return err
+	}
+	attachScopedUserToCtx(c, user, t.Scope(), AuthMethodPrivateToken)
 	return nil
 }
 
@@ -162,13 +212,42 @@ func AuthWithJWT(c *gin.Context, token string) error {
 		})
 		return terrors.ErrPlaceholder
 	}
+	if err = checkUserEnabled(c, user); err != nil {
+		return err
+	}
 	c.Set("claims", claims)
-	attachUserToCtx(c, user)
+	attachScopedUserToCtx(c, user, claims.Scope(), AuthMethodJWT)
 	return nil
 }
 
-func attachUserToCtx(c *gin.Context, u *models.User) {
+// checkUserEnabled aborts the request if user is disabled by administrators
+func checkUserEnabled(c *gin.Context, user *models.User) error {
+	if user.Disabled {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"error": terrors.ErrUserDisabled.Error(),
+		})
+		return terrors.ErrPlaceholder
+	}
+	return nil
+}
+
+func attachUserToCtx(c *gin.Context, u *models.User, method string) {
+	c.Set("authMethod", method)
 	c.Set("userid", u.ID)
 	c.Set("username", u.Username)
 	c.Set("user", u)
 }
+
+// attachScopedUserToCtx is like attachUserToCtx but the user is restricted by scope,
+// the administrator permission is dropped without user:admin scope.
+func attachScopedUserToCtx(c *gin.Context, u *models.User, scope *models.TokenScope, method string) {
+	if scope != nil {
+		c.Set("scope", scope)
+		if u.Admin && !scope.Has(models.ScopeUserAdmin) {
+			restricted := *u
+			restricted.Admin = false
+			u = &restricted
+		}
+	}
+	attachUserToCtx(c, u, method)
+}
@@ -12,3 +12,22 @@ func LoginUser(c *gin.Context) (user *models.User, exists bool) {
 	}
 	return
 }
+
+// LoginScope returns the restriction of the credential used by request, nil means no restriction
+func LoginScope(c *gin.Context) *models.TokenScope {
+	value, exists := c.Get("scope")
+	if !exists {
+		return nil
+	}
+	return value.(*models.TokenScope) //nolint
+}
+
+// CheckScope returns true if the credential used by request has scope
+func CheckScope(c *gin.Context, scope string) bool {
+	return LoginScope(c).Has(scope)
+}
+
+// LoginMethod returns how the user of request is authenticated, eg: AuthMethodJWT
+func LoginMethod(c *gin.Context) string {
+	return c.GetString("authMethod")
+}
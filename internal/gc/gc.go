@@ -0,0 +1,283 @@
+package gc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/projecteru2/core/log"
+	"github.com/projecteru2/vmihub/internal/blob"
+	"github.com/projecteru2/vmihub/internal/models"
+	"github.com/projecteru2/vmihub/internal/storage"
+	"github.com/projecteru2/vmihub/pkg/terrors"
+)
+
+const (
+	KindBlob   = "blob"
+	KindSlice  = "slice"
+	KindLegacy = "legacy"
+	KindUpload = "upload"
+	// objects which are not stored by vmihub, they are reported but never deleted
+	kindUnknown = "unknown"
+
+	blobPrefix       = "blobs/"
+	slicePrefix      = "_slice_"
+	queryBatchSize   = 500
+	defaultMinAge    = 24 * time.Hour
+	periodicLockName = "/vmihub/gc/lock"
+)
+
+// the layout of image files stored before the blob store: <username>/<name>:<tag>
+var legacyRegex = regexp.MustCompile(`^[a-z0-9._-]+/[a-z0-9._-]+:[a-zA-Z0-9._-]+$`)
+
+type Options struct {
+	DryRun bool
+	// objects and uploads which are younger than MinAge are never collected,
+	// so the uploads in progress are not affected
+	MinAge time.Duration
+}
+
+// Item is an object or an unfinished chunk write which can be reclaimed
+type Item struct {
+	Kind string
+	Name string
+	// transaction id for KindUpload
+	TransactionID string
+	Size          int64
+}
+
+func (it *Item) String() string {
+	if it.Kind == KindUpload {
+		return fmt.Sprintf("%s %s(%s)", it.Kind, it.Name, it.TransactionID)
+	}
+	return fmt.Sprintf("%s %s(%d bytes)", it.Kind, it.Name, it.Size)
+}
+
+type Report struct {
+	DryRun    bool
+	Reclaimed []*Item
+	Failed    []*Item
+	// the creating images which are abandoned by their uploads and marked as failed
+	Abandoned []string
+	// the objects which are not stored by vmihub, eg: other files in a shared bucket
+	Unknown []string
+}
+
+// Bytes returns the total size of reclaimed objects
+func (r *Report) Bytes() (ans int64) {
+	for _, it := range r.Reclaimed {
+		ans += it.Size
+	}
+	return
+}
+
+type references struct {
+	digests   map[string]struct{}
+	fullnames map[string]struct{}
+	slices    map[string]struct{}
+	uploadIDs map[string]struct{}
+	// the images which are reserved by unexpired upload sessions or active tasks
+	imageIDs map[int64]struct{}
+}
+
+// Run collects the storage objects which are not referenced by any image or
+// unexpired upload session, and aborts the stale chunk writes.
+// The creating images which are left by expired upload sessions are marked as failed,
+// so their tags can be uploaded again.
+func Run(ctx context.Context, sto storage.Storage, opts *Options) (*Report, error) {
+	logger := log.WithFunc("gc.Run")
+	if opts.MinAge <= 0 {
+		opts.MinAge = defaultMinAge
+	}
+	deadline := time.Now().Add(-opts.MinAge)
+	// load upload sessions before images, so a session finished in between
+	// will show up as an image
+	refs, err := loadReferences(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report := &Report{DryRun: opts.DryRun}
+	if err := failAbandonedImages(ctx, refs, deadline, report); err != nil {
+		return report, err
+	}
+	objs, err := sto.List(ctx, "")
+	if err != nil {
+		return report, fmt.Errorf("failed to list objects: %w", err)
+	}
+	for _, obj := range objs {
+		if obj.ModTime.After(deadline) {
+			continue
+		}
+		kind := classify(obj.Name, refs)
+		if kind == "" {
+			continue
+		}
+		if kind == kindUnknown {
+			logger.Debugf(ctx, "skipped unknown object %s", obj.Name)
+			report.Unknown = append(report.Unknown, obj.Name)
+			continue
+		}
+		item := &Item{Kind: kind, Name: obj.Name, Size: obj.Size}
+		if !opts.DryRun {
+			deleted, err := deleteObject(ctx, sto, item)
+			if err != nil {
+				logger.Errorf(ctx, err, "failed to delete %s", item)
+				report.Failed = append(report.Failed, item)
+				continue
+			}
+			if !deleted {
+				// the blob is referenced by an image saved after loading references
+				continue
+			}
+		}
+		logger.Infof(ctx, "reclaimed %s, dry run: %v", item, opts.DryRun)
+		report.Reclaimed = append(report.Reclaimed, item)
+	}
+
+	mSto, ok := sto.(storage.MultipartStorage)
+	if !ok {
+		return report, nil
+	}
+	writes, err := mSto.ListChunkWrites(ctx)
+	if err != nil {
+		return report, fmt.Errorf("failed to list chunk writes: %w", err)
+	}
+	for _, w := range writes {
+		if _, ok := refs.uploadIDs[w.TransactionID]; ok || w.CreatedAt.After(deadline) {
+			continue
+		}
+		item := &Item{Kind: KindUpload, Name: w.Name, TransactionID: w.TransactionID}
+		if !opts.DryRun {
+			if err := sto.AbortChunkWrite(ctx, w.Name, w.TransactionID); err != nil {
+				logger.Errorf(ctx, err, "failed to abort %s", item)
+				report.Failed = append(report.Failed, item)
+				continue
+			}
+		}
+		logger.Infof(ctx, "reclaimed %s, dry run: %v", item, opts.DryRun)
+		report.Reclaimed = append(report.Reclaimed, item)
+	}
+	return report, nil
+}
+
+// failAbandonedImages marks the creating images which are not updated since deadline as failed,
+// unless they are still reserved by an upload session or a task.
+func failAbandonedImages(ctx context.Context, refs *references, deadline time.Time, report *Report) error {
+	logger := log.WithFunc("gc.failAbandonedImages")
+	images, err := models.QueryStaleCreatingImages(ctx, deadline)
+	if err != nil {
+		return fmt.Errorf("failed to query creating images: %w", err)
+	}
+	for idx := range images {
+		img := &images[idx]
+		if _, ok := refs.imageIDs[img.ID]; ok {
+			continue
+		}
+		if !report.DryRun {
+			err := img.Repo.SetImageState(nil, img, models.ImageStateFailed)
+			if errors.Is(err, terrors.ErrInvalidImageState) {
+				// the image is reserved again or finished after loading references
+				continue
+			}
+			if err != nil {
+				logger.Errorf(ctx, err, "failed to mark image %s as failed", img.Fullname())
+				continue
+			}
+		}
+		logger.Infof(ctx, "marked abandoned image %s as failed, dry run: %v", img.Fullname(), report.DryRun)
+		report.Abandoned = append(report.Abandoned, img.Fullname())
+	}
+	return nil
+}
+
+// deleteObject deletes the object of item, a blob is released with its lock held,
+// so it is kept if an image referencing it is saved concurrently.
+func deleteObject(ctx context.Context, sto storage.Storage, item *Item) (bool, error) {
+	if digest := path.Base(item.Name); item.Kind == KindBlob && item.Name == models.BlobName(digest) {
+		return blob.Release(ctx, sto, digest)
+	}
+	return true, sto.Delete(ctx, item.Name, true)
+}
+
+// classify returns the kind of an unreferenced object, an empty string means the object is in use.
+// Only the objects in the layouts of vmihub are collected, the others are unknown.
+func classify(name string, refs *references) string {
+	if strings.HasPrefix(name, blobPrefix) {
+		if _, ok := refs.digests[path.Base(name)]; ok && name == models.BlobName(path.Base(name)) {
+			return ""
+		}
+		return KindBlob
+	}
+	if strings.HasPrefix(path.Base(name), slicePrefix) {
+		if _, ok := refs.slices[name]; ok {
+			return ""
+		}
+		return KindSlice
+	}
+	if !legacyRegex.MatchString(name) {
+		return kindUnknown
+	}
+	if _, ok := refs.fullnames[name]; ok {
+		return ""
+	}
+	return KindLegacy
+}
+
+func loadReferences(ctx context.Context) (*references, error) {
+	refs := &references{
+		digests:   map[string]struct{}{},
+		fullnames: map[string]struct{}{},
+		slices:    map[string]struct{}{},
+		uploadIDs: map[string]struct{}{},
+		imageIDs:  map[int64]struct{}{},
+	}
+	sessions, err := models.ListUploadSessions(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list upload sessions: %w", err)
+	}
+	for _, sess := range sessions {
+		refs.uploadIDs[sess.ID] = struct{}{}
+		if sess.Image != nil && sess.Image.Repo != nil {
+			refs.slices[sess.Image.SliceName()] = struct{}{}
+		}
+		if sess.Image != nil {
+			refs.imageIDs[sess.Image.ID] = struct{}{}
+		}
+	}
+	// the image of a pushed manifest or an import is reserved by its task only
+	tasks, err := models.QueryActiveTasks(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tasks: %w", err)
+	}
+	for idx := range tasks {
+		p := &struct {
+			Image *models.Image `json:"image"`
+		}{}
+		if err := tasks[idx].UnmarshalPayload(p); err == nil && p.Image != nil {
+			refs.imageIDs[p.Image.ID] = struct{}{}
+		}
+	}
+
+	var lastID int64
+	for {
+		images, err := models.QueryImagesAfterID(ctx, lastID, queryBatchSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query images: %w", err)
+		}
+		if len(images) == 0 {
+			break
+		}
+		for idx := range images {
+			img := &images[idx]
+			lastID = img.ID
+			refs.digests[img.Digest] = struct{}{}
+			// the images which are not migrated to blob store yet
+			refs.fullnames[img.Fullname()] = struct{}{}
+		}
+	}
+	return refs, nil
+}
@@ -0,0 +1,135 @@
+package gc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/projecteru2/vmihub/internal/models"
+	"github.com/projecteru2/vmihub/internal/storage/local"
+	"github.com/projecteru2/vmihub/internal/utils"
+	pkgutils "github.com/projecteru2/vmihub/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const imagesSQL = `SELECT i.id, i.repo_id, r.username, r.name, r.private, i.tag, i.size, i.digest, i.format, i.snapshot
+	           FROM image i, repository r
+	           WHERE r.id=i.repo_id AND i.id > ?
+	           ORDER BY i.id LIMIT ?`
+
+const creatingImagesSQL = `SELECT i.id, i.repo_id, r.username, r.name, r.private, i.tag, i.state, i.digest
+	           FROM image i, repository r
+	           WHERE r.id=i.repo_id AND i.state = ? AND i.updated_at < ?
+	           ORDER BY i.id`
+
+var imageColumns = []string{"id", "repo_id", "username", "name", "private", "tag", "size", "digest", "format", "snapshot"}
+
+func putObject(t *testing.T, sto *local.Store, name, content string, age time.Duration) {
+	digest, err := pkgutils.CalcDigestOfStr(content)
+	require.NoError(t, err)
+	err = sto.Put(context.Background(), name, digest, bytes.NewReader([]byte(content)))
+	require.NoError(t, err)
+	mtime := time.Now().Add(-age)
+	err = os.Chtimes(filepath.Join(sto.BaseDir, name), mtime, mtime)
+	require.NoError(t, err)
+}
+
+func TestRun(t *testing.T) {
+	utils.SetupRedis(nil, t)
+	err := models.Init(nil, t)
+	require.NoError(t, err)
+	ctx := context.Background()
+	sto := local.New(t.TempDir())
+
+	used, err := pkgutils.CalcDigestOfStr("used")
+	require.NoError(t, err)
+	orphan, err := pkgutils.CalcDigestOfStr("orphan")
+	require.NoError(t, err)
+	young, err := pkgutils.CalcDigestOfStr("young")
+	require.NoError(t, err)
+	old := 48 * time.Hour
+	putObject(t, sto, models.BlobName(used), "used", old)
+	putObject(t, sto, models.BlobName(orphan), "orphan", old)
+	putObject(t, sto, models.BlobName(young), "young", time.Minute)
+	putObject(t, sto, "user1/name1:v1", "used", old)
+	putObject(t, sto, "user1/name1:v2", "legacy", old)
+	putObject(t, sto, "user1/_slice_name1:v3", "uploading", old)
+	putObject(t, sto, "user1/_slice_name1:v4", "abandoned", old)
+	// the objects of others in a shared bucket
+	putObject(t, sto, "backups/db.sql", "backup", old)
+	putObject(t, sto, "tmp-upload-123", "temp", old)
+
+	// v3 is still uploading
+	img := &models.Image{ID: 3, Tag: "v3", Repo: &models.Repository{Username: "user1", Name: "name1"}}
+	bs, _ := json.Marshal(img)
+	utils.MockRedis.HSet(fmt.Sprintf(models.RedisUploadInfoKey, "upload1"), models.RedisUploadImageHKey, string(bs))
+
+	taskColumns := []string{"id", "type", "username", "status", "payload"}
+	for _, dryRun := range []bool{true, false} {
+		// v6 is pushed by manifest and waits for verifying
+		models.Mock.ExpectQuery("SELECT id, type, username, status, payload, result, error, attempts, created_at, updated_at FROM task WHERE status IN (?, ?) ORDER BY id").
+			WithArgs("pending", "running").
+			WillReturnRows(sqlmock.NewRows(taskColumns).
+				AddRow(1, "verify", "user1", "pending", []byte(`{"uploadId":"","image":{"id":6}}`)))
+		models.Mock.ExpectQuery(imagesSQL).
+			WithArgs(0, queryBatchSize).
+			WillReturnRows(sqlmock.NewRows(imageColumns).
+				AddRow(1, 1, "user1", "name1", false, "v1", 4, used, "qcow2", ""))
+		models.Mock.ExpectQuery(imagesSQL).
+			WithArgs(1, queryBatchSize).
+			WillReturnRows(sqlmock.NewRows(imageColumns))
+		// the upload of v5 has expired
+		models.Mock.ExpectQuery(creatingImagesSQL).
+			WithArgs(models.ImageStateCreating, sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "repo_id", "username", "name", "private", "tag", "state", "digest"}).
+				AddRow(3, 1, "user1", "name1", false, "v3", "creating", "").
+				AddRow(5, 1, "user1", "name1", false, "v5", "creating", "").
+				AddRow(6, 1, "user1", "name1", false, "v6", "creating", ""))
+		if !dryRun {
+			models.Mock.ExpectBegin()
+			models.Mock.ExpectExec("UPDATE image SET state = ? WHERE id = ? AND state = ?").
+				WithArgs(models.ImageStateFailed, 5, models.ImageStateCreating).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			models.Mock.ExpectCommit()
+		}
+		if !dryRun {
+			// the references are counted again before deleting the blob
+			models.Mock.ExpectQuery("SELECT count(*) FROM image WHERE digest = ?").
+				WithArgs(orphan).
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+		}
+
+		report, err := Run(ctx, sto, &Options{DryRun: dryRun})
+		assert.Nil(t, err)
+		assert.Nil(t, models.Mock.ExpectationsWereMet())
+		assert.Len(t, report.Failed, 0)
+		assert.Equal(t, []string{"user1/name1:v5"}, report.Abandoned)
+		assert.ElementsMatch(t, []string{"backups/db.sql", "tmp-upload-123"}, report.Unknown)
+		names := map[string]string{}
+		for _, it := range report.Reclaimed {
+			names[it.Name] = it.Kind
+		}
+		assert.Equal(t, map[string]string{
+			models.BlobName(orphan): KindBlob,
+			"user1/name1:v2":        KindLegacy,
+			"user1/_slice_name1:v4": KindSlice,
+		}, names)
+		assert.Equal(t, int64(len("orphan")+len("legacy")+len("abandoned")), report.Bytes())
+
+		exists, err := sto.Exists(ctx, models.BlobName(orphan))
+		assert.Nil(t, err)
+		assert.Equal(t, dryRun, exists)
+	}
+	for _, name := range []string{models.BlobName(used), models.BlobName(young), "user1/name1:v1", "user1/_slice_name1:v3", "backups/db.sql", "tmp-upload-123"} {
+		exists, err := sto.Exists(ctx, name)
+		assert.Nil(t, err)
+		assert.True(t, exists, name)
+	}
+}
@@ -0,0 +1,38 @@
+package gc
+
+import (
+	"context"
+	"time"
+
+	"github.com/projecteru2/core/log"
+	"github.com/projecteru2/vmihub/internal/storage"
+	"github.com/projecteru2/vmihub/internal/utils"
+)
+
+// RunPeriodically runs gc every interval until ctx is done.
+// When there are multiple server instances, only one of them runs gc in an interval.
+func RunPeriodically(ctx context.Context, sto storage.Storage, interval time.Duration, opts *Options) {
+	logger := log.WithFunc("gc.RunPeriodically")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// the lock is not released, so other instances skip this interval
+		mu := utils.NewRedisMutex(periodicLockName, interval*9/10)
+		if err := mu.TryLockContext(ctx); err != nil {
+			logger.Debugf(ctx, "gc is running by other instance: %s", err)
+			continue
+		}
+		report, err := Run(ctx, sto, opts)
+		if err != nil {
+			logger.Error(ctx, err, "failed to run gc")
+			continue
+		}
+		logger.Infof(ctx, "gc finished, reclaimed %d items(%d bytes), failed %d items",
+			len(report.Reclaimed), report.Bytes(), len(report.Failed))
+	}
+}
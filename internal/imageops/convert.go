@@ -0,0 +1,187 @@
+package imageops
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/projecteru2/core/log"
+	"github.com/projecteru2/vmihub/internal/blob"
+	"github.com/projecteru2/vmihub/internal/models"
+	"github.com/projecteru2/vmihub/internal/rbd"
+	"github.com/projecteru2/vmihub/internal/storage"
+	storFact "github.com/projecteru2/vmihub/internal/storage/factory"
+	"github.com/projecteru2/vmihub/internal/task"
+	"github.com/projecteru2/vmihub/internal/utils/idgen"
+	"github.com/projecteru2/vmihub/pkg/terrors"
+	pkgutils "github.com/projecteru2/vmihub/pkg/utils"
+)
+
+// ConvertPayload is the payload of convert task
+type ConvertPayload struct {
+	Username string `json:"username"`
+	Name     string `json:"name"`
+	Tag      string `json:"tag" description:"tag of the source image"`
+	DestTag  string `json:"destTag" description:"tag of the converted image"`
+	Format   string `json:"format" description:"target format"`
+}
+
+func handleConvert(ctx context.Context, t *models.Task) (any, error) {
+	p := &ConvertPayload{}
+	if err := t.UnmarshalPayload(p); err != nil {
+		return nil, task.Permanent(err)
+	}
+	img, err := getImage(ctx, p.Username, p.Name, p.Tag)
+	if err != nil {
+		return nil, err
+	}
+	destImg, err := img.Repo.GetImage(ctx, p.DestTag)
+	if err != nil {
+		return nil, err
+	}
+	if destImg != nil {
+		return nil, task.Permanent(fmt.Errorf("tag %s already exists", p.DestTag))
+	}
+	newImg, err := convertImage(ctx, storFact.Instance(), img, p.DestTag, p.Format)
+	if err != nil {
+		return nil, err
+	}
+	return imageResult(newImg), nil
+}
+
+// convertImage converts img to format and saves the converted image as destTag of the same repository
+func convertImage(ctx context.Context, sto storage.Storage, img *models.Image, destTag, format string) (*models.Image, error) {
+	dir, err := os.MkdirTemp("", "vmihub-convert-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	srcFile := filepath.Join(dir, "src")
+	if err := downloadImage(ctx, sto, img, srcFile); err != nil {
+		return nil, err
+	}
+	// images saved before uploads were inspected may have backing files which point to host files
+	srcInfo, err := Inspect(ctx, srcFile, img.Format)
+	if errors.Is(err, terrors.ErrInvalidImage) {
+		return nil, task.Permanent(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// rbd images are imported from raw files
+	fileFormat := format
+	if format == models.ImageFormatRBD {
+		fileFormat = models.ImageFormatRaw
+	}
+	destFile := srcFile
+	if srcInfo.Format != fileFormat {
+		destFile = filepath.Join(dir, "dest")
+		if err := Convert(ctx, srcFile, srcInfo.Format, destFile, fileFormat); err != nil {
+			return nil, err
+		}
+	}
+	destInfo, err := Info(ctx, destFile)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(destFile)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := pkgutils.CalcDigestOfFile(destFile)
+	if err != nil {
+		return nil, err
+	}
+
+	repo := img.Repo
+	// the size of converted image is unknown until now
+	if err := models.CheckQuota(ctx, repo.Username, 0, fi.Size()); err != nil {
+		if errors.Is(err, terrors.ErrQuotaExceeded) {
+			return nil, task.Permanent(err)
+		}
+		return nil, err
+	}
+	newImg := &models.Image{
+		Tag:         destTag,
+		Labels:      img.Labels,
+		Size:        fi.Size(),
+		VirtualSize: destInfo.VirtualSize,
+		ClusterSize: destInfo.ClusterSize,
+		Digest:      digest,
+		Format:      format,
+		OS:          img.OS,
+		Description: img.Description,
+		Repo:        repo,
+	}
+	if format == models.ImageFormatRBD {
+		if newImg.Snapshot, err = importRBD(ctx, repo, destTag, destFile, digest); err != nil {
+			return nil, err
+		}
+	} else if err := blob.PutFile(ctx, sto, destFile, digest); err != nil {
+		return nil, err
+	}
+	// the blob is left to gc if the tag is taken during conversion
+	if err := blob.Link(ctx, sto, newImg, func() error { return repo.SaveImage(nil, newImg) }); err != nil {
+		if newImg.Snapshot != "" {
+			removeSnapshot(ctx, newImg.Snapshot)
+		}
+		return nil, err
+	}
+	return newImg, nil
+}
+
+// importRBD imports the raw file to the configured pool and creates the protected snapshot referenced by image
+func importRBD(ctx context.Context, repo *models.Repository, tag, fname, digest string) (string, error) {
+	pool := rbd.Pool()
+	if pool == "" {
+		return "", task.Permanent(errors.New("rbd is not configured"))
+	}
+	// the image of a deleted tag is kept while it is cloned, so the name must be unique
+	image := fmt.Sprintf("%s.%s-%s-%s", repo.Username, repo.Name, tag, idgen.NextSID())
+	if err := rbd.Import(ctx, fname, pool, image); err != nil {
+		return "", err
+	}
+	snapshot, err := rbd.CreateSnapshot(ctx, pool, image, digest[:12])
+	if err != nil {
+		removeSnapshot(ctx, rbd.SnapshotName(pool, image, digest[:12]))
+		return "", err
+	}
+	return snapshot, nil
+}
+
+// removeSnapshot removes the snapshot and its image which are not referenced by any image
+func removeSnapshot(ctx context.Context, snapshot string) {
+	if err := rbd.Remove(ctx, snapshot); err != nil {
+		log.WithFunc("imageops.removeSnapshot").Errorf(ctx, err, "failed to remove snapshot %s", snapshot)
+	}
+}
+
+func downloadImage(ctx context.Context, sto storage.Storage, img *models.Image, fname string) error {
+	objName, err := blob.ObjectName(ctx, sto, img)
+	if err != nil {
+		return err
+	}
+	fp, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	return downloadObject(ctx, sto, objName, fp)
+}
+
+// downloadObject writes the object in storage to fp
+func downloadObject(ctx context.Context, sto storage.Storage, objName string, fp *os.File) error {
+	rc, err := sto.Get(ctx, objName)
+	if err != nil {
+		return fmt.Errorf("failed to read %s from storage: %w", objName, err)
+	}
+	defer rc.Close()
+	if _, err := io.Copy(fp, rc); err != nil {
+		return fmt.Errorf("failed to download %s: %w", objName, err)
+	}
+	return fp.Sync()
+}
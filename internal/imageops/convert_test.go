@@ -0,0 +1,182 @@
+package imageops
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/projecteru2/vmihub/config"
+	"github.com/projecteru2/vmihub/internal/models"
+	stoMocks "github.com/projecteru2/vmihub/internal/storage/mocks"
+	"github.com/projecteru2/vmihub/internal/task"
+	"github.com/projecteru2/vmihub/internal/utils"
+	"github.com/projecteru2/vmihub/internal/utils/sh"
+	shMocks "github.com/projecteru2/vmihub/internal/utils/sh/mocks"
+	"github.com/projecteru2/vmihub/pkg/terrors"
+	pkgutils "github.com/projecteru2/vmihub/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+var quotaColumns = ((*models.Quota)(nil)).ColumnNames()
+
+func fileSuffix(suffix string) any {
+	return mock.MatchedBy(func(s string) bool { return strings.HasSuffix(s, suffix) })
+}
+
+func TestConvertImage(t *testing.T) {
+	utils.SetupRedis(nil, t)
+	err := models.Init(nil, t)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	srcContent, destContent := "qcow2 content", "raw content"
+	srcDigest, _ := pkgutils.CalcDigestOfStr(srcContent)
+	destDigest, _ := pkgutils.CalcDigestOfStr(destContent)
+	img := &models.Image{
+		ID:     1,
+		Tag:    "v1",
+		Format: "qcow2",
+		Digest: srcDigest,
+		Repo:   &models.Repository{ID: 1, Username: "user1", Name: "name1"},
+	}
+
+	shell := &shMocks.Shell{}
+	defer sh.NewMockShell(shell)()
+	shell.On("ExecInOut", mock.Anything, mock.Anything, mock.Anything, "qemu-img", "info", "--output=json", fileSuffix("/src")).
+		Return([]byte(`{"format":"qcow2","virtual-size":1024,"actual-size":13}`), nil, nil).Once()
+	shell.On("ExecInOut", mock.Anything, mock.Anything, mock.Anything, "qemu-img", "check", "--output=json", "-f", "qcow2", fileSuffix("/src")).
+		Return([]byte(`{"corruptions":0,"leaks":0,"check-errors":0}`), nil, nil).Once()
+	shell.On("Exec", mock.Anything, "qemu-img", "convert", "-f", "qcow2", "-O", "raw", fileSuffix("/src"), fileSuffix("/dest")).
+		Run(func(args mock.Arguments) {
+			_ = os.WriteFile(args.String(8), []byte(destContent), 0644)
+		}).Return(nil).Once()
+	shell.On("ExecInOut", mock.Anything, mock.Anything, mock.Anything, "qemu-img", "info", "--output=json", fileSuffix("/dest")).
+		Return([]byte(`{"format":"raw","virtual-size":1024,"actual-size":11}`), nil, nil).Once()
+	defer shell.AssertExpectations(t)
+
+	sto := &stoMocks.Storage{}
+	sto.On("Exists", mock.Anything, models.BlobName(srcDigest)).Return(true, nil).Once()
+	sto.On("Get", mock.Anything, models.BlobName(srcDigest)).Return(io.NopCloser(bytes.NewBufferString(srcContent)), nil).Once()
+	sto.On("Exists", mock.Anything, models.BlobName(destDigest)).Return(false, nil).Once()
+	sto.On("Put", mock.Anything, models.BlobName(destDigest), destDigest, mock.Anything).Return(nil).Once()
+	// checked again with the blob locked before saving image
+	sto.On("Exists", mock.Anything, models.BlobName(destDigest)).Return(true, nil).Once()
+	defer sto.AssertExpectations(t)
+
+	models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM quota WHERE namespace = ?", quotaColumns)).
+		WithArgs("user1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "namespace"}))
+	models.Mock.ExpectBegin()
+	models.Mock.ExpectExec("INSERT INTO image(repo_id, tag, labels, state, size, virtual_size, cluster_size, format, os, digest, snapshot, description) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)").
+		WithArgs(1, "v1-raw", sqlmock.AnyArg(), models.ImageStateReady, len(destContent), 1024, 0, "raw", sqlmock.AnyArg(), destDigest, "", "").
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	models.Mock.ExpectCommit()
+
+	newImg, err := convertImage(ctx, sto, img, "v1-raw", "raw")
+	assert.Nil(t, err)
+	assert.Nil(t, models.Mock.ExpectationsWereMet())
+	assert.Equal(t, int64(2), newImg.ID)
+	assert.Equal(t, int64(1024), newImg.VirtualSize)
+
+	// conversion failed
+	shell.On("ExecInOut", mock.Anything, mock.Anything, mock.Anything, "qemu-img", "info", "--output=json", fileSuffix("/src")).
+		Return(nil, []byte("unknown format"), os.ErrInvalid).Once()
+	sto.On("Exists", mock.Anything, models.BlobName(srcDigest)).Return(true, nil).Once()
+	sto.On("Get", mock.Anything, models.BlobName(srcDigest)).Return(io.NopCloser(bytes.NewBufferString(srcContent)), nil).Once()
+	_, err = convertImage(ctx, sto, img, "v1-raw", "raw")
+	assert.ErrorContains(t, err, "unknown format")
+
+	// the source image has a backing file
+	shell.On("ExecInOut", mock.Anything, mock.Anything, mock.Anything, "qemu-img", "info", "--output=json", fileSuffix("/src")).
+		Return([]byte(`{"format":"qcow2","virtual-size":1024,"actual-size":13,"backing-filename":"/etc/shadow"}`), nil, nil).Once()
+	sto.On("Exists", mock.Anything, models.BlobName(srcDigest)).Return(true, nil).Once()
+	sto.On("Get", mock.Anything, models.BlobName(srcDigest)).Return(io.NopCloser(bytes.NewBufferString(srcContent)), nil).Once()
+	_, err = convertImage(ctx, sto, img, "v1-raw", "raw")
+	assert.ErrorIs(t, err, terrors.ErrInvalidImage)
+	assert.True(t, task.IsPermanent(err))
+
+	// quota exceeded
+	rawImg := *img
+	rawImg.Format = "raw"
+	img = &rawImg
+	shell.On("ExecInOut", mock.Anything, mock.Anything, mock.Anything, "qemu-img", "info", "--output=json", fileSuffix("/src")).
+		Return([]byte(`{"format":"raw","virtual-size":1024,"actual-size":13}`), nil, nil).Twice()
+	sto.On("Exists", mock.Anything, models.BlobName(srcDigest)).Return(true, nil).Once()
+	sto.On("Get", mock.Anything, models.BlobName(srcDigest)).Return(io.NopCloser(bytes.NewBufferString(srcContent)), nil).Once()
+	models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM quota WHERE namespace = ?", quotaColumns)).
+		WithArgs("user1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "namespace", "max_size", "max_images"}).AddRow(1, "user1", 0, 1))
+	models.Mock.ExpectQuery(`SELECT COALESCE(SUM(i.size), 0) AS size, COUNT(*) AS images
+		    FROM image i, repository r
+		    WHERE r.id=i.repo_id AND r.username=? AND i.state != ? AND i.id != ?`).
+		WithArgs("user1", models.ImageStateFailed, 0).
+		WillReturnRows(sqlmock.NewRows([]string{"size", "images"}).AddRow(13, 1))
+	_, err = convertImage(ctx, sto, img, "v1-raw", "raw")
+	assert.ErrorIs(t, err, terrors.ErrQuotaExceeded)
+	assert.True(t, task.IsPermanent(err))
+	assert.Nil(t, models.Mock.ExpectationsWereMet())
+}
+
+func TestConvertImageToRBD(t *testing.T) {
+	utils.SetupRedis(nil, t)
+	err := models.Init(nil, t)
+	require.NoError(t, err)
+	_, err = config.LoadTestConfig()
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	content := "raw content"
+	digest, _ := pkgutils.CalcDigestOfStr(content)
+	img := &models.Image{
+		ID:     1,
+		Tag:    "v1",
+		Format: "raw",
+		Digest: digest,
+		Repo:   &models.Repository{ID: 1, Username: "user1", Name: "name1"},
+	}
+	rbdImage := mock.MatchedBy(func(s string) bool { return strings.HasPrefix(s, "eru/user1.name1-v1-rbd-") })
+	snapshot := mock.MatchedBy(func(s string) bool {
+		return strings.HasPrefix(s, "eru/user1.name1-v1-rbd-") && strings.HasSuffix(s, "@"+digest[:12])
+	})
+
+	shell := &shMocks.Shell{}
+	defer sh.NewMockShell(shell)()
+	// the raw file is imported as it is
+	shell.On("ExecInOut", mock.Anything, mock.Anything, mock.Anything, "qemu-img", "info", "--output=json", fileSuffix("/src")).
+		Return([]byte(`{"format":"raw","virtual-size":11,"actual-size":11}`), nil, nil).Twice()
+	shell.On("ExecInOut", mock.Anything, mock.Anything, mock.Anything, "rbd", "--id", "eru", "import", "--image-format", "2", fileSuffix("/src"), rbdImage).
+		Return(nil, nil, nil).Once()
+	shell.On("ExecInOut", mock.Anything, mock.Anything, mock.Anything, "rbd", "--id", "eru", "snap", "create", snapshot).
+		Return(nil, nil, nil).Once()
+	shell.On("ExecInOut", mock.Anything, mock.Anything, mock.Anything, "rbd", "--id", "eru", "snap", "protect", snapshot).
+		Return(nil, nil, nil).Once()
+	defer shell.AssertExpectations(t)
+
+	sto := &stoMocks.Storage{}
+	sto.On("Exists", mock.Anything, models.BlobName(digest)).Return(true, nil).Once()
+	sto.On("Get", mock.Anything, models.BlobName(digest)).Return(io.NopCloser(bytes.NewBufferString(content)), nil).Once()
+	defer sto.AssertExpectations(t)
+
+	models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM quota WHERE namespace = ?", quotaColumns)).
+		WithArgs("user1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "namespace"}))
+	models.Mock.ExpectBegin()
+	models.Mock.ExpectExec("INSERT INTO image(repo_id, tag, labels, state, size, virtual_size, cluster_size, format, os, digest, snapshot, description) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)").
+		WithArgs(1, "v1-rbd", sqlmock.AnyArg(), models.ImageStateReady, len(content), 11, 0, "rbd", sqlmock.AnyArg(), digest, sqlmock.AnyArg(), "").
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	models.Mock.ExpectCommit()
+
+	newImg, err := convertImage(ctx, sto, img, "v1-rbd", "rbd")
+	assert.Nil(t, err)
+	assert.Nil(t, models.Mock.ExpectationsWereMet())
+	assert.Equal(t, "rbd", newImg.Format)
+	assert.True(t, strings.HasPrefix(newImg.Snapshot, "eru/user1.name1-v1-rbd-"))
+	assert.True(t, strings.HasSuffix(newImg.Snapshot, "@"+digest[:12]))
+}
@@ -0,0 +1,90 @@
+package imageops
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/projecteru2/vmihub/internal/models"
+	"github.com/projecteru2/vmihub/internal/utils/sh"
+	"github.com/projecteru2/vmihub/pkg/terrors"
+)
+
+// ImageInfo is the output of `qemu-img info`
+type ImageInfo struct {
+	Format          string `json:"format"`
+	VirtualSize     int64  `json:"virtual-size"`
+	ActualSize      int64  `json:"actual-size"`
+	ClusterSize     int64  `json:"cluster-size"`
+	BackingFilename string `json:"backing-filename"`
+	DirtyFlag       bool   `json:"dirty-flag"`
+}
+
+// Info returns the information of an image file
+func Info(ctx context.Context, fname string) (*ImageInfo, error) {
+	stdout, stderr, err := sh.ExecInOut(ctx, nil, nil, "qemu-img", "info", "--output=json", fname)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get info of %s: %w %s", fname, err, string(stderr))
+	}
+	info := &ImageInfo{}
+	if err := json.Unmarshal(stdout, info); err != nil {
+		return nil, fmt.Errorf("invalid output of qemu-img info: %w %s", err, string(stdout))
+	}
+	return info, nil
+}
+
+// CheckResult is the output of `qemu-img check`
+type CheckResult struct {
+	Corruptions int64 `json:"corruptions"`
+	Leaks       int64 `json:"leaks"`
+	CheckErrors int64 `json:"check-errors"`
+}
+
+// Check checks the consistency of a qcow2 image file,
+// qemu-img exits with non-zero code when any problem is found, so the output is parsed first.
+func Check(ctx context.Context, fname string) (*CheckResult, error) {
+	stdout, stderr, err := sh.ExecInOut(ctx, nil, nil, "qemu-img", "check", "--output=json", "-f", models.ImageFormatQcow2, fname)
+	res := &CheckResult{}
+	if jErr := json.Unmarshal(stdout, res); jErr != nil {
+		if err != nil {
+			return nil, fmt.Errorf("failed to check %s: %w %s", fname, err, string(stderr))
+		}
+		return nil, fmt.Errorf("invalid output of qemu-img check: %w %s", jErr, string(stdout))
+	}
+	return res, nil
+}
+
+// Inspect detects the real format of an uploaded image file and verifies it against the declared format.
+// An error wrapping terrors.ErrInvalidImage is returned if the file is not acceptable.
+func Inspect(ctx context.Context, fname, format string) (*ImageInfo, error) {
+	info, err := Info(ctx, fname)
+	if err != nil {
+		return nil, err
+	}
+	if info.Format != format {
+		return nil, fmt.Errorf("%w: format is %s, but %s is declared", terrors.ErrInvalidImage, info.Format, format)
+	}
+	if info.BackingFilename != "" {
+		return nil, fmt.Errorf("%w: backing file %s is not allowed", terrors.ErrInvalidImage, info.BackingFilename)
+	}
+	if info.Format != models.ImageFormatQcow2 {
+		return info, nil
+	}
+	res, err := Check(ctx, fname)
+	if err != nil {
+		return nil, err
+	}
+	// leaked clusters only waste space, so they are acceptable
+	if res.Corruptions > 0 || res.CheckErrors > 0 {
+		return nil, fmt.Errorf("%w: %d corruptions and %d check errors found", terrors.ErrInvalidImage, res.Corruptions, res.CheckErrors)
+	}
+	return info, nil
+}
+
+// Convert converts src in srcFormat to dest in destFormat
+func Convert(ctx context.Context, src, srcFormat, dest, destFormat string) error {
+	if err := sh.ExecContext(ctx, "qemu-img", "convert", "-f", srcFormat, "-O", destFormat, src, dest); err != nil {
+		return fmt.Errorf("failed to convert %s to %s: %w", src, destFormat, err)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package imageops
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/projecteru2/vmihub/internal/utils/sh"
+	shMocks "github.com/projecteru2/vmihub/internal/utils/sh/mocks"
+	"github.com/projecteru2/vmihub/pkg/terrors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestInspect(t *testing.T) {
+	ctx := context.Background()
+	fname := "/tmp/image"
+	shell := &shMocks.Shell{}
+	defer sh.NewMockShell(shell)()
+
+	mockInfo := func(out string) {
+		shell.On("ExecInOut", mock.Anything, mock.Anything, mock.Anything, "qemu-img", "info", "--output=json", fname).
+			Return([]byte(out), nil, nil).Once()
+	}
+	mockCheck := func(out string, err error) {
+		shell.On("ExecInOut", mock.Anything, mock.Anything, mock.Anything, "qemu-img", "check", "--output=json", "-f", "qcow2", fname).
+			Return([]byte(out), nil, err).Once()
+	}
+
+	// healthy qcow2 image, leaks are acceptable
+	mockInfo(`{"format":"qcow2","virtual-size":1024,"cluster-size":65536}`)
+	mockCheck(`{"check-errors":0,"leaks":3}`, errors.New("exit status 3"))
+	info, err := Inspect(ctx, fname, "qcow2")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1024), info.VirtualSize)
+	assert.Equal(t, int64(65536), info.ClusterSize)
+
+	// raw image isn't checked
+	mockInfo(`{"format":"raw","virtual-size":2048}`)
+	info, err = Inspect(ctx, fname, "raw")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2048), info.VirtualSize)
+
+	// format mismatch
+	mockInfo(`{"format":"qcow2","virtual-size":1024}`)
+	_, err = Inspect(ctx, fname, "raw")
+	assert.ErrorIs(t, err, terrors.ErrInvalidImage)
+
+	// backing file
+	mockInfo(`{"format":"qcow2","virtual-size":1024,"backing-filename":"/etc/passwd"}`)
+	_, err = Inspect(ctx, fname, "qcow2")
+	assert.ErrorIs(t, err, terrors.ErrInvalidImage)
+
+	// corrupted
+	mockInfo(`{"format":"qcow2","virtual-size":1024}`)
+	mockCheck(`{"check-errors":0,"corruptions":2}`, errors.New("exit status 2"))
+	_, err = Inspect(ctx, fname, "qcow2")
+	assert.ErrorIs(t, err, terrors.ErrInvalidImage)
+
+	// qemu-img fails
+	mockInfo(`{"format":"qcow2","virtual-size":1024}`)
+	mockCheck("", errors.New("exit status 1"))
+	_, err = Inspect(ctx, fname, "qcow2")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, terrors.ErrInvalidImage)
+
+	shell.AssertExpectations(t)
+}
@@ -0,0 +1,309 @@
+package imageops
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/projecteru2/core/log"
+	"github.com/projecteru2/vmihub/internal/blob"
+	"github.com/projecteru2/vmihub/internal/models"
+	"github.com/projecteru2/vmihub/internal/storage"
+	storFact "github.com/projecteru2/vmihub/internal/storage/factory"
+	"github.com/projecteru2/vmihub/internal/task"
+	"github.com/projecteru2/vmihub/internal/utils"
+	"github.com/projecteru2/vmihub/pkg/terrors"
+	"github.com/projecteru2/vmihub/pkg/types"
+)
+
+const (
+	// import image from a remote url
+	TaskTypeImport = "import"
+	// convert image to another format
+	TaskTypeConvert = "convert"
+	// verify the file of a chunk upload and save the image
+	TaskTypeVerify = "verify"
+)
+
+func init() {
+	task.Register(TaskTypeImport, handleImport)
+	task.Register(TaskTypeConvert, handleConvert)
+	task.Register(TaskTypeVerify, handleVerify)
+	task.OnFailure(TaskTypeImport, failImage)
+	task.OnFailure(TaskTypeVerify, failImage)
+}
+
+// ImportPayload is the payload of import task
+type ImportPayload struct {
+	Image *models.Image `json:"image"`
+	URL   string        `json:"url"`
+}
+
+// VerifyPayload is the payload of verify task, UploadID is empty for the images
+// pushed through the OCI API, whose files are in the blob store already.
+type VerifyPayload struct {
+	UploadID string        `json:"uploadId"`
+	Image    *models.Image `json:"image"`
+}
+
+func handleImport(ctx context.Context, t *models.Task) (any, error) {
+	p := &ImportPayload{}
+	if err := t.UnmarshalPayload(p); err != nil {
+		return nil, task.Permanent(err)
+	}
+	img := p.Image
+	if err := importRemoteFile(ctx, storFact.Instance(), img, p.URL); err != nil {
+		return nil, err
+	}
+	return imageResult(img), nil
+}
+
+// failImage marks the image reserved by a failed import or upload as failed,
+// both ImportPayload and VerifyPayload carry the image in the image field.
+func failImage(ctx context.Context, t *models.Task, _ error) {
+	p := &VerifyPayload{}
+	if err := t.UnmarshalPayload(p); err != nil || p.Image == nil || p.Image.Repo == nil {
+		return
+	}
+	img := p.Image
+	if img.ID == 0 || img.State != models.ImageStateCreating {
+		return
+	}
+	if err := img.Repo.SetImageState(nil, img, models.ImageStateFailed); err != nil {
+		log.WithFunc("imageops.failImage").Errorf(ctx, err, "failed to mark image %s as failed", img.Fullname())
+	}
+}
+
+func handleVerify(ctx context.Context, t *models.Task) (any, error) {
+	p := &VerifyPayload{}
+	if err := t.UnmarshalPayload(p); err != nil {
+		return nil, task.Permanent(err)
+	}
+	img := p.Image
+	if err := verifyUpload(ctx, storFact.Instance(), p.UploadID, img); err != nil {
+		return nil, err
+	}
+	return imageResult(img), nil
+}
+
+// importRemoteFile downloads the file of img from url, and saves the image after the file is verified
+func importRemoteFile(ctx context.Context, sto storage.Storage, img *models.Image, url string) error {
+	fp, err := os.CreateTemp("", "vmihub-import-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fp.Name())
+	defer fp.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return task.Permanent(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to download remote file %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("failed to download remote file %s, http code: %d", url, resp.StatusCode)
+		if resp.StatusCode < http.StatusInternalServerError {
+			err = task.Permanent(err)
+		}
+		return err
+	}
+	h := sha256.New()
+	nwritten, err := io.Copy(fp, io.TeeReader(resp.Body, h))
+	if err != nil {
+		return fmt.Errorf("failed to download remote file %s: %w", url, err)
+	}
+	if err := fp.Sync(); err != nil {
+		return err
+	}
+	if img.Size == 0 {
+		img.Size = nwritten
+	}
+	if img.Size != nwritten {
+		return task.Permanent(fmt.Errorf("size mismatch: got %d, user passed %d", nwritten, img.Size))
+	}
+	digest := fmt.Sprintf("%x", h.Sum(nil))
+	if img.Digest == "" {
+		img.Digest = digest
+	}
+	if img.Digest != digest {
+		return task.Permanent(fmt.Errorf("%w: got %s, user passed %s", terrors.ErrInvalidDigest, digest, img.Digest))
+	}
+	if img.Tag == utils.FakeTag {
+		img.Tag = digest[:10]
+	}
+	if err := inspect(ctx, img, fp.Name()); err != nil {
+		return err
+	}
+	if err := blob.PutFile(ctx, sto, fp.Name(), img.Digest); err != nil {
+		return err
+	}
+	return saveImage(ctx, sto, img)
+}
+
+// verifyUpload inspects the merged file of a chunk upload, then moves it to the blob store and saves the image.
+// The slice file is removed if it is not a valid image.
+func verifyUpload(ctx context.Context, sto storage.Storage, uploadID string, img *models.Image) error {
+	logger := log.WithFunc("imageops.verifyUpload")
+	// the slice is moved before saving image, so the blob is read when retrying
+	src := img.SliceName()
+	sliceExists, err := sto.Exists(ctx, src)
+	if err != nil {
+		return err
+	}
+	if !sliceExists {
+		src = img.BlobName()
+	}
+	fp, err := os.CreateTemp("", "vmihub-verify-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fp.Name())
+	defer fp.Close()
+	if err := downloadObject(ctx, sto, src, fp); err != nil {
+		return err
+	}
+	if err := inspect(ctx, img, fp.Name()); err != nil {
+		if sliceExists && errors.Is(err, terrors.ErrInvalidImage) {
+			if err := sto.Delete(ctx, img.SliceName(), true); err != nil {
+				logger.Errorf(ctx, err, "failed to remove slice file %s", img.SliceName())
+			}
+			removeUploadSession(ctx, uploadID)
+		}
+		return err
+	}
+	if sliceExists {
+		exists, err := sto.Exists(ctx, img.BlobName())
+		if err != nil {
+			return err
+		}
+		if exists {
+			// the same file is already stored, so the slice file is useless
+			if err := sto.Delete(ctx, img.SliceName(), true); err != nil {
+				logger.Errorf(ctx, err, "failed to remove slice file %s", img.SliceName())
+			}
+		} else if err := sto.Move(ctx, img.SliceName(), img.BlobName()); err != nil {
+			return fmt.Errorf("failed to move %s to %s: %w", img.SliceName(), img.BlobName(), err)
+		}
+	}
+	if err := saveImage(ctx, sto, img); err != nil {
+		return err
+	}
+	removeUploadSession(ctx, uploadID)
+	return nil
+}
+
+func removeUploadSession(ctx context.Context, uploadID string) {
+	if uploadID == "" {
+		return
+	}
+	if err := models.RemoveUploadSession(ctx, uploadID); err != nil {
+		// just log error
+		log.WithFunc("imageops.removeUploadSession").Errorf(ctx, err, "failed to delete upload session %s in redis", uploadID)
+	}
+}
+
+// inspect inspects the file of img, the error wrapping terrors.ErrInvalidImage is permanent
+func inspect(ctx context.Context, img *models.Image, fname string) error {
+	info, err := Inspect(ctx, fname, img.Format)
+	if errors.Is(err, terrors.ErrInvalidImage) {
+		return task.Permanent(err)
+	}
+	if err != nil {
+		return err
+	}
+	img.VirtualSize = info.VirtualSize
+	img.ClusterSize = info.ClusterSize
+	return nil
+}
+
+// saveImage saves the repository and img in one transaction, the image reserved by upload becomes ready.
+// The file of the image overwritten by img is released.
+func saveImage(ctx context.Context, sto storage.Storage, img *models.Image) error {
+	var oldImg *models.Image
+	if img.ID > 0 {
+		var err error
+		if oldImg, err = models.GetImageByID(ctx, img.ID); err != nil {
+			return err
+		}
+	}
+	if err := blob.Link(ctx, sto, img, func() error { return commitImage(img) }); err != nil {
+		return err
+	}
+	// the reserved image has no file
+	if oldImg != nil && oldImg.State != models.ImageStateCreating && oldImg.Digest != img.Digest {
+		// try best, the blob will be reclaimed by gc anyway
+		if err := blob.ReleaseImage(ctx, sto, oldImg); err != nil {
+			log.WithFunc("imageops.saveImage").Errorf(ctx, err, "failed to release file of image %s", oldImg.Fullname())
+		}
+	}
+	return nil
+}
+
+// commitImage saves the repository and img in one transaction
+func commitImage(img *models.Image) error {
+	repo := img.Repo
+	tx, err := models.Instance().Beginx()
+	if err != nil {
+		return err
+	}
+	if err := repo.Save(tx); err != nil {
+		return err
+	}
+	if err := repo.SaveImage(tx, img); err != nil {
+		return err
+	}
+	// the manifest pushed through the OCI API
+	if manifest := img.OCIManifest.Get(); manifest != nil && manifest.Manifest != "" {
+		if err := repo.SaveOCIManifest(tx, img); err != nil {
+			return err
+		}
+	}
+	if img.State == models.ImageStateCreating {
+		err := repo.SetImageState(tx, img, models.ImageStateReady)
+		if errors.Is(err, terrors.ErrInvalidImageState) {
+			// the image is changed by others, so retrying makes no sense
+			return task.Permanent(err)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// getImage returns the image with its repository, the error is permanent if the image doesn't exist
+func getImage(ctx context.Context, username, name, tag string) (*models.Image, error) {
+	repo, err := models.QueryRepo(ctx, username, name)
+	if err != nil {
+		return nil, err
+	}
+	if repo == nil {
+		return nil, task.Permanent(fmt.Errorf("repository %s/%s doesn't exist", username, name))
+	}
+	img, err := repo.GetImage(ctx, tag)
+	if err != nil {
+		return nil, err
+	}
+	if img == nil {
+		return nil, task.Permanent(fmt.Errorf("image %s/%s:%s doesn't exist", username, name, tag))
+	}
+	img.Repo = repo
+	return img, nil
+}
+
+func imageResult(img *models.Image) *types.TaskImageResult {
+	return &types.TaskImageResult{
+		ImageID:  img.ID,
+		Username: img.Repo.Username,
+		Name:     img.Repo.Name,
+		Tag:      img.Tag,
+	}
+}
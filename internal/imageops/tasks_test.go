@@ -0,0 +1,216 @@
+package imageops
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/projecteru2/vmihub/internal/models"
+	stoMocks "github.com/projecteru2/vmihub/internal/storage/mocks"
+	"github.com/projecteru2/vmihub/internal/task"
+	"github.com/projecteru2/vmihub/internal/utils"
+	"github.com/projecteru2/vmihub/internal/utils/sh"
+	shMocks "github.com/projecteru2/vmihub/internal/utils/sh/mocks"
+	"github.com/projecteru2/vmihub/pkg/terrors"
+	pkgutils "github.com/projecteru2/vmihub/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+const testContent = "test content"
+
+func mockQemuImg(shell *shMocks.Shell, format string) {
+	info := fmt.Sprintf(`{"format":%q,"virtual-size":1024,"cluster-size":65536}`, format)
+	shell.On("ExecInOut", mock.Anything, mock.Anything, mock.Anything, "qemu-img", "info", "--output=json", mock.Anything).
+		Return([]byte(info), nil, nil).Once()
+	if format == models.ImageFormatQcow2 {
+		shell.On("ExecInOut", mock.Anything, mock.Anything, mock.Anything, "qemu-img", "check", "--output=json", "-f", "qcow2", mock.Anything).
+			Return([]byte(`{"check-errors":0}`), nil, nil).Once()
+	}
+}
+
+func expectSaveImage(digest string) {
+	models.Mock.ExpectBegin()
+	models.Mock.ExpectExec("INSERT INTO repository(username, name, private) VALUES(?, ?, ?)").
+		WithArgs("user1", "name1", false).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	models.Mock.ExpectExec("INSERT INTO image(repo_id, tag, labels, state, size, virtual_size, cluster_size, format, os, digest, snapshot, description) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)").
+		WithArgs(1, "v1", sqlmock.AnyArg(), models.ImageStateReady, len(testContent), 1024, 65536, "qcow2", sqlmock.AnyArg(), digest, "", "").
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	models.Mock.ExpectCommit()
+}
+
+func TestImportRemoteFile(t *testing.T) {
+	utils.SetupRedis(nil, t)
+	err := models.Init(nil, t)
+	require.NoError(t, err)
+	ctx := context.Background()
+	digest, _ := pkgutils.CalcDigestOfStr(testContent)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/image.qcow2" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(testContent))
+	}))
+	defer srv.Close()
+
+	shell := &shMocks.Shell{}
+	defer sh.NewMockShell(shell)()
+	sto := &stoMocks.Storage{}
+	newImg := func() *models.Image {
+		return &models.Image{
+			Tag:    "v1",
+			Format: "qcow2",
+			Repo:   &models.Repository{Username: "user1", Name: "name1"},
+		}
+	}
+
+	// size and digest are filled by the downloaded file
+	mockQemuImg(shell, "qcow2")
+	sto.On("Exists", mock.Anything, models.BlobName(digest)).Return(false, nil).Once()
+	sto.On("Put", mock.Anything, models.BlobName(digest), digest, mock.Anything).Return(nil).Once()
+	sto.On("Exists", mock.Anything, models.BlobName(digest)).Return(true, nil).Once()
+	expectSaveImage(digest)
+	img := newImg()
+	err = importRemoteFile(ctx, sto, img, srv.URL+"/image.qcow2")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), img.ID)
+	assert.Equal(t, digest, img.Digest)
+	assert.Nil(t, models.Mock.ExpectationsWereMet())
+
+	// the errors which make no sense to retry
+	img = newImg()
+	err = importRemoteFile(ctx, sto, img, srv.URL+"/notexist")
+	assert.True(t, task.IsPermanent(err))
+
+	img = newImg()
+	img.Digest = "abc"
+	err = importRemoteFile(ctx, sto, img, srv.URL+"/image.qcow2")
+	assert.True(t, task.IsPermanent(err))
+	assert.ErrorIs(t, err, terrors.ErrInvalidDigest)
+
+	mockQemuImg(shell, "raw")
+	img = newImg()
+	err = importRemoteFile(ctx, sto, img, srv.URL+"/image.qcow2")
+	assert.True(t, task.IsPermanent(err))
+	assert.ErrorIs(t, err, terrors.ErrInvalidImage)
+
+	shell.AssertExpectations(t)
+	sto.AssertExpectations(t)
+}
+
+func TestVerifyUpload(t *testing.T) {
+	utils.SetupRedis(nil, t)
+	err := models.Init(nil, t)
+	require.NoError(t, err)
+	ctx := context.Background()
+	digest, _ := pkgutils.CalcDigestOfStr(testContent)
+	rdb := utils.GetRedisConn()
+
+	shell := &shMocks.Shell{}
+	defer sh.NewMockShell(shell)()
+	sto := &stoMocks.Storage{}
+	img := &models.Image{
+		Tag:    "v1",
+		Format: "qcow2",
+		Size:   int64(len(testContent)),
+		Digest: digest,
+		Repo:   &models.Repository{Username: "user1", Name: "name1"},
+	}
+	content := func() io.ReadCloser {
+		return io.NopCloser(bytes.NewBufferString(testContent))
+	}
+
+	// the slice file is moved to blob store
+	err = rdb.HSet(ctx, fmt.Sprintf(models.RedisUploadInfoKey, "upload1"), "image", "{}").Err()
+	require.NoError(t, err)
+	mockQemuImg(shell, "qcow2")
+	sto.On("Exists", mock.Anything, img.SliceName()).Return(true, nil).Once()
+	sto.On("Get", mock.Anything, img.SliceName()).Return(content(), nil).Once()
+	sto.On("Exists", mock.Anything, img.BlobName()).Return(false, nil).Once()
+	sto.On("Move", mock.Anything, img.SliceName(), img.BlobName()).Return(nil).Once()
+	sto.On("Exists", mock.Anything, img.BlobName()).Return(true, nil).Once()
+	expectSaveImage(digest)
+	err = verifyUpload(ctx, sto, "upload1", img)
+	assert.Nil(t, err)
+	assert.Nil(t, models.Mock.ExpectationsWereMet())
+	n, err := rdb.Exists(ctx, fmt.Sprintf(models.RedisUploadInfoKey, "upload1")).Result()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+
+	// the slice file is removed if it is not a valid image
+	img.ID = 0
+	mockQemuImg(shell, "raw")
+	sto.On("Exists", mock.Anything, img.SliceName()).Return(true, nil).Once()
+	sto.On("Get", mock.Anything, img.SliceName()).Return(content(), nil).Once()
+	sto.On("Delete", mock.Anything, img.SliceName(), true).Return(nil).Once()
+	err = verifyUpload(ctx, sto, "upload2", img)
+	assert.True(t, task.IsPermanent(err))
+
+	// the image pushed through the OCI API is verified in blob store, and its manifest is saved
+	img.ID = 0
+	img.OCIManifest = models.NewJSONColumn(&models.OCIManifest{Manifest: "{}", Config: "{}"})
+	mockQemuImg(shell, "qcow2")
+	sto.On("Exists", mock.Anything, img.SliceName()).Return(false, nil).Once()
+	sto.On("Get", mock.Anything, img.BlobName()).Return(content(), nil).Once()
+	sto.On("Exists", mock.Anything, img.BlobName()).Return(true, nil).Once()
+	models.Mock.ExpectBegin()
+	models.Mock.ExpectExec("UPDATE repository SET private = ? WHERE username = ? and name = ?").
+		WithArgs(false, "user1", "name1").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	models.Mock.ExpectExec("INSERT INTO image(repo_id, tag, labels, state, size, virtual_size, cluster_size, format, os, digest, snapshot, description) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)").
+		WithArgs(1, "v1", sqlmock.AnyArg(), models.ImageStateReady, len(testContent), 1024, 65536, "qcow2", sqlmock.AnyArg(), digest, "", "").
+		WillReturnResult(sqlmock.NewResult(3, 1))
+	models.Mock.ExpectExec("UPDATE image SET oci_manifest = ? WHERE id = ?").
+		WithArgs(sqlmock.AnyArg(), 3).
+		WillReturnResult(sqlmock.NewResult(3, 1))
+	models.Mock.ExpectCommit()
+	err = verifyUpload(ctx, sto, "", img)
+	assert.Nil(t, err)
+	assert.Nil(t, models.Mock.ExpectationsWereMet())
+
+	shell.AssertExpectations(t)
+	sto.AssertExpectations(t)
+}
+
+func TestFailImage(t *testing.T) {
+	utils.SetupRedis(nil, t)
+	err := models.Init(nil, t)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	newTask := func(state string) *models.Task {
+		tk, err := models.NewTask(TaskTypeVerify, "user1", &VerifyPayload{
+			UploadID: "upload1",
+			Image: &models.Image{
+				ID:    2,
+				Tag:   "v1",
+				State: state,
+				Repo:  &models.Repository{ID: 1, Username: "user1", Name: "name1"},
+			},
+		})
+		require.NoError(t, err)
+		return tk
+	}
+	// the reserved image fails
+	models.Mock.ExpectBegin()
+	models.Mock.ExpectExec("UPDATE image SET state = ? WHERE id = ? AND state = ?").
+		WithArgs(models.ImageStateFailed, 2, models.ImageStateCreating).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	models.Mock.ExpectCommit()
+	failImage(ctx, newTask(models.ImageStateCreating), errors.New("invalid image"))
+	assert.Nil(t, models.Mock.ExpectationsWereMet())
+
+	// the image overwritten by force upload is kept
+	failImage(ctx, newTask(models.ImageStateReady), errors.New("invalid image"))
+	assert.Nil(t, models.Mock.ExpectationsWereMet())
+}
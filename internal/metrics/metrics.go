@@ -0,0 +1,122 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/projecteru2/core/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "vmihub"
+
+// the uploads and conversions of images may take minutes
+var durationBuckets = []float64{.005, .025, .1, .5, 1, 5, 30, 120, 600}
+
+var (
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "The number of handled HTTP requests.",
+	}, []string{"method", "route", "status"})
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "The latency of HTTP requests.",
+		Buckets:   durationBuckets,
+	}, []string{"method", "route"})
+	UploadedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_uploaded_bytes_total",
+		Help:      "The number of bytes read from the bodies of HTTP requests.",
+	}, []string{"method", "route"})
+	DownloadedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_downloaded_bytes_total",
+		Help:      "The number of bytes written to the bodies of HTTP responses.",
+	}, []string{"method", "route"})
+
+	StorageOperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "storage_operation_duration_seconds",
+		Help:      "The latency of storage backend operations.",
+		Buckets:   durationBuckets,
+	}, []string{"operation"})
+	StorageOperationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "storage_operation_errors_total",
+		Help:      "The number of failed storage backend operations.",
+	}, []string{"operation"})
+
+	CacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_requests_total",
+		Help:      "The number of redis cache lookups, result is hit or miss.",
+	}, []string{"cache", "result"})
+
+	uploadSessionsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "chunk_upload_sessions"),
+		"The number of unfinished and unexpired chunk upload sessions.",
+		nil, nil,
+	)
+	registry = prometheus.NewRegistry()
+	// countUploadSessions is set by SetUploadSessionCounter,
+	// the sessions are stored in redis, so they are counted on scraping.
+	countUploadSessions func(ctx context.Context) (int, error)
+)
+
+func init() {
+	registry.MustRegister(
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		prometheus.NewGoCollector(),
+		HTTPRequests,
+		HTTPRequestDuration,
+		UploadedBytes,
+		DownloadedBytes,
+		StorageOperationDuration,
+		StorageOperationErrors,
+		CacheRequests,
+		uploadSessionsCollector{},
+	)
+}
+
+// Handler serves the metrics in the prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// ObserveCache records a lookup of cache
+func ObserveCache(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	CacheRequests.WithLabelValues(cache, result).Inc()
+}
+
+// SetUploadSessionCounter sets the function counting the chunk upload sessions
+func SetUploadSessionCounter(fn func(ctx context.Context) (int, error)) {
+	countUploadSessions = fn
+}
+
+type uploadSessionsCollector struct{}
+
+func (uploadSessionsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- uploadSessionsDesc
+}
+
+func (uploadSessionsCollector) Collect(ch chan<- prometheus.Metric) {
+	if countUploadSessions == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	count, err := countUploadSessions(ctx)
+	if err != nil {
+		log.WithFunc("metrics.Collect").Error(ctx, err, "failed to count chunk upload sessions")
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(uploadSessionsDesc, prometheus.GaugeValue, float64(count))
+}
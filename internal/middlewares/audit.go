@@ -0,0 +1,36 @@
+package middlewares
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/projecteru2/core/log"
+	"github.com/projecteru2/vmihub/internal/common"
+	"github.com/projecteru2/vmihub/internal/models"
+)
+
+// Audit middleware saves the audit logs of the requests marked by common.Audit
+func Audit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		l := common.GetAudit(c)
+		if l == nil {
+			return
+		}
+		if user, exists := common.LoginUser(c); exists {
+			l.Username = user.Username
+			l.AuthMethod = common.LoginMethod(c)
+		}
+		l.ClientIP = c.ClientIP()
+		l.Status = c.Writer.Status()
+		l.Result = models.AuditResultSuccess
+		if l.Status >= http.StatusBadRequest {
+			l.Result = models.AuditResultFailure
+		}
+		// the request is already handled, so just log the error
+		if err := l.Save(nil); err != nil {
+			log.WithFunc("Audit").Errorf(c, err, "failed to save audit log %s %s", l.Action, l.Target)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 
 	//nolint:nolintlint,goimports
 	"github.com/gin-gonic/gin"
+	"github.com/projecteru2/vmihub/internal/models"
 )
 
 // LoginRequired middleware
@@ -20,3 +21,23 @@ func LoginRequired() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// AdminRequired middleware rejects the users who aren't administrators
+func AdminRequired() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value, exists := c.Get("user")
+		if !exists {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "not logged in",
+			})
+			return
+		}
+		if user, ok := value.(*models.User); !ok || !user.Admin {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": "only administrators are allowed",
+			})
+			return
+		}
+		c.Next()
+	}
+}
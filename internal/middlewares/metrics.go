@@ -0,0 +1,48 @@
+package middlewares
+
+import (
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/projecteru2/vmihub/internal/metrics"
+)
+
+// countingReader counts the bytes read from the request body
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// Metrics middleware records the count, latency and transferred bytes of requests
+func Metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		t := time.Now()
+		var body *countingReader
+		if c.Request.Body != nil {
+			body = &countingReader{ReadCloser: c.Request.Body}
+			c.Request.Body = body
+		}
+		c.Next()
+
+		// use the route pattern rather than the path to keep the cardinality low,
+		// it is empty if no route is matched
+		route := c.FullPath()
+		method := c.Request.Method
+		metrics.HTTPRequests.WithLabelValues(method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		metrics.HTTPRequestDuration.WithLabelValues(method, route).Observe(time.Since(t).Seconds())
+		if body != nil && body.n > 0 {
+			metrics.UploadedBytes.WithLabelValues(method, route).Add(float64(body.n))
+		}
+		if size := c.Writer.Size(); size > 0 {
+			metrics.DownloadedBytes.WithLabelValues(method, route).Add(float64(size))
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package middlewares
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/projecteru2/vmihub/internal/common"
+)
+
+// RequireScope middleware rejects the scoped credentials without scope,
+// it should be used after Authenticate.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !common.CheckScope(c, scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": fmt.Sprintf("the token doesn't have scope %s", scope),
+			})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,22 @@
+package middlewares
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+)
+
+// Tracing middleware starts a span for each request, the trace context of caller is respected
+func Tracing(service string) gin.HandlerFunc {
+	trace := otelgin.Middleware(service, otelgin.WithFilter(func(r *http.Request) bool {
+		return r.URL.Path != "/healthz" && r.URL.Path != "/metrics"
+	}))
+	return func(c *gin.Context) {
+		// gin.Context falls back to the request context to carry the span,
+		// but the operations mustn't be canceled when the client goes away as before
+		c.Request = c.Request.WithContext(context.WithoutCancel(c.Request.Context()))
+		trace(c)
+	}
+}
@@ -0,0 +1,158 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// the actions recorded by audit log
+const (
+	AuditImagePush        = "image.push"
+	AuditImageUploadAbort = "image.upload.abort"
+	AuditImageImport      = "image.import"
+	AuditImageConvert     = "image.convert"
+	AuditImageTag         = "image.tag"
+	AuditImageState       = "image.state"
+	AuditImageDelete      = "image.delete"
+	AuditRepoDelete       = "repo.delete"
+	AuditRepoProtection   = "repo.protection"
+	AuditRepoMemberAdd    = "repo.member.add"
+	AuditRepoMemberRemove = "repo.member.remove"
+	AuditOrgCreate        = "org.create"
+	AuditOrgDelete        = "org.delete"
+	AuditOrgMemberSet     = "org.member.set"
+	AuditOrgMemberRemove  = "org.member.remove"
+	AuditTokenCreate      = "token.create"
+	AuditTokenDelete      = "token.delete"
+	AuditUserCreate       = "user.create"
+	AuditUserUpdate       = "user.update"
+	AuditUserDelete       = "user.delete"
+	AuditQuotaSet         = "quota.set"
+	AuditQuotaDelete      = "quota.delete"
+)
+
+// the target and detail columns are VARCHAR(255)
+const maxAuditTextLen = 255
+
+// the results of audited requests
+const (
+	AuditResultSuccess = "success"
+	AuditResultFailure = "failure"
+)
+
+// AuditLog records who did what to which target and how it ended
+type AuditLog struct {
+	ID         int64     `db:"id" json:"id"`
+	Username   string    `db:"username" json:"username" description:"user who sent the request, empty if not authenticated"`
+	AuthMethod string    `db:"auth_method" json:"authMethod" description:"session, jwt, private_token or basic"`
+	Action     string    `db:"action" json:"action" description:"eg: image.push"`
+	Target     string    `db:"target" json:"target" description:"eg: infra/centos:7"`
+	Digest     string    `db:"digest" json:"digest"`
+	Detail     string    `db:"detail" json:"detail"`
+	ClientIP   string    `db:"client_ip" json:"clientIp"`
+	Status     int       `db:"status" json:"status" description:"http status code"`
+	Result     string    `db:"result" json:"result" description:"success or failure"`
+	CreatedAt  time.Time `db:"created_at" json:"createdAt"`
+}
+
+func (*AuditLog) TableName() string {
+	return "audit_log"
+}
+
+func (l *AuditLog) ColumnNames() string {
+	names := GetColumnNames(l)
+	return strings.Join(names, ", ")
+}
+
+func (l *AuditLog) Save(tx *sqlx.Tx) (err error) {
+	if tx == nil {
+		tx, _ = db.Beginx()
+		defer func() {
+			if err == nil {
+				_ = tx.Commit()
+			}
+		}()
+	}
+	if len(l.Target) > maxAuditTextLen {
+		l.Target = l.Target[:maxAuditTextLen]
+	}
+	if len(l.Detail) > maxAuditTextLen {
+		l.Detail = l.Detail[:maxAuditTextLen]
+	}
+	sqlStr := `INSERT INTO audit_log(username, auth_method, action, target, digest, detail, client_ip, status, result)
+	           VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	sqlRes, err := tx.Exec(sqlStr, l.Username, l.AuthMethod, l.Action, l.Target, l.Digest,
+		l.Detail, l.ClientIP, l.Status, l.Result)
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to insert audit log: %v %w", l, err)
+	}
+	l.ID, _ = sqlRes.LastInsertId()
+	return nil
+}
+
+// AuditLogFilter the conditions of querying audit logs, the empty fields are ignored
+type AuditLogFilter struct {
+	Username string
+	Action   string
+	// the prefix of target, eg: infra/centos matches all tags of the repository
+	Target string
+	Result string
+	Since  time.Time
+	Until  time.Time
+}
+
+// QueryAuditLogs returns the audit logs matching filter from newest to oldest and the total count of them
+func QueryAuditLogs(ctx context.Context, filter *AuditLogFilter, pNum, pSize int) (ans []AuditLog, count int, err error) {
+	tblName := ((*AuditLog)(nil)).TableName()
+	columns := ((*AuditLog)(nil)).ColumnNames()
+	var (
+		conds []string
+		args  []any
+	)
+	if filter.Username != "" {
+		conds = append(conds, "username = ?")
+		args = append(args, filter.Username)
+	}
+	if filter.Action != "" {
+		conds = append(conds, "action = ?")
+		args = append(args, filter.Action)
+	}
+	if filter.Target != "" {
+		conds = append(conds, "target LIKE CONCAT(?, '%')")
+		args = append(args, escapeLike(filter.Target))
+	}
+	if filter.Result != "" {
+		conds = append(conds, "result = ?")
+		args = append(args, filter.Result)
+	}
+	if !filter.Since.IsZero() {
+		conds = append(conds, "created_at >= ?")
+		args = append(args, filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		conds = append(conds, "created_at < ?")
+		args = append(args, filter.Until)
+	}
+	where := ""
+	if len(conds) > 0 {
+		where = " WHERE " + strings.Join(conds, " AND ")
+	}
+	sqlStr := fmt.Sprintf("SELECT count(*) FROM %s%s", tblName, where)
+	if err = db.GetContext(ctx, &count, sqlStr, args...); err != nil {
+		return
+	}
+	offset := (pNum - 1) * pSize
+	sqlStr = fmt.Sprintf("SELECT %s FROM %s%s ORDER BY id DESC LIMIT ?, ?", columns, tblName, where)
+	err = db.SelectContext(ctx, &ans, sqlStr, append(args, offset, pSize)...)
+	return
+}
+
+// escapeLike escapes the wildcards of LIKE in s
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -6,4 +6,21 @@ const (
 
 	redisUserKey   = "/vmihub/user/%s"
 	redisUserIDKey = "/vmihub/userId/%d"
+
+	// upload sessions, the argument is upload id
+	RedisUploadInfoKey  = "/vmihub/chunk/info/%s"
+	RedisUploadSliceKey = "/vmihub/chunk/slice/%s"
+	// the fields of upload info
+	RedisUploadImageHKey     = "image"
+	RedisUploadChunkSizeHKey = "chunkSize"
+	RedisUploadChunkNumHKey  = "nChunks"
+	RedisUploadMergedHKey    = "merged"
+	// set atomically by the request which merges or aborts the upload
+	RedisUploadMergingHKey = "merging"
+
+	// the lock of a blob, the argument is digest
+	RedisBlobLockKey = "/vmihub/blob/lock/%s"
 )
+
+// all image files are stored under this prefix, see BlobName
+const blobPrefix = "blobs/sha256"
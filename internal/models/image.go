@@ -4,13 +4,16 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"path"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/duke-git/lancet/strutil"
 	"github.com/jmoiron/sqlx"
+	"github.com/projecteru2/vmihub/internal/metrics"
 	"github.com/projecteru2/vmihub/internal/utils"
+	"github.com/projecteru2/vmihub/pkg/terrors"
 	"github.com/projecteru2/vmihub/pkg/types"
 	pkgutils "github.com/projecteru2/vmihub/pkg/utils"
 	"github.com/redis/go-redis/v9"
@@ -23,14 +26,41 @@ const (
 	ImageFormatRBD   = "rbd"
 )
 
+const (
+	// the image is reserved by an upload, its file isn't available yet
+	ImageStateCreating = "creating"
+	// the file of image is uploaded and verified
+	ImageStateReady = "ready"
+	// the upload of image failed, it can be uploaded again
+	ImageStateFailed = "failed"
+	// the image is kept but shouldn't be used any more
+	ImageStateDeprecated = "deprecated"
+)
+
+// imageStateTransitions lists the states which an image can transit to from each state
+var imageStateTransitions = map[string][]string{
+	ImageStateCreating:   {ImageStateReady, ImageStateFailed},
+	ImageStateFailed:     {ImageStateCreating},
+	ImageStateReady:      {ImageStateDeprecated},
+	ImageStateDeprecated: {ImageStateReady},
+}
+
+// CanTransitImageState returns true if an image can transit from state from to state to
+func CanTransitImageState(from, to string) bool {
+	return lo.Contains(imageStateTransitions[from], to)
+}
+
 type Repository struct {
-	ID        int64     `db:"id" json:"id"`
-	Username  string    `db:"username" json:"username" description:"image's username"`
-	Name      string    `db:"name" json:"name" description:"image name"`
-	Private   bool      `db:"private" json:"private" description:"image is private"`
-	CreatedAt time.Time `db:"created_at" json:"createdAt" description:"image create time"`
-	UpdatedAt time.Time `db:"updated_at" json:"updatedAt" description:"image update time"`
-	Images    []Image   `db:"-" json:"-"`
+	ID            int64     `db:"id" json:"id"`
+	Username      string    `db:"username" json:"username" description:"image's username"`
+	Name          string    `db:"name" json:"name" description:"image name"`
+	Private       bool      `db:"private" json:"private" description:"image is private"`
+	ImmutableTags bool      `db:"immutable_tags" json:"immutableTags" description:"the existing tags can't be overwritten"`
+	ProtectedTags string    `db:"protected_tags" json:"protectedTags" description:"comma separated glob patterns of the tags which can't be overwritten or deleted, eg: release-*"`
+	LatestTag     string    `db:"latest_tag" json:"latestTag" description:"the tag which latest refers to, the newest image is used if it is empty"`
+	CreatedAt     time.Time `db:"created_at" json:"createdAt" description:"image create time"`
+	UpdatedAt     time.Time `db:"updated_at" json:"updatedAt" description:"image update time"`
+	Images        []Image   `db:"-" json:"-"`
 }
 
 func (*Repository) TableName() string {
@@ -47,8 +77,10 @@ type Image struct {
 	RepoID      int64                    `db:"repo_id" json:"repoId"`
 	Tag         string                   `db:"tag" json:"tag" description:"image tag, default:latest"`
 	Labels      JSONColumn[Labels]       `db:"labels" json:"labels"`
+	State       string                   `db:"state" json:"state" description:"image state"`
 	Size        int64                    `db:"size" json:"size" description:"actual file size(in bytes)"`
 	VirtualSize int64                    `db:"virtual_size" json:"virtualSize" description:"virtual size of image file"`
+	ClusterSize int64                    `db:"cluster_size" json:"clusterSize" description:"cluster size of qcow2 image file"`
 	Digest      string                   `db:"digest" json:"digest" description:"image digest"`
 	Format      string                   `db:"format" json:"format" description:"image format"`
 	OS          JSONColumn[types.OSInfo] `db:"os" json:"os"`
@@ -56,9 +88,17 @@ type Image struct {
 	Description string                   `db:"description" json:"description" description:"image description"`
 	CreatedAt   time.Time                `db:"created_at" json:"createdAt" description:"image create time"`
 	UpdatedAt   time.Time                `db:"updated_at" json:"updatedAt" description:"image update time"`
+	OCIManifest JSONColumn[OCIManifest]  `db:"oci_manifest" json:"ociManifest"`
 	Repo        *Repository              `db:"-" json:"repo"`
 }
 
+// OCIManifest is the manifest pushed through the OCI distribution API,
+// it is kept as is, so its digest doesn't change when it is pulled.
+type OCIManifest struct {
+	Manifest string `json:"manifest"`
+	Config   string `json:"config"`
+}
+
 func (*Image) TableName() string {
 	return "image"
 }
@@ -68,6 +108,57 @@ func (img *Image) ColumnNames() string {
 	return strings.Join(names, ", ")
 }
 
+// ProtectedTagPatterns returns the glob patterns of protected tags
+func (repo *Repository) ProtectedTagPatterns() []string {
+	return lo.Compact(lo.Map(strings.Split(repo.ProtectedTags, ","), func(p string, _ int) string {
+		return strings.TrimSpace(p)
+	}))
+}
+
+// TagProtected returns true if tag matches a protected pattern
+func (repo *Repository) TagProtected(tag string) bool {
+	for _, pattern := range repo.ProtectedTagPatterns() {
+		if ok, _ := path.Match(pattern, tag); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckOverwrite returns an error if the existing image can't be overwritten by a new file,
+// the images without file can always be overwritten.
+func (repo *Repository) CheckOverwrite(img *Image) error {
+	if !img.hasFile() {
+		return nil
+	}
+	if repo.TagProtected(img.Tag) {
+		return fmt.Errorf("%w: %s matches the protected patterns of %s", terrors.ErrProtectedTag, img.Tag, repo.Fullname())
+	}
+	if repo.ImmutableTags {
+		return fmt.Errorf("%w: the tags of %s are immutable", terrors.ErrImmutableTag, repo.Fullname())
+	}
+	return nil
+}
+
+// CheckDelete returns an error if the image can't be deleted
+func (repo *Repository) CheckDelete(img *Image) error {
+	if img.hasFile() && repo.TagProtected(img.Tag) {
+		return fmt.Errorf("%w: %s matches the protected patterns of %s", terrors.ErrProtectedTag, img.Tag, repo.Fullname())
+	}
+	return nil
+}
+
+// CheckSetLatest returns an error if latest, which refers to cur now, can't be pinned to another image,
+// latest is protected like the other tags.
+func (repo *Repository) CheckSetLatest(cur *Image) error {
+	if cur == nil {
+		return nil
+	}
+	latest := *cur
+	latest.Tag = "latest"
+	return repo.CheckOverwrite(&latest)
+}
+
 func (repo *Repository) Fullname() string {
 	return fmt.Sprintf("%s/%s", repo.Username, repo.Name)
 }
@@ -76,6 +167,16 @@ func (img *Image) Fullname() string {
 	return fmt.Sprintf("%s/%s:%s", img.Repo.Username, img.Repo.Name, img.Tag)
 }
 
+// Ready returns true if the file of image can be downloaded
+func (img *Image) Ready() bool {
+	return img.State == ImageStateReady
+}
+
+// hasFile returns false for the images whose upload isn't finished
+func (img *Image) hasFile() bool {
+	return img.State == ImageStateReady || img.State == ImageStateDeprecated
+}
+
 func (img *Image) NormalizeName() string {
 	if img.Repo.Username == "_" {
 		return fmt.Sprintf("%s:%s", img.Repo.Name, img.Tag)
@@ -87,6 +188,23 @@ func (img *Image) SliceName() string {
 	return fmt.Sprintf("%s/_slice_%s:%s", img.Repo.Username, img.Repo.Name, img.Tag)
 }
 
+// BlobName returns the name of the object which stores the image file.
+// Image files are addressed by digest, so the same file pushed under
+// different tags or repositories is only stored once.
+func (img *Image) BlobName() string {
+	return BlobName(img.Digest)
+}
+
+// BlobName returns the storage object name for a sha256 digest,
+// eg: blobs/sha256/ab/abcdef...
+func BlobName(digest string) string {
+	digest = strings.TrimPrefix(digest, "sha256:")
+	if len(digest) < 2 {
+		return path.Join(blobPrefix, digest)
+	}
+	return path.Join(blobPrefix, digest[:2], digest)
+}
+
 func (img *Image) GetRepo() (*Repository, error) {
 	var err error
 	if img.Repo == nil {
@@ -116,6 +234,13 @@ func (repo *Repository) GetImage(ctx context.Context, tag string) (*Image, error
 		img *Image
 		err error
 	)
+	if utils.IsDefaultTag(tag) && repo.LatestTag != "" {
+		// latest is pinned to a tag, fall back to the newest image if the tag is deleted or deprecated
+		if img, err = repo.GetImage(ctx, repo.LatestTag); err != nil || (img != nil && img.Ready()) {
+			return img, err
+		}
+		img = nil
+	}
 	if !utils.IsDefaultTag(tag) {
 		if img, err = getImageFromRedis(ctx, repo, tag); err != nil {
 			return nil, err
@@ -128,8 +253,9 @@ func (repo *Repository) GetImage(ctx context.Context, tag string) (*Image, error
 	tblName := ((*Image)(nil)).TableName()
 	columns := ((*Image)(nil)).ColumnNames()
 	if utils.IsDefaultTag(tag) {
-		sqlStr := fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? ORDER BY created_at DESC LIMIT 1", columns, tblName)
-		err = db.Get(img, sqlStr, repo.ID)
+		// the default tag refers to the latest image which can be used
+		sqlStr := fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? AND state = ? ORDER BY created_at DESC LIMIT 1", columns, tblName)
+		err = db.Get(img, sqlStr, repo.ID, ImageStateReady)
 	} else {
 		sqlStr := fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? AND tag = ?", columns, tblName)
 		err = db.Get(img, sqlStr, repo.ID, tag)
@@ -169,6 +295,11 @@ func (repo *Repository) Delete(tx *sqlx.Tx) (err error) {
 		_ = tx.Rollback()
 		return fmt.Errorf("falid to delete images %w", err)
 	}
+	sqlStr = "DELETE FROM repository_member WHERE repo_id = ?"
+	if _, err := tx.Exec(sqlStr, repo.ID); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("falid to delete members %w", err)
+	}
 	sqlStr = "DELETE FROM repository WHERE id = ?"
 	_, err = tx.Exec(sqlStr, repo.ID)
 	if err != nil {
@@ -263,8 +394,8 @@ func (repo *Repository) SaveImage(tx *sqlx.Tx, img *Image) (err error) {
 
 	var sqlRes sql.Result
 	if img.ID > 0 { //nolint
-		sqlStr := "UPDATE image SET digest = ?, size=?, snapshot=? WHERE id = ?"
-		_, err = tx.Exec(sqlStr, img.Digest, img.Size, img.Snapshot, img.ID)
+		sqlStr := "UPDATE image SET digest = ?, size=?, virtual_size=?, cluster_size=?, format=?, snapshot=? WHERE id = ?"
+		_, err = tx.Exec(sqlStr, img.Digest, img.Size, img.VirtualSize, img.ClusterSize, img.Format, img.Snapshot, img.ID)
 		if err != nil {
 			_ = tx.Rollback()
 			return fmt.Errorf("failed to update image: %v %w", img, err)
@@ -275,9 +406,17 @@ func (repo *Repository) SaveImage(tx *sqlx.Tx, img *Image) (err error) {
 			_ = tx.Rollback()
 			return fmt.Errorf("failed to insert image: %v %w", img, err)
 		}
-		sqlStr := "INSERT INTO image(repo_id, tag, labels, size, format, os, digest, snapshot, description) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)"
+		// the image is ready unless it is reserved by an upload
+		if img.State == "" {
+			img.State = ImageStateReady
+		}
+		if img.State != ImageStateReady && img.State != ImageStateCreating {
+			_ = tx.Rollback()
+			return fmt.Errorf("%w: can't create image in state %s", terrors.ErrInvalidImageState, img.State)
+		}
+		sqlStr := "INSERT INTO image(repo_id, tag, labels, state, size, virtual_size, cluster_size, format, os, digest, snapshot, description) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
 		img.RepoID = repo.ID
-		sqlRes, err = tx.Exec(sqlStr, img.RepoID, img.Tag, labels, img.Size, img.Format, osVal, img.Digest, img.Snapshot, img.Description)
+		sqlRes, err = tx.Exec(sqlStr, img.RepoID, img.Tag, labels, img.State, img.Size, img.VirtualSize, img.ClusterSize, img.Format, osVal, img.Digest, img.Snapshot, img.Description)
 		if err != nil {
 			_ = tx.Rollback()
 			return fmt.Errorf("failed to insert image: %v %w", img, err)
@@ -290,12 +429,136 @@ func (repo *Repository) SaveImage(tx *sqlx.Tx, img *Image) (err error) {
 	return nil
 }
 
+// SaveTagProtection saves the tag protection rules of repository
+func (repo *Repository) SaveTagProtection(tx *sqlx.Tx) (err error) {
+	for _, pattern := range repo.ProtectedTagPatterns() {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid tag pattern %s: %w", pattern, err)
+		}
+	}
+	if tx == nil {
+		tx, _ = db.Beginx()
+		defer func() {
+			if err == nil {
+				_ = tx.Commit()
+			}
+		}()
+	}
+	defer func() {
+		if err == nil {
+			_ = deleteRepoInRedis(context.TODO(), repo)
+		}
+	}()
+	sqlStr := "UPDATE repository SET immutable_tags = ?, protected_tags = ? WHERE id = ?"
+	if _, err = tx.Exec(sqlStr, repo.ImmutableTags, repo.ProtectedTags, repo.ID); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to update tag protection of repository: %v %w", repo, err)
+	}
+	return nil
+}
+
+// SetLatestTag pins the latest tag of repository to tag, an empty tag makes latest refer to the newest image again
+func (repo *Repository) SetLatestTag(tx *sqlx.Tx, tag string) (err error) {
+	if tx == nil {
+		tx, _ = db.Beginx()
+		defer func() {
+			if err == nil {
+				_ = tx.Commit()
+			}
+		}()
+	}
+	defer func() {
+		if err == nil {
+			_ = deleteRepoInRedis(context.TODO(), repo)
+		}
+	}()
+	if _, err = tx.Exec("UPDATE repository SET latest_tag = ? WHERE id = ?", tag, repo.ID); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to update latest tag of repository: %v %w", repo, err)
+	}
+	repo.LatestTag = tag
+	return nil
+}
+
+// SetImageState changes the state of img, an error wrapping terrors.ErrInvalidImageState
+// is returned if the transition isn't allowed or the state is changed by others.
+func (repo *Repository) SetImageState(tx *sqlx.Tx, img *Image, state string) (err error) {
+	if !CanTransitImageState(img.State, state) {
+		return fmt.Errorf("%w: %s -> %s", terrors.ErrInvalidImageState, img.State, state)
+	}
+	if tx == nil {
+		tx, _ = db.Beginx()
+		defer func() {
+			if err == nil {
+				_ = tx.Commit()
+			}
+		}()
+	}
+	defer func() {
+		if err == nil {
+			_ = deleteImageInRedis(context.TODO(), repo, img.Tag)
+		}
+	}()
+	res, err := tx.Exec("UPDATE image SET state = ? WHERE id = ? AND state = ?", state, img.ID, img.State)
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to update state of image: %v %w", img, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		_ = tx.Rollback()
+		return fmt.Errorf("%w: the state of image %d isn't %s", terrors.ErrInvalidImageState, img.ID, img.State)
+	}
+	img.State = state
+	return nil
+}
+
+// SaveOCIManifest saves the manifest pushed through the OCI distribution API
+func (repo *Repository) SaveOCIManifest(tx *sqlx.Tx, img *Image) (err error) {
+	if tx == nil {
+		tx, _ = db.Beginx()
+		defer func() {
+			if err == nil {
+				_ = tx.Commit()
+			}
+		}()
+	}
+	defer func() {
+		if err == nil {
+			_ = deleteImageInRedis(context.TODO(), repo, img.Tag)
+		}
+	}()
+	val, err := img.OCIManifest.Value()
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if _, err = tx.Exec("UPDATE image SET oci_manifest = ? WHERE id = ?", val, img.ID); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to update manifest of image: %v %w", img, err)
+	}
+	return nil
+}
+
+// QueryAllRepos returns all repositories ordered by username and name
+func QueryAllRepos(_ context.Context) (ans []Repository, err error) {
+	tblName := ((*Repository)(nil)).TableName()
+	columns := ((*Repository)(nil)).ColumnNames()
+	sqlStr := fmt.Sprintf("SELECT %s FROM %s ORDER BY username, name", columns, tblName)
+	err = db.Select(&ans, sqlStr)
+	return
+}
+
+// sharedRepoIDsSQL selects the ids of repositories shared with a user, its argument is username
+const sharedRepoIDsSQL = "SELECT m.repo_id FROM repository_member m, user u WHERE u.id=m.user_id AND u.username=?"
+
+// QueryRepoList returns the repositories of user and the repositories shared with user
 func QueryRepoList(user string, pNum, pSize int) (ans []Repository, err error) {
 	tblName := ((*Repository)(nil)).TableName()
 	columns := ((*Repository)(nil)).ColumnNames()
 	offset := (pNum - 1) * pSize
-	sqlStr := fmt.Sprintf("SELECT %s FROM %s WHERE username = ? ORDER BY updated_at DESC LIMIT ?, ?", columns, tblName)
-	err = db.Select(&ans, sqlStr, user, offset, pSize)
+	// the repositories shared with user are included
+	sqlStr := fmt.Sprintf("SELECT %s FROM %s WHERE username = ? OR id IN (%s) ORDER BY updated_at DESC LIMIT ?, ?", columns, tblName, sharedRepoIDsSQL)
+	err = db.Select(&ans, sqlStr, user, user, offset, pSize)
 	if err != nil {
 		return
 	}
@@ -394,30 +657,33 @@ type combainResult struct {
 	Private  bool   `db:"private" json:"private"`
 }
 
+// QueryImagesByUsername returns the images of user, the images of repositories shared with user are included
 func QueryImagesByUsername(req types.ImagesByUsernameRequest) (ans []Image, count int, err error) {
 	var rows *sqlx.Rows
 	var sRow *sql.Row
 	offset := (req.PageNum - 1) * req.PageSize
-	sqlStr := `SELECT i.id, i.repo_id, r.username, r.name, r.private, i.tag, i.size, i.digest, i.format, i.os, 
+	sqlStr := `SELECT i.id, i.repo_id, r.username, r.name, r.private, i.tag, i.state, i.size, i.digest, i.format, i.os, 
 	                  i.snapshot, i.description, i.created_at, i.updated_at, i.labels, i.region_code
 	           FROM image i, repository r 
 			   WHERE r.id=i.repo_id AND 
-			         r.username=? AND
+			         (r.username=? OR r.id IN (` + sharedRepoIDsSQL + `)) AND
+			         (? = '' OR i.state = ?) AND
 			         r.name like CONCAT('%', CONCAT(?, '%')) 
 			   ORDER BY i.updated_at DESC LIMIT ?, ?`
 	if strutil.IsBlank(req.RegionCode) {
-		rows, err = db.Queryx(sqlStr, req.Username, req.Keyword, offset, req.PageSize)
+		rows, err = db.Queryx(sqlStr, req.Username, req.Username, req.State, req.State, req.Keyword, offset, req.PageSize)
 	} else {
-		sqlStr = `SELECT i.id, i.repo_id, r.username, r.name, r.private, i.tag, i.size, i.digest, i.format, i.os, 
+		sqlStr = `SELECT i.id, i.repo_id, r.username, r.name, r.private, i.tag, i.state, i.size, i.digest, i.format, i.os, 
 		i.snapshot, i.description, i.created_at, i.updated_at, i.labels, i.region_code 
  FROM image i, repository r 
  WHERE r.id=i.repo_id AND 
-	   r.username=? AND
+	   (r.username=? OR r.id IN (` + sharedRepoIDsSQL + `)) AND
+	   (? = '' OR i.state = ?) AND
 	   r.name like CONCAT('%', CONCAT(?, '%')) AND
 	   r.region_code=? AND
 	   i.region_code=?
  ORDER BY i.updated_at DESC LIMIT ?, ?`
-		rows, err = db.Queryx(sqlStr, req.Username, req.Keyword, req.RegionCode, req.RegionCode, offset, req.PageSize)
+		rows, err = db.Queryx(sqlStr, req.Username, req.Username, req.State, req.State, req.Keyword, req.RegionCode, req.RegionCode, offset, req.PageSize)
 	}
 	if err != nil {
 		return nil, 0, err
@@ -437,21 +703,23 @@ func QueryImagesByUsername(req types.ImagesByUsernameRequest) (ans []Image, coun
 	sqlStr = `SELECT count(*) 
 	           FROM image i, repository r 
 			   WHERE r.id=i.repo_id AND 
-			         r.username=? AND
+			         (r.username=? OR r.id IN (` + sharedRepoIDsSQL + `)) AND
+			         (? = '' OR i.state = ?) AND
 			         r.name like CONCAT('%', CONCAT(?, '%')) 
 			   `
 	if strutil.IsBlank(req.RegionCode) {
-		sRow = db.QueryRow(sqlStr, req.Username, req.Keyword)
+		sRow = db.QueryRow(sqlStr, req.Username, req.Username, req.State, req.State, req.Keyword)
 	} else {
 		sqlStr = `SELECT count(*) 
 		FROM image i, repository r 
 		WHERE r.id=i.repo_id AND 
-			  r.username=? AND
+			  (r.username=? OR r.id IN (` + sharedRepoIDsSQL + `)) AND
+			  (? = '' OR i.state = ?) AND
 			  r.name like CONCAT('%', CONCAT(?, '%')) AND
 			  r.region_code=? AND
 	   		  i.region_code=?
 		`
-		sRow = db.QueryRow(sqlStr, req.Username, req.Keyword, req.RegionCode, req.RegionCode)
+		sRow = db.QueryRow(sqlStr, req.Username, req.Username, req.State, req.State, req.Keyword, req.RegionCode, req.RegionCode)
 	}
 	if err = sRow.Scan(&count); err != nil {
 		return nil, 0, err
@@ -464,28 +732,30 @@ func QueryPublicImagesByUsername(req types.ImagesByUsernameRequest) (ans []Image
 	var rows *sqlx.Rows
 	var sRow *sql.Row
 	offset := (req.PageNum - 1) * req.PageSize
-	sqlStr := `SELECT i.id, i.repo_id, r.username, r.name, i.tag, i.size, i.digest, i.format, i.os, 
+	sqlStr := `SELECT i.id, i.repo_id, r.username, r.name, i.tag, i.state, i.size, i.digest, i.format, i.os, 
 	                  i.snapshot, i.description, i.created_at, i.updated_at, i.labels, i.region_code
 	           FROM image i, repository r 
 			   WHERE r.id=i.repo_id AND 
 			         r.username=? AND
 					 r.private=0 AND
+			         (? = '' OR i.state = ?) AND
 			         r.name like CONCAT('%', CONCAT(?, '%')) 
 			   ORDER BY i.updated_at DESC LIMIT ?, ?`
 	if strutil.IsBlank(req.RegionCode) {
-		rows, err = db.Queryx(sqlStr, req.Username, req.Keyword, offset, req.PageSize)
+		rows, err = db.Queryx(sqlStr, req.Username, req.State, req.State, req.Keyword, offset, req.PageSize)
 	} else {
-		sqlStr = `SELECT i.id, i.repo_id, r.username, r.name, i.tag, i.size, i.digest, i.format, i.os, 
+		sqlStr = `SELECT i.id, i.repo_id, r.username, r.name, i.tag, i.state, i.size, i.digest, i.format, i.os, 
 				i.snapshot, i.description, i.created_at, i.updated_at, i.labels,i.region_code
 		FROM image i, repository r 
 		WHERE r.id=i.repo_id AND 
 			r.username=? AND
 			r.private=0 AND
+			(? = '' OR i.state = ?) AND
 			r.name like CONCAT('%', CONCAT(?, '%')) AND
 			r.region_code=? AND
 			i.region_code=?
 		ORDER BY i.updated_at DESC LIMIT ?, ?`
-		rows, err = db.Queryx(sqlStr, req.Username, req.Keyword, req.RegionCode, req.RegionCode, offset, req.PageSize)
+		rows, err = db.Queryx(sqlStr, req.Username, req.State, req.State, req.Keyword, req.RegionCode, req.RegionCode, offset, req.PageSize)
 	}
 	if err != nil {
 		return nil, 0, err
@@ -507,21 +777,23 @@ func QueryPublicImagesByUsername(req types.ImagesByUsernameRequest) (ans []Image
 			   WHERE r.id=i.repo_id AND 
 			         r.username=? AND
 					 r.private=0 AND
+			         (? = '' OR i.state = ?) AND
 			         r.name like CONCAT('%', CONCAT(?, '%')) 
 			   `
 	if strutil.IsBlank(req.RegionCode) {
-		sRow = db.QueryRow(sqlStr, req.Username, req.Keyword)
+		sRow = db.QueryRow(sqlStr, req.Username, req.State, req.State, req.Keyword)
 	} else {
 		sqlStr = `SELECT count(*) 
 		FROM image i, repository r 
 		WHERE r.id=i.repo_id AND 
 			  r.username=? AND
 			  r.private=0 AND
+			  (? = '' OR i.state = ?) AND
 			  r.name like CONCAT('%', CONCAT(?, '%')) AND
 			  r.region_code=? AND
 	   		  i.region_code=?
 		`
-		sRow = db.QueryRow(sqlStr, req.Username, req.Keyword, req.RegionCode, req.RegionCode)
+		sRow = db.QueryRow(sqlStr, req.Username, req.State, req.State, req.Keyword, req.RegionCode, req.RegionCode)
 	}
 	if err = sRow.Scan(&count); err != nil {
 		return nil, 0, err
@@ -534,6 +806,7 @@ func getRepoFromRedis(ctx context.Context, username, name string) (repo *Reposit
 	rKey := fmt.Sprintf(redistRepoKey, username, name)
 	repo = &Repository{}
 	err = utils.GetObjFromRedis(ctx, rKey, repo)
+	metrics.ObserveCache("repo", err == nil)
 	if err == redis.Nil {
 		return nil, nil //nolint
 	}
@@ -557,6 +830,14 @@ func getImageFromRedis(ctx context.Context, repo *Repository, tag string) (img *
 	if err == redis.Nil {
 		return nil, nil //nolint
 	}
+	// the images cached by old versions have no state
+	if err == nil && img.State == "" {
+		err = redis.Nil
+	}
+	metrics.ObserveCache("image", err == nil)
+	if err == redis.Nil {
+		return nil, nil //nolint
+	}
 	return
 }
 
@@ -629,3 +910,85 @@ func GetImageByID(_ context.Context, id int64) (*Image, error) {
 	image.Repo = &repo
 	return &image, nil
 }
+
+// CountImagesByDigest returns how many images reference the blob of digest.
+func CountImagesByDigest(_ context.Context, digest string) (count int, err error) {
+	tblName := ((*Image)(nil)).TableName()
+	sqlStr := fmt.Sprintf("SELECT count(*) FROM %s WHERE digest = ?", tblName)
+	err = db.Get(&count, sqlStr, digest)
+	return
+}
+
+// CountImagesBySnapshot returns how many images reference the rbd snapshot.
+func CountImagesBySnapshot(_ context.Context, snapshot string) (count int, err error) {
+	tblName := ((*Image)(nil)).TableName()
+	sqlStr := fmt.Sprintf("SELECT count(*) FROM %s WHERE snapshot = ?", tblName)
+	err = db.Get(&count, sqlStr, snapshot)
+	return
+}
+
+// QueryReposByDigest returns the repositories which have a verified image using the blob of digest,
+// the images which are being uploaded or failed are skipped since their digests are claimed by uploaders.
+func QueryReposByDigest(ctx context.Context, digest string) (ans []Repository, err error) {
+	sqlStr := `SELECT DISTINCT r.id, r.username, r.name, r.private
+	           FROM repository r, image i
+	           WHERE r.id=i.repo_id AND i.digest = ? AND i.state IN (?, ?)`
+	err = db.SelectContext(ctx, &ans, sqlStr, digest, ImageStateReady, ImageStateDeprecated)
+	return
+}
+
+// QueryImagesAfterID returns at most limit images whose id is greater than lastID,
+// the repository of each image is filled.
+func QueryImagesAfterID(_ context.Context, lastID int64, limit int) (ans []Image, err error) {
+	sqlStr := `SELECT i.id, i.repo_id, r.username, r.name, r.private, i.tag, i.size, i.digest, i.format, i.snapshot
+	           FROM image i, repository r
+	           WHERE r.id=i.repo_id AND i.id > ?
+	           ORDER BY i.id LIMIT ?`
+	rows, err := db.Queryx(sqlStr, lastID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var res combainResult
+		if err = rows.StructScan(&res); err != nil {
+			return nil, err
+		}
+		res.Image.Repo = &Repository{
+			ID:       res.RepoID,
+			Username: res.Username,
+			Name:     res.Name,
+			Private:  res.Private,
+		}
+		ans = append(ans, res.Image)
+	}
+	return ans, rows.Err()
+}
+
+// QueryStaleCreatingImages returns the images which are in creating state and not updated since deadline,
+// the repository of each image is filled.
+func QueryStaleCreatingImages(_ context.Context, deadline time.Time) (ans []Image, err error) {
+	sqlStr := `SELECT i.id, i.repo_id, r.username, r.name, r.private, i.tag, i.state, i.digest
+	           FROM image i, repository r
+	           WHERE r.id=i.repo_id AND i.state = ? AND i.updated_at < ?
+	           ORDER BY i.id`
+	rows, err := db.Queryx(sqlStr, ImageStateCreating, deadline)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var res combainResult
+		if err = rows.StructScan(&res); err != nil {
+			return nil, err
+		}
+		res.Image.Repo = &Repository{
+			ID:       res.RepoID,
+			Username: res.Username,
+			Name:     res.Name,
+			Private:  res.Private,
+		}
+		ans = append(ans, res.Image)
+	}
+	return ans, rows.Err()
+}
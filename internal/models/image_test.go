@@ -3,10 +3,12 @@ package models
 import (
 	"context"
 	"fmt"
+	"path"
 	"testing"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/projecteru2/vmihub/internal/utils"
+	"github.com/projecteru2/vmihub/pkg/terrors"
 	"github.com/projecteru2/vmihub/pkg/types"
 	"github.com/stretchr/testify/assert"
 )
@@ -24,8 +26,8 @@ func TestQueryRepo(t *testing.T) {
 	columns := ((*Repository)(nil)).ColumnNames()
 	{
 		// empty result
-		Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? ORDER BY updated_at DESC LIMIT ?, ?", columns, tableName)).
-			WithArgs("user2", 0, 10).
+		Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? OR id IN (SELECT m.repo_id FROM repository_member m, user u WHERE u.id=m.user_id AND u.username=?) ORDER BY updated_at DESC LIMIT ?, ?", columns, tableName)).
+			WithArgs("user2", "user2", 0, 10).
 			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name"}))
 
 		repos, err := QueryRepoList("user2", 1, 10)
@@ -36,8 +38,8 @@ func TestQueryRepo(t *testing.T) {
 		wantRows := sqlmock.NewRows([]string{"id", "username", "name"}).
 			AddRow(1, "user1", "name1").
 			AddRow(1, "user1", "name2")
-		Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? ORDER BY updated_at DESC LIMIT ?, ?", columns, tableName)).
-			WithArgs("user1", 0, 10).
+		Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE username = ? OR id IN (SELECT m.repo_id FROM repository_member m, user u WHERE u.id=m.user_id AND u.username=?) ORDER BY updated_at DESC LIMIT ?, ?", columns, tableName)).
+			WithArgs("user1", "user1", 0, 10).
 			WillReturnRows(wantRows)
 		repos, err := QueryRepoList("user1", 1, 10)
 		assert.Nil(t, err)
@@ -146,8 +148,8 @@ func TestGetImageCache(t *testing.T) {
 		Name:     "name1",
 	}
 	{
-		wantRows := sqlmock.NewRows([]string{"id", "repo_id", "tag"}).
-			AddRow(2, 1, "tag2")
+		wantRows := sqlmock.NewRows([]string{"id", "repo_id", "tag", "state"}).
+			AddRow(2, 1, "tag2", ImageStateReady)
 		Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? AND tag = ?", columns, tableName)).
 			WithArgs(1, "tag2").
 			WillReturnRows(wantRows)
@@ -164,6 +166,69 @@ func TestGetImageCache(t *testing.T) {
 	}
 }
 
+func TestGetLatestImage(t *testing.T) {
+	utils.SetupRedis(nil, t)
+	err := Init(nil, t)
+	assert.Nil(t, err)
+	defer func() {
+		err = Mock.ExpectationsWereMet()
+		assert.Nil(t, err)
+	}()
+
+	tableName := ((*Image)(nil)).TableName()
+	columns := ((*Image)(nil)).ColumnNames()
+
+	repo := &Repository{
+		ID:       1,
+		Username: "user1",
+		Name:     "name1",
+	}
+	Mock.ExpectBegin()
+	Mock.ExpectExec("UPDATE repository SET latest_tag = ? WHERE id = ?").
+		WithArgs("tag1", 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	Mock.ExpectCommit()
+	err = repo.SetLatestTag(nil, "tag1")
+	assert.Nil(t, err)
+	assert.Equal(t, "tag1", repo.LatestTag)
+	{
+		// latest refers to the pinned tag instead of the newest image
+		utils.MockRedis.FlushAll()
+		Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? AND tag = ?", columns, tableName)).
+			WithArgs(1, "tag1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "repo_id", "tag", "state"}).AddRow(2, 1, "tag1", ImageStateReady))
+		img, err := repo.GetImage(context.Background(), "latest")
+		assert.Nil(t, err)
+		assert.Equal(t, "tag1", img.Tag)
+	}
+	{
+		// the pinned tag is deleted
+		utils.MockRedis.FlushAll()
+		Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? AND tag = ?", columns, tableName)).
+			WithArgs(1, "tag1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "repo_id", "tag", "state"}))
+		Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? AND state = ? ORDER BY created_at DESC LIMIT 1", columns, tableName)).
+			WithArgs(1, ImageStateReady).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "repo_id", "tag", "state"}).AddRow(3, 1, "tag2", ImageStateReady))
+		img, err := repo.GetImage(context.Background(), "")
+		assert.Nil(t, err)
+		assert.Equal(t, "tag2", img.Tag)
+	}
+	{
+		// the pinned tag is deprecated
+		utils.MockRedis.FlushAll()
+		Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? AND tag = ?", columns, tableName)).
+			WithArgs(1, "tag1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "repo_id", "tag", "state"}).AddRow(2, 1, "tag1", ImageStateDeprecated))
+		Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE repo_id = ? AND state = ? ORDER BY created_at DESC LIMIT 1", columns, tableName)).
+			WithArgs(1, ImageStateReady).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "repo_id", "tag", "state"}).AddRow(3, 1, "tag2", ImageStateReady))
+		img, err := repo.GetImage(context.Background(), "latest")
+		assert.Nil(t, err)
+		assert.Equal(t, "tag2", img.Tag)
+	}
+}
+
 func TestSaveRepo(t *testing.T) {
 	utils.SetupRedis(nil, t)
 	err := Init(nil, t)
@@ -220,8 +285,8 @@ func TestSaveImage(t *testing.T) {
 	osVal, err := img.OS.Value()
 	assert.Nil(t, err)
 	Mock.ExpectBegin()
-	Mock.ExpectExec(fmt.Sprintf("INSERT INTO %s(repo_id, tag, labels, size, format, os, digest, snapshot, description) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)", tableName)).
-		WithArgs(repo.ID, img.Tag, sqlmock.AnyArg(), img.Size, img.Format, osVal, img.Digest, img.Snapshot, img.Description).
+	Mock.ExpectExec(fmt.Sprintf("INSERT INTO %s(repo_id, tag, labels, state, size, virtual_size, cluster_size, format, os, digest, snapshot, description) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", tableName)).
+		WithArgs(repo.ID, img.Tag, sqlmock.AnyArg(), ImageStateReady, img.Size, img.VirtualSize, img.ClusterSize, img.Format, osVal, img.Digest, img.Snapshot, img.Description).
 		WillReturnResult(sqlmock.NewResult(1234, 1))
 	tx, err := db.Beginx()
 	assert.Nil(t, err)
@@ -229,5 +294,118 @@ func TestSaveImage(t *testing.T) {
 	err = repo.SaveImage(tx, img)
 	assert.Nil(t, err)
 	assert.Equal(t, int64(1234), img.ID)
+	assert.Equal(t, ImageStateReady, img.State)
+
+	// images can't be created in other states
+	img = &Image{Tag: "v1", State: ImageStateFailed}
+	err = repo.SaveImage(tx, img)
+	assert.ErrorIs(t, err, terrors.ErrInvalidImageState)
+}
+
+func TestSetImageState(t *testing.T) {
+	utils.SetupRedis(nil, t)
+	err := Init(nil, t)
+	assert.Nil(t, err)
+	defer func() {
+		err = Mock.ExpectationsWereMet()
+		assert.Nil(t, err)
+	}()
+	repo := &Repository{
+		ID:       1,
+		Username: "user1",
+		Name:     "name1",
+	}
+	img := &Image{ID: 2, Tag: "v1", State: ImageStateCreating}
+
+	Mock.ExpectBegin()
+	Mock.ExpectExec("UPDATE image SET state = ? WHERE id = ? AND state = ?").
+		WithArgs(ImageStateReady, 2, ImageStateCreating).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	Mock.ExpectCommit()
+	err = repo.SetImageState(nil, img, ImageStateReady)
+	assert.Nil(t, err)
+	assert.Equal(t, ImageStateReady, img.State)
+
+	// the transition isn't allowed
+	err = repo.SetImageState(nil, img, ImageStateFailed)
+	assert.ErrorIs(t, err, terrors.ErrInvalidImageState)
+
+	// the state is changed by others
+	Mock.ExpectBegin()
+	Mock.ExpectExec("UPDATE image SET state = ? WHERE id = ? AND state = ?").
+		WithArgs(ImageStateDeprecated, 2, ImageStateReady).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	Mock.ExpectRollback()
+	err = repo.SetImageState(nil, img, ImageStateDeprecated)
+	assert.ErrorIs(t, err, terrors.ErrInvalidImageState)
+	assert.Equal(t, ImageStateReady, img.State)
+}
+
+func TestTagProtection(t *testing.T) {
+	repo := &Repository{
+		ID:            1,
+		Username:      "user1",
+		Name:          "name1",
+		ProtectedTags: "release-*, v1.?",
+	}
+	assert.Equal(t, []string{"release-*", "v1.?"}, repo.ProtectedTagPatterns())
+	assert.True(t, repo.TagProtected("release-1.0"))
+	assert.True(t, repo.TagProtected("v1.2"))
+	assert.False(t, repo.TagProtected("v1.20"))
+
+	img := &Image{Tag: "release-1.0", State: ImageStateReady}
+	assert.ErrorIs(t, repo.CheckOverwrite(img), terrors.ErrProtectedTag)
+	assert.ErrorIs(t, repo.CheckDelete(img), terrors.ErrProtectedTag)
+	// the failed upload can be retried and removed
+	img.State = ImageStateFailed
+	assert.Nil(t, repo.CheckOverwrite(img))
+	assert.Nil(t, repo.CheckDelete(img))
+
+	// the immutable tags can be deleted
+	repo.ImmutableTags = true
+	img = &Image{Tag: "latest", State: ImageStateDeprecated}
+	assert.ErrorIs(t, repo.CheckOverwrite(img), terrors.ErrImmutableTag)
+	assert.Nil(t, repo.CheckDelete(img))
+
+	// latest is checked by its own name instead of the tag it refers to
+	repo.ImmutableTags = false
+	repo.ProtectedTags = "latest"
+	assert.ErrorIs(t, repo.CheckSetLatest(&Image{Tag: "v1", State: ImageStateReady}), terrors.ErrProtectedTag)
+	assert.Nil(t, repo.CheckSetLatest(nil))
+}
+
+func TestSaveTagProtection(t *testing.T) {
+	utils.SetupRedis(nil, t)
+	err := Init(nil, t)
+	assert.Nil(t, err)
+	defer func() {
+		err = Mock.ExpectationsWereMet()
+		assert.Nil(t, err)
+	}()
+	repo := &Repository{
+		ID:            1,
+		Username:      "user1",
+		Name:          "name1",
+		ImmutableTags: true,
+		ProtectedTags: "release-*",
+	}
+	Mock.ExpectBegin()
+	Mock.ExpectExec("UPDATE repository SET immutable_tags = ?, protected_tags = ? WHERE id = ?").
+		WithArgs(true, "release-*", 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	Mock.ExpectCommit()
+	err = repo.SaveTagProtection(nil)
+	assert.Nil(t, err)
+
+	repo.ProtectedTags = "release-["
+	err = repo.SaveTagProtection(nil)
+	assert.ErrorIs(t, err, path.ErrBadPattern)
+}
 
+func TestBlobName(t *testing.T) {
+	digest := "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72"
+	assert.Equal(t, "blobs/sha256/6a/"+digest, BlobName(digest))
+	assert.Equal(t, "blobs/sha256/6a/"+digest, BlobName("sha256:"+digest))
+	img := &Image{Digest: digest}
+	assert.Equal(t, BlobName(digest), img.BlobName())
 }
@@ -1,12 +1,17 @@
 package models
 
 import (
+	"context"
+	"database/sql/driver"
 	"testing"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/XSAM/otelsql"
 	_ "github.com/go-sql-driver/mysql" // ignore lint error
 	"github.com/jmoiron/sqlx"
 	"github.com/projecteru2/vmihub/config"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
@@ -26,10 +31,21 @@ func Init(cfg *config.MysqlConfig, t *testing.T) (err error) {
 		Mock = mock
 		return nil
 	}
-	db, err = sqlx.Open("mysql", cfg.DSN)
+	// the queries are traced as the children of the spans in their contexts
+	sqlDB, err := otelsql.Open("mysql", cfg.DSN,
+		otelsql.WithAttributes(semconv.DBSystemMySQL),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{
+			DisableErrSkip: true,
+			OmitRows:       true,
+			SpanFilter: func(ctx context.Context, _ otelsql.Method, _ string, _ []driver.NamedValue) bool {
+				return trace.SpanContextFromContext(ctx).IsValid()
+			},
+		}),
+	)
 	if err != nil {
 		return
 	}
+	db = sqlx.NewDb(sqlDB, "mysql")
 	db.SetMaxOpenConns(cfg.MaxOpenConns)
 	db.SetMaxIdleConns(cfg.MaxIdleConns)
 	return
@@ -0,0 +1 @@
+ALTER TABLE `image` DROP INDEX idx_digest;
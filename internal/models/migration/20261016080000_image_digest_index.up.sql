@@ -0,0 +1 @@
+ALTER TABLE `image` ADD INDEX idx_digest (digest);
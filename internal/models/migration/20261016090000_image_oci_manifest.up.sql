@@ -0,0 +1 @@
+ALTER TABLE `image` ADD COLUMN oci_manifest JSON NULL COMMENT 'manifest pushed through OCI distribution API' AFTER description;
@@ -0,0 +1 @@
+ALTER TABLE `image` ADD COLUMN cluster_size BIGINT(20) UNSIGNED NOT NULL DEFAULT '0' COMMENT 'cluster size of qcow2 image, byte' AFTER virtual_size;
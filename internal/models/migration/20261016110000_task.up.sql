@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS `task` (
+    id BIGINT(20) UNSIGNED NOT NULL AUTO_INCREMENT COMMENT 'task id',
+    type VARCHAR(30) NOT NULL COMMENT 'task type',
+    username VARCHAR(50) NOT NULL COMMENT 'user who submitted the task',
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' COMMENT 'task status',
+    payload JSON NULL COMMENT 'task arguments',
+    result JSON NULL COMMENT 'task result',
+    error VARCHAR(1024) NOT NULL DEFAULT '' COMMENT 'error of the last attempt',
+    attempts INT(10) UNSIGNED NOT NULL DEFAULT '0' COMMENT 'number of attempts',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'create time',
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT 'update time',
+    PRIMARY KEY (id),
+    INDEX idx_username (username),
+    INDEX idx_status (status)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_unicode_ci;
@@ -0,0 +1 @@
+ALTER TABLE `image` ADD COLUMN state ENUM('creating', 'ready', 'failed', 'deprecated') NOT NULL DEFAULT 'ready' COMMENT 'image state' AFTER labels;
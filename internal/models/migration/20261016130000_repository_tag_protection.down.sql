@@ -0,0 +1,2 @@
+ALTER TABLE repository DROP COLUMN protected_tags;
+ALTER TABLE repository DROP COLUMN immutable_tags;
@@ -0,0 +1,2 @@
+ALTER TABLE repository ADD COLUMN immutable_tags BOOLEAN NOT NULL DEFAULT FALSE COMMENT 'existing tags can not be overwritten' AFTER private;
+ALTER TABLE repository ADD COLUMN protected_tags VARCHAR(255) NOT NULL DEFAULT '' COMMENT 'comma separated glob patterns of protected tags' AFTER immutable_tags;
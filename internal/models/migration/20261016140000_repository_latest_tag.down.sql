@@ -0,0 +1 @@
+ALTER TABLE repository DROP COLUMN latest_tag;
@@ -0,0 +1 @@
+ALTER TABLE repository ADD COLUMN latest_tag VARCHAR(40) NOT NULL DEFAULT '' COMMENT 'the tag which latest refers to, empty means the newest image' AFTER protected_tags;
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS organization (
+    id INT(10) UNSIGNED NOT NULL AUTO_INCREMENT COMMENT 'organization id',
+    name VARCHAR(50) NOT NULL COMMENT 'organization name, used as username of repositories',
+    description VARCHAR(255) NOT NULL DEFAULT '' COMMENT 'organization description',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'create time',
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT 'update time',
+    PRIMARY KEY (id),
+    UNIQUE KEY name (name)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_unicode_ci;
+
+CREATE TABLE IF NOT EXISTS organization_member (
+    org_id INT(10) UNSIGNED NOT NULL COMMENT 'organization id',
+    user_id INT(10) UNSIGNED NOT NULL COMMENT 'user id',
+    role VARCHAR(20) NOT NULL COMMENT 'owner, maintainer, developer or reader',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'create time',
+    PRIMARY KEY (org_id, user_id),
+    INDEX idx_user_id (user_id)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_unicode_ci;
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS repository_member (
+    repo_id MEDIUMINT NOT NULL COMMENT 'repo id',
+    user_id INT(10) UNSIGNED NOT NULL COMMENT 'user id',
+    perm VARCHAR(20) NOT NULL COMMENT 'read or write',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'create time',
+    PRIMARY KEY (repo_id, user_id),
+    INDEX idx_user_id (user_id)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_unicode_ci;
@@ -0,0 +1,2 @@
+ALTER TABLE private_token DROP COLUMN repos;
+ALTER TABLE private_token DROP COLUMN scopes;
@@ -0,0 +1,2 @@
+ALTER TABLE private_token ADD COLUMN scopes VARCHAR(255) NOT NULL DEFAULT '' COMMENT 'comma separated scopes, empty means all' AFTER token;
+ALTER TABLE private_token ADD COLUMN repos VARCHAR(255) NOT NULL DEFAULT '' COMMENT 'comma separated glob patterns of repositories, empty means all' AFTER scopes;
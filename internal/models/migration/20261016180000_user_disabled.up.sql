@@ -0,0 +1 @@
+ALTER TABLE user ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT FALSE COMMENT 'disabled users can not login' AFTER admin;
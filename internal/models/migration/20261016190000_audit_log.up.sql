@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS audit_log (
+    id BIGINT(20) UNSIGNED NOT NULL AUTO_INCREMENT COMMENT 'audit log id',
+    username VARCHAR(50) NOT NULL DEFAULT '' COMMENT 'user who sent the request, empty if not authenticated',
+    auth_method VARCHAR(20) NOT NULL DEFAULT '' COMMENT 'session, jwt, private_token or basic',
+    action VARCHAR(50) NOT NULL COMMENT 'eg: image.push',
+    target VARCHAR(255) NOT NULL DEFAULT '' COMMENT 'eg: infra/centos:7',
+    digest VARCHAR(100) NOT NULL DEFAULT '' COMMENT 'digest of image',
+    detail VARCHAR(255) NOT NULL DEFAULT '' COMMENT 'extra information of action',
+    client_ip VARCHAR(50) NOT NULL DEFAULT '' COMMENT 'client ip',
+    status INT(10) NOT NULL DEFAULT '0' COMMENT 'http status code',
+    result VARCHAR(20) NOT NULL COMMENT 'success or failure',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'create time',
+    PRIMARY KEY (id),
+    INDEX idx_username (username),
+    INDEX idx_action (action),
+    INDEX idx_target (target),
+    INDEX idx_created_at (created_at)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_unicode_ci;
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS quota (
+    id BIGINT(20) UNSIGNED NOT NULL AUTO_INCREMENT COMMENT 'quota id',
+    namespace VARCHAR(50) NOT NULL COMMENT 'username or organization name',
+    max_size BIGINT(20) NOT NULL DEFAULT '0' COMMENT 'max bytes of all images, 0 means unlimited',
+    max_images INT(10) NOT NULL DEFAULT '0' COMMENT 'max number of images, 0 means unlimited',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'create time',
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT 'update time',
+    PRIMARY KEY (id),
+    UNIQUE KEY uniq_namespace (namespace)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_unicode_ci;
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS user_oidc (
+    issuer VARCHAR(255) NOT NULL COMMENT 'issuer of identity provider',
+    subject VARCHAR(255) NOT NULL COMMENT 'subject of the account in identity provider',
+    user_id INT(10) UNSIGNED NOT NULL COMMENT 'user id',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'create time',
+    PRIMARY KEY (issuer, subject),
+    UNIQUE KEY uniq_issuer_user (issuer, user_id),
+    INDEX idx_user_id (user_id)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_unicode_ci;
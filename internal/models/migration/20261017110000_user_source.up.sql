@@ -0,0 +1 @@
+ALTER TABLE user ADD COLUMN source VARCHAR(20) NOT NULL DEFAULT 'local' COMMENT 'local, ldap or oidc, the directory users never login as local users' AFTER disabled;
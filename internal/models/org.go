@@ -0,0 +1,205 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/samber/lo"
+)
+
+// the roles of organization members, each role has all permissions of the roles before it
+const (
+	// pull the private images of organization
+	OrgRoleReader = "reader"
+	// push images to organization
+	OrgRoleDeveloper = "developer"
+	// delete images and repositories of organization
+	OrgRoleMaintainer = "maintainer"
+	// manage members and delete organization
+	OrgRoleOwner = "owner"
+)
+
+var orgRoles = []string{OrgRoleReader, OrgRoleDeveloper, OrgRoleMaintainer, OrgRoleOwner}
+
+// ValidOrgRole returns true if role is a known role
+func ValidOrgRole(role string) bool {
+	return lo.Contains(orgRoles, role)
+}
+
+// OrgRoleAtLeast returns true if role has all permissions of minRole
+func OrgRoleAtLeast(role, minRole string) bool {
+	return ValidOrgRole(role) && lo.IndexOf(orgRoles, role) >= lo.IndexOf(orgRoles, minRole)
+}
+
+// Organization is a namespace of repositories shared by its members,
+// its name is used as the username of repositories.
+type Organization struct {
+	ID          int64     `db:"id" json:"id"`
+	Name        string    `db:"name" json:"name" description:"organization name, it is unique among users and organizations"`
+	Description string    `db:"description" json:"description"`
+	CreatedAt   time.Time `db:"created_at" json:"createdAt"`
+	UpdatedAt   time.Time `db:"updated_at" json:"updatedAt"`
+}
+
+func (*Organization) TableName() string {
+	return "organization"
+}
+
+func (org *Organization) ColumnNames() string {
+	names := GetColumnNames(org)
+	return strings.Join(names, ", ")
+}
+
+type OrgMember struct {
+	OrgID     int64     `db:"org_id" json:"orgId"`
+	UserID    int64     `db:"user_id" json:"userId"`
+	Username  string    `db:"username" json:"username"`
+	Role      string    `db:"role" json:"role"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+}
+
+// CreateOrg saves a new organization, owner becomes its first owner
+func CreateOrg(tx *sqlx.Tx, org *Organization, owner *User) (err error) {
+	if tx == nil {
+		tx, _ = db.Beginx()
+		defer func() {
+			if err == nil {
+				_ = tx.Commit()
+			}
+		}()
+	}
+	sqlRes, err := tx.Exec("INSERT INTO organization(name, description) VALUES(?, ?)", org.Name, org.Description)
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to insert organization: %v %w", org, err)
+	}
+	if org.ID, err = sqlRes.LastInsertId(); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if _, err = tx.Exec("INSERT INTO organization_member(org_id, user_id, role) VALUES(?, ?, ?)", org.ID, owner.ID, OrgRoleOwner); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to insert owner of organization: %v %w", org, err)
+	}
+	return nil
+}
+
+// Delete removes the organization and its members, the repositories must be deleted before
+func (org *Organization) Delete(tx *sqlx.Tx) (err error) {
+	if tx == nil {
+		tx, _ = db.Beginx()
+		defer func() {
+			if err == nil {
+				_ = tx.Commit()
+			}
+		}()
+	}
+	if _, err = tx.Exec("DELETE FROM organization_member WHERE org_id = ?", org.ID); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to delete members of organization: %v %w", org, err)
+	}
+	if _, err = tx.Exec("DELETE FROM organization WHERE id = ?", org.ID); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to delete organization: %v %w", org, err)
+	}
+	return nil
+}
+
+// GetMembers returns the members of organization ordered by username
+func (org *Organization) GetMembers(ctx context.Context) (ans []OrgMember, err error) {
+	sqlStr := `SELECT m.org_id, m.user_id, u.username, m.role, m.created_at
+	           FROM organization_member m, user u
+	           WHERE u.id=m.user_id AND m.org_id=?
+	           ORDER BY u.username`
+	err = db.SelectContext(ctx, &ans, sqlStr, org.ID)
+	return
+}
+
+// SetMember adds user to organization or changes the role of an existing member
+func (org *Organization) SetMember(tx *sqlx.Tx, userID int64, role string) (err error) {
+	if !ValidOrgRole(role) {
+		return fmt.Errorf("invalid role %s", role)
+	}
+	if tx == nil {
+		tx, _ = db.Beginx()
+		defer func() {
+			if err == nil {
+				_ = tx.Commit()
+			}
+		}()
+	}
+	sqlStr := "INSERT INTO organization_member(org_id, user_id, role) VALUES(?, ?, ?) ON DUPLICATE KEY UPDATE role = ?"
+	if _, err = tx.Exec(sqlStr, org.ID, userID, role, role); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to set member %d of organization: %v %w", userID, org, err)
+	}
+	return nil
+}
+
+// RemoveMember removes user from organization
+func (org *Organization) RemoveMember(tx *sqlx.Tx, userID int64) (err error) {
+	if tx == nil {
+		tx, _ = db.Beginx()
+		defer func() {
+			if err == nil {
+				_ = tx.Commit()
+			}
+		}()
+	}
+	if _, err = tx.Exec("DELETE FROM organization_member WHERE org_id = ? AND user_id = ?", org.ID, userID); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to remove member %d of organization: %v %w", userID, org, err)
+	}
+	return nil
+}
+
+// QueryOrg returns the organization named name, nil is returned if it doesn't exist
+func QueryOrg(ctx context.Context, name string) (*Organization, error) {
+	tblName := ((*Organization)(nil)).TableName()
+	columns := ((*Organization)(nil)).ColumnNames()
+	org := &Organization{}
+	sqlStr := fmt.Sprintf("SELECT %s FROM %s WHERE name = ?", columns, tblName)
+	err := db.GetContext(ctx, org, sqlStr, name)
+	if err == sql.ErrNoRows {
+		return nil, nil //nolint:nilnil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return org, nil
+}
+
+// QueryOrgsByUser returns the organizations which user is a member of
+func QueryOrgsByUser(ctx context.Context, userID int64) (ans []Organization, err error) {
+	sqlStr := `SELECT o.id, o.name, o.description, o.created_at, o.updated_at
+	           FROM organization o, organization_member m
+	           WHERE o.id=m.org_id AND m.user_id=?
+	           ORDER BY o.name`
+	err = db.SelectContext(ctx, &ans, sqlStr, userID)
+	return
+}
+
+// GetOrgRole returns the role of user in the organization named orgName,
+// an empty string is returned if the user isn't a member or the organization doesn't exist.
+func GetOrgRole(ctx context.Context, orgName string, userID int64) (role string, err error) {
+	sqlStr := `SELECT m.role
+	           FROM organization_member m, organization o
+	           WHERE o.id=m.org_id AND o.name=? AND m.user_id=?`
+	err = db.GetContext(ctx, &role, sqlStr, orgName, userID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return
+}
+
+// CountReposByUsername returns how many repositories are under the namespace of username
+func CountReposByUsername(ctx context.Context, username string) (count int, err error) {
+	tblName := ((*Repository)(nil)).TableName()
+	sqlStr := fmt.Sprintf("SELECT count(*) FROM %s WHERE username = ?", tblName)
+	err = db.GetContext(ctx, &count, sqlStr, username)
+	return
+}
@@ -0,0 +1,43 @@
+package models
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/projecteru2/vmihub/internal/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrgRoleAtLeast(t *testing.T) {
+	assert.True(t, OrgRoleAtLeast(OrgRoleOwner, OrgRoleMaintainer))
+	assert.True(t, OrgRoleAtLeast(OrgRoleDeveloper, OrgRoleDeveloper))
+	assert.False(t, OrgRoleAtLeast(OrgRoleReader, OrgRoleDeveloper))
+	assert.False(t, OrgRoleAtLeast("", OrgRoleReader))
+	assert.False(t, OrgRoleAtLeast("guest", OrgRoleReader))
+}
+
+func TestGetOrgRole(t *testing.T) {
+	utils.SetupRedis(nil, t)
+	err := Init(nil, t)
+	assert.Nil(t, err)
+	defer func() {
+		err = Mock.ExpectationsWereMet()
+		assert.Nil(t, err)
+	}()
+	sqlStr := "SELECT m.role FROM organization_member m, organization o WHERE o.id=m.org_id AND o.name=? AND m.user_id=?"
+	Mock.ExpectQuery(sqlStr).
+		WithArgs("infra", 1).
+		WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(OrgRoleMaintainer))
+	role, err := GetOrgRole(context.Background(), "infra", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, OrgRoleMaintainer, role)
+
+	// not a member
+	Mock.ExpectQuery(sqlStr).
+		WithArgs("infra", 2).
+		WillReturnRows(sqlmock.NewRows([]string{"role"}))
+	role, err = GetOrgRole(context.Background(), "infra", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, "", role)
+}
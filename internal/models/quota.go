@@ -0,0 +1,129 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/projecteru2/vmihub/pkg/terrors"
+)
+
+// Quota limits the images under the namespace of a user or an organization,
+// the namespaces without quota are unlimited.
+type Quota struct {
+	ID        int64     `db:"id" json:"id"`
+	Namespace string    `db:"namespace" json:"namespace" description:"username or organization name"`
+	MaxSize   int64     `db:"max_size" json:"maxSize" description:"max bytes of all images, 0 means unlimited"`
+	MaxImages int64     `db:"max_images" json:"maxImages" description:"max number of images, 0 means unlimited"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+	UpdatedAt time.Time `db:"updated_at" json:"updatedAt"`
+}
+
+func (*Quota) TableName() string {
+	return "quota"
+}
+
+func (q *Quota) ColumnNames() string {
+	names := GetColumnNames(q)
+	return strings.Join(names, ", ")
+}
+
+// Save creates the quota of namespace or replaces the existing one
+func (q *Quota) Save(tx *sqlx.Tx) (err error) {
+	if tx == nil {
+		tx, _ = db.Beginx()
+		defer func() {
+			if err == nil {
+				_ = tx.Commit()
+			}
+		}()
+	}
+	sqlStr := `INSERT INTO quota(namespace, max_size, max_images) VALUES(?, ?, ?)
+	           ON DUPLICATE KEY UPDATE max_size = ?, max_images = ?`
+	if _, err = tx.Exec(sqlStr, q.Namespace, q.MaxSize, q.MaxImages, q.MaxSize, q.MaxImages); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to save quota: %v %w", q, err)
+	}
+	return nil
+}
+
+// Delete removes the quota, so the namespace becomes unlimited
+func (q *Quota) Delete(tx *sqlx.Tx) (err error) {
+	if tx == nil {
+		tx, _ = db.Beginx()
+		defer func() {
+			if err == nil {
+				_ = tx.Commit()
+			}
+		}()
+	}
+	if _, err = tx.Exec("DELETE FROM quota WHERE namespace = ?", q.Namespace); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to delete quota: %v %w", q, err)
+	}
+	return nil
+}
+
+// Check returns ErrQuotaExceeded if usage exceeds the quota after adding an image of size
+func (q *Quota) Check(usage *Usage, size int64) error {
+	if q.MaxSize > 0 && usage.Size+size > q.MaxSize {
+		return fmt.Errorf("%w: %s uses %d of %d bytes, the image needs %d bytes",
+			terrors.ErrQuotaExceeded, q.Namespace, usage.Size, q.MaxSize, size)
+	}
+	if q.MaxImages > 0 && usage.Images+1 > q.MaxImages {
+		return fmt.Errorf("%w: %s has %d of %d images", terrors.ErrQuotaExceeded, q.Namespace, usage.Images, q.MaxImages)
+	}
+	return nil
+}
+
+// GetQuota returns the quota of namespace, nil is returned if it is unlimited
+func GetQuota(ctx context.Context, namespace string) (*Quota, error) {
+	tblName := ((*Quota)(nil)).TableName()
+	columns := ((*Quota)(nil)).ColumnNames()
+	q := &Quota{}
+	sqlStr := fmt.Sprintf("SELECT %s FROM %s WHERE namespace = ?", columns, tblName)
+	err := db.GetContext(ctx, q, sqlStr, namespace)
+	if err == sql.ErrNoRows {
+		return nil, nil //nolint:nilnil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Usage is the consumption of a namespace, the failed images aren't counted
+type Usage struct {
+	Size   int64 `db:"size" json:"size" description:"bytes of all images"`
+	Images int64 `db:"images" json:"images" description:"number of images"`
+}
+
+// GetUsage computes the usage of namespace from image table,
+// the image whose id is excludeID is skipped, eg: the image which is being replaced.
+func GetUsage(ctx context.Context, namespace string, excludeID int64) (*Usage, error) {
+	sqlStr := `SELECT COALESCE(SUM(i.size), 0) AS size, COUNT(*) AS images
+	           FROM image i, repository r
+	           WHERE r.id=i.repo_id AND r.username=? AND i.state != ? AND i.id != ?`
+	usage := &Usage{}
+	if err := db.GetContext(ctx, usage, sqlStr, namespace, ImageStateFailed, excludeID); err != nil {
+		return nil, fmt.Errorf("failed to get usage of %s: %w", namespace, err)
+	}
+	return usage, nil
+}
+
+// CheckQuota returns ErrQuotaExceeded if there is no room in namespace for an image of size,
+// the image whose id is replacedID is going to be replaced, so it isn't counted.
+func CheckQuota(ctx context.Context, namespace string, replacedID, size int64) error {
+	q, err := GetQuota(ctx, namespace)
+	if err != nil || q == nil {
+		return err
+	}
+	usage, err := GetUsage(ctx, namespace, replacedID)
+	if err != nil {
+		return err
+	}
+	return q.Check(usage, size)
+}
@@ -0,0 +1,91 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// the permissions granted to the collaborators of repository
+const (
+	// pull images even if the repository is private
+	RepoPermRead = "read"
+	// pull and push images
+	RepoPermWrite = "write"
+)
+
+// ValidRepoPerm returns true if perm can be granted to collaborators
+func ValidRepoPerm(perm string) bool {
+	return perm == RepoPermRead || perm == RepoPermWrite
+}
+
+// RepoMember is a user who is granted a permission on a repository out of its namespace
+type RepoMember struct {
+	RepoID    int64     `db:"repo_id" json:"repoId"`
+	UserID    int64     `db:"user_id" json:"userId"`
+	Username  string    `db:"username" json:"username"`
+	Perm      string    `db:"perm" json:"perm" description:"read or write"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+}
+
+// GetMembers returns the collaborators of repository ordered by username
+func (repo *Repository) GetMembers(ctx context.Context) (ans []RepoMember, err error) {
+	sqlStr := `SELECT m.repo_id, m.user_id, u.username, m.perm, m.created_at
+	           FROM repository_member m, user u
+	           WHERE u.id=m.user_id AND m.repo_id=?
+	           ORDER BY u.username`
+	err = db.SelectContext(ctx, &ans, sqlStr, repo.ID)
+	return
+}
+
+// SetMember grants perm on repository to user, the existing grant is replaced
+func (repo *Repository) SetMember(tx *sqlx.Tx, userID int64, perm string) (err error) {
+	if !ValidRepoPerm(perm) {
+		return fmt.Errorf("invalid permission %s", perm)
+	}
+	if tx == nil {
+		tx, _ = db.Beginx()
+		defer func() {
+			if err == nil {
+				_ = tx.Commit()
+			}
+		}()
+	}
+	sqlStr := "INSERT INTO repository_member(repo_id, user_id, perm) VALUES(?, ?, ?) ON DUPLICATE KEY UPDATE perm = ?"
+	if _, err = tx.Exec(sqlStr, repo.ID, userID, perm, perm); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to set member %d of repository: %v %w", userID, repo, err)
+	}
+	return nil
+}
+
+// RemoveMember revokes the grant of user on repository
+func (repo *Repository) RemoveMember(tx *sqlx.Tx, userID int64) (err error) {
+	if tx == nil {
+		tx, _ = db.Beginx()
+		defer func() {
+			if err == nil {
+				_ = tx.Commit()
+			}
+		}()
+	}
+	if _, err = tx.Exec("DELETE FROM repository_member WHERE repo_id = ? AND user_id = ?", repo.ID, userID); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to remove member %d of repository: %v %w", userID, repo, err)
+	}
+	return nil
+}
+
+// GetRepoPerm returns the permission granted to user on repository,
+// an empty string is returned if the user isn't a collaborator.
+func GetRepoPerm(ctx context.Context, repoID, userID int64) (perm string, err error) {
+	sqlStr := "SELECT perm FROM repository_member WHERE repo_id = ? AND user_id = ?"
+	err = db.GetContext(ctx, &perm, sqlStr, repoID, userID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return
+}
@@ -0,0 +1,38 @@
+package models
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/projecteru2/vmihub/internal/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetRepoPerm(t *testing.T) {
+	utils.SetupRedis(nil, t)
+	err := Init(nil, t)
+	assert.Nil(t, err)
+	defer func() {
+		err = Mock.ExpectationsWereMet()
+		assert.Nil(t, err)
+	}()
+	sqlStr := "SELECT perm FROM repository_member WHERE repo_id = ? AND user_id = ?"
+	Mock.ExpectQuery(sqlStr).
+		WithArgs(1, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"perm"}).AddRow(RepoPermWrite))
+	perm, err := GetRepoPerm(context.Background(), 1, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, RepoPermWrite, perm)
+
+	// not a collaborator
+	Mock.ExpectQuery(sqlStr).
+		WithArgs(1, 3).
+		WillReturnRows(sqlmock.NewRows([]string{"perm"}))
+	perm, err = GetRepoPerm(context.Background(), 1, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, "", perm)
+
+	repo := &Repository{ID: 1}
+	assert.Error(t, repo.SetMember(nil, 2, "delete"))
+}
@@ -6,6 +6,14 @@ import "github.com/dgrijalva/jwt-go"
 type CustomClaims struct {
 	ID       int64
 	UserName string
+	// the same restriction as private tokens, empty means no restriction
+	Scopes []string `json:",omitempty"`
+	Repos  []string `json:",omitempty"`
 	// AuthorityId uint // 角色认证ID
 	jwt.StandardClaims
 }
+
+// Scope returns the restriction of claims, nil is returned if it isn't restricted
+func (claims *CustomClaims) Scope() *TokenScope {
+	return NewTokenScope(claims.Scopes, claims.Repos)
+}
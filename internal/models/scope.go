@@ -0,0 +1,104 @@
+package models
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+// the scopes of private tokens and jwt
+const (
+	// pull images
+	ScopeImageRead = "image:read"
+	// push images and change the settings of repositories
+	ScopeImageWrite = "image:write"
+	// delete images and repositories
+	ScopeImageDelete = "image:delete"
+	// manage the account, its tokens and organizations, and use the administrator permission
+	ScopeUserAdmin = "user:admin"
+)
+
+var scopes = []string{ScopeImageRead, ScopeImageWrite, ScopeImageDelete, ScopeUserAdmin}
+
+// TokenScope restricts what a credential can do on behalf of its user,
+// a nil TokenScope or an empty field means no restriction.
+type TokenScope struct {
+	Scopes []string `json:"scopes,omitempty"`
+	// glob patterns of repository fullnames, eg: infra/*
+	Repos []string `json:"repos,omitempty"`
+}
+
+// NewTokenScope returns nil if neither scopes nor repos is restricted
+func NewTokenScope(scopes, repos []string) *TokenScope {
+	if len(scopes) == 0 && len(repos) == 0 {
+		return nil
+	}
+	return &TokenScope{Scopes: scopes, Repos: repos}
+}
+
+// Check returns an error if there is an unknown scope or an invalid repository pattern
+func (s *TokenScope) Check() error {
+	if s == nil {
+		return nil
+	}
+	for _, scope := range s.Scopes {
+		if !lo.Contains(scopes, scope) {
+			return fmt.Errorf("invalid scope %s", scope)
+		}
+	}
+	for _, pattern := range s.Repos {
+		if strings.Contains(pattern, ",") {
+			return fmt.Errorf("invalid repository pattern %s", pattern)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid repository pattern %s: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Has returns true if scope is allowed
+func (s *TokenScope) Has(scope string) bool {
+	return s == nil || len(s.Scopes) == 0 || lo.Contains(s.Scopes, scope)
+}
+
+// HasRepo returns true if scope is allowed on the repository named fullname
+func (s *TokenScope) HasRepo(scope, fullname string) bool {
+	if !s.Has(scope) {
+		return false
+	}
+	if s == nil || len(s.Repos) == 0 {
+		return true
+	}
+	for _, pattern := range s.Repos {
+		if ok, _ := path.Match(pattern, fullname); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Contains returns true if other doesn't allow more than s
+func (s *TokenScope) Contains(other *TokenScope) bool {
+	if s == nil {
+		return true
+	}
+	if other == nil {
+		return false
+	}
+	if len(s.Scopes) > 0 && (len(other.Scopes) == 0 || !lo.Every(s.Scopes, other.Scopes)) {
+		return false
+	}
+	if len(s.Repos) > 0 && (len(other.Repos) == 0 || !lo.Every(s.Repos, other.Repos)) {
+		return false
+	}
+	return true
+}
+
+func splitList(s string) []string {
+	return lo.Compact(lo.Map(strings.Split(s, ","), func(p string, _ int) string {
+		return strings.TrimSpace(p)
+	}))
+}
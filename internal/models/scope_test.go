@@ -0,0 +1,48 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenScope(t *testing.T) {
+	var unrestricted *TokenScope
+	assert.True(t, unrestricted.Has(ScopeUserAdmin))
+	assert.True(t, unrestricted.HasRepo(ScopeImageDelete, "user1/name1"))
+	assert.Nil(t, NewTokenScope(nil, nil))
+
+	scope := NewTokenScope([]string{ScopeImageRead}, []string{"infra/*"})
+	assert.Nil(t, scope.Check())
+	assert.True(t, scope.HasRepo(ScopeImageRead, "infra/centos"))
+	assert.False(t, scope.HasRepo(ScopeImageRead, "user1/centos"))
+	assert.False(t, scope.HasRepo(ScopeImageWrite, "infra/centos"))
+	assert.False(t, scope.Has(ScopeUserAdmin))
+
+	// repository restriction only
+	scope = NewTokenScope(nil, []string{"user1/name1"})
+	assert.True(t, scope.HasRepo(ScopeImageDelete, "user1/name1"))
+	assert.True(t, scope.Has(ScopeUserAdmin))
+
+	assert.Error(t, NewTokenScope([]string{"image:all"}, nil).Check())
+	assert.Error(t, NewTokenScope(nil, []string{"infra/[a"}).Check())
+}
+
+func TestTokenScopeContains(t *testing.T) {
+	var unrestricted *TokenScope
+	readOnly := NewTokenScope([]string{ScopeImageRead}, nil)
+	assert.True(t, unrestricted.Contains(readOnly))
+	assert.False(t, readOnly.Contains(unrestricted))
+	assert.True(t, readOnly.Contains(NewTokenScope([]string{ScopeImageRead}, []string{"infra/*"})))
+	assert.False(t, readOnly.Contains(NewTokenScope([]string{ScopeImageRead, ScopeImageWrite}, nil)))
+	// a repository restriction can't be dropped
+	infra := NewTokenScope(nil, []string{"infra/*"})
+	assert.False(t, infra.Contains(readOnly))
+}
+
+func TestPrivateTokenScope(t *testing.T) {
+	token := &PrivateToken{}
+	assert.Nil(t, token.Scope())
+	token = &PrivateToken{Scopes: "image:read, image:write", Repos: "infra/*"}
+	assert.Equal(t, &TokenScope{Scopes: []string{ScopeImageRead, ScopeImageWrite}, Repos: []string{"infra/*"}}, token.Scope())
+}
@@ -0,0 +1,239 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/projecteru2/vmihub/pkg/types"
+)
+
+// the error column is VARCHAR(1024)
+const maxTaskErrorLen = 1024
+
+type Task struct {
+	ID        int64                       `db:"id" json:"id"`
+	Type      string                      `db:"type" json:"type"`
+	Username  string                      `db:"username" json:"username" description:"user who submitted the task"`
+	Status    string                      `db:"status" json:"status"`
+	Payload   JSONColumn[json.RawMessage] `db:"payload" json:"payload"`
+	Result    JSONColumn[json.RawMessage] `db:"result" json:"result"`
+	Error     string                      `db:"error" json:"error" description:"error of the last attempt"`
+	Attempts  int                         `db:"attempts" json:"attempts"`
+	CreatedAt time.Time                   `db:"created_at" json:"createdAt"`
+	UpdatedAt time.Time                   `db:"updated_at" json:"updatedAt"`
+}
+
+func (*Task) TableName() string {
+	return "task"
+}
+
+func (t *Task) ColumnNames() string {
+	names := GetColumnNames(t)
+	return strings.Join(names, ", ")
+}
+
+// NewTask returns a pending task, payload is marshaled to json
+func NewTask(typ, username string, payload any) (*Task, error) {
+	bs, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	raw := json.RawMessage(bs)
+	return &Task{
+		Type:     typ,
+		Username: username,
+		Status:   types.TaskStatusPending,
+		Payload:  NewJSONColumn(&raw),
+	}, nil
+}
+
+// UnmarshalPayload unmarshals the payload of task to v
+func (t *Task) UnmarshalPayload(v any) error {
+	if t.Payload.V == nil {
+		return fmt.Errorf("task %d has no payload", t.ID)
+	}
+	return json.Unmarshal(*t.Payload.V, v)
+}
+
+// SetResult marshals v to json and sets it as the result of task
+func (t *Task) SetResult(v any) error {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	raw := json.RawMessage(bs)
+	t.Result = NewJSONColumn(&raw)
+	return nil
+}
+
+func (t *Task) Save(tx *sqlx.Tx) (err error) {
+	if tx == nil {
+		tx, _ = db.Beginx()
+		defer func() {
+			if err == nil {
+				_ = tx.Commit()
+			}
+		}()
+	}
+	payload, err := t.Payload.Value()
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	sqlStr := "INSERT INTO task(type, username, status, payload) VALUES(?, ?, ?, ?)"
+	sqlRes, err := tx.Exec(sqlStr, t.Type, t.Username, t.Status, payload)
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to insert task: %v %w", t, err)
+	}
+	t.ID, err = sqlRes.LastInsertId()
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return nil
+}
+
+// Update saves the status, result, error and attempts of task
+func (t *Task) Update(tx *sqlx.Tx) (err error) {
+	if tx == nil {
+		tx, _ = db.Beginx()
+		defer func() {
+			if err == nil {
+				_ = tx.Commit()
+			}
+		}()
+	}
+	result, err := t.Result.Value()
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if len(t.Error) > maxTaskErrorLen {
+		t.Error = t.Error[:maxTaskErrorLen]
+	}
+	sqlStr := "UPDATE task SET status = ?, result = ?, error = ?, attempts = ? WHERE id = ?"
+	if _, err = tx.Exec(sqlStr, t.Status, result, t.Error, t.Attempts, t.ID); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to update task: %v %w", t, err)
+	}
+	return nil
+}
+
+// ClaimTask changes the status of task from fromStatus to running,
+// false is returned if the status has been changed by others.
+func ClaimTask(_ context.Context, id int64, fromStatus string) (bool, error) {
+	sqlStr := "UPDATE task SET status = ? WHERE id = ? AND status = ?"
+	res, err := db.Exec(sqlStr, types.TaskStatusRunning, id, fromStatus)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// TouchTask refreshes the update time of a running task, so it isn't reset as stale
+func TouchTask(_ context.Context, id int64) error {
+	sqlStr := "UPDATE task SET updated_at = CURRENT_TIMESTAMP WHERE id = ? AND status = ?"
+	_, err := db.Exec(sqlStr, id, types.TaskStatusRunning)
+	return err
+}
+
+// ResetStaleTasks changes the running tasks which are not updated since deadline back to pending,
+// they are left by the workers which have exited unexpectedly.
+func ResetStaleTasks(_ context.Context, deadline time.Time) (int64, error) {
+	sqlStr := "UPDATE task SET status = ? WHERE status = ? AND updated_at < ?"
+	res, err := db.Exec(sqlStr, types.TaskStatusPending, types.TaskStatusRunning, deadline)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func GetTask(_ context.Context, id int64) (*Task, error) {
+	tblName := ((*Task)(nil)).TableName()
+	columns := ((*Task)(nil)).ColumnNames()
+	t := &Task{}
+	sqlStr := fmt.Sprintf("SELECT %s FROM %s WHERE id = ?", columns, tblName)
+	err := db.Get(t, sqlStr, id)
+	if err == sql.ErrNoRows {
+		return nil, nil //nolint:nilnil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// QueryPendingTaskIDs returns the ids of all pending tasks
+func QueryPendingTaskIDs(_ context.Context) (ans []int64, err error) {
+	tblName := ((*Task)(nil)).TableName()
+	sqlStr := fmt.Sprintf("SELECT id FROM %s WHERE status = ? ORDER BY id", tblName)
+	err = db.Select(&ans, sqlStr, types.TaskStatusPending)
+	return
+}
+
+// QueryActiveTasks returns the pending and running tasks
+func QueryActiveTasks(_ context.Context) (ans []Task, err error) {
+	tblName := ((*Task)(nil)).TableName()
+	columns := ((*Task)(nil)).ColumnNames()
+	sqlStr := fmt.Sprintf("SELECT %s FROM %s WHERE status IN (?, ?) ORDER BY id", columns, tblName)
+	err = db.Select(&ans, sqlStr, types.TaskStatusPending, types.TaskStatusRunning)
+	return
+}
+
+// QueryTasks returns the tasks of username, all tasks are returned if username is empty.
+func QueryTasks(_ context.Context, username, status string, pNum, pSize int) (ans []Task, count int, err error) {
+	tblName := ((*Task)(nil)).TableName()
+	columns := ((*Task)(nil)).ColumnNames()
+	var (
+		conds []string
+		args  []any
+	)
+	if username != "" {
+		conds = append(conds, "username = ?")
+		args = append(args, username)
+	}
+	if status != "" {
+		conds = append(conds, "status = ?")
+		args = append(args, status)
+	}
+	where := ""
+	if len(conds) > 0 {
+		where = " WHERE " + strings.Join(conds, " AND ")
+	}
+	sqlStr := fmt.Sprintf("SELECT count(*) FROM %s%s", tblName, where)
+	if err = db.Get(&count, sqlStr, args...); err != nil {
+		return
+	}
+	offset := (pNum - 1) * pSize
+	sqlStr = fmt.Sprintf("SELECT %s FROM %s%s ORDER BY id DESC LIMIT ?, ?", columns, tblName, where)
+	err = db.Select(&ans, sqlStr, append(args, offset, pSize)...)
+	return
+}
+
+// ToResp converts task to the response of API
+func (t *Task) ToResp() *types.Task {
+	resp := &types.Task{
+		ID:        t.ID,
+		Type:      t.Type,
+		Username:  t.Username,
+		Status:    t.Status,
+		Error:     t.Error,
+		Attempts:  t.Attempts,
+		CreatedAt: t.CreatedAt,
+		UpdatedAt: t.UpdatedAt,
+	}
+	if t.Payload.V != nil {
+		resp.Payload = *t.Payload.V
+	}
+	if t.Result.V != nil {
+		resp.Result = *t.Result.V
+	}
+	return resp
+}
@@ -0,0 +1,108 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/projecteru2/vmihub/internal/utils"
+	"github.com/redis/go-redis/v9"
+)
+
+// UploadSession is an image upload which is started but not finished yet,
+// the state is stored in redis until the upload is finished or expired.
+type UploadSession struct {
+	ID        string
+	Image     *Image
+	ChunkSize uint64
+	NChunks   int
+	// the number of received chunks
+	Received int
+	// all chunks are merged and the image is being verified
+	Merged    bool
+	ExpiresAt time.Time
+}
+
+// CountUploadSessions returns the number of unexpired upload sessions.
+func CountUploadSessions(ctx context.Context) (int, error) {
+	rdb := utils.GetRedisConn()
+	prefix := fmt.Sprintf(RedisUploadInfoKey, "")
+	count := 0
+	iter := rdb.Scan(ctx, 0, prefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		count++
+	}
+	return count, iter.Err()
+}
+
+// GetUploadSession returns the upload session of id, nil is returned if it doesn't exist or is expired.
+func GetUploadSession(ctx context.Context, id string) (*UploadSession, error) {
+	rdb := utils.GetRedisConn()
+	rKey := fmt.Sprintf(RedisUploadInfoKey, id)
+	kv, err := rdb.HGetAll(ctx, rKey).Result()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to get upload session %s: %w", id, err)
+	}
+	if _, ok := kv[RedisUploadImageHKey]; !ok {
+		return nil, nil //nolint:nilnil
+	}
+	sess := &UploadSession{ID: id, Image: &Image{}}
+	for k, v := range kv {
+		switch k {
+		case RedisUploadImageHKey:
+			err = json.Unmarshal([]byte(v), sess.Image)
+		case RedisUploadChunkSizeHKey:
+			sess.ChunkSize, err = humanize.ParseBytes(v)
+		case RedisUploadChunkNumHKey:
+			sess.NChunks, err = strconv.Atoi(v)
+		case RedisUploadMergedHKey:
+			sess.Merged, err = strconv.ParseBool(v)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid upload session %s: %s %w", id, k, err)
+		}
+	}
+	received, err := rdb.HLen(ctx, fmt.Sprintf(RedisUploadSliceKey, id)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to count chunks of upload session %s: %w", id, err)
+	}
+	sess.Received = int(received)
+	ttl, err := rdb.TTL(ctx, rKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ttl of upload session %s: %w", id, err)
+	}
+	if ttl > 0 {
+		sess.ExpiresAt = time.Now().Add(ttl)
+	}
+	return sess, nil
+}
+
+// ListUploadSessions returns all unexpired upload sessions.
+func ListUploadSessions(ctx context.Context) ([]*UploadSession, error) {
+	rdb := utils.GetRedisConn()
+	prefix := fmt.Sprintf(RedisUploadInfoKey, "")
+	var ans []*UploadSession
+	iter := rdb.Scan(ctx, 0, prefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		sess, err := GetUploadSession(ctx, strings.TrimPrefix(iter.Val(), prefix))
+		if err != nil {
+			return nil, err
+		}
+		// the session may be finished during scanning
+		if sess == nil {
+			continue
+		}
+		ans = append(ans, sess)
+	}
+	return ans, iter.Err()
+}
+
+// RemoveUploadSession removes the redis keys of the upload session of id
+func RemoveUploadSession(ctx context.Context, id string) error {
+	rdb := utils.GetRedisConn()
+	return rdb.Del(ctx, fmt.Sprintf(RedisUploadInfoKey, id), fmt.Sprintf(RedisUploadSliceKey, id)).Err()
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"regexp"
 	"strings"
 	"time"
 
@@ -14,6 +15,17 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+var nameRegex = regexp.MustCompile(utils.NameRegex)
+
+const (
+	// the users created by administrators or registration
+	UserSourceLocal = "local"
+	// the users provisioned by LDAP logins
+	UserSourceLDAP = "ldap"
+	// the users provisioned by OIDC logins
+	UserSourceOIDC = "oidc"
+)
+
 type User struct {
 	ID        int64     `db:"id" json:"id"`
 	Username  string    `db:"username" json:"username" description:"Login user name"`
@@ -21,6 +33,8 @@ type User struct {
 	Nickname  string    `db:"nickname" json:"nickname" description:"user's nickname"`
 	Email     string    `db:"email" json:"email" description:"user's email"`
 	Admin     bool      `db:"admin" json:"admin" description:"is a admin"`
+	Disabled  bool      `db:"disabled" json:"disabled" description:"disabled users can't login"`
+	Source    string    `db:"source" json:"source" description:"where the user comes from: local, ldap or oidc"`
 	CreatedAt time.Time `db:"created_at" json:"createdAt" description:"user create time"`
 	UpdatedAt time.Time `db:"updated_at" json:"updatedAt" description:"user update time"`
 }
@@ -39,6 +53,8 @@ type PrivateToken struct {
 	Name      string    `db:"name" json:"name"`
 	UserID    int64     `db:"user_id" json:"userId"`
 	Token     string    `db:"token" json:"token"`
+	Scopes    string    `db:"scopes" json:"scopes" description:"comma separated scopes, empty means all scopes"`
+	Repos     string    `db:"repos" json:"repos" description:"comma separated glob patterns of repositories, empty means all repositories"`
 	ExpiredAt time.Time `db:"expired_at" json:"expiredAt"`
 	CreatedAt time.Time `db:"created_at" json:"createdAt" description:"user create time"`
 	LastUsed  time.Time `db:"last_used" json:"lastUsed"`
@@ -53,6 +69,11 @@ func (t *PrivateToken) columnNames() string {
 	return strings.Join(names, ", ")
 }
 
+// Scope returns the restriction of token, nil is returned if it isn't restricted
+func (t *PrivateToken) Scope() *TokenScope {
+	return NewTokenScope(splitList(t.Scopes), splitList(t.Repos))
+}
+
 func (t *PrivateToken) GetUser() (*User, error) {
 	return GetUserByID(context.TODO(), t.UserID)
 }
@@ -66,8 +87,8 @@ func (t *PrivateToken) Save(tx *sqlx.Tx) (err error) {
 			}
 		}()
 	}
-	sqlStr := "INSERT INTO private_token(user_id, name, token, expired_at) VALUES(?, ?, ?, ?)"
-	sqlRes, err := tx.Exec(sqlStr, t.UserID, t.Name, t.Token, t.ExpiredAt)
+	sqlStr := "INSERT INTO private_token(user_id, name, token, scopes, repos, expired_at) VALUES(?, ?, ?, ?, ?, ?)"
+	sqlRes, err := tx.Exec(sqlStr, t.UserID, t.Name, t.Token, t.Scopes, t.Repos, t.ExpiredAt)
 	if err != nil {
 		_ = tx.Rollback()
 		return fmt.Errorf("%w failed to insert private token: %v", err, t)
@@ -122,8 +143,8 @@ func (user *User) Update(tx *sqlx.Tx) (err error) {
 			deleteUserInRedis(context.TODO(), user)
 		}
 	}()
-	sqlStr := "UPDATE user SET nickname = ?, email = ? WHERE id = ?"
-	if _, err = tx.Exec(sqlStr, user.Nickname, user.Email, user.ID); err != nil {
+	sqlStr := "UPDATE user SET nickname = ?, email = ?, admin = ?, disabled = ? WHERE id = ?"
+	if _, err = tx.Exec(sqlStr, user.Nickname, user.Email, user.Admin, user.Disabled, user.ID); err != nil {
 		_ = tx.Rollback()
 		return fmt.Errorf("%w failed to update user: %v", err, user)
 	}
@@ -157,17 +178,200 @@ func CreateUser(tx *sqlx.Tx, user *User, password string) (err error) {
 		}()
 	}
 	if user.Password, err = utils.EncryptPassword(password); err != nil {
+		_ = tx.Rollback()
 		return err
 	}
-	sqlStr := "INSERT INTO user (username, password, email, nickname) VALUES (?, ?, ?, ?)"
-	sqlRes, err := tx.Exec(sqlStr, user.Username, user.Password, user.Email, user.Nickname)
+	if user.Source == "" {
+		user.Source = UserSourceLocal
+	}
+	sqlStr := "INSERT INTO user (username, password, email, nickname, admin, source) VALUES (?, ?, ?, ?, ?, ?)"
+	sqlRes, err := tx.Exec(sqlStr, user.Username, user.Password, user.Email, user.Nickname, user.Admin, user.Source)
 	if err != nil {
+		_ = tx.Rollback()
 		return err
 	}
 	user.ID, _ = sqlRes.LastInsertId()
 	return nil
 }
 
+// ProvisionUser returns the local user of an account authenticated by an external identity provider,
+// the user is created on first login with a password nobody knows, then the email, nickname
+// and admin flag are synced from account. The admin flag is kept if syncAdmin is false.
+// terrors.ErrNameTaken is returned if the user with the same name comes from another source.
+func ProvisionUser(ctx context.Context, account *User, syncAdmin bool) (*User, error) {
+	user, err := GetUser(ctx, account.Username)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return createProvisionedUser(ctx, account, syncAdmin, nil)
+	}
+	if user.Source != account.Source {
+		return nil, terrors.ErrNameTaken
+	}
+	return syncProvisionedUser(user, account, syncAdmin)
+}
+
+// ProvisionOIDCUser returns the user linked to the account of subject in the OIDC provider of issuer,
+// the user is created and linked on first login like ProvisionUser. An existing user with the same
+// name is never linked automatically, terrors.ErrNameTaken is returned unless an administrator links it.
+func ProvisionOIDCUser(ctx context.Context, issuer, subject string, account *User, syncAdmin bool) (*User, error) {
+	user, err := GetUserByOIDC(ctx, issuer, subject)
+	if err != nil {
+		return nil, err
+	}
+	if user != nil {
+		return syncProvisionedUser(user, account, syncAdmin)
+	}
+	if user, err = GetUser(ctx, account.Username); err != nil {
+		return nil, err
+	}
+	if user != nil {
+		return nil, terrors.ErrNameTaken
+	}
+	return createProvisionedUser(ctx, account, syncAdmin, func(tx *sqlx.Tx, user *User) error {
+		return user.LinkOIDC(tx, issuer, subject)
+	})
+}
+
+// createProvisionedUser creates the user of account, link is called in the same transaction if it isn't nil
+func createProvisionedUser(ctx context.Context, account *User, syncAdmin bool, link func(*sqlx.Tx, *User) error) (*User, error) {
+	if !nameRegex.MatchString(account.Username) {
+		return nil, terrors.ErrInvalidUserName
+	}
+	org, err := QueryOrg(ctx, account.Username)
+	if err != nil {
+		return nil, err
+	}
+	if org != nil {
+		return nil, terrors.ErrNameTaken
+	}
+	user := &User{
+		Username: account.Username,
+		Email:    account.Email,
+		Nickname: account.Nickname,
+		Admin:    syncAdmin && account.Admin,
+		Source:   account.Source,
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	if err := CreateUser(tx, user, utils.RandomString(32)); err != nil {
+		return nil, err
+	}
+	if link != nil {
+		if err := link(tx, user); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// syncProvisionedUser updates the email, nickname and admin flag of user from account
+func syncProvisionedUser(user, account *User, syncAdmin bool) (*User, error) {
+	updated := *user
+	if account.Email != "" {
+		updated.Email = account.Email
+	}
+	if account.Nickname != "" {
+		updated.Nickname = account.Nickname
+	}
+	if syncAdmin {
+		updated.Admin = account.Admin
+	}
+	if updated == *user {
+		return user, nil
+	}
+	if err := updated.Update(nil); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// LinkOIDC links user to the account of subject in the OIDC provider of issuer,
+// the previous account of user and the previous user of the account are unlinked.
+func (user *User) LinkOIDC(tx *sqlx.Tx, issuer, subject string) (err error) {
+	if tx == nil {
+		tx, _ = db.Beginx()
+		defer func() {
+			if err == nil {
+				_ = tx.Commit()
+			}
+		}()
+	}
+	if _, err = tx.Exec("DELETE FROM user_oidc WHERE issuer = ? AND user_id = ?", issuer, user.ID); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("%w failed to unlink OIDC account of user: %v", err, user)
+	}
+	sqlStr := "INSERT INTO user_oidc(issuer, subject, user_id) VALUES(?, ?, ?) ON DUPLICATE KEY UPDATE user_id = ?"
+	if _, err = tx.Exec(sqlStr, issuer, subject, user.ID, user.ID); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("%w failed to link OIDC account of user: %v", err, user)
+	}
+	return nil
+}
+
+// GetUserByOIDC returns the user linked to the account of subject in the OIDC provider of issuer
+func GetUserByOIDC(ctx context.Context, issuer, subject string) (*User, error) {
+	tblName := ((*User)(nil)).TableName()
+	columns := ((*User)(nil)).ColumnNames()
+	user := &User{}
+	sqlStr := fmt.Sprintf("SELECT %s FROM %s WHERE id = (SELECT user_id FROM user_oidc WHERE issuer = ? AND subject = ?)", columns, tblName)
+	err := db.GetContext(ctx, user, sqlStr, issuer, subject)
+	if err == sql.ErrNoRows {
+		return nil, nil //nolint:nilnil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// Delete removes user with its private tokens, memberships and OIDC links,
+// the repositories of user must be deleted before
+func (user *User) Delete(tx *sqlx.Tx) (err error) {
+	if tx == nil {
+		tx, _ = db.Beginx()
+		defer func() {
+			if err == nil {
+				_ = tx.Commit()
+			}
+		}()
+	}
+	defer func() {
+		if err == nil {
+			deleteUserInRedis(context.TODO(), user)
+		}
+	}()
+	for _, sqlStr := range []string{
+		"DELETE FROM private_token WHERE user_id = ?",
+		"DELETE FROM organization_member WHERE user_id = ?",
+		"DELETE FROM repository_member WHERE user_id = ?",
+		"DELETE FROM user_oidc WHERE user_id = ?",
+		"DELETE FROM user WHERE id = ?",
+	} {
+		if _, err = tx.Exec(sqlStr, user.ID); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("%w failed to delete user: %v", err, user)
+		}
+	}
+	return nil
+}
+
+// QueryUsers returns the users whose username contains keyword
+func QueryUsers(ctx context.Context, keyword string, pNum, pSize int) (ans []User, err error) {
+	tblName := ((*User)(nil)).TableName()
+	columns := ((*User)(nil)).ColumnNames()
+	offset := (pNum - 1) * pSize
+	sqlStr := fmt.Sprintf("SELECT %s FROM %s WHERE username LIKE CONCAT('%%', CONCAT(?, '%%')) ORDER BY id LIMIT ?, ?", columns, tblName)
+	err = db.SelectContext(ctx, &ans, sqlStr, keyword, offset, pSize)
+	return
+}
+
 func GetPrivateToken(token string) (*PrivateToken, error) {
 	privToken := &PrivateToken{}
 	tblName := ((*PrivateToken)(nil)).tableName()
@@ -260,6 +464,9 @@ func CheckAndGetUser(ctx context.Context, idStr, password string) (*User, error)
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
 		return nil, terrors.ErrInvalidUserPass
 	}
+	if user.Disabled {
+		return nil, terrors.ErrUserDisabled
+	}
 	return user, nil
 }
 
@@ -0,0 +1,198 @@
+package oidc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	gooidc "github.com/coreos/go-oidc/v3/oidc"
+	"github.com/projecteru2/vmihub/config"
+	"github.com/projecteru2/vmihub/internal/models"
+	"github.com/projecteru2/vmihub/internal/utils"
+	"github.com/redis/go-redis/v9"
+	"github.com/samber/lo"
+	"golang.org/x/oauth2"
+)
+
+const (
+	redisStateKey = "/vmihub/oidc/state/%s"
+
+	// the login must be finished before the state expires
+	stateTTL = 10 * time.Minute
+)
+
+var (
+	ErrDisabled     = errors.New("OIDC login is disabled")
+	ErrInvalidState = errors.New("invalid or expired OIDC state")
+	ErrAuthFailed   = errors.New("OIDC authentication failed")
+)
+
+var (
+	cfg      *config.OIDCConfig
+	oauthCfg *oauth2.Config
+	verifier *gooidc.IDTokenVerifier
+)
+
+// Identity is the user authenticated by the identity provider,
+// it is identified by Issuer and Subject, the other claims can be changed in the provider.
+type Identity struct {
+	Issuer   string
+	Subject  string
+	Username string
+	Email    string
+	Nickname string
+	Groups   []string
+}
+
+type stateInfo struct {
+	Nonce string `json:"nonce"`
+}
+
+// Init discovers the endpoints of identity provider, it does nothing if OIDC is disabled
+func Init(ctx context.Context, c *config.OIDCConfig) error {
+	cfg = nil
+	if !c.Enabled {
+		return nil
+	}
+	for _, gr := range c.GroupRoles {
+		if !models.ValidOrgRole(gr.Role) {
+			return fmt.Errorf("invalid role %s of group %s", gr.Role, gr.Group)
+		}
+	}
+	provider, err := gooidc.NewProvider(ctx, c.Issuer)
+	if err != nil {
+		return fmt.Errorf("failed to discover OIDC provider %s: %w", c.Issuer, err)
+	}
+	oauthCfg = &oauth2.Config{
+		ClientID:     c.ClientID,
+		ClientSecret: c.ClientSecret,
+		RedirectURL:  c.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       append([]string{gooidc.ScopeOpenID}, lo.Without(c.Scopes, gooidc.ScopeOpenID)...),
+	}
+	verifier = provider.Verifier(&gooidc.Config{ClientID: c.ClientID})
+	cfg = c
+	return nil
+}
+
+// Enabled returns true if users can login with the identity provider
+func Enabled() bool {
+	return cfg != nil
+}
+
+// Issuer returns the issuer of identity provider, it is empty if OIDC is disabled
+func Issuer() string {
+	if cfg == nil {
+		return ""
+	}
+	return cfg.Issuer
+}
+
+// AuthCodeURL returns the login url of identity provider,
+// the state in it is only valid for a while.
+func AuthCodeURL(ctx context.Context) (string, error) {
+	if !Enabled() {
+		return "", ErrDisabled
+	}
+	state, nonce := utils.RandomString(32), utils.RandomString(32)
+	if err := utils.SetObjToRedis(ctx, fmt.Sprintf(redisStateKey, state), &stateInfo{Nonce: nonce}, stateTTL); err != nil {
+		return "", err
+	}
+	return oauthCfg.AuthCodeURL(state, gooidc.Nonce(nonce)), nil
+}
+
+// Exchange redeems the authorization code and returns the identity in the verified ID token,
+// a state can only be used once.
+func Exchange(ctx context.Context, state, code string) (*Identity, error) {
+	if !Enabled() {
+		return nil, ErrDisabled
+	}
+	key := fmt.Sprintf(redisStateKey, state)
+	info := &stateInfo{}
+	if err := utils.GetObjFromRedis(ctx, key, info); err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, ErrInvalidState
+		}
+		return nil, err
+	}
+	if err := utils.DeleteObjectsInRedis(ctx, key); err != nil {
+		return nil, err
+	}
+	token, err := oauthCfg.Exchange(ctx, code)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to exchange code: %w", ErrAuthFailed, err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: no id_token in token response", ErrAuthFailed)
+	}
+	idToken, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrAuthFailed, err)
+	}
+	if idToken.Nonce != info.Nonce {
+		return nil, fmt.Errorf("%w: nonce mismatched", ErrAuthFailed)
+	}
+	claims := map[string]any{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrAuthFailed, err)
+	}
+	return newIdentity(idToken.Issuer, idToken.Subject, claims)
+}
+
+func newIdentity(issuer, subject string, claims map[string]any) (*Identity, error) {
+	if subject == "" {
+		return nil, fmt.Errorf("%w: no sub claim in ID token", ErrAuthFailed)
+	}
+	id := &Identity{
+		Issuer:   issuer,
+		Subject:  subject,
+		Username: stringClaim(claims, cfg.UsernameClaim),
+		Email:    stringClaim(claims, "email"),
+		Nickname: stringClaim(claims, "name"),
+	}
+	if id.Username == "" {
+		return nil, fmt.Errorf("%w: no %s claim in ID token", ErrAuthFailed, cfg.UsernameClaim)
+	}
+	switch groups := claims[cfg.GroupsClaim].(type) {
+	case string:
+		id.Groups = []string{groups}
+	case []any:
+		for _, g := range groups {
+			if s, ok := g.(string); ok {
+				id.Groups = append(id.Groups, s)
+			}
+		}
+	}
+	return id, nil
+}
+
+func stringClaim(claims map[string]any, name string) string {
+	s, _ := claims[name].(string)
+	return s
+}
+
+// IsAdmin returns true if the user is a member of admin groups,
+// managed is false if the admin flag isn't managed by the identity provider.
+func (id *Identity) IsAdmin() (admin, managed bool) {
+	if len(cfg.AdminGroups) == 0 {
+		return false, false
+	}
+	return len(lo.Intersect(cfg.AdminGroups, id.Groups)) > 0, true
+}
+
+// OrgRoles returns the roles of user in the organizations managed by the identity provider,
+// the highest role is used if several groups are mapped to one organization,
+// and an empty role means the user isn't a member.
+func (id *Identity) OrgRoles() map[string]string {
+	ans := map[string]string{}
+	for _, gr := range cfg.GroupRoles {
+		role := ans[gr.Org]
+		if lo.Contains(id.Groups, gr.Group) && !models.OrgRoleAtLeast(role, gr.Role) {
+			role = gr.Role
+		}
+		ans[gr.Org] = role
+	}
+	return ans
+}
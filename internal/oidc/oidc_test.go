@@ -0,0 +1,70 @@
+package oidc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/projecteru2/vmihub/config"
+	"github.com/projecteru2/vmihub/internal/models"
+	"github.com/projecteru2/vmihub/internal/testutils"
+	"github.com/projecteru2/vmihub/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExchange(t *testing.T) {
+	utils.SetupRedis(nil, t)
+	ctx := context.Background()
+	idp := testutils.NewMockIdP(t, "vmihub")
+	idp.Claims = map[string]any{
+		"preferred_username": "user1",
+		"email":              "user1@example.com",
+		"groups":             []string{"infra-dev", "infra-ops", "others"},
+	}
+	cfg := &config.OIDCConfig{
+		Enabled:       true,
+		Issuer:        idp.URL,
+		ClientID:      "vmihub",
+		RedirectURL:   "http://vmihub.test/callback",
+		UsernameClaim: "preferred_username",
+		GroupsClaim:   "groups",
+		GroupRoles: []config.OIDCGroupRole{
+			{Group: "infra-ops", Org: "infra", Role: models.OrgRoleMaintainer},
+			{Group: "infra-dev", Org: "infra", Role: models.OrgRoleDeveloper},
+			{Group: "ai-dev", Org: "ai", Role: models.OrgRoleDeveloper},
+		},
+	}
+	require.NoError(t, Init(ctx, cfg))
+	defer Init(ctx, &config.OIDCConfig{}) //nolint:errcheck
+
+	authURL, err := AuthCodeURL(ctx)
+	require.NoError(t, err)
+	callback := idp.Login(t, authURL)
+	state, code := callback.Query().Get("state"), callback.Query().Get("code")
+
+	_, err = Exchange(ctx, "unknown", code)
+	assert.ErrorIs(t, err, ErrInvalidState)
+
+	id, err := Exchange(ctx, state, code)
+	require.NoError(t, err)
+	assert.Equal(t, idp.URL, id.Issuer)
+	assert.Equal(t, "mock-subject", id.Subject)
+	assert.Equal(t, "user1", id.Username)
+	assert.Equal(t, "user1@example.com", id.Email)
+	admin, managed := id.IsAdmin()
+	assert.False(t, admin)
+	assert.False(t, managed)
+	assert.Equal(t, map[string]string{"infra": models.OrgRoleMaintainer, "ai": ""}, id.OrgRoles())
+
+	// the state is used
+	_, err = Exchange(ctx, state, code)
+	assert.ErrorIs(t, err, ErrInvalidState)
+
+	// the ID token is issued to another client
+	authURL, err = AuthCodeURL(ctx)
+	require.NoError(t, err)
+	callback = idp.Login(t, authURL)
+	idp.ClientID = "others"
+	_, err = Exchange(ctx, callback.Query().Get("state"), callback.Query().Get("code"))
+	assert.ErrorIs(t, err, ErrAuthFailed)
+}
@@ -0,0 +1,132 @@
+package rbd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/projecteru2/vmihub/config"
+	"github.com/projecteru2/vmihub/internal/utils/sh"
+	"github.com/projecteru2/vmihub/pkg/terrors"
+)
+
+// the errno printed by rbd
+const (
+	errNotFound = "(2) No such file or directory"
+	errBusy     = "(16) Device or resource busy"
+	errInvalid  = "(22) Invalid argument"
+)
+
+// Pool returns the configured pool, rbd is disabled if it is empty
+func Pool() string {
+	if cfg := config.GetCfg(); cfg != nil {
+		return cfg.RBD.Pool
+	}
+	return ""
+}
+
+// SnapshotName returns the full name of snapshot, eg: eru/ubuntu-18.04@v1
+func SnapshotName(pool, image, snap string) string {
+	return fmt.Sprintf("%s/%s@%s", pool, image, snap)
+}
+
+// ParseSnapshot splits the full name of snapshot to the image and snapshot name
+func ParseSnapshot(snapshot string) (image, snap string, err error) {
+	image, snap, ok := strings.Cut(snapshot, "@")
+	if !ok || image == "" || snap == "" {
+		return "", "", fmt.Errorf("invalid rbd snapshot %s", snapshot)
+	}
+	return image, snap, nil
+}
+
+// Import imports the raw image file src to pool as image
+func Import(ctx context.Context, src, pool, image string) error {
+	if _, err := run(ctx, "import", "--image-format", "2", src, fmt.Sprintf("%s/%s", pool, image)); err != nil {
+		return fmt.Errorf("failed to import %s to %s/%s: %w", src, pool, image, err)
+	}
+	return nil
+}
+
+// CreateSnapshot creates a protected snapshot of image, so it can be cloned.
+// The full name of snapshot is returned.
+func CreateSnapshot(ctx context.Context, pool, image, snap string) (string, error) {
+	snapshot := SnapshotName(pool, image, snap)
+	if _, err := run(ctx, "snap", "create", snapshot); err != nil {
+		return "", fmt.Errorf("failed to create snapshot %s: %w", snapshot, err)
+	}
+	if _, err := run(ctx, "snap", "protect", snapshot); err != nil {
+		return "", fmt.Errorf("failed to protect snapshot %s: %w", snapshot, err)
+	}
+	return snapshot, nil
+}
+
+// Children returns the images cloned from snapshot
+func Children(ctx context.Context, snapshot string) ([]string, error) {
+	out, err := run(ctx, "children", snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list children of %s: %w", snapshot, err)
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// Export returns the content of snapshot in raw format,
+// the returned reader must be closed to wait for rbd.
+func Export(ctx context.Context, snapshot string) (io.ReadCloser, error) {
+	rc, err := sh.ExecStream(ctx, "rbd", args("export", snapshot, "-")...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to export %s: %w", snapshot, err)
+	}
+	return rc, nil
+}
+
+// Remove unprotects and removes snapshot, then removes its image.
+// terrors.ErrRBDDependency is returned if the snapshot is cloned by others, and terrors.ErrRBDBusy if the image is in use.
+// The removed snapshot and image are skipped, so it can be retried.
+func Remove(ctx context.Context, snapshot string) error {
+	image, _, err := ParseSnapshot(snapshot)
+	if err != nil {
+		return err
+	}
+	if _, err := run(ctx, "snap", "unprotect", snapshot); err != nil && !isErr(err, errNotFound, errInvalid) {
+		if isErr(err, errBusy) {
+			return fmt.Errorf("%w: %s has children: %v", terrors.ErrRBDDependency, snapshot, err)
+		}
+		return fmt.Errorf("failed to unprotect snapshot %s: %w", snapshot, err)
+	}
+	if _, err := run(ctx, "snap", "rm", snapshot); err != nil && !isErr(err, errNotFound) {
+		return fmt.Errorf("failed to remove snapshot %s: %w", snapshot, err)
+	}
+	if _, err := run(ctx, "rm", image); err != nil && !isErr(err, errNotFound) {
+		if isErr(err, errBusy) {
+			return fmt.Errorf("%w: %s is in use: %v", terrors.ErrRBDBusy, image, err)
+		}
+		return fmt.Errorf("failed to remove image %s: %w", image, err)
+	}
+	return nil
+}
+
+// args prepends the ceph user to the arguments of rbd
+func args(a ...string) []string {
+	if cfg := config.GetCfg(); cfg != nil && cfg.RBD.Username != "" {
+		return append([]string{"--id", cfg.RBD.Username}, a...)
+	}
+	return a
+}
+
+func run(ctx context.Context, a ...string) ([]byte, error) {
+	stdout, stderr, err := sh.ExecInOut(ctx, nil, nil, "rbd", args(a...)...)
+	if err != nil {
+		return nil, fmt.Errorf("%w %s", err, strings.TrimSpace(string(stderr)))
+	}
+	return stdout, nil
+}
+
+func isErr(err error, msgs ...string) bool {
+	for _, msg := range msgs {
+		if strings.Contains(err.Error(), msg) {
+			return true
+		}
+	}
+	return false
+}
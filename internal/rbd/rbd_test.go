@@ -0,0 +1,94 @@
+package rbd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/projecteru2/vmihub/config"
+	"github.com/projecteru2/vmihub/internal/utils/sh"
+	shMocks "github.com/projecteru2/vmihub/internal/utils/sh/mocks"
+	"github.com/projecteru2/vmihub/pkg/terrors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshot(t *testing.T) {
+	_, err := config.LoadTestConfig()
+	require.NoError(t, err)
+	ctx := context.Background()
+	shell := &shMocks.Shell{}
+	defer sh.NewMockShell(shell)()
+	defer shell.AssertExpectations(t)
+
+	assert.Equal(t, "eru", Pool())
+	shell.On("ExecInOut", mock.Anything, mock.Anything, mock.Anything, "rbd", "--id", "eru", "import", "--image-format", "2", "/tmp/image", "eru/ubuntu").
+		Return(nil, nil, nil).Once()
+	err = Import(ctx, "/tmp/image", "eru", "ubuntu")
+	assert.Nil(t, err)
+
+	shell.On("ExecInOut", mock.Anything, mock.Anything, mock.Anything, "rbd", "--id", "eru", "snap", "create", "eru/ubuntu@v1").
+		Return(nil, nil, nil).Once()
+	shell.On("ExecInOut", mock.Anything, mock.Anything, mock.Anything, "rbd", "--id", "eru", "snap", "protect", "eru/ubuntu@v1").
+		Return(nil, []byte("rbd: protecting snap failed: (30) Read-only file system"), errors.New("exit status 30")).Once()
+	_, err = CreateSnapshot(ctx, "eru", "ubuntu", "v1")
+	assert.ErrorContains(t, err, "Read-only file system")
+
+	shell.On("ExecInOut", mock.Anything, mock.Anything, mock.Anything, "rbd", "--id", "eru", "children", "eru/ubuntu@v1").
+		Return([]byte("eru/vm1\neru/vm2\n"), nil, nil).Once()
+	children, err := Children(ctx, "eru/ubuntu@v1")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"eru/vm1", "eru/vm2"}, children)
+
+	shell.On("ExecStream", mock.Anything, "rbd", "--id", "eru", "export", "eru/ubuntu@v1", "-").
+		Return(io.NopCloser(strings.NewReader("raw content")), nil).Once()
+	rc, err := Export(ctx, "eru/ubuntu@v1")
+	require.NoError(t, err)
+	bs, err := io.ReadAll(rc)
+	assert.Nil(t, err)
+	assert.Equal(t, "raw content", string(bs))
+	assert.Nil(t, rc.Close())
+}
+
+func TestRemove(t *testing.T) {
+	_, err := config.LoadTestConfig()
+	require.NoError(t, err)
+	ctx := context.Background()
+	shell := &shMocks.Shell{}
+	defer sh.NewMockShell(shell)()
+	defer shell.AssertExpectations(t)
+
+	mockRBD := func(stderr string, args ...any) {
+		var err error
+		if stderr != "" {
+			err = errors.New("exit status 1")
+		}
+		args = append([]any{mock.Anything, mock.Anything, mock.Anything, "rbd", "--id", "eru"}, args...)
+		shell.On("ExecInOut", args...).Return(nil, []byte(stderr), err).Once()
+	}
+
+	err = Remove(ctx, "eru/ubuntu")
+	assert.Error(t, err)
+
+	// the snapshot is cloned
+	mockRBD("rbd: unprotecting snap failed: (16) Device or resource busy", "snap", "unprotect", "eru/ubuntu@v1")
+	err = Remove(ctx, "eru/ubuntu@v1")
+	assert.ErrorIs(t, err, terrors.ErrRBDDependency)
+
+	// the image is mapped
+	mockRBD("", "snap", "unprotect", "eru/ubuntu@v1")
+	mockRBD("", "snap", "rm", "eru/ubuntu@v1")
+	mockRBD("rbd: error: image still has watchers\nRemoving image: 0% complete...failed.\nrbd: delete error: (16) Device or resource busy", "rm", "eru/ubuntu")
+	err = Remove(ctx, "eru/ubuntu@v1")
+	assert.ErrorIs(t, err, terrors.ErrRBDBusy)
+
+	// retrying skips the removed snapshot
+	mockRBD("rbd: unprotecting snap failed: (2) No such file or directory", "snap", "unprotect", "eru/ubuntu@v1")
+	mockRBD("rbd: failed to remove snapshot: (2) No such file or directory", "snap", "rm", "eru/ubuntu@v1")
+	mockRBD("", "rm", "eru/ubuntu")
+	err = Remove(ctx, "eru/ubuntu@v1")
+	assert.Nil(t, err)
+}
@@ -0,0 +1,267 @@
+package azure
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/google/uuid"
+	"github.com/projecteru2/vmihub/config"
+	"github.com/projecteru2/vmihub/internal/storage"
+	stotypes "github.com/projecteru2/vmihub/internal/storage/types"
+)
+
+// the interval of polling the status of copying blob
+const copyPollInterval = 500 * time.Millisecond
+
+func init() {
+	storage.Register("azure", func(cfg *config.StorageConfig) (storage.Storage, error) {
+		if cfg.Azure == nil {
+			return nil, errors.New("storage.azure is not configured")
+		}
+		return New(cfg.Azure.Endpoint, cfg.Azure.AccountName, cfg.Azure.AccountKey, cfg.Azure.Container, cfg.Azure.BaseDir)
+	})
+}
+
+// Store keeps objects as block blobs in a container of Azure Blob Storage,
+// a chunk write stages the chunks as uncommitted blocks of the blob and commits them in order.
+type Store struct {
+	Endpoint    string
+	AccountName string
+	Container   string
+	BaseDir     string
+	client      *container.Client
+}
+
+// New creates a store of the container, endpoint is the url of blob service,
+// eg: https://<account>.blob.core.windows.net or http://127.0.0.1:10000/devstoreaccount1 of Azurite.
+func New(endpoint, accountName, accountKey, containerName, baseDir string) (*Store, error) {
+	cred, err := container.NewSharedKeyCredential(accountName, accountKey)
+	if err != nil {
+		return nil, err
+	}
+	containerURL := strings.TrimSuffix(endpoint, "/") + "/" + containerName
+	client, err := container.NewClientWithSharedKeyCredential(containerURL, cred, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{
+		Endpoint:    endpoint,
+		AccountName: accountName,
+		Container:   containerName,
+		BaseDir:     baseDir,
+		client:      client,
+	}, nil
+}
+
+func (s *Store) blobClient(name string) *blockblob.Client {
+	return s.client.NewBlockBlobClient(path.Join(s.BaseDir, name))
+}
+
+func (s *Store) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return s.SeekRead(ctx, name, 0)
+}
+
+func (s *Store) Delete(ctx context.Context, name string, ignoreNotExists bool) error {
+	_, err := s.blobClient(name).Delete(ctx, nil)
+	if ignoreNotExists && bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (s *Store) Put(ctx context.Context, name string, digest string, in io.ReadSeeker) error {
+	_, err := s.blobClient(name).UploadStream(ctx, in, &blockblob.UploadStreamOptions{
+		Metadata: map[string]*string{"sha256": to.Ptr(digest)},
+	})
+	return err
+}
+
+func (s *Store) PutWithChunk(ctx context.Context, name string, digest string, size int, chunkSize int, in io.ReaderAt) error {
+	_, err := s.blobClient(name).UploadStream(ctx, io.NewSectionReader(in, 0, int64(size)), &blockblob.UploadStreamOptions{
+		BlockSize: int64(chunkSize),
+		Metadata:  map[string]*string{"sha256": to.Ptr(digest)},
+	})
+	return err
+}
+
+func (s *Store) SeekRead(ctx context.Context, name string, start int64) (io.ReadCloser, error) {
+	resp, err := s.blobClient(name).DownloadStream(ctx, &blob.DownloadStreamOptions{
+		Range: blob.HTTPRange{Offset: start},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// CreateChunkWrite returns a new transaction id, nothing is created in the container
+// until the first chunk is staged.
+func (s *Store) CreateChunkWrite(_ context.Context, _ string) (string, error) {
+	return uuid.NewString(), nil
+}
+
+func (s *Store) ChunkWrite(ctx context.Context, name string, transactionID string, info *stotypes.ChunkInfo) error {
+	id := blockID(transactionID, info.Idx)
+	if _, err := s.blobClient(name).StageBlock(ctx, id, streaming.NopCloser(info.In), nil); err != nil {
+		return err
+	}
+	info.Raw = id
+	return nil
+}
+
+func (s *Store) CompleteChunkWrite(ctx context.Context, name string, transactionID string, chunkList []*stotypes.ChunkInfo) error {
+	chunks := make([]*stotypes.ChunkInfo, len(chunkList))
+	copy(chunks, chunkList)
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].Idx < chunks[j].Idx
+	})
+	ids := make([]string, 0, len(chunks))
+	for _, chunk := range chunks {
+		ids = append(ids, blockID(transactionID, chunk.Idx))
+	}
+	_, err := s.blobClient(name).CommitBlockList(ctx, ids, nil)
+	return err
+}
+
+// AbortChunkWrite does nothing, the uncommitted blocks are discarded by Azure
+// when the blob is committed next time or after a week.
+func (s *Store) AbortChunkWrite(_ context.Context, _ string, _ string) error {
+	return nil
+}
+
+func (s *Store) Move(ctx context.Context, src, dest string) error {
+	destClient := s.blobClient(dest)
+	resp, err := destClient.StartCopyFromURL(ctx, s.blobClient(src).URL(), nil)
+	if err != nil {
+		return err
+	}
+	status := resp.CopyStatus
+	for status != nil && *status == blob.CopyStatusTypePending {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(copyPollInterval):
+		}
+		props, err := destClient.GetProperties(ctx, nil)
+		if err != nil {
+			return err
+		}
+		status = props.CopyStatus
+	}
+	if status != nil && *status != blob.CopyStatusTypeSuccess {
+		return fmt.Errorf("failed to copy %s to %s: %s", src, dest, *status)
+	}
+	return s.Delete(ctx, src, true)
+}
+
+func (s *Store) GetSize(ctx context.Context, name string) (int64, error) {
+	props, err := s.blobClient(name).GetProperties(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	if props.ContentLength == nil {
+		return 0, nil
+	}
+	return *props.ContentLength, nil
+}
+
+func (s *Store) GetDigest(ctx context.Context, name string) (string, error) {
+	props, err := s.blobClient(name).GetProperties(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	// the case of metadata keys isn't preserved by http headers
+	for k, v := range props.Metadata {
+		if strings.EqualFold(k, "sha256") && v != nil {
+			return *v, nil
+		}
+	}
+	body, err := s.Get(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	hasher := sha256.New()
+	if _, err = io.Copy(hasher, body); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+func (s *Store) Exists(ctx context.Context, name string) (bool, error) {
+	_, err := s.blobClient(name).GetProperties(ctx, nil)
+	if err == nil {
+		return true, nil
+	}
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (s *Store) List(ctx context.Context, prefix string) ([]*stotypes.ObjectInfo, error) {
+	var ans []*stotypes.ObjectInfo
+	pager := s.client.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{
+		Prefix: to.Ptr(s.objectKey(prefix)),
+	})
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Segment.BlobItems {
+			info := &stotypes.ObjectInfo{
+				Name: s.objectName(*item.Name),
+			}
+			if item.Properties != nil {
+				if item.Properties.ContentLength != nil {
+					info.Size = *item.Properties.ContentLength
+				}
+				if item.Properties.LastModified != nil {
+					info.ModTime = *item.Properties.LastModified
+				}
+			}
+			ans = append(ans, info)
+		}
+	}
+	return ans, nil
+}
+
+// objectKey returns the blob name prefix of name in container, a trailing slash is kept
+func (s *Store) objectKey(name string) string {
+	if s.BaseDir == "" {
+		return name
+	}
+	key := path.Join(s.BaseDir, name)
+	if name == "" || strings.HasSuffix(name, "/") {
+		key += "/"
+	}
+	return key
+}
+
+func (s *Store) objectName(key string) string {
+	if s.BaseDir == "" {
+		return key
+	}
+	return strings.TrimPrefix(key, strings.TrimSuffix(s.BaseDir, "/")+"/")
+}
+
+// blockID returns the id of the block of chunk idx in transaction,
+// Azure requires the ids of a blob are base64 encoded and have the same length.
+func blockID(transactionID string, idx int) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s-%08d", transactionID, idx)))
+}
@@ -0,0 +1,407 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	stotypes "github.com/projecteru2/vmihub/internal/storage/types"
+	pkgutils "github.com/projecteru2/vmihub/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	fakeAccount = "devstoreaccount1"
+	// the well-known key of Azurite
+	fakeAccountKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+type fakeBlob struct {
+	data     []byte
+	metadata map[string]string
+	modTime  time.Time
+}
+
+// fakeBlobService is a stand-in of Azurite which serves the subset of Blob REST API used by Store
+type fakeBlobService struct {
+	mu         sync.Mutex
+	containers map[string]map[string]*fakeBlob
+	// uncommitted blocks of blobs, keyed by container/blob and then block id
+	blocks map[string]map[string][]byte
+}
+
+func newFakeBlobService(t *testing.T) *httptest.Server {
+	svc := &fakeBlobService{
+		containers: map[string]map[string]*fakeBlob{},
+		blocks:     map[string]map[string][]byte{},
+	}
+	ts := httptest.NewServer(svc)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func (svc *fakeBlobService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	// the path is /<account>/<container>[/<blob>]
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 3)
+	if len(parts) < 2 || parts[0] != fakeAccount {
+		writeError(w, http.StatusBadRequest, "InvalidUri")
+		return
+	}
+	q := r.URL.Query()
+	if len(parts) == 2 {
+		svc.serveContainer(w, r, parts[1], q)
+		return
+	}
+	blobs, ok := svc.containers[parts[1]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "ContainerNotFound")
+		return
+	}
+	svc.serveBlob(w, r, blobs, parts[1]+"/"+parts[2], parts[2], q)
+}
+
+func (svc *fakeBlobService) serveContainer(w http.ResponseWriter, r *http.Request, name string, q url.Values) {
+	switch {
+	case r.Method == http.MethodPut && q.Get("restype") == "container":
+		if _, ok := svc.containers[name]; ok {
+			writeError(w, http.StatusConflict, "ContainerAlreadyExists")
+			return
+		}
+		svc.containers[name] = map[string]*fakeBlob{}
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodGet && q.Get("comp") == "list":
+		blobs, ok := svc.containers[name]
+		if !ok {
+			writeError(w, http.StatusNotFound, "ContainerNotFound")
+			return
+		}
+		type properties struct {
+			LastModified  string `xml:"Last-Modified"`
+			ContentLength int64  `xml:"Content-Length"`
+			BlobType      string `xml:"BlobType"`
+		}
+		type blobItem struct {
+			Name       string     `xml:"Name"`
+			Properties properties `xml:"Properties"`
+		}
+		type result struct {
+			XMLName xml.Name   `xml:"EnumerationResults"`
+			Prefix  string     `xml:"Prefix"`
+			Blobs   []blobItem `xml:"Blobs>Blob"`
+		}
+		res := result{Prefix: q.Get("prefix")}
+		for blobName, b := range blobs {
+			if !strings.HasPrefix(blobName, res.Prefix) {
+				continue
+			}
+			res.Blobs = append(res.Blobs, blobItem{
+				Name: blobName,
+				Properties: properties{
+					LastModified:  b.modTime.UTC().Format(http.TimeFormat),
+					ContentLength: int64(len(b.data)),
+					BlobType:      "BlockBlob",
+				},
+			})
+		}
+		sort.Slice(res.Blobs, func(i, j int) bool {
+			return res.Blobs[i].Name < res.Blobs[j].Name
+		})
+		w.Header().Set("Content-Type", "application/xml")
+		_ = xml.NewEncoder(w).Encode(res)
+	default:
+		writeError(w, http.StatusBadRequest, "UnsupportedHttpVerb")
+	}
+}
+
+func (svc *fakeBlobService) serveBlob(w http.ResponseWriter, r *http.Request, blobs map[string]*fakeBlob, key, name string, q url.Values) { //nolint:gocyclo
+	switch {
+	case r.Method == http.MethodPut && q.Get("comp") == "block":
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidInput")
+			return
+		}
+		if svc.blocks[key] == nil {
+			svc.blocks[key] = map[string][]byte{}
+		}
+		svc.blocks[key][q.Get("blockid")] = data
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && q.Get("comp") == "blocklist":
+		var list struct {
+			Blocks []struct {
+				ID string `xml:",chardata"`
+			} `xml:",any"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&list); err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidXmlDocument")
+			return
+		}
+		var data []byte
+		for _, block := range list.Blocks {
+			chunk, ok := svc.blocks[key][block.ID]
+			if !ok {
+				writeError(w, http.StatusBadRequest, "InvalidBlockList")
+				return
+			}
+			data = append(data, chunk...)
+		}
+		// committing discards all uncommitted blocks
+		delete(svc.blocks, key)
+		blobs[name] = &fakeBlob{data: data, metadata: readMetadata(r.Header), modTime: time.Now()}
+		writeBlobHeaders(w, blobs[name])
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && r.Header.Get("x-ms-copy-source") != "":
+		srcURL, err := url.Parse(r.Header.Get("x-ms-copy-source"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidHeaderValue")
+			return
+		}
+		parts := strings.SplitN(strings.TrimPrefix(srcURL.Path, "/"), "/", 3)
+		if len(parts) < 3 || svc.containers[parts[1]][parts[2]] == nil {
+			writeError(w, http.StatusNotFound, "CannotVerifyCopySource")
+			return
+		}
+		src := svc.containers[parts[1]][parts[2]]
+		blobs[name] = &fakeBlob{data: bytes.Clone(src.data), metadata: src.metadata, modTime: time.Now()}
+		w.Header().Set("x-ms-copy-id", "copy-"+name)
+		w.Header().Set("x-ms-copy-status", "success")
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidInput")
+			return
+		}
+		blobs[name] = &fakeBlob{data: data, metadata: readMetadata(r.Header), modTime: time.Now()}
+		writeBlobHeaders(w, blobs[name])
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		b, ok := blobs[name]
+		if !ok {
+			writeError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		writeBlobHeaders(w, b)
+		if r.Method == http.MethodHead {
+			w.Header().Set("Content-Length", strconv.Itoa(len(b.data)))
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		rng := r.Header.Get("x-ms-range")
+		if rng == "" {
+			rng = r.Header.Get("Range")
+		}
+		if rng == "" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(b.data)))
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write(b.data)
+			return
+		}
+		var start, end int64
+		end = int64(len(b.data)) - 1
+		if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end); err != nil && start == 0 {
+			writeError(w, http.StatusBadRequest, "InvalidRange")
+			return
+		}
+		if start >= int64(len(b.data)) {
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+			return
+		}
+		if end >= int64(len(b.data)) {
+			end = int64(len(b.data)) - 1
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(b.data)))
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = w.Write(b.data[start : end+1])
+	case r.Method == http.MethodDelete:
+		if _, ok := blobs[name]; !ok {
+			writeError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		delete(blobs, name)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		writeError(w, http.StatusBadRequest, "UnsupportedHttpVerb")
+	}
+}
+
+func readMetadata(header http.Header) map[string]string {
+	metadata := map[string]string{}
+	for k := range header {
+		if strings.HasPrefix(strings.ToLower(k), "x-ms-meta-") {
+			metadata[strings.ToLower(k[len("x-ms-meta-"):])] = header.Get(k)
+		}
+	}
+	return metadata
+}
+
+func writeBlobHeaders(w http.ResponseWriter, b *fakeBlob) {
+	w.Header().Set("Last-Modified", b.modTime.UTC().Format(http.TimeFormat))
+	w.Header().Set("ETag", fmt.Sprintf("\"%x\"", b.modTime.UnixNano()))
+	w.Header().Set("x-ms-blob-type", "BlockBlob")
+	for k, v := range b.metadata {
+		w.Header().Set("x-ms-meta-"+k, v)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("x-ms-error-code", code)
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"utf-8\"?><Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func newTestStore(t *testing.T) *Store {
+	ts := newFakeBlobService(t)
+	stor, err := New(ts.URL+"/"+fakeAccount, fakeAccount, fakeAccountKey, "eru", "images")
+	assert.Nil(t, err)
+	_, err = stor.client.Create(context.Background(), nil)
+	assert.Nil(t, err)
+	return stor
+}
+
+func TestPut(t *testing.T) {
+	stor := newTestStore(t)
+	ctx := context.Background()
+
+	name := "test-put1"
+	content := []byte("hello world ")
+	digest, err := pkgutils.CalcDigestOfStr(string(content))
+	assert.Nil(t, err)
+	err = stor.Put(ctx, name, digest, bytes.NewReader(content))
+	assert.Nil(t, err)
+
+	reader, err := stor.Get(ctx, name)
+	assert.Nil(t, err)
+	newVal, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, string(content), string(newVal))
+
+	reader, err = stor.SeekRead(ctx, name, 6)
+	assert.Nil(t, err)
+	newVal, err = io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, "world ", string(newVal))
+
+	size, err := stor.GetSize(ctx, name)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(content)), size)
+	newDigest, err := stor.GetDigest(ctx, name)
+	assert.Nil(t, err)
+	assert.Equal(t, digest, newDigest)
+}
+
+func TestPutWithChunk(t *testing.T) {
+	stor := newTestStore(t)
+	ctx := context.Background()
+
+	name := "test-put-with-chunk1"
+	content := bytes.Repeat([]byte("hello world "), 200*1024)
+	digest, err := pkgutils.CalcDigestOfStr(string(content))
+	assert.Nil(t, err)
+	err = stor.PutWithChunk(ctx, name, digest, len(content), 1024*1024, bytes.NewReader(content))
+	assert.Nil(t, err)
+
+	reader, err := stor.Get(ctx, name)
+	assert.Nil(t, err)
+	newVal, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, content, newVal)
+}
+
+func TestChunkUpload(t *testing.T) {
+	stor := newTestStore(t)
+	ctx := context.Background()
+
+	chunkSize := 5
+	content := []byte("hello world, chunks")
+	nChunks := (len(content) + chunkSize - 1) / chunkSize
+	name := "test-chunk-upload1"
+	tID, err := stor.CreateChunkWrite(ctx, name)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, tID)
+
+	// write chunks in reverse order, they are committed by index
+	ciInfoList := make([]*stotypes.ChunkInfo, 0, nChunks)
+	for idx := nChunks - 1; idx >= 0; idx-- {
+		start := idx * chunkSize
+		end := min(start+chunkSize, len(content))
+		ciInfo := &stotypes.ChunkInfo{
+			Idx:       idx,
+			Size:      int64(end - start),
+			ChunkSize: int64(chunkSize),
+			In:        bytes.NewReader(content[start:end]),
+		}
+		err = stor.ChunkWrite(ctx, name, tID, ciInfo)
+		assert.Nil(t, err)
+		ciInfoList = append(ciInfoList, ciInfo)
+	}
+	exists, err := stor.Exists(ctx, name)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	err = stor.CompleteChunkWrite(ctx, name, tID, ciInfoList)
+	assert.Nil(t, err)
+	reader, err := stor.Get(ctx, name)
+	assert.Nil(t, err)
+	newVal, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, string(content), string(newVal))
+
+	// the digest is computed if there is no metadata
+	digest, err := pkgutils.CalcDigestOfStr(string(content))
+	assert.Nil(t, err)
+	newDigest, err := stor.GetDigest(ctx, name)
+	assert.Nil(t, err)
+	assert.Equal(t, digest, newDigest)
+}
+
+func TestMoveListDelete(t *testing.T) {
+	stor := newTestStore(t)
+	ctx := context.Background()
+
+	for _, name := range []string{"a/1", "a/2", "b/1"} {
+		err := stor.Put(ctx, name, "digest-"+name, bytes.NewReader([]byte(name)))
+		assert.Nil(t, err)
+	}
+	err := stor.Move(ctx, "a/2", "b/2")
+	assert.Nil(t, err)
+	exists, err := stor.Exists(ctx, "a/2")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+	digest, err := stor.GetDigest(ctx, "b/2")
+	assert.Nil(t, err)
+	assert.Equal(t, "digest-a/2", digest)
+
+	objs, err := stor.List(ctx, "b/")
+	assert.Nil(t, err)
+	assert.Len(t, objs, 2)
+	assert.Equal(t, "b/1", objs[0].Name)
+	assert.Equal(t, "b/2", objs[1].Name)
+	assert.Equal(t, int64(3), objs[1].Size)
+
+	err = stor.Delete(ctx, "b/1", false)
+	assert.Nil(t, err)
+	err = stor.Delete(ctx, "b/1", false)
+	assert.NotNil(t, err)
+	err = stor.Delete(ctx, "b/1", true)
+	assert.Nil(t, err)
+	objs, err = stor.List(ctx, "")
+	assert.Nil(t, err)
+	assert.Len(t, objs, 2)
+}
@@ -1,31 +1,28 @@
 package factory
 
 import (
-	"fmt"
-
 	"github.com/projecteru2/vmihub/config"
 	"github.com/projecteru2/vmihub/internal/storage"
-	"github.com/projecteru2/vmihub/internal/storage/local"
-	"github.com/projecteru2/vmihub/internal/storage/mocks"
-	"github.com/projecteru2/vmihub/internal/storage/s3"
+
+	// the drivers register themselves
+	_ "github.com/projecteru2/vmihub/internal/storage/azure"
+	_ "github.com/projecteru2/vmihub/internal/storage/gcs"
+	_ "github.com/projecteru2/vmihub/internal/storage/local"
+	_ "github.com/projecteru2/vmihub/internal/storage/s3"
 )
 
 var (
 	stor storage.Storage
 )
 
+// Init creates the storage by the driver registered as cfg.Type
 func Init(cfg *config.StorageConfig) (storage.Storage, error) {
 	var err error
 	if stor == nil {
-		switch cfg.Type {
-		case "local":
-			stor = local.New(cfg.Local.BaseDir)
-		case "s3":
-			stor, err = s3.New(cfg.S3.Endpoint, cfg.S3.AccessKey, cfg.S3.SecretKey, cfg.S3.Bucket, cfg.S3.BaseDir, nil)
-		case "mock":
-			stor = &mocks.Storage{}
-		default:
-			err = fmt.Errorf("unknown storage type %s", cfg.Type)
+		stor, err = storage.Open(cfg)
+		// the mock is asserted by tests, so it isn't wrapped
+		if err == nil && cfg.Type != "mock" {
+			stor = storage.Instrument(stor)
 		}
 	}
 	return stor, err
@@ -0,0 +1,323 @@
+package gcs
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	gstorage "cloud.google.com/go/storage"
+	"github.com/google/uuid"
+	"github.com/projecteru2/core/log"
+	"github.com/projecteru2/vmihub/config"
+	"github.com/projecteru2/vmihub/internal/storage"
+	stotypes "github.com/projecteru2/vmihub/internal/storage/types"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+const (
+	// the chunks of a chunk write are staged under <base dir>/.chunks/<transaction id>/
+	chunkDir = ".chunks"
+	// the object which marks a chunk write, the target name is kept in its metadata
+	markerName = "name"
+	// the max number of source objects of a compose request
+	maxComposeSources = 32
+)
+
+func init() {
+	storage.Register("gcs", func(cfg *config.StorageConfig) (storage.Storage, error) {
+		if cfg.GCS == nil {
+			return nil, errors.New("storage.gcs is not configured")
+		}
+		return New(cfg.GCS.Endpoint, cfg.GCS.CredentialsFile, cfg.GCS.Bucket, cfg.GCS.BaseDir)
+	})
+}
+
+// Store keeps objects in a bucket of Google Cloud Storage, a chunk write uploads
+// the chunks as separate objects and composes them into the target object.
+type Store struct {
+	Endpoint string
+	Bucket   string
+	BaseDir  string
+	client   *gstorage.Client
+}
+
+// New creates a store of the bucket, endpoint is empty for Google Cloud Storage,
+// or the url of an emulator, eg: http://127.0.0.1:4443/storage/v1/ of fake-gcs-server.
+// The application default credentials are used if credentialsFile is empty.
+func New(endpoint, credentialsFile, bucket, baseDir string) (*Store, error) {
+	var opts []option.ClientOption
+	if endpoint != "" {
+		opts = append(opts, option.WithEndpoint(endpoint), gstorage.WithJSONReads())
+	}
+	switch {
+	case credentialsFile != "":
+		opts = append(opts, option.WithCredentialsFile(credentialsFile))
+	case endpoint != "":
+		// the emulators don't check credentials
+		opts = append(opts, option.WithoutAuthentication())
+	}
+	client, err := gstorage.NewClient(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{
+		Endpoint: endpoint,
+		Bucket:   bucket,
+		BaseDir:  baseDir,
+		client:   client,
+	}, nil
+}
+
+func (s *Store) object(name string) *gstorage.ObjectHandle {
+	return s.client.Bucket(s.Bucket).Object(path.Join(s.BaseDir, name))
+}
+
+func (s *Store) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return s.object(name).NewReader(ctx)
+}
+
+func (s *Store) Delete(ctx context.Context, name string, ignoreNotExists bool) error {
+	err := s.object(name).Delete(ctx)
+	if ignoreNotExists && errors.Is(err, gstorage.ErrObjectNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *Store) Put(ctx context.Context, name string, digest string, in io.ReadSeeker) error {
+	return s.write(ctx, name, digest, 0, in)
+}
+
+func (s *Store) PutWithChunk(ctx context.Context, name string, digest string, size int, chunkSize int, in io.ReaderAt) error {
+	return s.write(ctx, name, digest, chunkSize, io.NewSectionReader(in, 0, int64(size)))
+}
+
+// write uploads in as object name by a resumable upload, the chunk size is rounded up
+// to a multiple of 256KiB by the client and the default size is used if it is 0.
+func (s *Store) write(ctx context.Context, name string, digest string, chunkSize int, in io.Reader) error {
+	w := s.object(name).NewWriter(ctx)
+	if chunkSize > 0 {
+		w.ChunkSize = chunkSize
+	}
+	if digest != "" {
+		w.Metadata = map[string]string{"sha256": digest}
+	}
+	if _, err := io.Copy(w, in); err != nil {
+		_ = w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (s *Store) SeekRead(ctx context.Context, name string, start int64) (io.ReadCloser, error) {
+	return s.object(name).NewRangeReader(ctx, start, -1)
+}
+
+// CreateChunkWrite writes the marker of a new chunk write, so it is listed by ListChunkWrites
+func (s *Store) CreateChunkWrite(ctx context.Context, name string) (string, error) {
+	transactionID := uuid.NewString()
+	w := s.object(path.Join(chunkDir, transactionID, markerName)).NewWriter(ctx)
+	w.Metadata = map[string]string{markerName: name}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return transactionID, nil
+}
+
+func (s *Store) ChunkWrite(ctx context.Context, _ string, transactionID string, info *stotypes.ChunkInfo) error {
+	chunkName := chunkObjectName(transactionID, info.Idx)
+	if err := s.write(ctx, chunkName, "", 0, info.In); err != nil {
+		return err
+	}
+	info.Raw = chunkName
+	return nil
+}
+
+// CompleteChunkWrite composes the chunks into object name, a compose request accepts
+// at most 32 sources, so more chunks are composed into intermediate objects level by level.
+func (s *Store) CompleteChunkWrite(ctx context.Context, name string, transactionID string, chunkList []*stotypes.ChunkInfo) error {
+	chunks := make([]*stotypes.ChunkInfo, len(chunkList))
+	copy(chunks, chunkList)
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].Idx < chunks[j].Idx
+	})
+	srcs := make([]string, 0, len(chunks))
+	for _, chunk := range chunks {
+		srcs = append(srcs, chunkObjectName(transactionID, chunk.Idx))
+	}
+	for level := 0; len(srcs) > maxComposeSources; level++ {
+		composed := make([]string, 0, (len(srcs)+maxComposeSources-1)/maxComposeSources)
+		for start := 0; start < len(srcs); start += maxComposeSources {
+			dest := path.Join(chunkDir, transactionID, fmt.Sprintf("compose-%d-%08d", level, len(composed)))
+			if err := s.compose(ctx, dest, srcs[start:min(start+maxComposeSources, len(srcs))]); err != nil {
+				return err
+			}
+			composed = append(composed, dest)
+		}
+		srcs = composed
+	}
+	if err := s.compose(ctx, name, srcs); err != nil {
+		return err
+	}
+	// the object is complete, so the failure of cleaning is only logged
+	if err := s.AbortChunkWrite(ctx, name, transactionID); err != nil {
+		log.WithFunc("gcs.CompleteChunkWrite").Warnf(ctx, "failed to remove chunks of %s: %s", transactionID, err)
+	}
+	return nil
+}
+
+func (s *Store) compose(ctx context.Context, dest string, srcs []string) error {
+	handles := make([]*gstorage.ObjectHandle, 0, len(srcs))
+	for _, src := range srcs {
+		handles = append(handles, s.object(src))
+	}
+	_, err := s.object(dest).ComposerFrom(handles...).Run(ctx)
+	return err
+}
+
+// AbortChunkWrite removes the staged chunks, the marker is removed at last,
+// so the chunk write is still listed if it fails in the middle.
+func (s *Store) AbortChunkWrite(ctx context.Context, _ string, transactionID string) error {
+	prefix := path.Join(chunkDir, transactionID) + "/"
+	objs, err := s.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	marker := prefix + markerName
+	for _, obj := range objs {
+		if obj.Name == marker {
+			continue
+		}
+		if err := s.Delete(ctx, obj.Name, true); err != nil {
+			return err
+		}
+	}
+	return s.Delete(ctx, marker, true)
+}
+
+func (s *Store) ListChunkWrites(ctx context.Context) ([]*stotypes.ChunkWriteInfo, error) {
+	var ans []*stotypes.ChunkWriteInfo
+	it := s.client.Bucket(s.Bucket).Objects(ctx, &gstorage.Query{Prefix: s.objectKey(chunkDir + "/")})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// <chunk dir>/<transaction id>/name
+		parts := strings.Split(strings.TrimPrefix(s.objectName(attrs.Name), chunkDir+"/"), "/")
+		if len(parts) != 2 || parts[1] != markerName {
+			continue
+		}
+		ans = append(ans, &stotypes.ChunkWriteInfo{
+			Name:          attrs.Metadata[markerName],
+			TransactionID: parts[0],
+			CreatedAt:     attrs.Created,
+		})
+	}
+	return ans, nil
+}
+
+func (s *Store) Move(ctx context.Context, src, dest string) error {
+	if _, err := s.object(dest).CopierFrom(s.object(src)).Run(ctx); err != nil {
+		return err
+	}
+	return s.Delete(ctx, src, true)
+}
+
+func (s *Store) GetSize(ctx context.Context, name string) (int64, error) {
+	attrs, err := s.object(name).Attrs(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return attrs.Size, nil
+}
+
+func (s *Store) GetDigest(ctx context.Context, name string) (string, error) {
+	attrs, err := s.object(name).Attrs(ctx)
+	if err != nil {
+		return "", err
+	}
+	if digest, ok := attrs.Metadata["sha256"]; ok {
+		return digest, nil
+	}
+	body, err := s.Get(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	hasher := sha256.New()
+	if _, err = io.Copy(hasher, body); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+func (s *Store) Exists(ctx context.Context, name string) (bool, error) {
+	_, err := s.object(name).Attrs(ctx)
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, gstorage.ErrObjectNotExist) {
+		return false, nil
+	}
+	return false, err
+}
+
+// List returns all objects whose name starts with prefix, the staged chunks are
+// skipped unless prefix is under the chunk dir.
+func (s *Store) List(ctx context.Context, prefix string) ([]*stotypes.ObjectInfo, error) {
+	var ans []*stotypes.ObjectInfo
+	listChunks := strings.HasPrefix(prefix, chunkDir+"/")
+	it := s.client.Bucket(s.Bucket).Objects(ctx, &gstorage.Query{Prefix: s.objectKey(prefix)})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := s.objectName(attrs.Name)
+		if !listChunks && strings.HasPrefix(name, chunkDir+"/") {
+			continue
+		}
+		ans = append(ans, &stotypes.ObjectInfo{
+			Name:    name,
+			Size:    attrs.Size,
+			ModTime: attrs.Updated,
+		})
+	}
+	return ans, nil
+}
+
+// objectKey returns the key prefix of name in bucket, a trailing slash is kept
+func (s *Store) objectKey(name string) string {
+	if s.BaseDir == "" {
+		return name
+	}
+	key := path.Join(s.BaseDir, name)
+	if name == "" || strings.HasSuffix(name, "/") {
+		key += "/"
+	}
+	return key
+}
+
+func (s *Store) objectName(key string) string {
+	if s.BaseDir == "" {
+		return key
+	}
+	return strings.TrimPrefix(key, strings.TrimSuffix(s.BaseDir, "/")+"/")
+}
+
+func chunkObjectName(transactionID string, idx int) string {
+	return path.Join(chunkDir, transactionID, fmt.Sprintf("%08d", idx))
+}
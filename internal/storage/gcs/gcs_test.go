@@ -0,0 +1,194 @@
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/fsouza/fake-gcs-server/fakestorage"
+	stotypes "github.com/projecteru2/vmihub/internal/storage/types"
+	pkgutils "github.com/projecteru2/vmihub/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestStore(t *testing.T) *Store {
+	server, err := fakestorage.NewServerWithOptions(fakestorage.Options{
+		Scheme: "http",
+		Host:   "127.0.0.1",
+	})
+	assert.Nil(t, err)
+	t.Cleanup(server.Stop)
+	server.CreateBucket("eru")
+
+	stor, err := New(server.URL()+"/storage/v1/", "", "eru", "images")
+	assert.Nil(t, err)
+	return stor
+}
+
+func TestPut(t *testing.T) {
+	stor := newTestStore(t)
+	ctx := context.Background()
+
+	name := "test-put1"
+	content := []byte("hello world ")
+	digest, err := pkgutils.CalcDigestOfStr(string(content))
+	assert.Nil(t, err)
+	err = stor.Put(ctx, name, digest, bytes.NewReader(content))
+	assert.Nil(t, err)
+
+	reader, err := stor.Get(ctx, name)
+	assert.Nil(t, err)
+	newVal, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, string(content), string(newVal))
+
+	reader, err = stor.SeekRead(ctx, name, 6)
+	assert.Nil(t, err)
+	newVal, err = io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, "world ", string(newVal))
+
+	size, err := stor.GetSize(ctx, name)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(content)), size)
+	newDigest, err := stor.GetDigest(ctx, name)
+	assert.Nil(t, err)
+	assert.Equal(t, digest, newDigest)
+}
+
+func TestPutWithChunk(t *testing.T) {
+	stor := newTestStore(t)
+	ctx := context.Background()
+
+	name := "test-put-with-chunk1"
+	content := bytes.Repeat([]byte("hello world "), 100*1024)
+	digest, err := pkgutils.CalcDigestOfStr(string(content))
+	assert.Nil(t, err)
+	err = stor.PutWithChunk(ctx, name, digest, len(content), 256*1024, bytes.NewReader(content))
+	assert.Nil(t, err)
+
+	reader, err := stor.Get(ctx, name)
+	assert.Nil(t, err)
+	newVal, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, content, newVal)
+}
+
+func TestChunkUpload(t *testing.T) {
+	stor := newTestStore(t)
+	ctx := context.Background()
+
+	// more chunks than a compose request accepts
+	nChunks := maxComposeSources + 8
+	chunkSize := 3
+	content := bytes.Repeat([]byte("abc"), nChunks)
+	name := "test-chunk-upload1"
+	tID, err := stor.CreateChunkWrite(ctx, name)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, tID)
+
+	writes, err := stor.ListChunkWrites(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, writes, 1)
+	assert.Equal(t, name, writes[0].Name)
+	assert.Equal(t, tID, writes[0].TransactionID)
+
+	ciInfoList := make([]*stotypes.ChunkInfo, 0, nChunks)
+	for idx := 0; idx < nChunks; idx++ {
+		start := idx * chunkSize
+		ciInfo := &stotypes.ChunkInfo{
+			Idx:       idx,
+			Size:      int64(chunkSize),
+			ChunkSize: int64(chunkSize),
+			In:        bytes.NewReader(content[start : start+chunkSize]),
+		}
+		err = stor.ChunkWrite(ctx, name, tID, ciInfo)
+		assert.Nil(t, err)
+		ciInfoList = append(ciInfoList, ciInfo)
+	}
+	// the staged chunks aren't listed as objects
+	objs, err := stor.List(ctx, "")
+	assert.Nil(t, err)
+	assert.Len(t, objs, 0)
+
+	err = stor.CompleteChunkWrite(ctx, name, tID, ciInfoList)
+	assert.Nil(t, err)
+	reader, err := stor.Get(ctx, name)
+	assert.Nil(t, err)
+	newVal, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, string(content), string(newVal))
+
+	// the digest is computed if there is no metadata
+	digest, err := pkgutils.CalcDigestOfStr(string(content))
+	assert.Nil(t, err)
+	newDigest, err := stor.GetDigest(ctx, name)
+	assert.Nil(t, err)
+	assert.Equal(t, digest, newDigest)
+
+	writes, err = stor.ListChunkWrites(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, writes, 0)
+	chunks, err := stor.List(ctx, chunkDir+"/")
+	assert.Nil(t, err)
+	assert.Len(t, chunks, 0)
+}
+
+func TestAbortChunkWrite(t *testing.T) {
+	stor := newTestStore(t)
+	ctx := context.Background()
+
+	name := "test-chunk-abort1"
+	tID, err := stor.CreateChunkWrite(ctx, name)
+	assert.Nil(t, err)
+	err = stor.ChunkWrite(ctx, name, tID, &stotypes.ChunkInfo{Idx: 0, Size: 5, In: bytes.NewReader([]byte("hello"))})
+	assert.Nil(t, err)
+
+	err = stor.AbortChunkWrite(ctx, name, tID)
+	assert.Nil(t, err)
+	writes, err := stor.ListChunkWrites(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, writes, 0)
+	chunks, err := stor.List(ctx, chunkDir+"/")
+	assert.Nil(t, err)
+	assert.Len(t, chunks, 0)
+	exists, err := stor.Exists(ctx, name)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+}
+
+func TestMoveListDelete(t *testing.T) {
+	stor := newTestStore(t)
+	ctx := context.Background()
+
+	for _, name := range []string{"a/1", "a/2", "b/1"} {
+		err := stor.Put(ctx, name, "digest-"+name, bytes.NewReader([]byte(name)))
+		assert.Nil(t, err)
+	}
+	err := stor.Move(ctx, "a/2", "b/2")
+	assert.Nil(t, err)
+	exists, err := stor.Exists(ctx, "a/2")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+	digest, err := stor.GetDigest(ctx, "b/2")
+	assert.Nil(t, err)
+	assert.Equal(t, "digest-a/2", digest)
+
+	objs, err := stor.List(ctx, "b/")
+	assert.Nil(t, err)
+	assert.Len(t, objs, 2)
+	assert.Equal(t, "b/1", objs[0].Name)
+	assert.Equal(t, "b/2", objs[1].Name)
+	assert.Equal(t, int64(3), objs[1].Size)
+
+	err = stor.Delete(ctx, "b/1", false)
+	assert.Nil(t, err)
+	err = stor.Delete(ctx, "b/1", false)
+	assert.NotNil(t, err)
+	err = stor.Delete(ctx, "b/1", true)
+	assert.Nil(t, err)
+	objs, err = stor.List(ctx, "")
+	assert.Nil(t, err)
+	assert.Len(t, objs, 2)
+}
@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/projecteru2/vmihub/internal/metrics"
+	stotypes "github.com/projecteru2/vmihub/internal/storage/types"
+	"github.com/projecteru2/vmihub/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Instrument wraps sto to record the latency and errors of its operations as metrics and spans,
+// the returned storage implements MultipartStorage if sto does.
+func Instrument(sto Storage) Storage {
+	inst := &instrumented{sto: sto}
+	if mSto, ok := sto.(MultipartStorage); ok {
+		return &instrumentedMultipart{instrumented: inst, mSto: mSto}
+	}
+	return inst
+}
+
+type instrumented struct {
+	sto Storage
+}
+
+// startOp starts an operation on object name,
+// the returned function is deferred with the address of the returned error to finish it.
+func startOp(ctx context.Context, op, name string) (context.Context, func(err *error)) {
+	t := time.Now()
+	ctx, end := tracing.Start(ctx, "storage."+op, attribute.String("storage.object", name))
+	return ctx, func(err *error) {
+		metrics.StorageOperationDuration.WithLabelValues(op).Observe(time.Since(t).Seconds())
+		if *err != nil {
+			metrics.StorageOperationErrors.WithLabelValues(op).Inc()
+		}
+		end(err)
+	}
+}
+
+func (s *instrumented) Get(ctx context.Context, name string) (rc io.ReadCloser, err error) {
+	ctx, end := startOp(ctx, "get", name)
+	defer end(&err)
+	return s.sto.Get(ctx, name)
+}
+
+func (s *instrumented) Delete(ctx context.Context, name string, ignoreNotExists bool) (err error) {
+	ctx, end := startOp(ctx, "delete", name)
+	defer end(&err)
+	return s.sto.Delete(ctx, name, ignoreNotExists)
+}
+
+func (s *instrumented) Put(ctx context.Context, name string, digest string, in io.ReadSeeker) (err error) {
+	ctx, end := startOp(ctx, "put", name)
+	defer end(&err)
+	return s.sto.Put(ctx, name, digest, in)
+}
+
+func (s *instrumented) PutWithChunk(ctx context.Context, name string, digest string, size int, chunkSize int, in io.ReaderAt) (err error) {
+	ctx, end := startOp(ctx, "put_with_chunk", name)
+	defer end(&err)
+	return s.sto.PutWithChunk(ctx, name, digest, size, chunkSize, in)
+}
+
+func (s *instrumented) SeekRead(ctx context.Context, name string, start int64) (rc io.ReadCloser, err error) {
+	ctx, end := startOp(ctx, "seek_read", name)
+	defer end(&err)
+	return s.sto.SeekRead(ctx, name, start)
+}
+
+func (s *instrumented) CreateChunkWrite(ctx context.Context, name string) (id string, err error) {
+	ctx, end := startOp(ctx, "create_chunk_write", name)
+	defer end(&err)
+	return s.sto.CreateChunkWrite(ctx, name)
+}
+
+func (s *instrumented) ChunkWrite(ctx context.Context, name string, transactionID string, info *stotypes.ChunkInfo) (err error) {
+	ctx, end := startOp(ctx, "chunk_write", name)
+	defer end(&err)
+	return s.sto.ChunkWrite(ctx, name, transactionID, info)
+}
+
+func (s *instrumented) CompleteChunkWrite(ctx context.Context, name string, transactionID string, chunkList []*stotypes.ChunkInfo) (err error) {
+	ctx, end := startOp(ctx, "complete_chunk_write", name)
+	defer end(&err)
+	return s.sto.CompleteChunkWrite(ctx, name, transactionID, chunkList)
+}
+
+func (s *instrumented) AbortChunkWrite(ctx context.Context, name string, transactionID string) (err error) {
+	ctx, end := startOp(ctx, "abort_chunk_write", name)
+	defer end(&err)
+	return s.sto.AbortChunkWrite(ctx, name, transactionID)
+}
+
+func (s *instrumented) Move(ctx context.Context, src, dest string) (err error) {
+	ctx, end := startOp(ctx, "move", src)
+	defer end(&err)
+	return s.sto.Move(ctx, src, dest)
+}
+
+func (s *instrumented) GetSize(ctx context.Context, name string) (size int64, err error) {
+	ctx, end := startOp(ctx, "get_size", name)
+	defer end(&err)
+	return s.sto.GetSize(ctx, name)
+}
+
+func (s *instrumented) GetDigest(ctx context.Context, name string) (digest string, err error) {
+	ctx, end := startOp(ctx, "get_digest", name)
+	defer end(&err)
+	return s.sto.GetDigest(ctx, name)
+}
+
+func (s *instrumented) Exists(ctx context.Context, name string) (exists bool, err error) {
+	ctx, end := startOp(ctx, "exists", name)
+	defer end(&err)
+	return s.sto.Exists(ctx, name)
+}
+
+func (s *instrumented) List(ctx context.Context, prefix string) (objs []*stotypes.ObjectInfo, err error) {
+	ctx, end := startOp(ctx, "list", prefix)
+	defer end(&err)
+	return s.sto.List(ctx, prefix)
+}
+
+type instrumentedMultipart struct {
+	*instrumented
+	mSto MultipartStorage
+}
+
+func (s *instrumentedMultipart) ListChunkWrites(ctx context.Context) (writes []*stotypes.ChunkWriteInfo, err error) {
+	ctx, end := startOp(ctx, "list_chunk_writes", "")
+	defer end(&err)
+	return s.mSto.ListChunkWrites(ctx)
+}
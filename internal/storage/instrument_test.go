@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/projecteru2/vmihub/internal/metrics"
+	"github.com/projecteru2/vmihub/internal/storage/mocks"
+	stotypes "github.com/projecteru2/vmihub/internal/storage/types"
+	"github.com/projecteru2/vmihub/internal/tracing"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestInstrument(t *testing.T) {
+	ctx := context.Background()
+	sto := &mocks.Storage{}
+	sto.On("Exists", mock.Anything, "a").Return(true, nil)
+	sto.On("Exists", mock.Anything, "b").Return(false, errors.New("timeout"))
+
+	mSto := Instrument(sto)
+	_, ok := mSto.(MultipartStorage)
+	assert.False(t, ok)
+
+	errCount := testutil.ToFloat64(metrics.StorageOperationErrors.WithLabelValues("exists"))
+	exists, err := mSto.Exists(ctx, "a")
+	assert.Nil(t, err)
+	assert.True(t, exists)
+	_, err = mSto.Exists(ctx, "b")
+	assert.Error(t, err)
+	assert.Equal(t, errCount+1, testutil.ToFloat64(metrics.StorageOperationErrors.WithLabelValues("exists")))
+	assert.Equal(t, 1, testutil.CollectAndCount(metrics.StorageOperationDuration, "vmihub_storage_operation_duration_seconds"))
+	sto.AssertExpectations(t)
+
+	// the operations are traced as the children of the span in context
+	sr := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	pCtx, end := tracing.Start(ctx, "request")
+	_, err = mSto.Exists(pCtx, "b")
+	assert.Error(t, err)
+	end(nil)
+	spans := sr.Ended()
+	assert.Len(t, spans, 2)
+	assert.Equal(t, "storage.exists", spans[0].Name())
+	assert.Equal(t, spans[1].SpanContext().SpanID(), spans[0].Parent().SpanID())
+	assert.Equal(t, codes.Error, spans[0].Status().Code)
+
+	// the chunk writes can still be listed by gc
+	_, ok = Instrument(&multipartStorage{Storage: sto}).(MultipartStorage)
+	assert.True(t, ok)
+}
+
+type multipartStorage struct {
+	*mocks.Storage
+}
+
+func (*multipartStorage) ListChunkWrites(context.Context) ([]*stotypes.ChunkWriteInfo, error) {
+	return nil, nil
+}
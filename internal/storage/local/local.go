@@ -2,19 +2,43 @@ package local
 
 import (
 	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/google/uuid"
+	"github.com/projecteru2/vmihub/config"
+	"github.com/projecteru2/vmihub/internal/storage"
 	stotypes "github.com/projecteru2/vmihub/internal/storage/types"
 	"github.com/projecteru2/vmihub/internal/utils"
 	"github.com/projecteru2/vmihub/pkg/terrors"
 	pkgutils "github.com/projecteru2/vmihub/pkg/utils"
 )
 
+const (
+	// the chunks of unfinished transactions are staged under this directory,
+	// it is in BaseDir so the assembled file can be renamed into place
+	chunkDir = ".chunks"
+	// the file in the directory of transaction which keeps the name of object
+	chunkNameFile = "name"
+)
+
+func init() {
+	storage.Register("local", func(cfg *config.StorageConfig) (storage.Storage, error) {
+		if cfg.Local == nil {
+			return nil, errors.New("storage.local is not configured")
+		}
+		return New(cfg.Local.BaseDir), nil
+	})
+}
+
 type Store struct {
 	BaseDir string
 }
@@ -57,9 +81,12 @@ func (s *Store) Put(_ context.Context, name string, digest string, in io.ReadSee
 	if err := utils.EnsureDir(filepath.Dir(fullName)); err != nil {
 		return fmt.Errorf("failed to create dir %w", err)
 	}
+	// write to a temporary file first, so a broken upload never shows up under the final name
+	tmpName := fmt.Sprintf("%s.%s.tmp", fullName, uuid.New().String())
+	defer os.Remove(tmpName)
 
 	if err := utils.Invoke(func() error {
-		f, err := os.OpenFile(fullName, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0766)
+		f, err := os.OpenFile(tmpName, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0766)
 		if err != nil {
 			return err
 		}
@@ -72,18 +99,19 @@ func (s *Store) Put(_ context.Context, name string, digest string, in io.ReadSee
 		return err
 	}
 
-	fileDigest, err := pkgutils.CalcDigestOfFile(fullName)
+	fileDigest, err := pkgutils.CalcDigestOfFile(tmpName)
 	if err != nil {
 		return err
 	}
 	if fileDigest != digest {
 		return terrors.ErrInvalidDigest
 	}
-	return nil
+	return os.Rename(tmpName, fullName)
 }
 
-func (s *Store) PutWithChunk(ctx context.Context, name string, digest string, size int, chunkSize int, in io.ReaderAt) error { //nolint
-	return nil
+func (s *Store) PutWithChunk(ctx context.Context, name string, digest string, size int, _ int, in io.ReaderAt) error {
+	// there is no size limit for local file, so just write the whole file
+	return s.Put(ctx, name, digest, io.NewSectionReader(in, 0, int64(size)))
 }
 
 func (s *Store) SeekRead(_ context.Context, name string, start int64) (io.ReadCloser, error) {
@@ -100,34 +128,191 @@ func (s *Store) SeekRead(_ context.Context, name string, start int64) (io.ReadCl
 	return f, nil
 }
 
-func (s *Store) CreateChunkWrite(_ context.Context, _ string) (string, error) {
-	return uuid.New().String(), nil
+func (s *Store) CreateChunkWrite(_ context.Context, name string) (string, error) {
+	transactionID := uuid.New().String()
+	dir := s.chunkDir(transactionID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create dir %w", err)
+	}
+	// the name is kept with the chunks, so unfinished transactions can be listed
+	if err := os.WriteFile(filepath.Join(dir, chunkNameFile), []byte(name), 0644); err != nil { //nolint:gosec
+		_ = os.RemoveAll(dir)
+		return "", err
+	}
+	return transactionID, nil
 }
 
-func (s *Store) ChunkWrite(_ context.Context, name string, _ string, info *stotypes.ChunkInfo) error {
-	in := info.In
-	offset := int64(info.Idx) * info.ChunkSize
-	filename := filepath.Join(s.BaseDir, name)
-	if err := utils.EnsureDir(filepath.Dir(filename)); err != nil {
+// ChunkWrite stages a chunk in the directory of transaction, the chunk is verified if its digest is given.
+// A chunk written again replaces the old one, so the transaction is never corrupted by a broken write.
+func (s *Store) ChunkWrite(_ context.Context, _ string, transactionID string, info *stotypes.ChunkInfo) error {
+	dir, err := s.openChunkDir(transactionID)
+	if err != nil {
+		return err
+	}
+	chunkName := filepath.Join(dir, strconv.Itoa(info.Idx))
+	tmpName := fmt.Sprintf("%s.%s.tmp", chunkName, uuid.New().String())
+	defer os.Remove(tmpName)
+
+	if err := utils.Invoke(func() error {
+		f, err := os.OpenFile(tmpName, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0766)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err = io.Copy(f, info.In); err != nil {
+			return err
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if info.Digest != "" {
+		digest, err := pkgutils.CalcDigestOfFile(tmpName)
+		if err != nil {
+			return err
+		}
+		if digest != info.Digest {
+			return fmt.Errorf("%w: chunk %d", terrors.ErrInvalidDigest, info.Idx)
+		}
+	}
+	return os.Rename(tmpName, chunkName)
+}
+
+// CompleteChunkWrite assembles the chunks of transaction in the order of index and verifies their digests,
+// the assembled file replaces name atomically, so readers never see a partial file.
+func (s *Store) CompleteChunkWrite(_ context.Context, name string, transactionID string, chunkList []*stotypes.ChunkInfo) error {
+	dir, err := s.openChunkDir(transactionID)
+	if err != nil {
+		return err
+	}
+	chunks := make([]*stotypes.ChunkInfo, len(chunkList))
+	copy(chunks, chunkList)
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Idx < chunks[j].Idx })
+	for idx, chunk := range chunks {
+		if chunk.Idx != idx {
+			return fmt.Errorf("chunk %d is missing", idx)
+		}
+	}
+
+	fullName := filepath.Join(s.BaseDir, name)
+	if err := utils.EnsureDir(filepath.Dir(fullName)); err != nil {
 		return fmt.Errorf("failed to create dir %w", err)
 	}
+	tmpName := fmt.Sprintf("%s.%s.tmp", fullName, uuid.New().String())
+	defer os.Remove(tmpName)
 
-	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0766)
+	if err := assembleChunks(tmpName, dir, chunks); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, fullName); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(fullName)); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// AbortChunkWrite removes the staged chunks of transaction, the file of name is untouched
+func (s *Store) AbortChunkWrite(_ context.Context, _ string, transactionID string) error {
+	if _, err := uuid.Parse(transactionID); err != nil {
+		return fmt.Errorf("invalid transaction id %s", transactionID)
+	}
+	return os.RemoveAll(s.chunkDir(transactionID))
+}
+
+// ListChunkWrites returns the unfinished transactions
+func (s *Store) ListChunkWrites(_ context.Context) ([]*stotypes.ChunkWriteInfo, error) {
+	entries, err := os.ReadDir(filepath.Join(s.BaseDir, chunkDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ans []*stotypes.ChunkWriteInfo
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		fname := filepath.Join(s.chunkDir(entry.Name()), chunkNameFile)
+		bs, err := os.ReadFile(fname)
+		if err != nil {
+			return nil, err
+		}
+		fi, err := os.Stat(fname)
+		if err != nil {
+			return nil, err
+		}
+		ans = append(ans, &stotypes.ChunkWriteInfo{
+			Name:          string(bs),
+			TransactionID: entry.Name(),
+			CreatedAt:     fi.ModTime(),
+		})
+	}
+	return ans, nil
+}
+
+func (s *Store) chunkDir(transactionID string) string {
+	return filepath.Join(s.BaseDir, chunkDir, transactionID)
+}
+
+// openChunkDir returns the directory of an existing transaction
+func (s *Store) openChunkDir(transactionID string) (string, error) {
+	if _, err := uuid.Parse(transactionID); err != nil {
+		return "", fmt.Errorf("invalid transaction id %s", transactionID)
+	}
+	dir := s.chunkDir(transactionID)
+	if _, err := os.Stat(dir); err != nil {
+		return "", fmt.Errorf("chunk write %s doesn't exist: %w", transactionID, err)
+	}
+	return dir, nil
+}
+
+// assembleChunks concatenates the chunks in dir to fname and flushes it to disk
+func assembleChunks(fname, dir string, chunks []*stotypes.ChunkInfo) error {
+	f, err := os.OpenFile(fname, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0766)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	if _, err = f.Seek(offset, 0); err != nil {
-		return fmt.Errorf("failed to seek %w", err)
+	for _, chunk := range chunks {
+		if err := appendChunk(f, filepath.Join(dir, strconv.Itoa(chunk.Idx)), chunk.Digest); err != nil {
+			return fmt.Errorf("failed to append chunk %d: %w", chunk.Idx, err)
+		}
 	}
-	_, err = io.Copy(f, in)
-	return err
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
 }
 
-func (s *Store) CompleteChunkWrite(_ context.Context, _ string, _ string, _ []*stotypes.ChunkInfo) error {
+func appendChunk(w io.Writer, fname, digest string) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(w, io.TeeReader(f, h)); err != nil {
+		return err
+	}
+	if digest != "" && fmt.Sprintf("%x", h.Sum(nil)) != digest {
+		return terrors.ErrInvalidDigest
+	}
 	return nil
 }
 
+// syncDir flushes the entries of dir, so a renamed file survives crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
 func (s *Store) Copy(_ context.Context, src, dest string) error {
 	destName := filepath.Join(s.BaseDir, dest)
 	srcName := filepath.Join(s.BaseDir, src)
@@ -135,25 +320,85 @@ func (s *Store) Copy(_ context.Context, src, dest string) error {
 	if err != nil {
 		return fmt.Errorf("failed to open %s: %w", srcName, err)
 	}
-	destF, err := os.OpenFile(destName, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0766)
+	defer srcF.Close()
 	if err := utils.EnsureDir(filepath.Dir(destName)); err != nil {
 		return fmt.Errorf("failed to create dir for %s: %w", destName, err)
 	}
+	destF, err := os.OpenFile(destName, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0766)
 	if err != nil {
 		return fmt.Errorf("failed to open %s: %w", destName, err)
 	}
+	defer destF.Close()
 	_, err = io.Copy(destF, srcF)
 	return err
 }
 
 func (s *Store) Move(ctx context.Context, src, dest string) error {
+	srcName := filepath.Join(s.BaseDir, src)
+	destName := filepath.Join(s.BaseDir, dest)
+	if err := utils.EnsureDir(filepath.Dir(destName)); err != nil {
+		return fmt.Errorf("failed to create dir for %s: %w", destName, err)
+	}
+	// rename is cheap when src and dest are in the same file system
+	if err := os.Rename(srcName, destName); err == nil {
+		return nil
+	}
 	if err := s.Copy(ctx, src, dest); err != nil {
 		return err
 	}
-	srcName := filepath.Join(s.BaseDir, src)
 	return os.Remove(srcName)
 }
 
+func (s *Store) Exists(_ context.Context, name string) (bool, error) {
+	filename := filepath.Join(s.BaseDir, name)
+	_, err := os.Stat(filename)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (s *Store) List(_ context.Context, prefix string) ([]*stotypes.ObjectInfo, error) {
+	var ans []*stotypes.ObjectInfo
+	err := filepath.WalkDir(s.BaseDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			// the staged chunks are not objects
+			if p == filepath.Join(s.BaseDir, chunkDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		name, err := filepath.Rel(s.BaseDir, p)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		ans = append(ans, &stotypes.ObjectInfo{
+			Name:    name,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+		return nil
+	})
+	return ans, err
+}
+
 func (s *Store) GetSize(_ context.Context, name string) (int64, error) {
 	filename := filepath.Join(s.BaseDir, name)
 	info, err := os.Stat(filename)
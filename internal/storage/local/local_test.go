@@ -6,9 +6,12 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/google/uuid"
+	stotypes "github.com/projecteru2/vmihub/internal/storage/types"
+	"github.com/projecteru2/vmihub/pkg/terrors"
 	pkgutils "github.com/projecteru2/vmihub/pkg/utils"
 	"github.com/stretchr/testify/suite"
 )
@@ -87,3 +90,146 @@ func (s *testSuite) TestPut() {
 	s.Nil(err)
 	s.Equal(v1, string(res))
 }
+
+func (s *testSuite) TestPutInvalidDigest() {
+	v1 := "gagagaga"
+	digest, err := pkgutils.CalcDigestOfStr(val)
+	s.Nil(err)
+	err = s.sto.Put(context.Background(), "invalid", digest, bytes.NewReader([]byte(v1)))
+	s.ErrorIs(err, terrors.ErrInvalidDigest)
+	// the broken file must not be visible
+	exists, err := s.sto.Exists(context.Background(), "invalid")
+	s.Nil(err)
+	s.False(exists)
+}
+
+func (s *testSuite) TestExists() {
+	exists, err := s.sto.Exists(context.Background(), name)
+	s.Nil(err)
+	s.True(exists)
+	exists, err = s.sto.Exists(context.Background(), "not-exists")
+	s.Nil(err)
+	s.False(exists)
+}
+
+func (s *testSuite) TestMove() {
+	dest := "blobs/sha256/ab/abcdef"
+	defer s.sto.Delete(context.Background(), dest, true) //nolint:errcheck
+	err := s.sto.Move(context.Background(), name, dest)
+	s.Nil(err)
+	exists, err := s.sto.Exists(context.Background(), name)
+	s.Nil(err)
+	s.False(exists)
+	out, err := s.sto.Get(context.Background(), dest)
+	s.Nil(err)
+	res, err := io.ReadAll(out)
+	s.Nil(err)
+	s.Equal(val, string(res))
+}
+
+func (s *testSuite) TestList() {
+	objs, err := s.sto.List(context.Background(), "")
+	s.Nil(err)
+	s.Len(objs, 1)
+	s.Equal(name, objs[0].Name)
+	s.Equal(int64(len(val)), objs[0].Size)
+
+	objs, err = s.sto.List(context.Background(), "blobs/")
+	s.Nil(err)
+	s.Len(objs, 0)
+}
+
+func (s *testSuite) writeChunk(txID string, idx int, content string) *stotypes.ChunkInfo {
+	digest, err := pkgutils.CalcDigestOfStr(content)
+	s.Nil(err)
+	info := &stotypes.ChunkInfo{
+		Idx:    idx,
+		Size:   int64(len(content)),
+		Digest: digest,
+		In:     strings.NewReader(content),
+	}
+	err = s.sto.ChunkWrite(context.Background(), name, txID, info)
+	s.Nil(err)
+	return info
+}
+
+func (s *testSuite) TestChunkWrite() {
+	ctx := context.Background()
+	txID, err := s.sto.CreateChunkWrite(ctx, name)
+	s.Nil(err)
+	s.NotEmpty(txID)
+
+	// the chunks are written in any order and a chunk can be written again
+	c2 := s.writeChunk(txID, 2, "ccc")
+	c0 := s.writeChunk(txID, 0, "xxxx")
+	c0 = s.writeChunk(txID, 0, "aaaa")
+	c1 := s.writeChunk(txID, 1, "bbbb")
+	// a broken chunk is rejected and the staged one is kept
+	err = s.sto.ChunkWrite(ctx, name, txID, &stotypes.ChunkInfo{Idx: 1, Digest: c1.Digest, In: strings.NewReader("bb")})
+	s.ErrorIs(err, terrors.ErrInvalidDigest)
+
+	writes, err := s.sto.ListChunkWrites(ctx)
+	s.Nil(err)
+	s.Len(writes, 1)
+	s.Equal(name, writes[0].Name)
+	s.Equal(txID, writes[0].TransactionID)
+	// the staged chunks are neither objects nor visible to readers
+	objs, err := s.sto.List(ctx, "")
+	s.Nil(err)
+	s.Len(objs, 1)
+	s.assertContent(val)
+
+	err = s.sto.CompleteChunkWrite(ctx, name, txID, []*stotypes.ChunkInfo{c1, c2})
+	s.ErrorContains(err, "chunk 0 is missing")
+	s.assertContent(val)
+
+	err = s.sto.CompleteChunkWrite(ctx, name, txID, []*stotypes.ChunkInfo{c2, c0, c1})
+	s.Nil(err)
+	s.assertContent("aaaabbbbccc")
+	writes, err = s.sto.ListChunkWrites(ctx)
+	s.Nil(err)
+	s.Len(writes, 0)
+	// the transaction is finished
+	err = s.sto.CompleteChunkWrite(ctx, name, txID, []*stotypes.ChunkInfo{c0, c1, c2})
+	s.Error(err)
+}
+
+func (s *testSuite) TestCompleteChunkWriteInvalidDigest() {
+	ctx := context.Background()
+	txID, err := s.sto.CreateChunkWrite(ctx, name)
+	s.Nil(err)
+	c0 := s.writeChunk(txID, 0, "aaaa")
+	c0.Digest = strings.Repeat("0", 64)
+	err = s.sto.CompleteChunkWrite(ctx, name, txID, []*stotypes.ChunkInfo{c0})
+	s.ErrorIs(err, terrors.ErrInvalidDigest)
+	s.assertContent(val)
+	err = s.sto.AbortChunkWrite(ctx, name, txID)
+	s.Nil(err)
+}
+
+func (s *testSuite) TestAbortChunkWrite() {
+	ctx := context.Background()
+	txID, err := s.sto.CreateChunkWrite(ctx, name)
+	s.Nil(err)
+	s.writeChunk(txID, 0, "aaaa")
+	err = s.sto.AbortChunkWrite(ctx, name, txID)
+	s.Nil(err)
+	writes, err := s.sto.ListChunkWrites(ctx)
+	s.Nil(err)
+	s.Len(writes, 0)
+	s.assertContent(val)
+
+	err = s.sto.ChunkWrite(ctx, name, txID, &stotypes.ChunkInfo{Idx: 1, In: strings.NewReader("bbbb")})
+	s.Error(err)
+	err = s.sto.AbortChunkWrite(ctx, name, "../..")
+	s.Error(err)
+}
+
+func (s *testSuite) assertContent(content string) {
+	out, err := s.sto.Get(context.Background(), name)
+	s.Require().Nil(err)
+	defer out.Close()
+	res, err := io.ReadAll(out)
+	s.Nil(err)
+	s.Equal(content, string(res))
+}
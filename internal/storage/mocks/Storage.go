@@ -34,6 +34,24 @@ func (_m *Storage) ChunkWrite(ctx context.Context, name string, transactionID st
 	return r0
 }
 
+// AbortChunkWrite provides a mock function with given fields: ctx, name, transactionID
+func (_m *Storage) AbortChunkWrite(ctx context.Context, name string, transactionID string) error {
+	ret := _m.Called(ctx, name, transactionID)
+
+	if len(ret) == 0 {
+		panic("no return value specified for AbortChunkWrite")
+	}
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) error); ok {
+		r0 = rf(ctx, name, transactionID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // CompleteChunkWrite provides a mock function with given fields: ctx, name, transactionID, chunkList
 func (_m *Storage) CompleteChunkWrite(ctx context.Context, name string, transactionID string, chunkList []*types.ChunkInfo) error {
 	ret := _m.Called(ctx, name, transactionID, chunkList)
@@ -98,6 +116,34 @@ func (_m *Storage) Delete(ctx context.Context, name string, ignoreNotExists bool
 	return r0
 }
 
+// Exists provides a mock function with given fields: ctx, name
+func (_m *Storage) Exists(ctx context.Context, name string) (bool, error) {
+	ret := _m.Called(ctx, name)
+
+	if len(ret) == 0 {
+		panic("no return value specified for Exists")
+	}
+
+	var r0 bool
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, string) (bool, error)); ok {
+		return rf(ctx, name)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, string) bool); ok {
+		r0 = rf(ctx, name)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, name)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // Get provides a mock function with given fields: ctx, name
 func (_m *Storage) Get(ctx context.Context, name string) (io.ReadCloser, error) {
 	ret := _m.Called(ctx, name)
@@ -184,6 +230,36 @@ func (_m *Storage) GetSize(ctx context.Context, name string) (int64, error) {
 	return r0, r1
 }
 
+// List provides a mock function with given fields: ctx, prefix
+func (_m *Storage) List(ctx context.Context, prefix string) ([]*types.ObjectInfo, error) {
+	ret := _m.Called(ctx, prefix)
+
+	if len(ret) == 0 {
+		panic("no return value specified for List")
+	}
+
+	var r0 []*types.ObjectInfo
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, string) ([]*types.ObjectInfo, error)); ok {
+		return rf(ctx, prefix)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, string) []*types.ObjectInfo); ok {
+		r0 = rf(ctx, prefix)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]*types.ObjectInfo)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, prefix)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // Move provides a mock function with given fields: ctx, src, dest
 func (_m *Storage) Move(ctx context.Context, src string, dest string) error {
 	ret := _m.Called(ctx, src, dest)
@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/projecteru2/vmihub/config"
+)
+
+// Driver creates a storage from config, each driver reads its own section of config
+type Driver func(cfg *config.StorageConfig) (Storage, error)
+
+var (
+	driversMu sync.RWMutex
+	drivers   = map[string]Driver{}
+)
+
+// Register makes a driver available by name, it is called in the init function of the package of driver.
+// It panics if the driver is nil or the name is registered twice.
+func Register(name string, driver Driver) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	if driver == nil {
+		panic("storage: register driver is nil")
+	}
+	if _, ok := drivers[name]; ok {
+		panic("storage: register driver twice for " + name)
+	}
+	drivers[name] = driver
+}
+
+// Drivers returns the sorted names of registered drivers
+func Drivers() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Open creates the storage of cfg.Type by the registered driver
+func Open(cfg *config.StorageConfig) (Storage, error) {
+	driversMu.RLock()
+	driver, ok := drivers[cfg.Type]
+	driversMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown storage type %s, valid types: %s", cfg.Type, strings.Join(Drivers(), ", "))
+	}
+	return driver(cfg)
+}
@@ -0,0 +1,31 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/projecteru2/vmihub/config"
+	"github.com/projecteru2/vmihub/internal/storage/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	sto := &mocks.Storage{}
+	Register("registry-test", func(*config.StorageConfig) (Storage, error) {
+		return sto, nil
+	})
+	assert.Contains(t, Drivers(), "registry-test")
+	assert.Panics(t, func() {
+		Register("registry-test", func(*config.StorageConfig) (Storage, error) {
+			return nil, nil
+		})
+	})
+	assert.Panics(t, func() {
+		Register("registry-nil", nil)
+	})
+
+	got, err := Open(&config.StorageConfig{Type: "registry-test"})
+	assert.Nil(t, err)
+	assert.Equal(t, sto, got)
+	_, err = Open(&config.StorageConfig{Type: "unknown"})
+	assert.ErrorContains(t, err, "unknown storage type unknown, valid types: ")
+}
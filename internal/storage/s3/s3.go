@@ -3,17 +3,22 @@ package s3
 import (
 	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"net/http/httptest"
 	"path"
 	"strings"
 	"testing"
 
 	"github.com/projecteru2/core/log"
+	"github.com/projecteru2/vmihub/config"
+	"github.com/projecteru2/vmihub/internal/storage"
 	stotypes "github.com/projecteru2/vmihub/internal/storage/types"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	s3svc "github.com/aws/aws-sdk-go/service/s3"
@@ -23,6 +28,15 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+func init() {
+	storage.Register("s3", func(cfg *config.StorageConfig) (storage.Storage, error) {
+		if cfg.S3 == nil {
+			return nil, errors.New("storage.s3 is not configured")
+		}
+		return New(cfg.S3.Endpoint, cfg.S3.AccessKey, cfg.S3.SecretKey, cfg.S3.Bucket, cfg.S3.BaseDir, nil)
+	})
+}
+
 type Store struct {
 	Endpoint  string
 	AccessKey string
@@ -154,9 +168,7 @@ func (s *Store) PutWithChunk(ctx context.Context, name string, digest string, si
 		}
 		respChunk, err := s.s3Client.UploadPart(param)
 		if err != nil {
-			s.s3Client.AbortMultipartUploadRequest(&s3svc.AbortMultipartUploadInput{
-				UploadId: aws.String(uploadID),
-			})
+			_ = s.AbortChunkWrite(ctx, name, uploadID)
 			return fmt.Errorf("%w upload part %d", err, partNum)
 		}
 		cp := &s3svc.CompletedPart{
@@ -222,9 +234,6 @@ func (s *Store) ChunkWrite(_ context.Context, name string, transactionID string,
 	}
 	respChunk, err := s.s3Client.UploadPart(param)
 	if err != nil {
-		s.s3Client.AbortMultipartUploadRequest(&s3svc.AbortMultipartUploadInput{
-			UploadId: aws.String(transactionID),
-		})
 		return err
 	}
 	var c s3svc.CompletedPart
@@ -310,9 +319,7 @@ func (s *Store) Move(ctx context.Context, src, dest string) error {
 				UploadId:        respInit.UploadId,
 			})
 			if err != nil {
-				s.s3Client.AbortMultipartUploadRequest(&s3svc.AbortMultipartUploadInput{
-					UploadId: respInit.UploadId,
-				})
+				_ = s.AbortChunkWrite(ctx, dest, aws.StringValue(respInit.UploadId))
 				return err
 			}
 
@@ -349,6 +356,85 @@ func (s *Store) GetSize(_ context.Context, name string) (int64, error) {
 	return aws.Int64Value(head.ContentLength), nil
 }
 
+func (s *Store) Exists(_ context.Context, name string) (bool, error) {
+	_, err := s.s3Client.HeadObject(&s3svc.HeadObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(path.Join(s.BaseDir, name))})
+	if err == nil {
+		return true, nil
+	}
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) && reqErr.StatusCode() == http.StatusNotFound {
+		return false, nil
+	}
+	return false, err
+}
+
+func (s *Store) List(_ context.Context, prefix string) ([]*stotypes.ObjectInfo, error) {
+	var ans []*stotypes.ObjectInfo
+	err := s.s3Client.ListObjectsV2Pages(&s3svc.ListObjectsV2Input{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(s.objectKey(prefix)),
+	}, func(page *s3svc.ListObjectsV2Output, _ bool) bool {
+		for _, obj := range page.Contents {
+			ans = append(ans, &stotypes.ObjectInfo{
+				Name:    s.objectName(aws.StringValue(obj.Key)),
+				Size:    aws.Int64Value(obj.Size),
+				ModTime: aws.TimeValue(obj.LastModified),
+			})
+		}
+		return true
+	})
+	return ans, err
+}
+
+func (s *Store) ListChunkWrites(_ context.Context) ([]*stotypes.ChunkWriteInfo, error) {
+	var ans []*stotypes.ChunkWriteInfo
+	err := s.s3Client.ListMultipartUploadsPages(&s3svc.ListMultipartUploadsInput{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(s.objectKey("")),
+	}, func(page *s3svc.ListMultipartUploadsOutput, _ bool) bool {
+		for _, upload := range page.Uploads {
+			ans = append(ans, &stotypes.ChunkWriteInfo{
+				Name:          s.objectName(aws.StringValue(upload.Key)),
+				TransactionID: aws.StringValue(upload.UploadId),
+				CreatedAt:     aws.TimeValue(upload.Initiated),
+			})
+		}
+		return true
+	})
+	return ans, err
+}
+
+// AbortChunkWrite aborts the multipart upload, the uploaded parts are discarded
+func (s *Store) AbortChunkWrite(_ context.Context, name string, transactionID string) error {
+	_, err := s.s3Client.AbortMultipartUpload(&s3svc.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.Bucket),
+		Key:      aws.String(path.Join(s.BaseDir, name)),
+		UploadId: aws.String(transactionID),
+	})
+	return err
+}
+
+// objectKey returns the key prefix of name in bucket, a trailing slash is kept
+func (s *Store) objectKey(name string) string {
+	if s.BaseDir == "" {
+		return name
+	}
+	key := path.Join(s.BaseDir, name)
+	if name == "" || strings.HasSuffix(name, "/") {
+		key += "/"
+	}
+	return key
+}
+
+func (s *Store) objectName(key string) string {
+	if s.BaseDir == "" {
+		return key
+	}
+	return strings.TrimPrefix(key, strings.TrimSuffix(s.BaseDir, "/")+"/")
+}
+
 func (s *Store) GetDigest(ctx context.Context, name string) (string, error) {
 	head, err := s.s3Client.HeadObject(&s3svc.HeadObjectInput{
 		Bucket: aws.String(s.Bucket),
@@ -128,3 +128,63 @@ func TestChunkDownload(t *testing.T) {
 	}
 	assert.Equal(t, string(content), string(ckNewVal))
 }
+
+func TestExists(t *testing.T) {
+	stor, err := New("", "xxxx", "yyyyyy", "eru", "images", t)
+	assert.Nil(t, err)
+
+	name := "test-exists1"
+	exists, err := stor.Exists(context.Background(), name)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	content := []byte("hello world ")
+	digest, err := pkgutils.CalcDigestOfStr(string(content))
+	assert.Nil(t, err)
+	err = stor.Put(context.Background(), name, digest, bytes.NewReader(content))
+	assert.Nil(t, err)
+	exists, err = stor.Exists(context.Background(), name)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+}
+
+func TestList(t *testing.T) {
+	stor, err := New("", "xxxx", "yyyyyy", "eru", "images", t)
+	assert.Nil(t, err)
+
+	content := []byte("hello world ")
+	digest, err := pkgutils.CalcDigestOfStr(string(content))
+	assert.Nil(t, err)
+	for _, name := range []string{"blobs/sha256/ab/abc", "user1/name1:v1"} {
+		err = stor.Put(context.Background(), name, digest, bytes.NewReader(content))
+		assert.Nil(t, err)
+	}
+	objs, err := stor.List(context.Background(), "")
+	assert.Nil(t, err)
+	assert.Len(t, objs, 2)
+	objs, err = stor.List(context.Background(), "blobs/")
+	assert.Nil(t, err)
+	assert.Len(t, objs, 1)
+	assert.Equal(t, "blobs/sha256/ab/abc", objs[0].Name)
+	assert.Equal(t, int64(len(content)), objs[0].Size)
+}
+
+func TestAbortChunkWrite(t *testing.T) {
+	stor, err := New("", "xxxx", "yyyyyy", "eru", "images", t)
+	assert.Nil(t, err)
+
+	name := "user1/_slice_name1:v1"
+	uploadID, err := stor.CreateChunkWrite(context.Background(), name)
+	assert.Nil(t, err)
+	writes, err := stor.ListChunkWrites(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, writes, 1)
+	assert.Equal(t, name, writes[0].Name)
+	assert.Equal(t, uploadID, writes[0].TransactionID)
+
+	err = stor.AbortChunkWrite(context.Background(), name, uploadID)
+	assert.Nil(t, err)
+	writes, err = stor.ListChunkWrites(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, writes, 0)
+}
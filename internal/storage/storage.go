@@ -16,7 +16,18 @@ type Storage interface { //nolint:interfacebloat
 	CreateChunkWrite(ctx context.Context, name string) (string, error)
 	ChunkWrite(ctx context.Context, name string, transactionID string, info *stotypes.ChunkInfo) error
 	CompleteChunkWrite(ctx context.Context, name string, transactionID string, chunkList []*stotypes.ChunkInfo) error
+	// AbortChunkWrite discards the chunks written in transaction, the object of name is untouched
+	AbortChunkWrite(ctx context.Context, name string, transactionID string) error
 	Move(ctx context.Context, src, dest string) error
 	GetSize(ctx context.Context, name string) (int64, error)
 	GetDigest(ctx context.Context, name string) (string, error)
+	Exists(ctx context.Context, name string) (bool, error)
+	// List returns all objects whose name starts with prefix
+	List(ctx context.Context, prefix string) ([]*stotypes.ObjectInfo, error)
+}
+
+// MultipartStorage is implemented by storages whose chunk writes occupy
+// resources until they are completed or aborted, eg: s3 multipart uploads and the staged chunks of local storage.
+type MultipartStorage interface {
+	ListChunkWrites(ctx context.Context) ([]*stotypes.ChunkWriteInfo, error)
 }
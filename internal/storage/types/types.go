@@ -3,8 +3,23 @@ package types
 import (
 	"encoding/json"
 	"io"
+	"time"
 )
 
+// ObjectInfo describes an object in storage
+type ObjectInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// ChunkWriteInfo describes an unfinished chunk write transaction
+type ChunkWriteInfo struct {
+	Name          string
+	TransactionID string
+	CreatedAt     time.Time
+}
+
 type ChunkInfo struct {
 	Idx       int           `json:"idx"`
 	Size      int64         `json:"size"`
@@ -0,0 +1,291 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/projecteru2/core/log"
+	"github.com/projecteru2/vmihub/internal/models"
+	"github.com/projecteru2/vmihub/internal/utils"
+	"github.com/projecteru2/vmihub/pkg/types"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisQueueKey   = "/vmihub/task/queue"
+	popTimeout      = 5 * time.Second
+	recoverInterval = 10 * time.Minute
+	// the update time of a running task is refreshed periodically by its worker
+	heartbeatInterval = time.Minute
+	// a running task which misses several heartbeats is left by a crashed worker
+	staleTimeout = 5 * heartbeatInterval
+)
+
+// Handler processes a task, the returned value is saved as the result of task.
+// The handler is retried when it returns an error, unless the error is wrapped by Permanent.
+type Handler func(ctx context.Context, t *models.Task) (any, error)
+
+// FailureHandler is called when a task fails after all attempts, err is the final error of task.
+type FailureHandler func(ctx context.Context, t *models.Task, err error)
+
+var (
+	mu              sync.RWMutex
+	handlers        = map[string]Handler{}
+	failureHandlers = map[string]FailureHandler{}
+)
+
+// Register registers the handler of a task type, it is usually called in init function
+func Register(typ string, h Handler) {
+	mu.Lock()
+	defer mu.Unlock()
+	handlers[typ] = h
+}
+
+// OnFailure registers the failure handler of a task type, which is used to clean up
+func OnFailure(typ string, h FailureHandler) {
+	mu.Lock()
+	defer mu.Unlock()
+	failureHandlers[typ] = h
+}
+
+func getHandler(typ string) Handler {
+	mu.RLock()
+	defer mu.RUnlock()
+	return handlers[typ]
+}
+
+func getFailureHandler(typ string) FailureHandler {
+	mu.RLock()
+	defer mu.RUnlock()
+	return failureHandlers[typ]
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent wraps an error which makes no sense to retry, such as invalid arguments
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent returns true if err is wrapped by Permanent
+func IsPermanent(err error) bool {
+	var pErr *permanentError
+	return errors.As(err, &pErr)
+}
+
+type Options struct {
+	Workers int
+	// max attempts of each task
+	MaxAttempts int
+	// timeout of each attempt
+	Timeout time.Duration
+}
+
+// Submit saves a task to db and pushes it to the queue
+func Submit(ctx context.Context, typ, username string, payload any) (*models.Task, error) {
+	t, err := models.NewTask(typ, username, payload)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Save(nil); err != nil {
+		return nil, err
+	}
+	// the pending task will be pushed again by recovery if it fails
+	if err := push(ctx, t.ID); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func push(ctx context.Context, id int64) error {
+	return utils.GetRedisConn().LPush(ctx, redisQueueKey, id).Err()
+}
+
+// pop waits for a task id until timeout, 0 is returned if no task is available
+func pop(ctx context.Context, timeout time.Duration) (int64, error) {
+	res, err := utils.GetRedisConn().BRPop(ctx, timeout, redisQueueKey).Result()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	// the result is [key, value]
+	return strconv.ParseInt(res[1], 10, 64)
+}
+
+// Start runs the workers until ctx is done, the unfinished tasks are recovered periodically
+func Start(ctx context.Context, opts *Options) {
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			work(ctx, opts)
+		}()
+	}
+	ticker := time.NewTicker(recoverInterval)
+	defer ticker.Stop()
+	for {
+		recoverTasks(ctx)
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// recoverTasks pushes the pending tasks to queue again, so the tasks
+// lost by redis or left by crashed workers will be processed eventually.
+// A task is never processed twice, since it is claimed before running.
+func recoverTasks(ctx context.Context) {
+	logger := log.WithFunc("task.recoverTasks")
+	deadline := time.Now().Add(-staleTimeout)
+	if n, err := models.ResetStaleTasks(ctx, deadline); err != nil {
+		logger.Error(ctx, err, "failed to reset stale tasks")
+	} else if n > 0 {
+		logger.Warnf(ctx, "reset %d stale tasks", n)
+	}
+	ids, err := models.QueryPendingTaskIDs(ctx)
+	if err != nil {
+		logger.Error(ctx, err, "failed to query pending tasks")
+		return
+	}
+	for _, id := range ids {
+		if err := push(ctx, id); err != nil {
+			logger.Errorf(ctx, err, "failed to push task %d", id)
+			return
+		}
+	}
+}
+
+func work(ctx context.Context, opts *Options) {
+	logger := log.WithFunc("task.work")
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		id, err := pop(ctx, popTimeout)
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Error(ctx, err, "failed to pop task")
+				time.Sleep(popTimeout)
+			}
+			continue
+		}
+		if id == 0 {
+			continue
+		}
+		if err := process(ctx, id, opts); err != nil {
+			logger.Errorf(ctx, err, "failed to process task %d", id)
+		}
+	}
+}
+
+// process claims the task and runs it, nothing is done if the task is claimed by others
+func process(ctx context.Context, id int64, opts *Options) error {
+	ok, err := models.ClaimTask(ctx, id, types.TaskStatusPending)
+	if err != nil || !ok {
+		return err
+	}
+	t, err := models.GetTask(ctx, id)
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return fmt.Errorf("task %d doesn't exist", id)
+	}
+	return run(ctx, t, opts)
+}
+
+// run runs the handler of task with retries and saves the final status of task
+func run(ctx context.Context, t *models.Task, opts *Options) error {
+	logger := log.WithFunc("task.run")
+	var (
+		res any
+		err error
+	)
+	h := getHandler(t.Type)
+	if h == nil {
+		err = fmt.Errorf("unknown task type %s", t.Type)
+	} else {
+		hctx, stop := context.WithCancel(ctx)
+		go heartbeat(hctx, t.ID, heartbeatInterval)
+		var hErr error
+		err = utils.BackoffRetry(ctx, opts.MaxAttempts, func() error {
+			t.Attempts++
+			actx, cancel := context.WithTimeout(ctx, opts.Timeout)
+			defer cancel()
+			res, hErr = h(actx, t)
+			if IsPermanent(hErr) {
+				// stop retrying, hErr is kept as the result
+				return nil
+			}
+			if hErr != nil {
+				logger.Warnf(ctx, "attempt %d of task %d failed: %s", t.Attempts, t.ID, hErr)
+			}
+			return hErr
+		})
+		stop()
+		if hErr != nil {
+			err = hErr
+		}
+	}
+	switch {
+	case ctx.Err() != nil:
+		// the server is shutting down, so leave the task to others
+		t.Status = types.TaskStatusPending
+		return t.Update(nil)
+	case err != nil:
+		logger.Errorf(ctx, err, "task %d(%s) failed", t.ID, t.Type)
+		t.Status = types.TaskStatusFailed
+		t.Error = err.Error()
+		if fh := getFailureHandler(t.Type); fh != nil {
+			fh(ctx, t, err)
+		}
+	default:
+		if err = t.SetResult(res); err != nil {
+			return err
+		}
+		t.Status = types.TaskStatusSuccess
+		t.Error = ""
+	}
+	return t.Update(nil)
+}
+
+// heartbeat refreshes the update time of the running task every interval until ctx is done
+func heartbeat(ctx context.Context, id int64, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := models.TouchTask(ctx, id); err != nil {
+				log.WithFunc("task.heartbeat").Warnf(ctx, "failed to refresh task %d: %s", id, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/projecteru2/vmihub/internal/models"
+	"github.com/projecteru2/vmihub/internal/utils"
+	"github.com/projecteru2/vmihub/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	taskTableName = ((*models.Task)(nil)).TableName()
+	taskColumns   = ((*models.Task)(nil)).ColumnNames()
+	testOpts      = &Options{Workers: 1, MaxAttempts: 3, Timeout: time.Minute}
+)
+
+func expectClaim(id int64, claimed bool) {
+	var affected int64
+	if claimed {
+		affected = 1
+	}
+	models.Mock.ExpectExec("UPDATE task SET status = ? WHERE id = ? AND status = ?").
+		WithArgs(types.TaskStatusRunning, id, types.TaskStatusPending).
+		WillReturnResult(sqlmock.NewResult(0, affected))
+}
+
+func expectGet(id int64, typ string) {
+	models.Mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE id = ?", taskColumns, taskTableName)).
+		WithArgs(id).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "type", "username", "status", "payload"}).
+			AddRow(id, typ, "user1", types.TaskStatusRunning, []byte(`{"n":1}`)))
+}
+
+func expectUpdate(id int64, status string, result any, errStr string, attempts int) {
+	models.Mock.ExpectBegin()
+	models.Mock.ExpectExec("UPDATE task SET status = ?, result = ?, error = ?, attempts = ? WHERE id = ?").
+		WithArgs(status, result, errStr, attempts, id).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	models.Mock.ExpectCommit()
+}
+
+func TestSubmit(t *testing.T) {
+	utils.SetupRedis(nil, t)
+	err := models.Init(nil, t)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	models.Mock.ExpectBegin()
+	models.Mock.ExpectExec("INSERT INTO task(type, username, status, payload) VALUES(?, ?, ?, ?)").
+		WithArgs("test", "user1", types.TaskStatusPending, []byte(`{"n":1}`)).
+		WillReturnResult(sqlmock.NewResult(12, 1))
+	models.Mock.ExpectCommit()
+	task, err := Submit(ctx, "test", "user1", map[string]int{"n": 1})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(12), task.ID)
+	assert.Nil(t, models.Mock.ExpectationsWereMet())
+
+	id, err := pop(ctx, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(12), id)
+}
+
+func TestProcess(t *testing.T) {
+	utils.SetupRedis(nil, t)
+	err := models.Init(nil, t)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	calls := 0
+	Register("test-ok", func(_ context.Context, t *models.Task) (any, error) {
+		calls++
+		p := map[string]int{}
+		if err := t.UnmarshalPayload(&p); err != nil {
+			return nil, err
+		}
+		return map[string]int{"n": p["n"] + 1}, nil
+	})
+	Register("test-permanent", func(context.Context, *models.Task) (any, error) {
+		calls++
+		return nil, Permanent(errors.New("invalid payload"))
+	})
+	var failure error
+	OnFailure("test-permanent", func(_ context.Context, _ *models.Task, err error) {
+		failure = err
+	})
+	Register("test-retry", func(context.Context, *models.Task) (any, error) {
+		calls++
+		if calls < 2 {
+			return nil, errors.New("temporary error")
+		}
+		return nil, nil
+	})
+
+	// success
+	expectClaim(1, true)
+	expectGet(1, "test-ok")
+	expectUpdate(1, types.TaskStatusSuccess, []byte(`{"n":2}`), "", 1)
+	err = process(ctx, 1, testOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, calls)
+	assert.Nil(t, models.Mock.ExpectationsWereMet())
+
+	// the task is claimed by others
+	calls = 0
+	expectClaim(2, false)
+	err = process(ctx, 2, testOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, calls)
+	assert.Nil(t, models.Mock.ExpectationsWereMet())
+
+	// permanent error isn't retried
+	expectClaim(3, true)
+	expectGet(3, "test-permanent")
+	expectUpdate(3, types.TaskStatusFailed, []byte("null"), "invalid payload", 1)
+	err = process(ctx, 3, testOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, calls)
+	assert.EqualError(t, failure, "invalid payload")
+	assert.Nil(t, models.Mock.ExpectationsWereMet())
+
+	// temporary error is retried
+	calls = 0
+	expectClaim(4, true)
+	expectGet(4, "test-retry")
+	expectUpdate(4, types.TaskStatusSuccess, []byte("null"), "", 2)
+	err = process(ctx, 4, testOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, calls)
+	assert.Nil(t, models.Mock.ExpectationsWereMet())
+
+	// unknown task type
+	expectClaim(5, true)
+	expectGet(5, "unknown")
+	expectUpdate(5, types.TaskStatusFailed, []byte("null"), "unknown task type unknown", 0)
+	err = process(ctx, 5, testOpts)
+	assert.Nil(t, err)
+	assert.Nil(t, models.Mock.ExpectationsWereMet())
+}
+
+func TestHeartbeat(t *testing.T) {
+	utils.SetupRedis(nil, t)
+	err := models.Init(nil, t)
+	require.NoError(t, err)
+	models.Mock.ExpectExec("UPDATE task SET updated_at = CURRENT_TIMESTAMP WHERE id = ? AND status = ?").
+		WithArgs(1, types.TaskStatusRunning).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		heartbeat(ctx, 1, 10*time.Millisecond)
+	}()
+	assert.Eventually(t, func() bool {
+		return models.Mock.ExpectationsWereMet() == nil
+	}, time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+}
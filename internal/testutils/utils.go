@@ -15,12 +15,19 @@ import (
 	"github.com/projecteru2/vmihub/config"
 	"github.com/projecteru2/vmihub/internal/middlewares"
 	"github.com/projecteru2/vmihub/internal/models"
+	"github.com/projecteru2/vmihub/internal/storage"
 	storFact "github.com/projecteru2/vmihub/internal/storage/factory"
 	storageMocks "github.com/projecteru2/vmihub/internal/storage/mocks"
 	"github.com/projecteru2/vmihub/internal/utils"
 	"github.com/projecteru2/vmihub/internal/utils/redissession"
 )
 
+func init() {
+	storage.Register("mock", func(*config.StorageConfig) (storage.Storage, error) {
+		return &storageMocks.Storage{}, nil
+	})
+}
+
 func Prepare(ctx context.Context, t *testing.T) error {
 	cfg, err := config.LoadTestConfig()
 	if err != nil {
@@ -85,6 +92,15 @@ func GetMockStorage() *storageMocks.Storage {
 	return sto.(*storageMocks.Storage)
 }
 
+// ResetMockStorage clears the expectations and calls recorded by the mock storage,
+// the storage instance is shared by all tests.
+func ResetMockStorage() *storageMocks.Storage {
+	sto := GetMockStorage()
+	sto.ExpectedCalls = nil
+	sto.Calls = nil
+	return sto
+}
+
 func AddAuth(req *http.Request, username, password string) {
 	val := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
 	req.Header.Set("Authorization", fmt.Sprintf("Basic %s", val))
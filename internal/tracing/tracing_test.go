@@ -0,0 +1,48 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/projecteru2/vmihub/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestInit(t *testing.T) {
+	ctx := context.Background()
+	shutdown, err := Init(ctx, &config.TracingConfig{})
+	require.NoError(t, err)
+	assert.Nil(t, shutdown(ctx))
+	assert.ElementsMatch(t, []string{"traceparent", "tracestate", "baggage"}, otel.GetTextMapPropagator().Fields())
+
+	_, err = Init(ctx, &config.TracingConfig{Enabled: true, Exporter: "zipkin"})
+	assert.Error(t, err)
+
+	shutdown, err = Init(ctx, &config.TracingConfig{Enabled: true, Exporter: "stdout", ServiceName: "vmihub", SampleRatio: 1})
+	require.NoError(t, err)
+	assert.Nil(t, shutdown(ctx))
+}
+
+func TestStart(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+
+	ctx, end := Start(context.Background(), "parent")
+	_, endChild := Start(ctx, "child")
+	err := errors.New("not found")
+	endChild(&err)
+	end(nil)
+
+	spans := sr.Ended()
+	require.Len(t, spans, 2)
+	assert.Equal(t, "child", spans[0].Name())
+	assert.Equal(t, spans[1].SpanContext().SpanID(), spans[0].Parent().SpanID())
+	assert.Equal(t, codes.Error, spans[0].Status().Code)
+	assert.Equal(t, codes.Unset, spans[1].Status().Code)
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/go-redsync/redsync/v4"
 	"github.com/go-redsync/redsync/v4/redis/goredis/v9"
 	"github.com/projecteru2/vmihub/config"
+	"github.com/redis/go-redis/extra/redisotel/v9"
 	"github.com/redis/go-redis/v9"
 )
 
@@ -46,9 +47,13 @@ func SetupRedis(cfg *config.RedisConfig, t *testing.T) {
 		cli = redis.NewClient(&redis.Options{
 			Addr: MockRedis.Addr(), // Redis 服务器地址
 		})
+		rs = redsync.New(goredis.NewPool(cli))
 		return
 	}
 	cli = NewRedisCient(cfg)
+	// the commands may contain sessions and tokens, so they are omitted from spans,
+	// it fails only if the client type is unknown
+	_ = redisotel.InstrumentTracing(cli, redisotel.WithDBStatement(false))
 	rs = redsync.New(goredis.NewPool(cli))
 }
 
@@ -91,6 +91,39 @@ func (_m *Shell) ExecInOut(ctx context.Context, env map[string]string, stdin io.
 	return r0, r1, r2
 }
 
+// ExecStream provides a mock function with given fields: ctx, name, args
+func (_m *Shell) ExecStream(ctx context.Context, name string, args ...string) (io.ReadCloser, error) {
+	_va := make([]interface{}, len(args))
+	for _i := range args {
+		_va[_i] = args[_i]
+	}
+	var _ca []interface{}
+	_ca = append(_ca, ctx, name)
+	_ca = append(_ca, _va...)
+	ret := _m.Called(_ca...)
+
+	var r0 io.ReadCloser
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, ...string) (io.ReadCloser, error)); ok {
+		return rf(ctx, name, args...)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, string, ...string) io.ReadCloser); ok {
+		r0 = rf(ctx, name, args...)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(io.ReadCloser)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, string, ...string) error); ok {
+		r1 = rf(ctx, name, args...)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // Move provides a mock function with given fields: src, dest
 func (_m *Shell) Move(src string, dest string) error {
 	ret := _m.Called(src, dest)
@@ -19,6 +19,7 @@ type Shell interface {
 	Remove(fpth string) error
 	Exec(ctx context.Context, name string, args ...string) error
 	ExecInOut(ctx context.Context, env map[string]string, stdin io.Reader, name string, args ...string) ([]byte, []byte, error)
+	ExecStream(ctx context.Context, name string, args ...string) (io.ReadCloser, error)
 }
 
 // Remove .
@@ -45,3 +46,9 @@ func ExecInOut(ctx context.Context, env map[string]string, stdin io.Reader, name
 func ExecContext(ctx context.Context, name string, args ...string) error {
 	return shell.Exec(ctx, name, args...)
 }
+
+// ExecStream runs a command and returns its stdout as a stream,
+// closing the stream waits for the command and returns its error.
+func ExecStream(ctx context.Context, name string, args ...string) (io.ReadCloser, error) {
+	return shell.ExecStream(ctx, name, args...)
+}
@@ -39,6 +39,42 @@ func (s shx) ExecInOut(ctx context.Context, env map[string]string, stdin io.Read
 	return stdout.Bytes(), stderr.Bytes(), err
 }
 
+func (s shx) ExecStream(ctx context.Context, name string, args ...string) (io.ReadCloser, error) {
+	var stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stderr = &stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return &cmdReader{ReadCloser: stdout, cmd: cmd, stderr: &stderr}, nil
+}
+
+// cmdReader reads the stdout of a running command
+type cmdReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
+
+// Close closes stdout first, so the command isn't blocked if the output isn't read to the end
+func (r *cmdReader) Close() error {
+	_ = r.ReadCloser.Close()
+
+	if err := r.cmd.Wait(); err != nil {
+		return fmt.Errorf("%w %s", err, r.stderr.String())
+	}
+
+	return nil
+}
+
 func (s shx) Exec(ctx context.Context, name string, args ...string) error {
 	var cmd = exec.CommandContext(ctx, name, args...)
 
@@ -0,0 +1,160 @@
+package verification
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/projecteru2/core/log"
+	"github.com/projecteru2/vmihub/config"
+	"github.com/projecteru2/vmihub/internal/utils"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisCodeKey     = "/vmihub/verification/code/%s"
+	redisAttemptsKey = "/vmihub/verification/attempts/%s"
+	redisTargetKey   = "/vmihub/verification/target/%s"
+
+	codeLength = 6
+	// the code is invalidated after too many wrong guesses
+	maxAttempts = 5
+	// a target can't receive codes more frequently
+	resendInterval = time.Minute
+)
+
+var (
+	ErrInvalidCode = errors.New("invalid or expired verification code")
+	ErrTooFrequent = errors.New("verification code is sent too frequently")
+)
+
+// Sender delivers verification codes to users, eg: by email or SMS
+type Sender interface {
+	Send(ctx context.Context, target, code string) error
+}
+
+// LogSender writes codes to log, it is a stand-in for development
+type LogSender struct{}
+
+func (LogSender) Send(ctx context.Context, target, code string) error {
+	log.WithFunc("verification.LogSender").Infof(ctx, "verification code of %s: %s", target, code)
+	return nil
+}
+
+// FileSender appends codes to a file, it is a stand-in for tests and development
+type FileSender struct {
+	mu   sync.Mutex
+	Path string
+}
+
+func (s *FileSender) Send(_ context.Context, target, code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "%s %s %s\n", time.Now().Format(time.RFC3339), target, code)
+	return err
+}
+
+var (
+	sender  Sender = LogSender{}
+	codeTTL        = 5 * time.Minute
+)
+
+// Init sets the sender according to config
+func Init(cfg *config.RegisterConfig) error {
+	if cfg.CodeTTL > 0 {
+		codeTTL = cfg.CodeTTL
+	}
+	switch cfg.Sender {
+	case "", "log":
+		sender = LogSender{}
+	case "file":
+		if cfg.File == "" {
+			return errors.New("file of verification codes is empty")
+		}
+		sender = &FileSender{Path: cfg.File}
+	default:
+		return fmt.Errorf("unknown verification code sender %s", cfg.Sender)
+	}
+	return nil
+}
+
+// SetSender replaces the sender, it is used by email or SMS senders out of this package
+func SetSender(s Sender) {
+	sender = s
+}
+
+type codeInfo struct {
+	Target string `json:"target"`
+	Code   string `json:"code"`
+}
+
+// SendCode sends a new code to target and returns the id to check it
+func SendCode(ctx context.Context, target string) (id string, err error) {
+	cli := utils.GetRedisConn()
+	ok, err := cli.SetNX(ctx, fmt.Sprintf(redisTargetKey, target), 1, resendInterval).Result()
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", ErrTooFrequent
+	}
+	code, err := randomCode()
+	if err != nil {
+		return "", err
+	}
+	if id, err = utils.GetUniqueStr(); err != nil {
+		return "", err
+	}
+	if err = utils.SetObjToRedis(ctx, fmt.Sprintf(redisCodeKey, id), &codeInfo{Target: target, Code: code}, codeTTL); err != nil {
+		return "", err
+	}
+	if err = sender.Send(ctx, target, code); err != nil {
+		_ = utils.DeleteObjectsInRedis(ctx, fmt.Sprintf(redisCodeKey, id), fmt.Sprintf(redisTargetKey, target))
+		return "", err
+	}
+	return id, nil
+}
+
+// CheckCode returns ErrInvalidCode if code of id isn't sent to target,
+// a code can only be used once.
+func CheckCode(ctx context.Context, id, target, code string) error {
+	codeKey, attemptsKey := fmt.Sprintf(redisCodeKey, id), fmt.Sprintf(redisAttemptsKey, id)
+	info := &codeInfo{}
+	if err := utils.GetObjFromRedis(ctx, codeKey, info); err != nil {
+		if errors.Is(err, redis.Nil) {
+			return ErrInvalidCode
+		}
+		return err
+	}
+	if info.Target == target && info.Code == code {
+		return utils.DeleteObjectsInRedis(ctx, codeKey, attemptsKey)
+	}
+	cli := utils.GetRedisConn()
+	attempts, err := cli.Incr(ctx, attemptsKey).Result()
+	if err != nil {
+		return err
+	}
+	_ = cli.Expire(ctx, attemptsKey, codeTTL)
+	if attempts >= maxAttempts {
+		_ = utils.DeleteObjectsInRedis(ctx, codeKey, attemptsKey)
+	}
+	return ErrInvalidCode
+}
+
+func randomCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1_000_000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", codeLength, n.Int64()), nil
+}
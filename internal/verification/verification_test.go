@@ -0,0 +1,74 @@
+package verification
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/projecteru2/vmihub/config"
+	"github.com/projecteru2/vmihub/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type memSender struct {
+	codes map[string]string
+}
+
+func (s *memSender) Send(_ context.Context, target, code string) error {
+	s.codes[target] = code
+	return nil
+}
+
+func TestCheckCode(t *testing.T) {
+	utils.SetupRedis(nil, t)
+	s := &memSender{codes: map[string]string{}}
+	SetSender(s)
+	ctx := context.Background()
+
+	id, err := SendCode(ctx, "user1@example.com")
+	require.NoError(t, err)
+	code := s.codes["user1@example.com"]
+	assert.Len(t, code, codeLength)
+
+	// can't send again immediately
+	_, err = SendCode(ctx, "user1@example.com")
+	assert.ErrorIs(t, err, ErrTooFrequent)
+
+	assert.ErrorIs(t, CheckCode(ctx, id, "user2@example.com", code), ErrInvalidCode)
+	assert.Nil(t, CheckCode(ctx, id, "user1@example.com", code))
+	// a code can only be used once
+	assert.ErrorIs(t, CheckCode(ctx, id, "user1@example.com", code), ErrInvalidCode)
+}
+
+func TestCheckCodeAttempts(t *testing.T) {
+	utils.SetupRedis(nil, t)
+	s := &memSender{codes: map[string]string{}}
+	SetSender(s)
+	ctx := context.Background()
+
+	id, err := SendCode(ctx, "user1")
+	require.NoError(t, err)
+	for i := 0; i < maxAttempts; i++ {
+		assert.ErrorIs(t, CheckCode(ctx, id, "user1", "wrong"), ErrInvalidCode)
+	}
+	assert.ErrorIs(t, CheckCode(ctx, id, "user1", s.codes["user1"]), ErrInvalidCode)
+}
+
+func TestFileSender(t *testing.T) {
+	utils.SetupRedis(nil, t)
+	fname := filepath.Join(t.TempDir(), "codes")
+	err := Init(&config.RegisterConfig{Sender: "file", File: fname})
+	require.NoError(t, err)
+	defer SetSender(LogSender{})
+
+	_, err = SendCode(context.Background(), "user1")
+	require.NoError(t, err)
+	bs, err := os.ReadFile(fname)
+	require.NoError(t, err)
+	assert.True(t, strings.Contains(string(bs), " user1 "))
+
+	assert.Error(t, Init(&config.RegisterConfig{Sender: "pigeon"}))
+}
@@ -15,6 +15,8 @@ var (
 	ErrInvalidState     = errors.New("guest state is invalid")
 	ErrInvalidUserName  = errors.New("invalid username")
 	ErrInvalidPassword  = errors.New("invalid password")
+	ErrUserDisabled     = errors.New("user is disabled")
+	ErrNameTaken        = errors.New("name is already taken")
 
 	ErrIPAMNoAvailableIP    = errors.New("no available IP")
 	ErrIPAMNotReserved      = errors.New("IP is not reserved")
@@ -40,6 +42,16 @@ var (
 	ErrInvalidDistrib = errors.New("os distrib is empty")
 	ErrInvalidArch    = errors.New("os arch is empty")
 	ErrInvalidFormat  = errors.New("format is empty")
+	ErrInvalidImage   = errors.New("invalid image file")
+
+	ErrInvalidImageState = errors.New("invalid image state")
+
+	ErrImmutableTag = errors.New("tag is immutable")
+	ErrProtectedTag = errors.New("tag is protected")
+
+	ErrQuotaExceeded = errors.New("quota exceeded")
+
+	ErrBlobNotFound = errors.New("blob doesn't exist")
 )
 
 type ErrHTTPResp struct { //nolint
@@ -66,6 +66,26 @@ func (req *ImageCreateRequest) Check() error {
 	return nil
 }
 
+type ImageStateRequest struct {
+	State string `json:"state" binding:"required"`
+}
+
+type TagProtectionRequest struct {
+	Immutable bool     `json:"immutable"`
+	Patterns  []string `json:"patterns"`
+}
+
+type TagImageRequest struct {
+	// the tag of the image in the same repository
+	Source string `json:"source" binding:"required"`
+}
+
+type RepoMemberRequest struct {
+	Username string `json:"username" binding:"required"`
+	// read or write, it is ignored when the member is removed
+	Perm string `json:"perm"`
+}
+
 type ImageInfoRequest struct {
 	Username   string
 	ImgName    string
@@ -74,8 +94,10 @@ type ImageInfoRequest struct {
 }
 
 type ImagesByUsernameRequest struct {
-	Username   string
-	Keyword    string
+	Username string
+	Keyword  string
+	// only return the images in this state if it isn't empty
+	State      string
 	PageNum    int
 	PageSize   int
 	RegionCode string
@@ -87,10 +109,12 @@ type ImageInfoResp struct {
 	Username    string    `json:"username"`
 	Name        string    `json:"name"`
 	Tag         string    `json:"tag" description:"image tag, default:latest"`
+	State       string    `json:"state" description:"image state"`
 	Format      string    `json:"format"`
 	OS          OSInfo    `json:"os"`
 	Private     bool      `json:"private"`
 	Size        int64     `json:"size"`
+	VirtualSize int64     `json:"virtualSize"`
 	Digest      string    `json:"digest" description:"image digest"`
 	Snapshot    string    `json:"snapshot"`
 	Description string    `json:"description" description:"image description"`
@@ -113,6 +137,32 @@ func (img *ImageInfoResp) RBDName() string {
 type ImageListResp struct {
 }
 
+// UploadSessionResp is a chunk upload which isn't finished yet
+type UploadSessionResp struct {
+	UploadID  string    `json:"uploadID"`
+	Image     string    `json:"image" description:"fullname of the uploaded image"`
+	Size      int64     `json:"size"`
+	Digest    string    `json:"digest"`
+	ChunkSize uint64    `json:"chunkSize"`
+	NChunks   int       `json:"nChunks" description:"number of chunks"`
+	Received  int       `json:"received" description:"number of received chunks"`
+	Merged    bool      `json:"merged" description:"all chunks are merged and the image is being verified"`
+	ExpiresAt time.Time `json:"expiresAt" description:"the session expires if there is no activity before it" example:"format: RFC3339"`
+}
+
+// UploadChunkResp is a chunk received by server
+type UploadChunkResp struct {
+	Idx    int    `json:"idx"`
+	Size   int64  `json:"size"`
+	Digest string `json:"digest" description:"sha256 of the chunk"`
+}
+
+// UploadStatusResp is the progress of a chunk upload, it is resumed by uploading the missing chunks
+type UploadStatusResp struct {
+	UploadSessionResp
+	Chunks []*UploadChunkResp `json:"chunks" description:"received chunks ordered by index"`
+}
+
 type ContextKey string
 
 type ImageTreeNode struct {
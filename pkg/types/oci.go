@@ -0,0 +1,17 @@
+package types
+
+const (
+	// OCIArtifactType is the artifact type of the OCI manifest of an image
+	OCIArtifactType = "application/vnd.vmihub.image.v1"
+	// OCIConfigMediaType is the media type of the config blob, the content is OCIImageConfig
+	OCIConfigMediaType = "application/vnd.vmihub.image.config.v1+json"
+	// OCILayerMediaTypePrefix is the prefix of the media type of the image file, the suffix is the format, eg: qcow2
+	OCILayerMediaTypePrefix = "application/vnd.vmihub.image.layer.v1."
+)
+
+// OCIImageConfig is the config blob of the OCI manifest of an image
+type OCIImageConfig struct {
+	OS          OSInfo `json:"os"`
+	Format      string `json:"format"`
+	VirtualSize int64  `json:"virtualSize"`
+}
@@ -0,0 +1,11 @@
+package types
+
+type OrgCreateRequest struct {
+	Name        string `json:"name" binding:"required,min=1,max=50" example:"infra"`
+	Description string `json:"description" binding:"max=255"`
+}
+
+type OrgMemberRequest struct {
+	// one of owner, maintainer, developer and reader
+	Role string `json:"role" binding:"required" example:"developer"`
+}
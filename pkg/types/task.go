@@ -0,0 +1,40 @@
+package types
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	TaskStatusPending = "pending"
+	TaskStatusRunning = "running"
+	TaskStatusSuccess = "success"
+	TaskStatusFailed  = "failed"
+)
+
+// Task is a job which is processed by the workers of server in background
+type Task struct {
+	ID       int64           `json:"id"`
+	Type     string          `json:"type"`
+	Username string          `json:"username" description:"user who submitted the task"`
+	Status   string          `json:"status"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+	Result   json.RawMessage `json:"result,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	// number of times the task has been tried
+	Attempts  int       `json:"attempts"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func (t *Task) Finished() bool {
+	return t.Status == TaskStatusSuccess || t.Status == TaskStatusFailed
+}
+
+// TaskImageResult is the result of the tasks which create an image
+type TaskImageResult struct {
+	ImageID  int64  `json:"imageId"`
+	Username string `json:"username"`
+	Name     string `json:"name"`
+	Tag      string `json:"tag"`
+}
@@ -16,6 +16,54 @@ type RegisterRequest struct {
 	Nickname string `json:"nickname"`
 }
 
+func (req *RegisterRequest) Check() error {
+	if req.Username == "" {
+		return terrors.ErrInvalidUserName
+	}
+	return nil
+}
+
+// VerificationCodeTarget returns where the verification code of registration is sent,
+// it is the email if it is provided, otherwise the username such as a phone number.
+func (req *RegisterRequest) VerificationCodeTarget() string {
+	if req.Email != "" {
+		return req.Email
+	}
+	return req.Username
+}
+
+type VerificationCodeRequest struct {
+	// email or phone number
+	Target string `json:"target" binding:"required"`
+}
+
+type VerificationCodeResp struct {
+	SMSID string `json:"smsId"`
+}
+
+type AdminCreateUserRequest struct {
+	Username string `json:"username" binding:"required"`
+	Password string `json:"password" binding:"required,min=3,max=20"`
+	Email    string `json:"email"`
+	Nickname string `json:"nickname"`
+	Admin    bool   `json:"admin"`
+}
+
+// AdminUpdateUserRequest only changes the fields which are provided
+type AdminUpdateUserRequest struct {
+	Email    *string `json:"email"`
+	Nickname *string `json:"nickname"`
+	Admin    *bool   `json:"admin"`
+	Disabled *bool   `json:"disabled"`
+	// reset password if it isn't empty
+	Password string `json:"password" binding:"omitempty,min=3,max=20"`
+}
+
+// AdminLinkOIDCRequest links a user to an account of the OIDC provider
+type AdminLinkOIDCRequest struct {
+	Subject string `json:"subject" binding:"required" description:"sub claim of the account"`
+}
+
 type UpdateUserRequest struct {
 	Email    string `json:"email"`
 	Nickname string `json:"nickname"`
@@ -45,6 +93,9 @@ func (req *ResetUserPwdRequest) Check() error {
 type LoginRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	// restrict the jwt like private tokens, they are ignored by login
+	Scopes []string `json:"scopes,omitempty"`
+	Repos  []string `json:"repos,omitempty"`
 }
 
 func (req *LoginRequest) Check() error {
@@ -69,7 +120,9 @@ type UserInfoResp struct {
 	Nickname string `json:"nickname" binding:"required,min=1,max=20"`
 	Email    string `json:"email" binding:"required,email"`
 	IsAdmin  bool   `json:"isAdmin"`
+	Disabled bool   `json:"disabled"`
 	Type     string `json:"type"`
+	Source   string `json:"source" description:"local, ldap or oidc"`
 }
 
 type TokenResponse struct {
@@ -80,8 +133,30 @@ type TokenResponse struct {
 type PrivateTokenRequest struct {
 	Name      string    `json:"name" binding:"required,min=1,max=20" example:"my-token"`
 	ExpiredAt time.Time `json:"expiredAt" example:"RFC3339: 2023-11-30T14:30:00.123+08:00"`
+	// image:read, image:write, image:delete or user:admin, empty means all scopes
+	Scopes []string `json:"scopes" example:"image:read"`
+	// glob patterns of repositories which the token can access, empty means all repositories
+	Repos []string `json:"repos" example:"infra/*"`
 }
 
 type PrivateTokenDeleteRequest struct {
 	Name string `json:"name" binding:"required,min=1,max=20"`
 }
+
+type UsageResp struct {
+	// username or organization name
+	Namespace string `json:"namespace"`
+	// bytes and number of images, the failed images aren't counted
+	Size   int64 `json:"size"`
+	Images int64 `json:"images"`
+	// 0 means unlimited
+	MaxSize   int64 `json:"maxSize"`
+	MaxImages int64 `json:"maxImages"`
+}
+
+type QuotaRequest struct {
+	// max bytes of all images, 0 means unlimited
+	MaxSize int64 `json:"maxSize" binding:"min=0" example:"107374182400"`
+	// max number of images, 0 means unlimited
+	MaxImages int64 `json:"maxImages" binding:"min=0" example:"100"`
+}